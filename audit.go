@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/theopticians/optician-api/core/store"
+)
+
+// auditHandler replies with a page of the audit log entries matching the
+// query. Clients accepting application/x-ndjson get every matching entry
+// instead, as JSON lines, to export the log.
+func (s *server) auditHandler(rw http.ResponseWriter, req *http.Request) {
+	err := s.authorizeAdmin(req)
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+
+	q, err := parseAuditQuery(req.URL.Query())
+	if err != nil {
+		writeErrorStatus(rw, http.StatusBadRequest, err)
+		return
+	}
+
+	if req.Header.Get("Accept") == "application/x-ndjson" {
+		s.exportAudit(rw, q)
+		return
+	}
+
+	page, err := s.core.QueryAudit(q)
+
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+
+	entriesJSON, err := json.Marshal(page.Entries)
+
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+
+	setNextPage(rw, req, page.Next)
+	rw.Write(entriesJSON)
+}
+
+// exportAudit streams the entries matching the query as JSON lines, page by
+// page. The limit of the query is ignored.
+func (s *server) exportAudit(rw http.ResponseWriter, q store.AuditQuery) {
+	q.Limit = store.MaxLimit
+
+	page, err := s.core.QueryAudit(q)
+
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/x-ndjson")
+	rw.WriteHeader(http.StatusOK)
+
+	encoder := json.NewEncoder(rw)
+
+	for {
+		for _, e := range page.Entries {
+			err = encoder.Encode(e)
+			if err != nil {
+				// The client is gone
+				return
+			}
+		}
+
+		if page.Next == "" {
+			return
+		}
+
+		if f, ok := rw.(http.Flusher); ok {
+			f.Flush()
+		}
+
+		q.Cursor = page.Next
+		page, err = s.core.QueryAudit(q)
+
+		if err != nil {
+			// The status is already sent, the error is the last line
+			encoder.Encode(struct {
+				Error errorModel `json:"error"`
+			}{newErrorModel(errorStatus(err), err)})
+			return
+		}
+	}
+}
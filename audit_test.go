@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"image"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/theopticians/optician-api/core"
+	"github.com/theopticians/optician-api/core/structs"
+)
+
+func TestAuditHandler(t *testing.T) {
+	s, h := newAuthTestServer(t)
+
+	uploaderKey, uploader := createKey(t, s, "p", structs.RoleUploader)
+
+	caseJSON := `{"projectid":"p","branch":"master","target":"home","browser":"chrome","batch":"b1","image":"` + imageToBase64(image.NewNRGBA(image.Rect(0, 0, 4, 3))) + `"}`
+
+	rw := authRequest(h, "POST", "/cases", uploader, caseJSON)
+	if rw.Code != http.StatusAccepted {
+		t.Fatal("Expected case to be added, got", rw.Code, rw.Body.String())
+	}
+
+	rw = authRequest(h, "GET", "/audit?action=case.added", uploader, "")
+	if rw.Code != http.StatusForbidden {
+		t.Fatal("Expected only admins to read the audit log, got", rw.Code, rw.Body.String())
+	}
+
+	rw = authRequest(h, "GET", "/audit?project=p&action=case.added", testAdminToken, "")
+	if rw.Code != http.StatusOK {
+		t.Fatal("Expected the audit log, got", rw.Code, rw.Body.String())
+	}
+
+	var entries []structs.AuditEntry
+	err := json.Unmarshal(rw.Body.Bytes(), &entries)
+	if err != nil || len(entries) != 1 || entries[0].Actor != "key:"+uploaderKey.ID || entries[0].Batch != "b1" {
+		t.Fatal("Expected the case added by the uploader key, got", rw.Body.String(), err)
+	}
+
+	rw = authRequest(h, "GET", "/audit?sort=-nope", testAdminToken, "")
+	if rw.Code != http.StatusBadRequest {
+		t.Fatal("Expected invalid queries to be rejected, got", rw.Code, rw.Body.String())
+	}
+
+	export := exportAuditRequest(t, h, "/audit?project=p&sort=timestamp&limit=1")
+	if len(export) < 3 || export[0].Action != core.AuditProjectCreated || export[len(export)-1].Action != core.AuditCaseAdded {
+		t.Fatal("Expected every entry of the project, oldest first, regardless of the limit, got", export)
+	}
+}
+
+func exportAuditRequest(t *testing.T, h http.Handler, url string) []structs.AuditEntry {
+	req := httptest.NewRequest("GET", url, nil)
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	req.Header.Set("Accept", "application/x-ndjson")
+
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+
+	if rw.Code != http.StatusOK || rw.Header().Get("Content-Type") != "application/x-ndjson" {
+		t.Fatal("Expected JSON lines, got", rw.Code, rw.Body.String())
+	}
+
+	entries := []structs.AuditEntry{}
+	scanner := bufio.NewScanner(strings.NewReader(rw.Body.String()))
+	for scanner.Scan() {
+		var e structs.AuditEntry
+		err := json.Unmarshal(scanner.Bytes(), &e)
+		if err != nil {
+			t.Fatal("Invalid JSON line", scanner.Text(), err)
+		}
+		entries = append(entries, e)
+	}
+
+	return entries
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/theopticians/optician-api/core"
+	"github.com/theopticians/optician-api/core/store"
+)
+
+// principal is the authenticated caller of a request.
+type principal struct {
+	// actor identifies the caller in the results it reviews or masks.
+	actor string
+
+	// admin callers can do anything, including managing projects and
+	// keys.
+	admin bool
+
+	// roles are the roles of the caller in each project.
+	roles map[string][]string
+}
+
+func (p *principal) can(project, role string) bool {
+	if p.admin {
+		return true
+	}
+
+	for _, r := range p.roles[project] {
+		if r == role {
+			return true
+		}
+	}
+
+	return false
+}
+
+type principalKey struct{}
+
+func requestPrincipal(req *http.Request) *principal {
+	p, _ := req.Context().Value(principalKey{}).(*principal)
+	return p
+}
+
+// actor returns the identity of the caller of the request, empty when
+// authentication is disabled.
+func actor(req *http.Request) string {
+	if p := requestPrincipal(req); p != nil {
+		return p.actor
+	}
+
+	return ""
+}
+
+// authenticate sets the principal of requests with an Authorization: Bearer
+// header, either the admin token, an API key or the JWT of a user. Invalid
+// credentials are rejected, requests without any go on anonymously and are
+// rejected by the handlers that need a role.
+func (s *server) authenticate(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if !s.authEnabled {
+			h.ServeHTTP(rw, req)
+			return
+		}
+
+		header := req.Header.Get("Authorization")
+		if header == "" {
+			h.ServeHTTP(rw, req)
+			return
+		}
+
+		if !strings.HasPrefix(header, "Bearer ") {
+			writeError(rw, core.UnauthorizedError{Message: "Expected an Authorization: Bearer header"})
+			return
+		}
+
+		p, err := s.principal(strings.TrimPrefix(header, "Bearer "))
+		if err != nil {
+			writeError(rw, err)
+			return
+		}
+
+		h.ServeHTTP(rw, req.WithContext(context.WithValue(req.Context(), principalKey{}, p)))
+	})
+}
+
+func (s *server) principal(token string) (*principal, error) {
+	if s.adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(s.adminToken)) == 1 {
+		return &principal{actor: "admin", admin: true}, nil
+	}
+
+	// JWTs have three parts, API keys two
+	if s.oidc != nil && strings.Count(token, ".") == 2 {
+		return s.oidc.principal(token)
+	}
+
+	k, err := s.core.Authenticate(token)
+	if err != nil {
+		return nil, err
+	}
+
+	return &principal{
+		actor: "key:" + k.ID,
+		roles: map[string][]string{k.Project: {k.Role}},
+	}, nil
+}
+
+// authorize returns an error unless the caller of the request has the role in
+// the project. Everything is allowed when authentication is disabled.
+func (s *server) authorize(req *http.Request, project, role string) error {
+	if !s.authEnabled {
+		return nil
+	}
+
+	p := requestPrincipal(req)
+	if p == nil {
+		return core.UnauthorizedError{Message: "Authentication required"}
+	}
+
+	if !p.can(project, role) {
+		return core.ForbiddenError{Message: "The " + role + " role in project " + project + " is required"}
+	}
+
+	return nil
+}
+
+// authenticated returns an error unless the request has a caller. Resources
+// are looked up only after, so anonymous callers can't tell which exist.
+func (s *server) authenticated(req *http.Request) error {
+	if requestPrincipal(req) == nil {
+		return core.UnauthorizedError{Message: "Authentication required"}
+	}
+
+	return nil
+}
+
+// authorizeAdmin returns an error unless the caller of the request is an
+// admin.
+func (s *server) authorizeAdmin(req *http.Request) error {
+	if !s.authEnabled {
+		return nil
+	}
+
+	p := requestPrincipal(req)
+	if p == nil {
+		return core.UnauthorizedError{Message: "Authentication required"}
+	}
+
+	if !p.admin {
+		return core.ForbiddenError{Message: "Admin access is required"}
+	}
+
+	return nil
+}
+
+// authorizeResult authorizes the caller of the request with the role in the
+// project of the result.
+func (s *server) authorizeResult(req *http.Request, id, role string) error {
+	if !s.authEnabled {
+		return nil
+	}
+
+	err := s.authenticated(req)
+	if err != nil {
+		return err
+	}
+
+	r, err := s.core.GetTest(id)
+	if err != nil {
+		return err
+	}
+
+	return s.authorize(req, r.Project, role)
+}
+
+// authorizeBatch authorizes the caller of the request with the role in the
+// project of the batch. Batches from before batches were stored, or stored
+// without a project, have it in their results.
+func (s *server) authorizeBatch(req *http.Request, id, role string) error {
+	if !s.authEnabled {
+		return nil
+	}
+
+	err := s.authenticated(req)
+	if err != nil {
+		return err
+	}
+
+	b, err := s.core.GetBatch(id)
+	if err != nil && err != store.NotFoundError {
+		return err
+	}
+
+	if b.Project == "" {
+		results, err := s.core.ResultsByBatchs(id)
+		if err != nil {
+			return err
+		}
+
+		if len(results) > 0 {
+			b.Project = results[0].Project
+		}
+	}
+
+	return s.authorize(req, b.Project, role)
+}
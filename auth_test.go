@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"image"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/theopticians/optician-api/core/structs"
+)
+
+const testAdminToken = "0123456789abcdef0123456789abcdef"
+
+func newAuthTestServer(t *testing.T) (*server, http.Handler) {
+	s := newTestServer()
+	s.authEnabled = true
+	s.adminToken = testAdminToken
+
+	for _, p := range []string{"p", "other"} {
+		_, err := s.core.CreateProject(structs.Project{ID: p}, "tester")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return s, s.authenticate(s.router())
+}
+
+func createKey(t *testing.T, s *server, project, role string) (structs.APIKey, string) {
+	k, token, err := s.core.CreateAPIKey(structs.APIKey{Project: project, Role: role}, "tester")
+	if err != nil {
+		t.Fatal("Error creating key:", err)
+	}
+
+	return k, token
+}
+
+func authRequest(h http.Handler, method, url, token, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, url, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+
+	return rw
+}
+
+func TestAuthorization(t *testing.T) {
+	s, h := newAuthTestServer(t)
+
+	_, uploader := createKey(t, s, "p", structs.RoleUploader)
+	reviewerKey, reviewer := createKey(t, s, "p", structs.RoleReviewer)
+	_, otherReviewer := createKey(t, s, "other", structs.RoleReviewer)
+
+	caseJSON := `{"projectid":"p","branch":"master","target":"home","browser":"chrome","batch":"b1","image":"` + imageToBase64(image.NewNRGBA(image.Rect(0, 0, 4, 3))) + `"}`
+
+	rw := authRequest(h, "POST", "/cases", reviewer, caseJSON)
+	if rw.Code != http.StatusForbidden {
+		t.Fatal("Expected reviewers not to upload, got", rw.Code, rw.Body.String())
+	}
+
+	rw = authRequest(h, "POST", "/cases", uploader, caseJSON)
+	if rw.Code != http.StatusAccepted {
+		t.Fatal("Expected uploaders to upload, got", rw.Code, rw.Body.String())
+	}
+
+	var r structs.Result
+	json.Unmarshal(rw.Body.Bytes(), &r)
+
+	tests := []struct {
+		name  string
+		token string
+		code  int
+	}{
+		{"anonymous", "", http.StatusUnauthorized},
+		{"invalid key", "nope.nope", http.StatusUnauthorized},
+		{"uploader", uploader, http.StatusForbidden},
+		{"reviewer of another project", otherReviewer, http.StatusForbidden},
+		{"reviewer", reviewer, http.StatusOK},
+	}
+
+	for _, test := range tests {
+		rw = authRequest(h, "POST", "/results/"+r.ID+"/accept", test.token, "")
+		if rw.Code != test.code {
+			t.Error(test.name+": expected status", test.code, "accepting, got", rw.Code, rw.Body.String())
+		}
+	}
+
+	accepted, err := s.core.GetTest(r.ID)
+	if err != nil || accepted.ReviewedBy != "key:"+reviewerKey.ID {
+		t.Fatal("Expected the accept to be attributed to the reviewer key, got", accepted.ReviewedBy, err)
+	}
+
+	rw = authRequest(h, "GET", "/results/"+r.ID, "", "")
+	if rw.Code != http.StatusOK {
+		t.Fatal("Expected reads to stay open, got", rw.Code)
+	}
+}
+
+func TestAPIKeyManagement(t *testing.T) {
+	s, h := newAuthTestServer(t)
+
+	_, reviewer := createKey(t, s, "p", structs.RoleReviewer)
+
+	rw := authRequest(h, "POST", "/projects/p/keys", reviewer, `{"name":"CI","role":"uploader"}`)
+	if rw.Code != http.StatusForbidden {
+		t.Fatal("Expected only admins to create keys, got", rw.Code, rw.Body.String())
+	}
+
+	rw = authRequest(h, "POST", "/projects/p/keys", testAdminToken, `{"name":"CI","role":"uploader"}`)
+	if rw.Code != http.StatusCreated {
+		t.Fatal("Expected key to be created, got", rw.Code, rw.Body.String())
+	}
+
+	var created createdAPIKey
+	err := json.Unmarshal(rw.Body.Bytes(), &created)
+	if err != nil || created.Token == "" || created.Hash != "" {
+		t.Fatal("Expected created key with its token, got", rw.Body.String(), err)
+	}
+
+	_, err = s.core.Authenticate(created.Token)
+	if err != nil {
+		t.Fatal("Expected the token of the created key to authenticate, got", err)
+	}
+
+	rw = authRequest(h, "DELETE", "/keys/"+created.ID, testAdminToken, "")
+	if rw.Code != http.StatusNoContent {
+		t.Fatal("Expected key to be deleted, got", rw.Code, rw.Body.String())
+	}
+}
+
+func TestBatchAuthorization(t *testing.T) {
+	s, h := newAuthTestServer(t)
+
+	_, uploader := createKey(t, s, "p", structs.RoleUploader)
+
+	for _, b := range []structs.Batch{{ID: "empty", Project: "p"}, {ID: "noproject"}} {
+		_, err := s.core.OpenBatch(b, "tester")
+		if err != nil {
+			t.Fatal("Error opening batch:", err)
+		}
+	}
+
+	tests := []struct {
+		name  string
+		url   string
+		token string
+		code  int
+	}{
+		{"anonymous on a missing batch", "/batches/missing/finalize", "", http.StatusUnauthorized},
+		{"anonymous on a batch", "/batches/empty/finalize", "", http.StatusUnauthorized},
+		{"anonymous on a missing result", "/results/missing/accept", "", http.StatusUnauthorized},
+		{"uploader on a missing batch", "/batches/missing/finalize", uploader, http.StatusNotFound},
+		{"uploader on a batch without project", "/batches/noproject/finalize", uploader, http.StatusForbidden},
+		{"uploader on a batch without results", "/batches/empty/finalize", uploader, http.StatusOK},
+	}
+
+	for _, test := range tests {
+		rw := authRequest(h, "POST", test.url, test.token, "")
+		if rw.Code != test.code {
+			t.Error(test.name+": expected status", test.code, "got", rw.Code, rw.Body.String())
+		}
+	}
+}
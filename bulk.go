@@ -0,0 +1,547 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path"
+	"sync"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"github.com/theopticians/optician-api/core"
+	"github.com/theopticians/optician-api/core/store"
+	"github.com/theopticians/optician-api/core/structs"
+)
+
+// bulkConcurrency is the number of cases of a bulk upload added concurrently.
+const bulkConcurrency = 8
+
+// manifestName is the name of the manifest file in archives, and of the
+// manifest part in multipart uploads.
+const manifestName = "manifest.json"
+
+// maxPendingSize caps the size of the files read before the manifest, which
+// are kept in memory until it's read.
+const maxPendingSize = 256 << 20
+
+var (
+	errEntryTooLarge   = errors.New("The file is larger than the maximum size of a case")
+	errPendingTooLarge = errors.New("Too many files before the manifest, send the manifest first")
+)
+
+// bulkManifest describes the screenshots of a bulk upload. The case fields
+// other than target and browser are shared by every case.
+type bulkManifest struct {
+	ProjectID  string `json:"projectid"`
+	Branch     string `json:"branch"`
+	Commit     string `json:"commit"`
+	Repository string `json:"repository"`
+
+	Cases []bulkEntry `json:"cases"`
+}
+
+type bulkEntry struct {
+	File    string `json:"file"`
+	Target  string `json:"target"`
+	Browser string `json:"browser"`
+}
+
+// bulkOutcome is the outcome of a file of a bulk upload, either the result of
+// its case or the error adding it.
+type bulkOutcome struct {
+	File   string      `json:"file"`
+	Result *ApiResult  `json:"result,omitempty"`
+	Error  *errorModel `json:"error,omitempty"`
+}
+
+// bulkError is the response to an upload failing after some of its files
+// were processed, with their outcomes.
+type bulkError struct {
+	errorModel
+	Outcomes []bulkOutcome `json:"outcomes"`
+}
+
+// bulkUpload matches the files of an upload with the entries of its manifest
+// and adds each case as soon as both are read, so archives are processed
+// while they're streamed. Its methods are called from the goroutine reading
+// the upload, cases are added from their own goroutines.
+type bulkUpload struct {
+	s     *server
+	req   *http.Request
+	batch string
+
+	manifest *bulkManifest
+	entries  map[string]bulkEntry
+	seen     map[string]bool
+
+	// pending has the files read before the manifest, pendingSize their
+	// total size.
+	pending     map[string][]byte
+	pendingSize int64
+
+	// size is the total size of the files read, decompressed.
+	size int64
+
+	sem      chan struct{}
+	wg       sync.WaitGroup
+	outcomes chan bulkOutcome
+}
+
+func newBulkUpload(s *server, req *http.Request, batch string) *bulkUpload {
+	return &bulkUpload{
+		s:        s,
+		req:      req,
+		batch:    batch,
+		seen:     map[string]bool{},
+		pending:  map[string][]byte{},
+		sem:      make(chan struct{}, bulkConcurrency),
+		outcomes: make(chan bulkOutcome, bulkConcurrency),
+	}
+}
+
+func (u *bulkUpload) setManifest(data []byte) error {
+	if u.manifest != nil {
+		return errors.New("The upload has more than one manifest")
+	}
+
+	var m bulkManifest
+	err := json.Unmarshal(data, &m)
+	if err != nil {
+		return errors.Wrap(err, "invalid manifest")
+	}
+
+	err = core.ValidateRevision(m.Repository, m.Commit)
+	if err != nil {
+		return err
+	}
+
+	u.entries = map[string]bulkEntry{}
+	cases := map[structs.CaseKey]bool{}
+	for _, e := range m.Cases {
+		file := path.Clean(e.File)
+		if _, ok := u.entries[file]; ok {
+			return errors.New("The manifest has file " + e.File + " more than once")
+		}
+
+		key := structs.CaseKey{Project: m.ProjectID, Target: e.Target, Browser: e.Browser}
+		if cases[key] {
+			return errors.New("The manifest has target " + e.Target + " on " + e.Browser + " more than once")
+		}
+
+		u.entries[file] = e
+		cases[key] = true
+	}
+
+	err = u.s.authorize(u.req, m.ProjectID, structs.RoleUploader)
+	if err != nil {
+		return err
+	}
+
+	// The batch is opened before adding its cases concurrently, or each of
+	// them would try to open it.
+	_, err = u.s.core.GetBatch(u.batch)
+	if err == store.NotFoundError {
+		_, err = u.s.core.OpenBatch(structs.Batch{
+			ID:         u.batch,
+			Project:    m.ProjectID,
+			Branch:     m.Branch,
+			Commit:     m.Commit,
+			Repository: m.Repository,
+		}, actor(u.req))
+		if _, ok := err.(core.ConflictError); ok {
+			// Opened by a concurrent request
+			err = nil
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	u.manifest = &m
+
+	for name, data := range u.pending {
+		u.add(name, data)
+	}
+	u.pending = nil
+
+	return nil
+}
+
+// addFile adds the case of the file, or keeps it until the manifest is read.
+func (u *bulkUpload) addFile(name string, data []byte) error {
+	name = path.Clean(name)
+
+	if u.manifest == nil {
+		u.pendingSize += int64(len(data))
+		if u.pendingSize > maxPendingSize {
+			return errPendingTooLarge
+		}
+
+		u.pending[name] = data
+		return nil
+	}
+
+	u.add(name, data)
+
+	return nil
+}
+
+// readFile reads a file of the upload, up to the maximum size of a case. The
+// total size of the files is capped like the size of the upload, so that
+// compressed archives can't expand past it.
+func (u *bulkUpload) readFile(r io.Reader) ([]byte, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, u.s.maxUploadSize+1))
+	if err != nil {
+		return nil, err
+	}
+
+	u.size += int64(len(data))
+	if u.size > u.s.maxBulkUploadSize {
+		return nil, errUploadTooLarge
+	}
+
+	if int64(len(data)) > u.s.maxUploadSize {
+		return nil, errEntryTooLarge
+	}
+
+	return data, nil
+}
+
+// addEntry reads the file of an archive entry or multipart part and adds it,
+// or sets it as the manifest. Files over the maximum size of a case are
+// rejected on their own.
+func (u *bulkUpload) addEntry(name string, r io.Reader) error {
+	manifest := path.Clean(name) == manifestName
+
+	data, err := u.readFile(r)
+	if err == errEntryTooLarge && !manifest {
+		u.reject(name, http.StatusRequestEntityTooLarge, err.Error())
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if manifest {
+		return u.setManifest(data)
+	}
+
+	return u.addFile(name, data)
+}
+
+// reject reports the error of a file without adding it.
+func (u *bulkUpload) reject(name string, code int, message string) {
+	u.seen[path.Clean(name)] = true
+	u.outcomes <- bulkOutcome{File: name, Error: &errorModel{Code: code, Message: message}}
+}
+
+func (u *bulkUpload) add(name string, data []byte) {
+	e, ok := u.entries[name]
+	if !ok {
+		u.outcomes <- bulkOutcome{File: name, Error: &errorModel{Code: http.StatusUnprocessableEntity, Message: "The file is not in the manifest"}}
+		return
+	}
+
+	u.seen[name] = true
+
+	u.sem <- struct{}{}
+	u.wg.Add(1)
+
+	go func() {
+		defer func() {
+			<-u.sem
+			u.wg.Done()
+		}()
+
+		u.outcomes <- u.addCase(e, data)
+	}()
+}
+
+func (u *bulkUpload) addCase(e bulkEntry, data []byte) bulkOutcome {
+	outcome := bulkOutcome{File: e.File}
+
+	img, err := u.s.imageLimits.decode(bytes.NewReader(data))
+	if err != nil {
+		e := newErrorModel(uploadErrorStatus(err), err)
+		outcome.Error = &e
+		return outcome
+	}
+
+	r, err := u.s.core.AddCase(structs.Case{
+		ProjectID:  u.manifest.ProjectID,
+		Branch:     u.manifest.Branch,
+		Target:     e.Target,
+		Browser:    e.Browser,
+		Batch:      u.batch,
+		Commit:     u.manifest.Commit,
+		Repository: u.manifest.Repository,
+		Image:      img,
+	}, actor(u.req))
+	if err == nil {
+		var apiResult ApiResult
+		apiResult, err = u.s.apiResult(r)
+		outcome.Result = &apiResult
+	}
+	if err != nil {
+		outcome.Result = nil
+		e := newErrorModel(errorStatus(err), err)
+		outcome.Error = &e
+	}
+
+	return outcome
+}
+
+// finish waits for the cases being added, and reports the manifest entries
+// without file.
+func (u *bulkUpload) finish() error {
+	defer close(u.outcomes)
+
+	if u.manifest == nil {
+		return errors.New("The upload has no " + manifestName)
+	}
+
+	for _, e := range u.manifest.Cases {
+		if !u.seen[path.Clean(e.File)] {
+			u.outcomes <- bulkOutcome{File: e.File, Error: &errorModel{Code: http.StatusUnprocessableEntity, Message: "The file is not in the upload"}}
+		}
+	}
+
+	u.wg.Wait()
+
+	return nil
+}
+
+// read reads the files of the upload from a multipart, tar, gzipped tar or zip
+// body.
+func (u *bulkUpload) read(req *http.Request, body io.Reader) error {
+	mediaType, params, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err != nil {
+		return errUnsupportedContent
+	}
+
+	switch mediaType {
+	case "multipart/form-data":
+		return u.readMultipart(multipart.NewReader(body, params["boundary"]))
+	case "application/x-tar":
+		return u.readTar(tar.NewReader(body))
+	case "application/gzip", "application/x-gzip":
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			return errors.Wrap(err, "invalid gzip body")
+		}
+
+		// Skipped entries are decompressed too
+		tarball := &limitedBody{r: gz, n: u.s.maxBulkUploadSize}
+		err = u.readTar(tar.NewReader(tarball))
+		if tarball.exceeded {
+			return errUploadTooLarge
+		}
+		return err
+	case "application/zip":
+		return u.readZip(body)
+	}
+
+	return errUnsupportedContent
+}
+
+func (u *bulkUpload) readMultipart(r *multipart.Reader) error {
+	for {
+		part, err := r.NextPart()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return errors.Wrap(err, "invalid multipart body")
+		}
+
+		name := partFileName(part)
+		if part.FormName() == "manifest" {
+			name = manifestName
+		}
+		if name == "" {
+			continue
+		}
+
+		err = u.addEntry(name, part)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// partFileName returns the file name of the part with its directories, which
+// multipart.Part.FileName strips.
+func partFileName(part *multipart.Part) string {
+	_, params, err := mime.ParseMediaType(part.Header.Get("Content-Disposition"))
+	if err != nil {
+		return ""
+	}
+
+	return params["filename"]
+}
+
+func (u *bulkUpload) readTar(r *tar.Reader) error {
+	for {
+		h, err := r.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return errors.Wrap(err, "invalid tar archive")
+		}
+
+		if h.Typeflag != tar.TypeReg && h.Typeflag != tar.TypeRegA {
+			continue
+		}
+
+		err = u.addEntry(h.Name, r)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// readZip spools the archive to a temporary file, zip archives can't be read
+// as a stream.
+func (u *bulkUpload) readZip(body io.Reader) error {
+	f, err := ioutil.TempFile("", "optician-upload")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	size, err := io.Copy(f, body)
+	if err != nil {
+		return err
+	}
+
+	r, err := zip.NewReader(f, size)
+	if err != nil {
+		return errors.Wrap(err, "invalid zip archive")
+	}
+
+	// The manifest is read first so files aren't kept waiting for it
+	files := []*zip.File{}
+	for _, file := range r.File {
+		if path.Clean(file.Name) == manifestName {
+			files = append([]*zip.File{file}, files...)
+		} else if !file.FileInfo().IsDir() {
+			files = append(files, file)
+		}
+	}
+
+	for _, file := range files {
+		err = u.addZipFile(file)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (u *bulkUpload) addZipFile(file *zip.File) error {
+	r, err := file.Open()
+	if err != nil {
+		return errors.Wrap(err, "invalid zip archive")
+	}
+	defer r.Close()
+
+	return u.addEntry(file.Name, r)
+}
+
+// bulkCasesHandler adds the cases of a multipart, tar or zip upload to the
+// batch. The outcome of every file is returned once all of them are
+// processed, along with the error if the upload fails, or streamed as JSON
+// lines as they're processed if the client accepts application/x-ndjson.
+func (s *server) bulkCasesHandler(rw http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+
+	defer req.Body.Close()
+
+	body := &limitedBody{r: req.Body, n: s.maxBulkUploadSize}
+	u := newBulkUpload(s, req, vars["id"])
+
+	errc := make(chan error, 1)
+	go func() {
+		err := u.read(req, body)
+		if body.exceeded {
+			err = errUploadTooLarge
+		}
+
+		if finishErr := u.finish(); err == nil {
+			err = finishErr
+		}
+
+		errc <- err
+	}()
+
+	flusher, stream := rw.(http.Flusher)
+	stream = stream && req.Header.Get("Accept") == "application/x-ndjson"
+
+	if stream {
+		// HTTP/1 servers close the body once the response is started,
+		// unless reading it while writing is enabled.
+		http.NewResponseController(rw).EnableFullDuplex()
+
+		rw.Header().Set("Content-Type", "application/x-ndjson")
+		rw.WriteHeader(http.StatusOK)
+		flusher.Flush()
+	}
+
+	encoder := json.NewEncoder(rw)
+	outcomes := []bulkOutcome{}
+
+	for o := range u.outcomes {
+		if stream {
+			encoder.Encode(o)
+			flusher.Flush()
+		} else {
+			outcomes = append(outcomes, o)
+		}
+	}
+
+	err := <-errc
+
+	if stream {
+		// The status is already sent, the error is the last line
+		if err != nil {
+			encoder.Encode(struct {
+				Error errorModel `json:"error"`
+			}{newErrorModel(bulkErrorStatus(err), err)})
+		}
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+
+	if err != nil {
+		// Cases added before the error are kept, their outcomes are sent
+		// with it.
+		code := bulkErrorStatus(err)
+		rw.WriteHeader(code)
+		encoder.Encode(bulkError{newErrorModel(code, err), outcomes})
+		return
+	}
+
+	encoder.Encode(outcomes)
+}
+
+func bulkErrorStatus(err error) int {
+	if err == errPendingTooLarge {
+		return http.StatusRequestEntityTooLarge
+	}
+
+	if status := errorStatus(err); status != http.StatusInternalServerError {
+		return status
+	}
+
+	return uploadErrorStatus(err)
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"image"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/theopticians/optician-api/core"
+	"github.com/theopticians/optician-api/core/store/memory"
+)
+
+const testManifest = `{"projectid":"p","branch":"master","cases":[
+	{"file":"home.png","target":"home","browser":"chrome"},
+	{"file":"shots/about.png","target":"about","browser":"chrome"},
+	{"file":"missing.png","target":"missing","browser":"chrome"}
+]}`
+
+func newTestServer() *server {
+	return &server{
+		core:              core.NewService(core.DefaultConfig(memory.NewMemoryStore())),
+		maxUploadSize:     1 << 20,
+		maxBulkUploadSize: 1 << 20,
+		imageLimits:       testLimits,
+	}
+}
+
+func bulkRequest(t *testing.T, contentType string, body []byte) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/batches/b1/cases", bytes.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+
+	rw := httptest.NewRecorder()
+	newTestServer().router().ServeHTTP(rw, req)
+
+	return rw
+}
+
+// checkOutcomes checks the outcomes of an upload of testManifest with
+// home.png, shots/about.png and extra.png.
+func checkOutcomes(t *testing.T, outcomes []bulkOutcome) {
+	if len(outcomes) != 4 {
+		t.Fatal("Expected 4 outcomes, got", outcomes)
+	}
+
+	byFile := map[string]bulkOutcome{}
+	for _, o := range outcomes {
+		byFile[o.File] = o
+	}
+
+	for _, file := range []string{"home.png", "shots/about.png"} {
+		if o := byFile[file]; o.Error != nil || o.Result == nil || o.Result.Batch != "b1" {
+			t.Error("Expected result for", file, "got", o.Result, o.Error)
+		}
+	}
+
+	for _, file := range []string{"missing.png", "extra.png"} {
+		if o := byFile[file]; o.Error == nil || o.Error.Code != http.StatusUnprocessableEntity {
+			t.Error("Expected error for", file, "got", o.Result, o.Error)
+		}
+	}
+}
+
+func TestBulkCasesMultipart(t *testing.T) {
+	body := new(bytes.Buffer)
+	w := multipart.NewWriter(body)
+
+	// Files before the manifest wait for it
+	for _, name := range []string{"home.png", "extra.png"} {
+		part, _ := w.CreateFormFile("files", name)
+		part.Write(pngBytes(t))
+	}
+	w.WriteField("manifest", testManifest)
+	part, _ := w.CreateFormFile("files", "shots/about.png")
+	part.Write(pngBytes(t))
+	w.Close()
+
+	rw := bulkRequest(t, w.FormDataContentType(), body.Bytes())
+	if rw.Code != http.StatusOK {
+		t.Fatal("Expected status 200, got", rw.Code, rw.Body.String())
+	}
+
+	var outcomes []bulkOutcome
+	err := json.Unmarshal(rw.Body.Bytes(), &outcomes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkOutcomes(t, outcomes)
+}
+
+func TestBulkCasesTar(t *testing.T) {
+	body := new(bytes.Buffer)
+	w := tar.NewWriter(body)
+
+	files := map[string][]byte{
+		"home.png":        pngBytes(t),
+		"manifest.json":   []byte(testManifest),
+		"shots/about.png": pngBytes(t),
+		"extra.png":       pngBytes(t),
+	}
+	for _, name := range []string{"home.png", "manifest.json", "shots/about.png", "extra.png"} {
+		w.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(files[name])), Typeflag: tar.TypeReg})
+		w.Write(files[name])
+	}
+	w.Close()
+
+	req := httptest.NewRequest("POST", "/batches/b1/cases", body)
+	req.Header.Set("Content-Type", "application/x-tar")
+	req.Header.Set("Accept", "application/x-ndjson")
+
+	rw := httptest.NewRecorder()
+	newTestServer().router().ServeHTTP(rw, req)
+
+	if rw.Code != http.StatusOK || rw.Header().Get("Content-Type") != "application/x-ndjson" {
+		t.Fatal("Expected streamed outcomes, got", rw.Code, rw.Body.String())
+	}
+
+	var outcomes []bulkOutcome
+	scanner := bufio.NewScanner(rw.Body)
+	for scanner.Scan() {
+		var o bulkOutcome
+		err := json.Unmarshal(scanner.Bytes(), &o)
+		if err != nil {
+			t.Fatal(err)
+		}
+		outcomes = append(outcomes, o)
+	}
+
+	checkOutcomes(t, outcomes)
+}
+
+func TestBulkCasesZip(t *testing.T) {
+	body := new(bytes.Buffer)
+	w := zip.NewWriter(body)
+
+	for _, name := range []string{"home.png", "shots/about.png", "extra.png"} {
+		f, _ := w.Create(name)
+		f.Write(pngBytes(t))
+	}
+	f, _ := w.Create("manifest.json")
+	f.Write([]byte(testManifest))
+	w.Close()
+
+	rw := bulkRequest(t, "application/zip", body.Bytes())
+	if rw.Code != http.StatusOK {
+		t.Fatal("Expected status 200, got", rw.Code, rw.Body.String())
+	}
+
+	var outcomes []bulkOutcome
+	err := json.Unmarshal(rw.Body.Bytes(), &outcomes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkOutcomes(t, outcomes)
+}
+
+func TestBulkCasesErrors(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        []byte
+		code        int
+	}{
+		{"no manifest", "application/x-tar", tarOf(t, "home.png", pngBytes(t)), http.StatusBadRequest},
+		{"bad manifest", "application/x-tar", tarOf(t, "manifest.json", []byte("{")), http.StatusBadRequest},
+		{"duplicate case", "application/x-tar", tarOf(t, "manifest.json", []byte(`{"projectid":"p","cases":[
+			{"file":"a.png","target":"home","browser":"chrome"},
+			{"file":"b.png","target":"home","browser":"chrome"}]}`)), http.StatusBadRequest},
+		{"unsupported", "image/png", pngBytes(t), http.StatusUnsupportedMediaType},
+		{"too large", "application/x-tar", tarOf(t, "home.png", make([]byte, 2<<20)), http.StatusRequestEntityTooLarge},
+	}
+
+	for _, test := range tests {
+		rw := bulkRequest(t, test.contentType, test.body)
+		if rw.Code != test.code {
+			t.Error(test.name+": expected status", test.code, "got", rw.Code, rw.Body.String())
+		}
+	}
+}
+
+func TestBulkCasesPartialError(t *testing.T) {
+	body := new(bytes.Buffer)
+	w := tar.NewWriter(body)
+	for _, f := range []struct {
+		name string
+		data []byte
+	}{{"manifest.json", []byte(testManifest)}, {"home.png", pngBytes(t)}} {
+		w.WriteHeader(&tar.Header{Name: f.name, Mode: 0644, Size: int64(len(f.data)), Typeflag: tar.TypeReg})
+		w.Write(f.data)
+	}
+	w.Flush()
+	body.Write(bytes.Repeat([]byte("x"), 512))
+
+	rw := bulkRequest(t, "application/x-tar", body.Bytes())
+	if rw.Code != http.StatusBadRequest {
+		t.Fatal("Expected status 400, got", rw.Code, rw.Body.String())
+	}
+
+	var e bulkError
+	err := json.Unmarshal(rw.Body.Bytes(), &e)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	added := false
+	for _, o := range e.Outcomes {
+		added = added || (o.File == "home.png" && o.Result != nil)
+	}
+	if e.Code != http.StatusBadRequest || !added {
+		t.Fatal("Expected the error with the outcome of home.png, got", rw.Body.String())
+	}
+}
+
+func TestBulkCasesLimits(t *testing.T) {
+	wide := new(bytes.Buffer)
+	err := png.Encode(wide, image.NewNRGBA(image.Rect(0, 0, 101, 1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Files of zeros compress to almost nothing, their size is capped once
+	// decompressed.
+	s := newTestServer()
+	s.maxBulkUploadSize = 4 << 20
+
+	req := httptest.NewRequest("POST", "/batches/b1/cases", bytes.NewReader(gzipTar(t, map[string][]byte{
+		"manifest.json":   []byte(testManifest),
+		"home.png":        make([]byte, 2<<20),
+		"shots/about.png": wide.Bytes(),
+	})))
+	req.Header.Set("Content-Type", "application/gzip")
+
+	rw := httptest.NewRecorder()
+	s.router().ServeHTTP(rw, req)
+	if rw.Code != http.StatusOK {
+		t.Fatal("Expected status 200, got", rw.Code, rw.Body.String())
+	}
+
+	var outcomes []bulkOutcome
+	err = json.Unmarshal(rw.Body.Bytes(), &outcomes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, o := range outcomes {
+		if o.File != "missing.png" && (o.Error == nil || o.Error.Code != http.StatusRequestEntityTooLarge) {
+			t.Error("Expected", o.File, "to be too large, got", o.Result, o.Error)
+		}
+	}
+
+	rw = bulkRequest(t, "application/gzip", gzipTar(t, map[string][]byte{
+		"manifest.json":   []byte(testManifest),
+		"home.png":        make([]byte, 900<<10),
+		"shots/about.png": make([]byte, 900<<10),
+	}))
+	if rw.Code != http.StatusRequestEntityTooLarge {
+		t.Fatal("Expected the decompressed upload to be too large, got", rw.Code, rw.Body.String())
+	}
+}
+
+// gzipTar returns a gzipped tar of the files, the manifest first.
+func gzipTar(t *testing.T, files map[string][]byte) []byte {
+	body := new(bytes.Buffer)
+	gz := gzip.NewWriter(body)
+	w := tar.NewWriter(gz)
+
+	names := []string{"manifest.json"}
+	for name := range files {
+		if name != "manifest.json" {
+			names = append(names, name)
+		}
+	}
+
+	for _, name := range names {
+		w.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(files[name])), Typeflag: tar.TypeReg})
+		w.Write(files[name])
+	}
+	w.Close()
+	gz.Close()
+
+	return body.Bytes()
+}
+
+func tarOf(t *testing.T, name string, data []byte) []byte {
+	body := new(bytes.Buffer)
+	w := tar.NewWriter(body)
+	w.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), Typeflag: tar.TypeReg})
+	w.Write(data)
+	w.Close()
+
+	return body.Bytes()
+}
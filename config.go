@@ -0,0 +1,495 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/theopticians/optician-api/core"
+	"github.com/theopticians/optician-api/core/imgdiff"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Config is the configuration of the server. It's read from the YAML file
+// given with -config or OPTICIAN_CONFIG, then overridden by environment
+// variables, then by flags.
+type Config struct {
+	// Listen is the address the API listens on.
+	Listen string `yaml:"listen"`
+
+	// MaxUploadSize is the maximum size of the body of a case, like 20MB.
+	MaxUploadSize byteSize `yaml:"max_upload_size"`
+
+	// MaxBulkUploadSize is the maximum size of the body of a bulk upload.
+	MaxBulkUploadSize byteSize `yaml:"max_bulk_upload_size"`
+
+	// MaxImageWidth and MaxImageHeight are the maximum dimensions in pixels
+	// of uploaded images.
+	MaxImageWidth  int `yaml:"max_image_width"`
+	MaxImageHeight int `yaml:"max_image_height"`
+
+	TLS TLSConfig `yaml:"tls"`
+
+	Store  StoreConfig  `yaml:"store"`
+	Images ImagesConfig `yaml:"images"`
+	Diff   DiffConfig   `yaml:"diff"`
+
+	// Workers is the number of diffs computed concurrently.
+	Workers int `yaml:"workers"`
+
+	// BatchIdleTimeout is the time without new cases after which a batch
+	// is automatically finalized. Zero disables it.
+	BatchIdleTimeout duration `yaml:"batch_idle_timeout"`
+
+	// Retention is the age after which batches are deleted, with their
+	// results, for projects without their own retention. Zero keeps them
+	// forever.
+	Retention duration `yaml:"retention"`
+
+	WebhookMaxAttempts int `yaml:"webhook_max_attempts"`
+
+	CORS CORSConfig `yaml:"cors"`
+
+	// PublicURL is the URL the API is reachable at, used to link commit
+	// statuses to their batch.
+	PublicURL string `yaml:"public_url"`
+
+	GitHub GitHubConfig `yaml:"github"`
+
+	Auth AuthConfig `yaml:"auth"`
+
+	// AutoCreateProjects creates the projects of cases and batches on
+	// first use. Unknown projects are rejected otherwise.
+	AutoCreateProjects bool `yaml:"auto_create_projects"`
+
+	// AutoMigrate migrates the store on startup. When false the server
+	// refuses to start with pending migrations.
+	AutoMigrate bool `yaml:"auto_migrate"`
+}
+
+// TLSConfig enables HTTPS when both files are set.
+type TLSConfig struct {
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+}
+
+type StoreConfig struct {
+	// Type is boltdb, sql, sqlite or memory.
+	Type string `yaml:"type"`
+
+	// Path is the database file of the boltdb and sqlite stores.
+	Path string `yaml:"path"`
+
+	// Dialect and DSN select the database of the sql store.
+	Dialect string `yaml:"dialect"`
+	DSN     string `yaml:"dsn"`
+}
+
+type ImagesConfig struct {
+	// Type is store, to keep images in the store, or files, to keep them
+	// as PNG files in Path.
+	Type string `yaml:"type"`
+	Path string `yaml:"path"`
+}
+
+type DiffConfig struct {
+	// Threshold is the color distance above which pixels are different.
+	Threshold float64 `yaml:"threshold"`
+
+	// ClusterDistance is the distance under which clusters of differences
+	// are merged.
+	ClusterDistance int `yaml:"cluster_distance"`
+}
+
+type CORSConfig struct {
+	// Origins allowed to call the API, * allows any.
+	Origins stringList `yaml:"origins"`
+}
+
+// GitHubConfig enables commit statuses when Token is set.
+type GitHubConfig struct {
+	Token  string `yaml:"token"`
+	APIURL string `yaml:"api_url"`
+}
+
+// AuthConfig requires the callers of mutating endpoints to authenticate when
+// Enabled. AdminToken manages projects, API keys and webhooks.
+type AuthConfig struct {
+	Enabled    bool       `yaml:"enabled"`
+	AdminToken string     `yaml:"admin_token"`
+	OIDC       OIDCConfig `yaml:"oidc"`
+}
+
+// OIDCConfig authenticates users with the JWTs of an identity provider when
+// Issuer is set. The keys of the provider are read from JWKSFile, or fetched
+// from JWKSURL.
+type OIDCConfig struct {
+	Issuer   string `yaml:"issuer"`
+	Audience string `yaml:"audience"`
+	JWKSURL  string `yaml:"jwks_url"`
+	JWKSFile string `yaml:"jwks_file"`
+
+	// UserClaim identifies the user in the results it reviews.
+	UserClaim string `yaml:"user_claim"`
+
+	// RolesClaim lists the roles of the user as project:role, like
+	// web:reviewer, or admin.
+	RolesClaim string `yaml:"roles_claim"`
+}
+
+func defaultConfig() Config {
+	c := core.DefaultConfig(nil)
+
+	return Config{
+		Listen:            ":9000",
+		MaxUploadSize:     20 << 20,
+		MaxBulkUploadSize: 1 << 30,
+		MaxImageWidth:     4096,
+		MaxImageHeight:    16384,
+		Store: StoreConfig{
+			Type:    "boltdb",
+			Dialect: "cockroach",
+		},
+		Images: ImagesConfig{
+			Type: "store",
+		},
+		Diff: DiffConfig{
+			Threshold:       imgdiff.DefaultThreshold,
+			ClusterDistance: imgdiff.DefaultClusterDistance,
+		},
+		Workers:            c.Workers,
+		BatchIdleTimeout:   duration(c.BatchIdleTimeout),
+		WebhookMaxAttempts: c.WebhookMaxAttempts,
+		CORS:               CORSConfig{Origins: stringList{"*"}},
+		Auth: AuthConfig{
+			OIDC: OIDCConfig{UserClaim: "sub", RolesClaim: "optician_roles"},
+		},
+		AutoCreateProjects: c.AutoCreateProjects,
+		AutoMigrate:        true,
+	}
+}
+
+// flags registers a flag for every setting, bound to the config fields.
+func (c *Config) flags(fs *flag.FlagSet) {
+	fs.StringVar(&c.Listen, "listen", c.Listen, "address to listen on")
+	fs.Var(&c.MaxUploadSize, "max-upload-size", "maximum size of the body of a case, like 20MB")
+	fs.Var(&c.MaxBulkUploadSize, "max-bulk-upload-size", "maximum size of the body of a bulk upload, like 1GB")
+	fs.IntVar(&c.MaxImageWidth, "max-image-width", c.MaxImageWidth, "maximum width in pixels of uploaded images")
+	fs.IntVar(&c.MaxImageHeight, "max-image-height", c.MaxImageHeight, "maximum height in pixels of uploaded images")
+	fs.StringVar(&c.TLS.CertFile, "tls-cert", c.TLS.CertFile, "TLS certificate file")
+	fs.StringVar(&c.TLS.KeyFile, "tls-key", c.TLS.KeyFile, "TLS key file")
+	fs.StringVar(&c.Store.Type, "store", c.Store.Type, "store type: boltdb, sql, sqlite or memory")
+	fs.StringVar(&c.Store.Path, "store-path", c.Store.Path, "database file of the boltdb and sqlite stores")
+	fs.StringVar(&c.Store.Dialect, "sql-dialect", c.Store.Dialect, "SQL dialect: cockroach, postgres, sqlite or mysql")
+	fs.StringVar(&c.Store.DSN, "dsn", c.Store.DSN, "SQL data source name")
+	fs.StringVar(&c.Images.Type, "images", c.Images.Type, "image storage: store or files")
+	fs.StringVar(&c.Images.Path, "images-path", c.Images.Path, "directory of the files image storage")
+	fs.Float64Var(&c.Diff.Threshold, "diff-threshold", c.Diff.Threshold, "color distance above which pixels are different")
+	fs.IntVar(&c.Diff.ClusterDistance, "diff-cluster-distance", c.Diff.ClusterDistance, "distance under which clusters of differences are merged")
+	fs.IntVar(&c.Workers, "workers", c.Workers, "number of diffs computed concurrently")
+	fs.Var(&c.BatchIdleTimeout, "batch-idle-timeout", "idle time after which batches are finalized, 0 disables it")
+	fs.Var(&c.Retention, "retention", "age after which batches are deleted, 0 keeps them forever")
+	fs.IntVar(&c.WebhookMaxAttempts, "webhook-max-attempts", c.WebhookMaxAttempts, "attempts before a webhook delivery fails")
+	fs.Var(&c.CORS.Origins, "cors-origins", "comma separated origins allowed to call the API, * allows any")
+	fs.StringVar(&c.PublicURL, "public-url", c.PublicURL, "URL the API is reachable at")
+	fs.StringVar(&c.GitHub.Token, "github-token", c.GitHub.Token, "GitHub token to post commit statuses")
+	fs.StringVar(&c.GitHub.APIURL, "github-api-url", c.GitHub.APIURL, "GitHub API URL, for GitHub Enterprise")
+	fs.BoolVar(&c.Auth.Enabled, "auth", c.Auth.Enabled, "require authentication on mutating endpoints")
+	fs.StringVar(&c.Auth.AdminToken, "admin-token", c.Auth.AdminToken, "token of the admin, who manages projects, API keys and webhooks")
+	fs.StringVar(&c.Auth.OIDC.Issuer, "oidc-issuer", c.Auth.OIDC.Issuer, "issuer of the JWTs of users, enables OIDC")
+	fs.StringVar(&c.Auth.OIDC.Audience, "oidc-audience", c.Auth.OIDC.Audience, "required audience of the JWTs of users")
+	fs.StringVar(&c.Auth.OIDC.JWKSURL, "oidc-jwks-url", c.Auth.OIDC.JWKSURL, "URL of the keys of the issuer")
+	fs.StringVar(&c.Auth.OIDC.JWKSFile, "oidc-jwks-file", c.Auth.OIDC.JWKSFile, "file with the keys of the issuer, instead of the URL")
+	fs.StringVar(&c.Auth.OIDC.UserClaim, "oidc-user-claim", c.Auth.OIDC.UserClaim, "claim identifying users")
+	fs.StringVar(&c.Auth.OIDC.RolesClaim, "oidc-roles-claim", c.Auth.OIDC.RolesClaim, "claim with the project:role roles of users")
+	fs.BoolVar(&c.AutoCreateProjects, "auto-create-projects", c.AutoCreateProjects, "create unknown projects on their first case")
+	fs.BoolVar(&c.AutoMigrate, "auto-migrate", c.AutoMigrate, "migrate the store on startup")
+}
+
+// envFlags maps the environment variables to the flag they override.
+var envFlags = map[string]string{
+	"LISTEN_ADDR":           "listen",
+	"MAX_UPLOAD_SIZE":       "max-upload-size",
+	"MAX_BULK_UPLOAD_SIZE":  "max-bulk-upload-size",
+	"MAX_IMAGE_WIDTH":       "max-image-width",
+	"MAX_IMAGE_HEIGHT":      "max-image-height",
+	"TLS_CERT_FILE":         "tls-cert",
+	"TLS_KEY_FILE":          "tls-key",
+	"STORE_TYPE":            "store",
+	"STORE_PATH":            "store-path",
+	"SQLITE_PATH":           "store-path",
+	"SQL_DIALECT":           "sql-dialect",
+	"SQL_URL":               "dsn",
+	"IMAGES_TYPE":           "images",
+	"IMAGES_PATH":           "images-path",
+	"DIFF_THRESHOLD":        "diff-threshold",
+	"DIFF_CLUSTER_DISTANCE": "diff-cluster-distance",
+	"WORKERS":               "workers",
+	"BATCH_IDLE_TIMEOUT":    "batch-idle-timeout",
+	"RETENTION":             "retention",
+	"WEBHOOK_MAX_ATTEMPTS":  "webhook-max-attempts",
+	"CORS_ORIGINS":          "cors-origins",
+	"PUBLIC_URL":            "public-url",
+	"GITHUB_TOKEN":          "github-token",
+	"GITHUB_API_URL":        "github-api-url",
+	"AUTH_ENABLED":          "auth",
+	"AUTH_ADMIN_TOKEN":      "admin-token",
+	"OIDC_ISSUER":           "oidc-issuer",
+	"OIDC_AUDIENCE":         "oidc-audience",
+	"OIDC_JWKS_URL":         "oidc-jwks-url",
+	"OIDC_JWKS_FILE":        "oidc-jwks-file",
+	"OIDC_USER_CLAIM":       "oidc-user-claim",
+	"OIDC_ROLES_CLAIM":      "oidc-roles-claim",
+	"AUTO_CREATE_PROJECTS":  "auto-create-projects",
+	"AUTO_MIGRATE":          "auto-migrate",
+}
+
+// loadConfig reads the config from the file, the environment and the flags in
+// args, and validates it. It returns the arguments left after the flags.
+func loadConfig(args []string) (Config, []string, error) {
+	c := defaultConfig()
+
+	fs := flag.NewFlagSet("optician-api", flag.ContinueOnError)
+	path := fs.String("config", os.Getenv("OPTICIAN_CONFIG"), "YAML config file")
+	c.flags(fs)
+
+	// Flags are parsed first to find the config file, and again after
+	// reading it so they take precedence.
+	err := fs.Parse(args)
+	if err != nil {
+		return c, nil, err
+	}
+
+	if *path != "" {
+		data, err := ioutil.ReadFile(*path)
+		if err != nil {
+			return c, nil, errors.Wrap(err, "error reading config file")
+		}
+
+		err = yaml.UnmarshalStrict(data, &c)
+		if err != nil {
+			return c, nil, errors.Wrap(err, "error parsing config file "+*path)
+		}
+	}
+
+	err = c.loadEnv(fs)
+	if err != nil {
+		return c, nil, err
+	}
+
+	err = fs.Parse(args)
+	if err != nil {
+		return c, nil, err
+	}
+
+	err = c.validate()
+	if err != nil {
+		return c, nil, err
+	}
+
+	return c, fs.Args(), nil
+}
+
+func (c *Config) loadEnv(fs *flag.FlagSet) error {
+	for env, name := range envFlags {
+		value := os.Getenv(env)
+		if value == "" {
+			continue
+		}
+
+		err := fs.Set(name, value)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %s", env, err)
+		}
+	}
+
+	// Deployments predating SQL_URL set the host and port of a local
+	// CockroachDB node.
+	if c.Store.DSN == "" && os.Getenv("SQL_HOST") != "" {
+		c.Store.DSN = fmt.Sprintf("postgresql://root@%s:%s/optician?sslmode=disable", os.Getenv("SQL_HOST"), os.Getenv("SQL_PORT"))
+	}
+
+	return nil
+}
+
+// validate returns an error listing every invalid setting.
+func (c Config) validate() error {
+	var invalid []string
+
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			invalid = append(invalid, fmt.Sprintf(format, args...))
+		}
+	}
+
+	check(c.Listen != "", "listen is required")
+	check(c.MaxUploadSize > 0, "max_upload_size must be positive")
+	check(c.MaxBulkUploadSize > 0, "max_bulk_upload_size must be positive")
+	check(c.MaxImageWidth > 0 && c.MaxImageHeight > 0, "max_image_width and max_image_height must be positive")
+	check((c.TLS.CertFile == "") == (c.TLS.KeyFile == ""), "tls needs both cert_file and key_file")
+
+	switch c.Store.Type {
+	case "boltdb", "sqlite", "memory":
+	case "sql":
+		check(c.Store.DSN != "", "store.dsn is required for the sql store")
+		check(c.Store.Dialect != "", "store.dialect is required for the sql store")
+	default:
+		check(false, "unknown store.type %q, expected boltdb, sql, sqlite or memory", c.Store.Type)
+	}
+
+	switch c.Images.Type {
+	case "store":
+	case "files":
+		check(c.Images.Path != "", "images.path is required for files image storage")
+	default:
+		check(false, "unknown images.type %q, expected store or files", c.Images.Type)
+	}
+
+	check(c.Diff.Threshold > 0, "diff.threshold must be positive")
+	check(c.Diff.ClusterDistance > 0, "diff.cluster_distance must be positive")
+	check(c.Workers > 0, "workers must be positive")
+	check(c.BatchIdleTimeout >= 0, "batch_idle_timeout can't be negative")
+	check(c.Retention >= 0, "retention can't be negative")
+	check(c.WebhookMaxAttempts > 0, "webhook_max_attempts must be positive")
+
+	for _, origin := range c.CORS.Origins {
+		if origin == "*" {
+			continue
+		}
+		u, err := url.Parse(origin)
+		check(err == nil && u.Scheme != "" && u.Host != "" && u.Path == "", "invalid cors origin %q, expected scheme://host[:port]", origin)
+	}
+
+	if c.PublicURL != "" {
+		u, err := url.Parse(c.PublicURL)
+		check(err == nil && u.Scheme != "" && u.Host != "", "invalid public_url %q", c.PublicURL)
+	}
+
+	check(c.Auth.AdminToken == "" || len(c.Auth.AdminToken) >= 32, "auth.admin_token must be at least 32 characters")
+	check(!c.Auth.Enabled || c.Auth.AdminToken != "" || c.Auth.OIDC.Issuer != "", "auth.admin_token or auth.oidc.issuer is required when auth is enabled")
+
+	oidc := c.Auth.OIDC
+	if oidc.Issuer != "" {
+		check((oidc.JWKSURL == "") != (oidc.JWKSFile == ""), "auth.oidc needs either jwks_url or jwks_file")
+		check(oidc.UserClaim != "" && oidc.RolesClaim != "", "auth.oidc needs user_claim and roles_claim")
+		if oidc.JWKSURL != "" {
+			u, err := url.Parse(oidc.JWKSURL)
+			check(err == nil && u.Scheme != "" && u.Host != "", "invalid auth.oidc.jwks_url %q", oidc.JWKSURL)
+		}
+	} else {
+		check(oidc.JWKSURL == "" && oidc.JWKSFile == "", "auth.oidc.issuer is required with a JWKS")
+	}
+
+	if len(invalid) > 0 {
+		return errors.New("invalid config:\n  " + strings.Join(invalid, "\n  "))
+	}
+
+	return nil
+}
+
+// duration is a time.Duration read from strings like 6h or 30m.
+type duration time.Duration
+
+func (d *duration) String() string {
+	return time.Duration(*d).String()
+}
+
+func (d *duration) Set(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+
+	*d = duration(v)
+
+	return nil
+}
+
+func (d *duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	err := unmarshal(&s)
+	if err != nil {
+		return err
+	}
+
+	return d.Set(s)
+}
+
+// byteSize is a size in bytes read from strings like 512KB or 20MB.
+type byteSize int64
+
+var byteUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"GB", 1 << 30},
+	{"MB", 1 << 20},
+	{"KB", 1 << 10},
+	{"B", 1},
+}
+
+func (s *byteSize) String() string {
+	for _, u := range byteUnits {
+		if int64(*s) >= u.size && int64(*s)%u.size == 0 {
+			return strconv.FormatInt(int64(*s)/u.size, 10) + u.suffix
+		}
+	}
+
+	return strconv.FormatInt(int64(*s), 10)
+}
+
+func (s *byteSize) Set(v string) error {
+	v = strings.ToUpper(strings.TrimSpace(v))
+
+	unit := int64(1)
+	for _, u := range byteUnits {
+		if strings.HasSuffix(v, u.suffix) {
+			v = strings.TrimSpace(strings.TrimSuffix(v, u.suffix))
+			unit = u.size
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return errors.New("invalid size " + v + ", expected a number of B, KB, MB or GB")
+	}
+
+	*s = byteSize(n * unit)
+
+	return nil
+}
+
+func (s *byteSize) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var v string
+	err := unmarshal(&v)
+	if err != nil {
+		return err
+	}
+
+	return s.Set(v)
+}
+
+// stringList is a list read from comma separated flags.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = nil
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*l = append(*l, v)
+		}
+	}
+
+	return nil
+}
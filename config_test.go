@@ -0,0 +1,124 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	f, err := ioutil.TempFile("", "optician-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	_, err = f.WriteString(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return f.Name()
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	path := writeConfig(t, `
+listen: ":8000"
+workers: 2
+batch_idle_timeout: 1h
+store:
+  type: sqlite
+  path: /tmp/file.sqlite
+cors:
+  origins: ["https://a.example.com"]
+`)
+	defer os.Remove(path)
+
+	os.Setenv("WORKERS", "3")
+	defer os.Unsetenv("WORKERS")
+
+	c, args, err := loadConfig([]string{"-config", path, "-listen", ":7000", "migrate", "status"})
+	if err != nil {
+		t.Fatal("Error loading config:", err)
+	}
+
+	if c.Listen != ":7000" {
+		t.Fatal("Expected flag to override the file, got", c.Listen)
+	}
+
+	if c.Workers != 3 {
+		t.Fatal("Expected environment to override the file, got", c.Workers)
+	}
+
+	if time.Duration(c.BatchIdleTimeout) != time.Hour || c.Store.Type != "sqlite" || c.Store.Path != "/tmp/file.sqlite" {
+		t.Fatal("Expected settings from the file, got", c)
+	}
+
+	if len(c.CORS.Origins) != 1 || c.CORS.Origins[0] != "https://a.example.com" {
+		t.Fatal("Expected cors origins from the file, got", c.CORS.Origins)
+	}
+
+	if c.WebhookMaxAttempts != defaultConfig().WebhookMaxAttempts {
+		t.Fatal("Expected default webhook max attempts, got", c.WebhookMaxAttempts)
+	}
+
+	if len(args) != 2 || args[0] != "migrate" {
+		t.Fatal("Expected the subcommand to be left in args, got", args)
+	}
+}
+
+func TestLoadConfigUnknownKey(t *testing.T) {
+	path := writeConfig(t, "listne: \":8000\"\n")
+	defer os.Remove(path)
+
+	_, _, err := loadConfig([]string{"-config", path})
+	if err == nil {
+		t.Fatal("Expected error loading a config with an unknown key")
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	c := defaultConfig()
+	c.Store.Type = "sql"
+	c.Images.Type = "files"
+	c.TLS.CertFile = "server.crt"
+	c.Workers = 0
+	c.CORS.Origins = stringList{"example.com"}
+	c.Auth.Enabled = true
+	c.Auth.OIDC.JWKSFile = "jwks.json"
+
+	err := c.validate()
+	if err == nil {
+		t.Fatal("Expected invalid config")
+	}
+
+	for _, setting := range []string{"store.dsn", "images.path", "tls", "workers", "cors", "auth.admin_token", "auth.oidc.issuer"} {
+		if !strings.Contains(err.Error(), setting) {
+			t.Fatal("Expected error to report", setting, "got", err)
+		}
+	}
+
+	err = defaultConfig().validate()
+	if err != nil {
+		t.Fatal("Expected default config to be valid, got", err)
+	}
+}
+
+func TestByteSize(t *testing.T) {
+	tests := map[string]int64{"512": 512, "20MB": 20 << 20, "4 kb": 4 << 10, "1GB": 1 << 30}
+
+	for v, expected := range tests {
+		var s byteSize
+		err := s.Set(v)
+		if err != nil || int64(s) != expected {
+			t.Error("Expected", v, "to be", expected, "bytes, got", int64(s), err)
+		}
+	}
+
+	var s byteSize
+	if err := s.Set("20 potatoes"); err == nil {
+		t.Error("Expected error parsing an invalid size")
+	}
+}
@@ -2,27 +2,41 @@ package core
 
 import (
 	"image"
-	"time"
 
 	"github.com/pkg/errors"
 	"github.com/theopticians/optician-api/core/store"
 	"github.com/theopticians/optician-api/core/structs"
 )
 
-func Batchs() ([]structs.BatchInfo, error) {
-	return db.GetBatchs()
+func (s *Service) Batchs() ([]structs.BatchInfo, error) {
+	return s.db.GetBatchs()
 }
 
 // TESTS
-func Results() ([]structs.Result, error) {
-	return db.GetResults()
+func (s *Service) Results() ([]structs.Result, error) {
+	return s.db.GetResults()
 }
 
-func ResultsByBatchs(batch string) ([]structs.Result, error) {
-	return db.GetResultsByBatch(batch)
+func (s *Service) QueryResults(q store.ResultQuery) (store.ResultPage, error) {
+	return s.db.QueryResults(q)
 }
 
-func AddCase(c structs.Case) (structs.Result, error) {
+func (s *Service) QueryBatchs(q store.BatchQuery) (store.BatchPage, error) {
+	return s.db.QueryBatchs(q)
+}
+
+func (s *Service) ResultsByBatchs(batch string) ([]structs.Result, error) {
+	return batchResults(s.db, batch)
+}
+
+// AddCase stores the case and queues its diff. The returned result is pending
+// until a worker computes it. The image, the result and its job are stored in
+// a single transaction.
+func (s *Service) AddCase(c structs.Case, by string) (structs.Result, error) {
+	err := validateCase(c)
+	if err != nil {
+		return structs.Result{}, err
+	}
 
 	testImage := c.Image
 	projectID := c.ProjectID
@@ -31,141 +45,334 @@ func AddCase(c structs.Case) (structs.Result, error) {
 	browser := c.Browser
 	batch := c.Batch
 
-	if batchIsOld(batch) {
-		return structs.Result{}, errors.New("The batch " + batch + " is too old, start a new one")
+	project, err := s.ensureProject(projectID, by)
+	if err != nil {
+		return structs.Result{}, err
 	}
 
-	if batchHasTest(batch, projectID, branch, target, browser) {
-		return structs.Result{}, errors.New("The batch " + batch + " already has this test")
+	b, err := s.caseBatch(c, by)
+	if err != nil {
+		return structs.Result{}, errors.Wrap(err, "error getting batch")
 	}
 
-	if batchHasDifferentBranch(batch, branch) {
-		return structs.Result{}, errors.New("The same batch was used for a different branch. Only one branch can be tested in a batch")
+	if b.Finalized() {
+		return structs.Result{}, ConflictError{"The batch " + batch + " is finalized, start a new one"}
 	}
 
-	randID := RandStringBytes(14)
+	var results structs.Result
+	var job structs.Job
+	var event structs.Event
 
-	imgID, err := db.StoreImage(testImage)
+	err = s.db.Transaction(func(tx store.Store) error {
+		batchResults, err := tx.GetResultsByBatch(batch)
+		if err != nil {
+			return errors.Wrap(err, "error getting batch results")
+		}
 
-	baseImgID, err := db.GetBaseImageID(projectID, branch, target, browser)
-	if err != nil {
-		if err == store.NotFoundError {
-			// IF no base image found, set this as base image
-			baseImgID = imgID
-			db.SetBaseImageID(baseImgID, projectID, branch, target, browser)
-		} else {
-			return structs.Result{}, errors.Wrap(err, "error getting base image ID")
+		if batchHasTest(batchResults, projectID, branch, target, browser) {
+			return ConflictError{"The batch " + batch + " already has this test"}
 		}
-	}
 
-	maskID, err := db.GetBaseMaskID(projectID, branch, target, browser)
-	if err != nil {
-		if err == store.NotFoundError {
-			maskID = "nomask"
-		} else {
-			return structs.Result{}, errors.Wrap(err, "error getting base mask id")
+		if batchHasDifferentBranch(batchResults, branch) {
+			return ConflictError{"The same batch was used for a different branch. Only one branch can be tested in a batch"}
+		}
+
+		imgID, err := s.imageStore(tx).StoreImage(testImage)
+		if err != nil {
+			return errors.Wrap(err, "error storing image")
+		}
+
+		// Until the case has a base image on its branch, it's diffed against
+		// the one of the default branch of the project, with its mask
+		baseBranch := branch
+		baseImgID, err := tx.GetBaseImageID(projectID, branch, target, browser)
+		if err == store.NotFoundError && project.DefaultBranch != "" && project.DefaultBranch != branch {
+			baseBranch = project.DefaultBranch
+			baseImgID, err = tx.GetBaseImageID(projectID, baseBranch, target, browser)
+		}
+		if err != nil {
+			if err == store.NotFoundError {
+				// IF no base image found, set this as base image
+				baseImgID = imgID
+				baseBranch = branch
+				err = tx.SetBaseImageID(baseImgID, projectID, branch, target, browser)
+				if err != nil {
+					return errors.Wrap(err, "error setting base image ID")
+				}
+			} else {
+				return errors.Wrap(err, "error getting base image ID")
+			}
+		}
+
+		maskID, err := tx.GetBaseMaskID(projectID, baseBranch, target, browser)
+		if err != nil {
+			if err == store.NotFoundError {
+				maskID = "nomask"
+			} else {
+				return errors.Wrap(err, "error getting base mask id")
+			}
+		}
+
+		results = structs.Result{
+			ID:          RandStringBytes(14),
+			Project:     projectID,
+			Branch:      branch,
+			Batch:       c.Batch,
+			Target:      target,
+			Browser:     browser,
+			Commit:      c.Commit,
+			Repository:  c.Repository,
+			ImageID:     imgID,
+			MaskID:      maskID,
+			BaseImageID: baseImgID,
+			Status:      structs.StatusPending,
+			Timestamp:   s.now(),
+		}
+
+		err = tx.StoreResult(results)
+		if err != nil {
+			return errors.Wrap(err, "error storing result")
+		}
+
+		err = s.audit(tx, structs.AuditEntry{Actor: by, Action: AuditCaseAdded, Project: projectID, Batch: batch, Result: results.ID}, nil, results)
+		if err != nil {
+			return err
+		}
+
+		job = s.newJob(results)
+		err = tx.StoreJob(job)
+		if err != nil {
+			return errors.Wrap(err, "error storing job")
 		}
+
+		err = s.touchBatch(tx, batch)
+		if err != nil {
+			return err
+		}
+
+		event, err = s.emitResult(tx, EventResultCreated, results)
+		return err
+	})
+	if err != nil {
+		return structs.Result{}, err
 	}
 
-	results := structs.Result{
-		ID:          randID,
-		Project:     projectID,
-		Branch:      branch,
-		Batch:       c.Batch,
-		Target:      target,
-		Browser:     browser,
-		ImageID:     imgID,
-		MaskID:      maskID,
-		BaseImageID: baseImgID,
-		Timestamp:   time.Now(),
+	s.enqueue(job)
+	s.publish(event)
+
+	return results, nil
+}
+
+// validateCase checks the case has everything needed to identify it and diff
+// it.
+func validateCase(c structs.Case) error {
+	required := []struct{ name, value string }{
+		{"projectid", c.ProjectID},
+		{"branch", c.Branch},
+		{"target", c.Target},
+		{"browser", c.Browser},
+		{"batch", c.Batch},
 	}
 
-	err = RunTest(&results)
+	for _, r := range required {
+		if r.value == "" {
+			return ValidationError{"The case has no " + r.name}
+		}
+	}
 
-	err = db.StoreResult(results)
+	if c.Image == nil {
+		return ValidationError{"The case has no image"}
+	}
 
-	return results, err
+	return ValidateRevision(c.Repository, c.Commit)
 }
 
-func GetTest(id string) (structs.Result, error) {
-	return db.GetResult(id)
+func (s *Service) GetTest(id string) (structs.Result, error) {
+	return s.db.GetResult(id)
 }
 
-func AcceptTest(testID string) error {
-	test, err := db.GetResult(testID)
+// AcceptTest sets the image of the result as the base image of its case.
+func (s *Service) AcceptTest(testID, by string) error {
+	var test structs.Result
+	var event structs.Event
+
+	err := s.db.Transaction(func(tx store.Store) error {
+		var err error
+		test, err = tx.GetResult(testID)
+
+		if err != nil {
+			return err
+		}
+
+		lastTest, err := tx.GetLastResult(test.Project, test.Branch, test.Target, test.Browser)
+
+		if err != nil {
+			return err
+		}
+
+		if testID != lastTest.ID {
+			return StaleResultError{"Cannot accept an old test. Last test is " + lastTest.ID, lastTest.ID}
+		}
+
+		err = s.auditAccept(tx, test, by)
+		if err != nil {
+			return err
+		}
+
+		test.Review = structs.ReviewAccepted
+		test.ReviewedBy = by
 
+		err = tx.AcceptResults([]structs.Result{test})
+		if err != nil {
+			return err
+		}
+
+		event, err = s.emitResult(tx, EventResultAccepted, test)
+		return err
+	})
 	if err != nil {
 		return err
 	}
 
-	lastTest, err := db.GetLastResult(test.Project, test.Branch, test.Target, test.Browser)
+	s.publish(event)
+
+	go s.reportChangedBatch(test.Batch)
+
+	return nil
+}
+
+// RejectTest marks the result as rejected.
+func (s *Service) RejectTest(testID, by string) error {
+	var test structs.Result
+	var event structs.Event
+
+	err := s.db.Transaction(func(tx store.Store) error {
+		var err error
+		test, err = tx.GetResult(testID)
+
+		if err != nil {
+			return err
+		}
+
+		lastTest, err := tx.GetLastResult(test.Project, test.Branch, test.Target, test.Browser)
+
+		if err != nil {
+			return err
+		}
+
+		if testID != lastTest.ID {
+			return StaleResultError{"Cannot reject an old test. Last test is " + lastTest.ID, lastTest.ID}
+		}
 
+		event, err = s.reject(tx, test, by)
+		return err
+	})
 	if err != nil {
 		return err
 	}
 
-	if testID != lastTest.ID {
-		return errors.New("Cannot accept an old test. Last test is " + lastTest.ID)
-	}
+	s.publish(event)
 
-	return db.SetBaseImageID(test.ImageID, test.Project, test.Branch, test.Target, test.Browser)
+	go s.reportChangedBatch(test.Batch)
+
+	return nil
 }
 
 // IMAGES
 
-func GetImage(id string) image.Image {
-	img, err := db.GetImage(id)
-	if err != nil {
-		panic(err)
-	}
-
-	return img
+func (s *Service) GetImage(id string) (image.Image, error) {
+	return s.imageStore(s.db).GetImage(id)
 }
 
 // MASKS
 
-func GetMask(id string) ([]image.Rectangle, error) {
-	return db.GetMask(id)
+func (s *Service) GetMask(id string) ([]image.Rectangle, error) {
+	return s.db.GetMask(id)
 }
 
-func MaskTest(testID string, mask []image.Rectangle) (structs.Result, error) {
-	test, err := GetTest(testID)
-	if err != nil {
-		return structs.Result{}, err
+// MaskTest sets the mask of the case of the result and recomputes its diff.
+func (s *Service) MaskTest(testID string, mask []image.Rectangle, by string) (structs.Result, error) {
+	for _, r := range mask {
+		if r.Max.X < r.Min.X || r.Max.Y < r.Min.Y {
+			return structs.Result{}, ValidationError{"The mask has an invalid rectangle " + r.String()}
+		}
 	}
 
-	lastTest, err := db.GetLastResult(test.Project, test.Branch, test.Target, test.Browser)
-
+	test, err := s.GetTest(testID)
 	if err != nil {
 		return structs.Result{}, err
 	}
 
-	if testID != lastTest.ID {
-		return structs.Result{}, errors.New("Cannot add masks based on an old test")
-	}
-
-	maskID, err := db.StoreMask(mask)
+	d, err := s.computeDiff(test.Project, test.BaseImageID, test.ImageID, "", mask)
 	if err != nil {
 		return structs.Result{}, err
 	}
 
-	err = db.SetBaseMaskID(maskID, test.Project, test.Branch, test.Target, test.Browser)
-	if err != nil {
-		return structs.Result{}, err
-	}
+	// The mask, the base mask and the diff are stored together, and only if
+	// the test is still the last one of its case.
+	var event structs.Event
+	err = s.db.Transaction(func(tx store.Store) error {
+		// Read again, so reviews and diffs stored since are kept
+		var err error
+		test, err = tx.GetResult(testID)
+		if err != nil {
+			return err
+		}
 
-	test.MaskID = maskID
+		lastTest, err := tx.GetLastResult(test.Project, test.Branch, test.Target, test.Browser)
 
-	err = RunTest(&test)
-	if err != nil {
-		return structs.Result{}, err
-	}
+		if err != nil {
+			return err
+		}
+
+		if testID != lastTest.ID {
+			return StaleResultError{"Cannot add masks based on an old test. Last test is " + lastTest.ID, lastTest.ID}
+		}
+
+		maskID, err := tx.StoreMask(mask)
+		if err != nil {
+			return err
+		}
 
-	err = db.StoreResult(test)
+		oldMaskID, err := tx.GetBaseMaskID(test.Project, test.Branch, test.Target, test.Browser)
+		if err != nil && err != store.NotFoundError {
+			return err
+		}
+		before := maskState{MaskID: oldMaskID, DiffScore: test.DiffScore}
+
+		err = tx.SetBaseMaskID(maskID, test.Project, test.Branch, test.Target, test.Browser)
+		if err != nil {
+			return err
+		}
+
+		d.comparison.MaskID = maskID
+
+		err = d.store(s.imageStore(tx))
+		if err != nil {
+			return err
+		}
+
+		d.apply(&test)
+		test.MaskedBy = by
 
+		err = s.audit(tx, structs.AuditEntry{Actor: by, Action: AuditMaskChanged, Project: test.Project, Batch: test.Batch, Result: test.ID}, before, maskState{MaskID: maskID, DiffScore: test.DiffScore})
+		if err != nil {
+			return err
+		}
+
+		err = tx.StoreResult(test)
+		if err != nil {
+			return err
+		}
+
+		event, err = s.emitResult(tx, EventMaskChanged, test)
+		return err
+	})
 	if err != nil {
 		return structs.Result{}, err
 	}
 
+	s.publish(event)
+
 	return test, nil
 }
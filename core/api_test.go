@@ -0,0 +1,217 @@
+package core
+
+import (
+	"image"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	_ "image/png"
+
+	"github.com/pkg/errors"
+	"github.com/theopticians/optician-api/core/store/memory"
+	"github.com/theopticians/optician-api/core/structs"
+)
+
+var (
+	testImg1 = readImage("./testimages/so_1.png")
+	testImg2 = readImage("./testimages/so_2.png")
+)
+
+func readImage(path string) image.Image {
+	reader, err := os.Open(path)
+	if err != nil {
+		panic(err)
+	}
+	defer reader.Close()
+	im, _, err := image.Decode(reader)
+	if err != nil {
+		panic(err)
+	}
+	return im
+}
+
+func addCase(t *testing.T, project string, img image.Image, batch string) structs.Result {
+	r, err := svc.AddCase(structs.Case{ProjectID: project, Branch: "master", Target: "home", Browser: "chrome", Batch: batch, Image: img}, "tester")
+	if err != nil {
+		t.Fatal("Error adding case:", err)
+	}
+
+	if r.Status != structs.StatusPending {
+		t.Fatal("Expected a pending result, got", r.Status)
+	}
+
+	r, err = svc.WaitResult(r.ID, 10*time.Second)
+	if err != nil {
+		t.Fatal("Error waiting result:", err)
+	}
+
+	if r.Status != structs.StatusDone {
+		t.Fatal("Expected result to be done, got", r.Status, r.Error)
+	}
+
+	return r
+}
+
+func TestAcceptScenario(t *testing.T) {
+	project := "api_" + RandStringBytes(10)
+
+	first := addCase(t, project, testImg1, project+"_b1")
+	if first.BaseImageID != first.ImageID || first.DiffScore != 0 {
+		t.Fatal("Expected the first case to be its own base image, got", first)
+	}
+
+	second := addCase(t, project, testImg2, project+"_b2")
+	if second.BaseImageID != first.ImageID || second.DiffScore == 0 {
+		t.Fatal("Expected the second case to differ from the first, got", second)
+	}
+
+	_, err := svc.AddCase(structs.Case{ProjectID: project, Branch: "master", Target: "home", Browser: "chrome", Batch: project + "_b2", Image: testImg2}, "tester")
+	if _, ok := errors.Cause(err).(ConflictError); !ok {
+		t.Fatal("Expected conflict error adding the same case twice to a batch, got", err)
+	}
+
+	_, err = svc.AddCase(structs.Case{ProjectID: project, Branch: "master", Browser: "chrome", Batch: project + "_b2", Image: testImg2}, "tester")
+	if _, ok := err.(ValidationError); !ok {
+		t.Fatal("Expected validation error adding a case without target, got", err)
+	}
+
+	jobs, err := svc.db.GetJobs()
+	if err != nil || len(jobs) != 0 {
+		t.Fatal("Expected no job left, got", jobs, err)
+	}
+
+	err = svc.AcceptTest(first.ID, "tester")
+	if stale, ok := err.(StaleResultError); !ok || stale.LastResultID != second.ID {
+		t.Fatal("Expected stale result error accepting an old result, got", err)
+	}
+
+	err = svc.AcceptTest(second.ID, "tester")
+	if err != nil {
+		t.Fatal("Error accepting result:", err)
+	}
+
+	accepted, err := svc.GetTest(second.ID)
+	if err != nil || accepted.ReviewedBy != "tester" {
+		t.Fatal("Expected the result to be attributed to its reviewer, got", accepted.ReviewedBy, err)
+	}
+
+	baseImageID, err := svc.db.GetBaseImageID(project, "master", "home", "chrome")
+	if err != nil || baseImageID != second.ImageID {
+		t.Fatal("Expected accepted image to be the base image, got", baseImageID, err)
+	}
+
+	third := addCase(t, project, testImg2, project+"_b3")
+	if third.BaseImageID != second.ImageID || third.DiffScore != 0 {
+		t.Fatal("Expected the third case to match the accepted one, got", third)
+	}
+}
+
+func TestMaskScenario(t *testing.T) {
+	project := "api_" + RandStringBytes(10)
+
+	addCase(t, project, testImg1, project+"_b1")
+	second := addCase(t, project, testImg2, project+"_b2")
+
+	bounds := testImg1.Bounds().Union(testImg2.Bounds())
+	masked, err := svc.MaskTest(second.ID, []image.Rectangle{bounds}, "tester")
+	if err != nil {
+		t.Fatal("Error masking result:", err)
+	}
+
+	if masked.DiffScore != 0 || masked.MaskID == "nomask" || masked.DiffImageID == second.DiffImageID || masked.MaskedBy != "tester" {
+		t.Fatal("Expected masked result to have a new diff without differences, got", masked)
+	}
+
+	maskID, err := svc.db.GetBaseMaskID(project, "master", "home", "chrome")
+	if err != nil || maskID != masked.MaskID {
+		t.Fatal("Expected the mask to be the base mask, got", maskID, err)
+	}
+
+	third := addCase(t, project, testImg2, project+"_b3")
+	if third.MaskID != masked.MaskID || third.DiffScore != 0 {
+		t.Fatal("Expected the next case to use the mask, got", third)
+	}
+
+	_, err = svc.MaskTest(second.ID, []image.Rectangle{}, "tester")
+	if err == nil {
+		t.Fatal("Expected error masking an old result")
+	}
+}
+
+// hookedComparator runs before each comparison of the default comparator.
+type hookedComparator struct {
+	ImgDiff
+	before func()
+}
+
+func (c *hookedComparator) Compare(base, img image.Image, mask []image.Rectangle) (image.Image, float64, []image.Rectangle, error) {
+	if c.before != nil {
+		c.before()
+	}
+
+	return c.ImgDiff.Compare(base, img, mask)
+}
+
+func TestMaskKeepsReview(t *testing.T) {
+	comparator := &hookedComparator{}
+
+	c := DefaultConfig(memory.NewMemoryStore())
+	c.Comparator = comparator
+	s := NewService(c)
+
+	err := s.StartWorkers()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var second structs.Result
+	for i, img := range []image.Image{testImg1, testImg2} {
+		second, err = s.AddCase(structs.Case{ProjectID: "p", Branch: "master", Target: "home", Browser: "chrome", Batch: "b" + strconv.Itoa(i), Image: img}, "tester")
+		if err != nil {
+			t.Fatal("Error adding case:", err)
+		}
+
+		_, err = s.WaitResult(second.ID, 10*time.Second)
+		if err != nil {
+			t.Fatal("Error waiting result:", err)
+		}
+	}
+
+	// Accepted while the masked diff is computed
+	comparator.before = func() {
+		comparator.before = nil
+
+		err := s.AcceptTest(second.ID, "user:ana")
+		if err != nil {
+			t.Fatal("Error accepting test:", err)
+		}
+	}
+
+	masked, err := s.MaskTest(second.ID, []image.Rectangle{image.Rect(0, 0, 10, 10)}, "user:bob")
+	if err != nil {
+		t.Fatal("Error masking result:", err)
+	}
+
+	stored, err := s.GetTest(second.ID)
+	if err != nil || stored.Review != structs.ReviewAccepted || stored.ReviewedBy != "user:ana" || stored.MaskID != masked.MaskID || stored.MaskedBy != "user:bob" {
+		t.Fatal("Expected the masked result to keep its review, got", stored, err)
+	}
+}
+
+func TestDifferentSizeFails(t *testing.T) {
+	project := "api_" + RandStringBytes(10)
+
+	addCase(t, project, testImg1, project+"_b1")
+
+	r, err := svc.AddCase(structs.Case{ProjectID: project, Branch: "master", Target: "home", Browser: "chrome", Batch: project + "_b2", Image: image.NewNRGBA(image.Rect(0, 0, 10, 10))}, "tester")
+	if err != nil {
+		t.Fatal("Error adding case:", err)
+	}
+
+	r, err = svc.WaitResult(r.ID, 10*time.Second)
+	if err != nil || r.Status != structs.StatusFailed || r.Error == "" {
+		t.Fatal("Expected the result of a different size image to fail, got", r, err)
+	}
+}
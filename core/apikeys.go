@@ -0,0 +1,136 @@
+package core
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/theopticians/optician-api/core/store"
+	"github.com/theopticians/optician-api/core/structs"
+)
+
+var roles = []string{structs.RoleUploader, structs.RoleReviewer}
+
+// CreateAPIKey stores a new key of an existing project. It returns the key
+// and its token, which is only known at creation: the store keeps its hash.
+func (s *Service) CreateAPIKey(k structs.APIKey, by string) (structs.APIKey, string, error) {
+	if !matchesAny(roles, k.Role) {
+		return structs.APIKey{}, "", ValidationError{"Unknown role " + k.Role + ", expected uploader or reviewer"}
+	}
+
+	_, err := s.db.GetProject(k.Project)
+	if err == store.NotFoundError {
+		return structs.APIKey{}, "", NotFoundError{"The project " + k.Project + " doesn't exist"}
+	} else if err != nil {
+		return structs.APIKey{}, "", errors.Wrap(err, "error getting project")
+	}
+
+	secret, err := randomSecret()
+	if err != nil {
+		return structs.APIKey{}, "", errors.Wrap(err, "error generating API key")
+	}
+
+	k.ID = RandStringBytes(14)
+	k.Hash = hashSecret(secret)
+	k.CreatedAt = s.now()
+
+	err = s.db.Transaction(func(tx store.Store) error {
+		err := tx.StoreAPIKey(k)
+		if err != nil {
+			return errors.Wrap(err, "error storing API key")
+		}
+
+		return s.audit(tx, structs.AuditEntry{Actor: by, Action: AuditAPIKeyCreated, Project: k.Project, Object: k.ID}, nil, withoutHash(k))
+	})
+	if err != nil {
+		return structs.APIKey{}, "", err
+	}
+
+	k.Hash = ""
+
+	return k, k.ID + "." + secret, nil
+}
+
+// APIKeys returns the keys of the project, without their hashes.
+func (s *Service) APIKeys(project string) ([]structs.APIKey, error) {
+	keys, err := s.db.GetAPIKeys(project)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range keys {
+		keys[i].Hash = ""
+	}
+
+	return keys, nil
+}
+
+// DeleteAPIKey deletes the key, after which its token doesn't authenticate.
+func (s *Service) DeleteAPIKey(id, by string) error {
+	return s.db.Transaction(func(tx store.Store) error {
+		old, err := tx.GetAPIKey(id)
+		if err != nil {
+			return err
+		}
+
+		err = tx.DeleteAPIKey(id)
+		if err != nil {
+			return err
+		}
+
+		return s.audit(tx, structs.AuditEntry{Actor: by, Action: AuditAPIKeyDeleted, Project: old.Project, Object: id}, withoutHash(old), nil)
+	})
+}
+
+func withoutHash(k structs.APIKey) structs.APIKey {
+	k.Hash = ""
+	return k
+}
+
+// Authenticate returns the key of the token, or an UnauthorizedError if it
+// isn't a valid key.
+func (s *Service) Authenticate(token string) (structs.APIKey, error) {
+	invalid := UnauthorizedError{"Invalid API key"}
+
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return structs.APIKey{}, invalid
+	}
+
+	k, err := s.db.GetAPIKey(parts[0])
+	if err == store.NotFoundError {
+		return structs.APIKey{}, invalid
+	} else if err != nil {
+		return structs.APIKey{}, errors.Wrap(err, "error getting API key")
+	}
+
+	if subtle.ConstantTimeCompare([]byte(k.Hash), []byte(hashSecret(parts[1]))) != 1 {
+		return structs.APIKey{}, invalid
+	}
+
+	k.Hash = ""
+
+	return k, nil
+}
+
+// randomSecret returns 32 random bytes, hex encoded. Secrets can't come from
+// RandStringBytes, which isn't cryptographically secure.
+func randomSecret() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+// hashSecret hashes a random secret. Secrets have too much entropy to be
+// brute forced, so a slow password hash isn't needed.
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,58 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/theopticians/optician-api/core/structs"
+)
+
+func TestAPIKeys(t *testing.T) {
+	project := "keys_" + RandStringBytes(10)
+
+	_, _, err := svc.CreateAPIKey(structs.APIKey{Project: project, Role: structs.RoleUploader}, "tester")
+	if _, ok := err.(NotFoundError); !ok {
+		t.Fatal("Expected not found error creating a key of an unknown project, got", err)
+	}
+
+	_, err = svc.CreateProject(structs.Project{ID: project}, "tester")
+	if err != nil {
+		t.Fatal("Error creating project:", err)
+	}
+
+	_, _, err = svc.CreateAPIKey(structs.APIKey{Project: project, Role: "admin"}, "tester")
+	if _, ok := err.(ValidationError); !ok {
+		t.Fatal("Expected validation error creating a key with an unknown role, got", err)
+	}
+
+	k, token, err := svc.CreateAPIKey(structs.APIKey{Project: project, Name: "CI", Role: structs.RoleUploader}, "tester")
+	if err != nil || k.Hash != "" || token == "" {
+		t.Fatal("Expected created key with its token and without its hash, got", k, token, err)
+	}
+
+	authenticated, err := svc.Authenticate(token)
+	if err != nil || authenticated.ID != k.ID || authenticated.Role != structs.RoleUploader || authenticated.Hash != "" {
+		t.Fatal("Expected the token to authenticate its key, got", authenticated, err)
+	}
+
+	for _, invalid := range []string{"", k.ID, k.ID + ".wrong", "missing." + token} {
+		_, err = svc.Authenticate(invalid)
+		if _, ok := err.(UnauthorizedError); !ok {
+			t.Error("Expected unauthorized error authenticating", invalid, "got", err)
+		}
+	}
+
+	keys, err := svc.APIKeys(project)
+	if err != nil || len(keys) != 1 || keys[0].Hash != "" {
+		t.Fatal("Expected the key of the project without its hash, got", keys, err)
+	}
+
+	err = svc.DeleteAPIKey(k.ID, "tester")
+	if err != nil {
+		t.Fatal("Error deleting key:", err)
+	}
+
+	_, err = svc.Authenticate(token)
+	if _, ok := err.(UnauthorizedError); !ok {
+		t.Fatal("Expected unauthorized error authenticating a deleted key, got", err)
+	}
+}
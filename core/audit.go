@@ -0,0 +1,109 @@
+package core
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/theopticians/optician-api/core/store"
+	"github.com/theopticians/optician-api/core/structs"
+)
+
+const (
+	AuditCaseAdded      = "case.added"
+	AuditResultAccepted = "result.accepted"
+	AuditResultRejected = "result.rejected"
+	AuditMaskChanged    = "mask.changed"
+	AuditBaseReverted   = "baseline.reverted"
+	AuditBatchOpened    = "batch.opened"
+	AuditBatchFinalized = "batch.finalized"
+	AuditBatchPurged    = "batch.purged"
+	AuditProjectCreated = "project.created"
+	AuditProjectUpdated = "project.updated"
+	AuditProjectDeleted = "project.deleted"
+	AuditAPIKeyCreated  = "apikey.created"
+	AuditAPIKeyDeleted  = "apikey.deleted"
+	AuditWebhookCreated = "webhook.created"
+	AuditWebhookDeleted = "webhook.deleted"
+)
+
+// SystemActor is the actor of the changes the service makes on its own, like
+// finalizing idle batches and purging expired ones.
+const SystemActor = "system"
+
+// reviewState is the review of a result, with the base image of its case for
+// accepts, before and after it changes.
+type reviewState struct {
+	Review      string `json:"review"`
+	BaseImageID string `json:"baseimage,omitempty"`
+}
+
+// baselineState is the base image of a case, before and after it's reverted.
+type baselineState struct {
+	BaseImageID string `json:"baseimage"`
+}
+
+// maskState is the base mask of the case of a result, and the diff score of
+// the result with it, before and after it changes.
+type maskState struct {
+	MaskID    string  `json:"mask"`
+	DiffScore float64 `json:"diffscore"`
+}
+
+func (s *Service) QueryAudit(q store.AuditQuery) (store.AuditPage, error) {
+	return s.db.QueryAudit(q)
+}
+
+// audit appends an entry to the audit log, with before and after encoded as
+// JSON unless nil. db is the transaction of the change, so that both are
+// stored or neither.
+func (s *Service) audit(db store.Store, e structs.AuditEntry, before, after interface{}) error {
+	e.ID = RandStringBytes(14)
+	e.Timestamp = s.now()
+
+	var err error
+	e.Before, err = auditValue(before)
+	if err != nil {
+		return err
+	}
+
+	e.After, err = auditValue(after)
+	if err != nil {
+		return err
+	}
+
+	err = db.AppendAudit(e)
+	if err != nil {
+		return errors.Wrap(err, "error appending audit entry")
+	}
+
+	return nil
+}
+
+func auditValue(v interface{}) (structs.JSON, error) {
+	if v == nil {
+		return nil, nil
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, errors.Wrap(err, "error encoding audit value")
+	}
+
+	return b, nil
+}
+
+// baseImageID returns the base image of the case, empty if it has none.
+func baseImageID(db store.Store, r structs.Result) (string, error) {
+	id, err := db.GetBaseImageID(r.Project, r.Branch, r.Target, r.Browser)
+	if err == store.NotFoundError {
+		return "", nil
+	}
+
+	return id, err
+}
+
+// caseObject is the audit object of the changes to the base image of a case.
+func caseObject(project, branch, target, browser string) string {
+	return strings.Join([]string{project, branch, target, browser}, "|")
+}
@@ -0,0 +1,77 @@
+package core
+
+import (
+	"encoding/json"
+	"image"
+	"testing"
+
+	"github.com/theopticians/optician-api/core/store"
+	"github.com/theopticians/optician-api/core/structs"
+)
+
+func TestAuditLog(t *testing.T) {
+	project := "audit_" + RandStringBytes(10)
+
+	first := addCase(t, project, testImg1, project+"_b1")
+	second := addCase(t, project, testImg2, project+"_b2")
+
+	err := svc.AcceptTest(second.ID, "user:ana")
+	if err != nil {
+		t.Fatal("Error accepting test:", err)
+	}
+
+	_, err = svc.MaskTest(second.ID, []image.Rectangle{image.Rect(0, 0, 10, 10)}, "user:bob")
+	if err != nil {
+		t.Fatal("Error masking test:", err)
+	}
+
+	_, err = svc.UpdateProject(structs.Project{ID: project, RetentionDays: 7}, "admin")
+	if err != nil {
+		t.Fatal("Error updating project:", err)
+	}
+
+	page, err := svc.QueryAudit(store.AuditQuery{Project: project, Sort: "timestamp"})
+	if err != nil {
+		t.Fatal("Error querying audit log:", err)
+	}
+
+	actions := []string{}
+	for _, e := range page.Entries {
+		actions = append(actions, e.Action)
+	}
+
+	expected := []string{AuditProjectCreated, AuditBatchOpened, AuditCaseAdded, AuditBatchOpened, AuditCaseAdded, AuditResultAccepted, AuditMaskChanged, AuditProjectUpdated}
+	if len(actions) != len(expected) {
+		t.Fatal("Expected audit entries", expected, "got", actions)
+	}
+	for i := range expected {
+		if actions[i] != expected[i] {
+			t.Fatal("Expected audit entries", expected, "got", actions)
+		}
+	}
+
+	page, err = svc.QueryAudit(store.AuditQuery{Result: second.ID, Action: AuditResultAccepted})
+	if err != nil || len(page.Entries) != 1 {
+		t.Fatal("Expected the accept of the result, got", page, err)
+	}
+
+	accept := page.Entries[0]
+	var before, after reviewState
+	json.Unmarshal(accept.Before, &before)
+	json.Unmarshal(accept.After, &after)
+	if accept.Actor != "user:ana" || accept.Batch != project+"_b2" || before.BaseImageID != first.ImageID || after.BaseImageID != second.ImageID || after.Review != structs.ReviewAccepted {
+		t.Fatal("Expected the accept with the base image it replaced, got", accept)
+	}
+
+	page, err = svc.QueryAudit(store.AuditQuery{Project: project, Action: AuditProjectUpdated})
+	if err != nil || len(page.Entries) != 1 {
+		t.Fatal("Expected the update of the project, got", page, err)
+	}
+
+	var oldProject, newProject structs.Project
+	json.Unmarshal(page.Entries[0].Before, &oldProject)
+	json.Unmarshal(page.Entries[0].After, &newProject)
+	if page.Entries[0].Actor != "admin" || oldProject.RetentionDays != 0 || newProject.RetentionDays != 7 {
+		t.Fatal("Expected the settings before and after the update, got", page.Entries[0])
+	}
+}
@@ -0,0 +1,97 @@
+package core
+
+import (
+	"encoding/json"
+
+	"github.com/pkg/errors"
+	"github.com/theopticians/optician-api/core/store"
+	"github.com/theopticians/optician-api/core/structs"
+)
+
+// RevertBaseline sets the base image of the case back to the one it had
+// before it was last accepted. Reverting again goes further back, through
+// the accepts not reverted yet. It returns the baseline with the restored
+// image.
+func (s *Service) RevertBaseline(b structs.Baseline, by string) (structs.Baseline, error) {
+	if b.Project == "" || b.Branch == "" || b.Target == "" || b.Browser == "" {
+		return structs.Baseline{}, ValidationError{"The baseline needs a project, branch, target and browser"}
+	}
+
+	object := caseObject(b.Project, b.Branch, b.Target, b.Browser)
+
+	err := s.db.Transaction(func(tx store.Store) error {
+		current, err := tx.GetBaseImageID(b.Project, b.Branch, b.Target, b.Browser)
+		if err == store.NotFoundError {
+			return NotFoundError{"The case has no base image"}
+		} else if err != nil {
+			return errors.Wrap(err, "error getting base image ID")
+		}
+
+		b.ImageID, err = previousBaseImageID(tx, object)
+		if err != nil {
+			return err
+		}
+
+		if b.ImageID == "" {
+			return ConflictError{"The base image of the case has no accepts left to revert"}
+		}
+
+		// The image may have been purged since
+		_, err = s.imageStore(tx).GetImage(b.ImageID)
+		if err == store.NotFoundError {
+			return ConflictError{"The base image " + b.ImageID + " to revert to was deleted"}
+		} else if err != nil {
+			return errors.Wrap(err, "error getting base image")
+		}
+
+		err = tx.SetBaseImageID(b.ImageID, b.Project, b.Branch, b.Target, b.Browser)
+		if err != nil {
+			return errors.Wrap(err, "error setting base image ID")
+		}
+
+		return s.audit(tx, structs.AuditEntry{Actor: by, Action: AuditBaseReverted, Project: b.Project, Object: object}, baselineState{BaseImageID: current}, baselineState{BaseImageID: b.ImageID})
+	})
+	if err != nil {
+		return structs.Baseline{}, err
+	}
+
+	return b, nil
+}
+
+// previousBaseImageID returns the base image the case had before its last
+// accept that is not reverted yet, from the audit log, or "" if there's none.
+func previousBaseImageID(tx store.Store, object string) (string, error) {
+	reverted := 0
+
+	// Newest entries first
+	q := store.AuditQuery{Object: object}
+	for {
+		page, err := tx.QueryAudit(q)
+		if err != nil {
+			return "", errors.Wrap(err, "error querying audit log")
+		}
+
+		for _, e := range page.Entries {
+			switch {
+			case e.Action == AuditBaseReverted:
+				reverted++
+			case e.Action == AuditResultAccepted && reverted > 0:
+				reverted--
+			case e.Action == AuditResultAccepted:
+				var before reviewState
+				err := json.Unmarshal(e.Before, &before)
+				if err != nil {
+					return "", errors.Wrap(err, "error decoding audit entry")
+				}
+
+				return before.BaseImageID, nil
+			}
+		}
+
+		if page.Next == "" {
+			return "", nil
+		}
+
+		q.Cursor = page.Next
+	}
+}
@@ -0,0 +1,114 @@
+package core
+
+import (
+	"image"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/theopticians/optician-api/core/store"
+	"github.com/theopticians/optician-api/core/store/memory"
+	"github.com/theopticians/optician-api/core/structs"
+)
+
+func TestRevertBaseline(t *testing.T) {
+	project := "revert_" + RandStringBytes(10)
+
+	accept := func(r structs.Result) {
+		err := svc.AcceptTest(r.ID, "user:ana")
+		if err != nil {
+			t.Fatal("Error accepting test:", err)
+		}
+	}
+
+	first := addTargetCase(t, project, project+"_b1", "home", testImg1)
+	second := addTargetCase(t, project, project+"_b2", "home", testImg2)
+	accept(second)
+	accept(addTargetCase(t, project, project+"_b3", "home", testImg1))
+
+	baseline := structs.Baseline{Project: project, Branch: "master", Target: "home", Browser: "chrome"}
+
+	// Each revert goes back one accept, to the base image of the first case
+	for _, r := range []structs.Result{second, first} {
+		reverted, err := svc.RevertBaseline(baseline, "user:bob")
+		if err != nil || reverted.ImageID != r.ImageID {
+			t.Fatal("Expected the base image to be reverted to", r.ImageID, "got", reverted, err)
+		}
+
+		base, err := baseImageID(svc.db, r)
+		if err != nil || base != r.ImageID {
+			t.Fatal("Expected the base image to be", r.ImageID, "got", base, err)
+		}
+	}
+
+	_, err := svc.RevertBaseline(baseline, "user:bob")
+	if _, ok := err.(ConflictError); !ok {
+		t.Fatal("Expected a conflict error reverting the first base image, got", err)
+	}
+
+	page, err := svc.QueryAudit(store.AuditQuery{Project: project, Action: AuditBaseReverted})
+	if err != nil || len(page.Entries) != 2 {
+		t.Fatal("Expected 2 revert audit entries, got", page.Entries, err)
+	}
+
+	e := page.Entries[0]
+	if e.Actor != "user:bob" || e.Object != caseObject(project, "master", "home", "chrome") || string(e.Before) != `{"baseimage":"`+second.ImageID+`"}` || string(e.After) != `{"baseimage":"`+first.ImageID+`"}` {
+		t.Fatal("Unexpected revert audit entry", e)
+	}
+
+	_, err = svc.RevertBaseline(structs.Baseline{Project: project, Branch: "master", Target: "about", Browser: "chrome"}, "user:bob")
+	if _, ok := err.(NotFoundError); !ok {
+		t.Fatal("Expected a not found error reverting a case without base image, got", err)
+	}
+
+	_, err = svc.RevertBaseline(structs.Baseline{Project: project}, "user:bob")
+	if _, ok := err.(ValidationError); !ok {
+		t.Fatal("Expected a validation error reverting an incomplete case, got", err)
+	}
+}
+
+func TestRevertPurgedBaseline(t *testing.T) {
+	s := NewService(DefaultConfig(memory.NewMemoryStore()))
+
+	err := s.StartWorkers()
+	if err != nil {
+		t.Fatal("Error starting workers:", err)
+	}
+
+	var results []structs.Result
+	for i, img := range []image.Image{testImg1, testImg2} {
+		r, err := s.AddCase(structs.Case{ProjectID: "p", Branch: "master", Target: "home", Browser: "chrome", Batch: "b" + strconv.Itoa(i), Image: img}, "tester")
+		if err != nil {
+			t.Fatal("Error adding case:", err)
+		}
+
+		r, err = s.WaitResult(r.ID, 10*time.Second)
+		if err != nil {
+			t.Fatal("Error waiting result:", err)
+		}
+
+		results = append(results, r)
+	}
+
+	err = s.AcceptTest(results[1].ID, "user:ana")
+	if err != nil {
+		t.Fatal("Error accepting test:", err)
+	}
+
+	// The first image is referenced by the purged results only
+	n, err := s.PurgeBatches(results[1].Timestamp.Add(time.Second))
+	if err != nil || n != 2 {
+		t.Fatal("Expected both batches to be purged, got", n, err)
+	}
+
+	baseline := structs.Baseline{Project: "p", Branch: "master", Target: "home", Browser: "chrome"}
+	_, err = s.RevertBaseline(baseline, "user:bob")
+	if _, ok := err.(ConflictError); !ok {
+		t.Fatal("Expected a conflict reverting to a purged image, got", err)
+	}
+
+	base, err := s.db.GetBaseImageID("p", "master", "home", "chrome")
+	if err != nil || base != results[1].ImageID {
+		t.Fatal("Expected the base image to be kept, got", base, err)
+	}
+}
@@ -1,32 +1,365 @@
 package core
 
-func batchHasTest(batch, projectID, branch, target, browser string) bool {
-	res, err := db.GetResultsByBatch(batch)
+import (
+	"time"
 
+	"github.com/pkg/errors"
+	"github.com/theopticians/optician-api/core/store"
+	"github.com/theopticians/optician-api/core/structs"
+)
+
+// OpenBatch stores a new batch, with a random ID unless it has one.
+func (s *Service) OpenBatch(b structs.Batch, by string) (structs.Batch, error) {
+	err := ValidateRevision(b.Repository, b.Commit)
 	if err != nil {
-		return false
+		return structs.Batch{}, err
 	}
 
-	for i := 0; i < len(res); i++ {
-		if res[i].Project == projectID && res[i].Branch == branch && res[i].Target == target && res[i].Browser == browser {
-			return true
+	if b.Project != "" {
+		_, err := s.ensureProject(b.Project, by)
+		if err != nil {
+			return structs.Batch{}, err
 		}
 	}
-	return false
+
+	if b.ID == "" {
+		b.ID = RandStringBytes(14)
+	} else {
+		_, err := s.db.GetBatch(b.ID)
+		if err == nil {
+			return structs.Batch{}, ConflictError{"The batch " + b.ID + " already exists"}
+		} else if err != store.NotFoundError {
+			return structs.Batch{}, errors.Wrap(err, "error getting batch")
+		}
+	}
+
+	now := s.now()
+	b.CreatedAt = now
+	b.UpdatedAt = now
+	b.FinalizedAt = nil
+
+	var event structs.Event
+	err = s.db.Transaction(func(tx store.Store) error {
+		err := tx.StoreBatch(b)
+		if err != nil {
+			return errors.Wrap(err, "error storing batch")
+		}
+
+		err = s.audit(tx, structs.AuditEntry{Actor: by, Action: AuditBatchOpened, Project: b.Project, Batch: b.ID}, nil, b)
+		if err != nil {
+			return err
+		}
+
+		event, err = s.emitBatch(tx, EventBatchOpened, b)
+		return err
+	})
+	if err != nil {
+		return structs.Batch{}, err
+	}
+
+	s.publishBatch(event)
+
+	return b, nil
 }
 
-func batchIsOld(batch string) bool {
-	//TODO
-	return false
+// GetBatch returns the batch. Open batches idle for longer than the
+// BatchIdleTimeout are returned as finalized when they timed out, although
+// they are only stored as such by FinalizeIdleBatches.
+func (s *Service) GetBatch(id string) (structs.Batch, error) {
+	b, err := s.db.GetBatch(id)
+	if err != nil {
+		return structs.Batch{}, err
+	}
+
+	if s.batchIsOld(b) {
+		at := b.UpdatedAt.Add(s.config.BatchIdleTimeout)
+		b.FinalizedAt = &at
+	}
+
+	return b, nil
+}
+
+func (s *Service) BatchSummary(id string) (structs.BatchSummary, error) {
+	b, err := s.GetBatch(id)
+	if err != nil {
+		return structs.BatchSummary{}, err
+	}
+
+	return batchSummary(s.db, b)
+}
+
+// batchSummary counts the results of the batch in db, which may be a
+// transaction.
+func batchSummary(db store.Store, b structs.Batch) (structs.BatchSummary, error) {
+	results, err := db.GetResultsByBatch(b.ID)
+	if err != nil {
+		return structs.BatchSummary{}, errors.Wrap(err, "error getting batch results")
+	}
+
+	// Accepted differences don't fail the batch
+	summary := structs.BatchSummary{Batch: b, Cases: len(results)}
+	for _, r := range results {
+		if r.Failed() && r.Review != structs.ReviewAccepted {
+			summary.Failed++
+		}
+		if r.Pending() {
+			summary.Pending++
+		}
+	}
+
+	if b.MissingAsFailures {
+		summary.Failed += len(b.Missing)
+	}
+
+	if b.Finalized() && b.ExpectedCases > summary.Cases {
+		summary.Shortfall = b.ExpectedCases - summary.Cases
+	}
+
+	return summary, nil
+}
+
+// FinalizeBatch closes the batch, after which it doesn't accept new cases.
+// The cases of the batch are compared against the reference in opts to find
+// missing and newly added cases.
+func (s *Service) FinalizeBatch(id string, opts structs.FinalizeOptions, by string) (structs.BatchSummary, error) {
+	b, err := s.GetBatch(id)
+	if err != nil {
+		return structs.BatchSummary{}, err
+	}
+
+	if b.Finalized() {
+		return structs.BatchSummary{}, ConflictError{"The batch " + id + " is already finalized"}
+	}
+
+	_, err = s.finalizeBatch(id, s.now(), opts, by)
+	if err != nil {
+		return structs.BatchSummary{}, err
+	}
+
+	return s.BatchSummary(id)
+}
+
+// finalizeBatch finalizes the batch as stored in the transaction, so that
+// cases added and activity recorded since it was read are kept.
+func (s *Service) finalizeBatch(id string, at time.Time, opts structs.FinalizeOptions, by string) (structs.Batch, error) {
+	var b structs.Batch
+	var event structs.Event
+
+	err := s.db.Transaction(func(tx store.Store) error {
+		current, err := tx.GetBatch(id)
+		if err != nil {
+			return errors.Wrap(err, "error getting batch")
+		}
+
+		if current.Finalized() {
+			return ConflictError{"The batch " + id + " is already finalized"}
+		}
+
+		results, err := tx.GetResultsByBatch(id)
+		if err != nil {
+			return errors.Wrap(err, "error getting batch results")
+		}
+
+		reference, err := referenceCases(tx, current, results, opts.Reference)
+		if err != nil {
+			return err
+		}
+
+		b = current
+		b.Missing, b.Added = compareCases(reference, resultCases(results))
+		b.MissingAsFailures = opts.MissingAsFailures
+		b.FinalizedAt = &at
+
+		err = tx.StoreBatch(b)
+		if err != nil {
+			return errors.Wrap(err, "error storing batch")
+		}
+
+		err = s.audit(tx, structs.AuditEntry{Actor: by, Action: AuditBatchFinalized, Project: b.Project, Batch: b.ID}, current, b)
+		if err != nil {
+			return err
+		}
+
+		event, err = s.emitBatch(tx, EventBatchFinalized, b)
+		return err
+	})
+	if err != nil {
+		return structs.Batch{}, err
+	}
+
+	s.publishBatch(event)
+
+	return b, nil
 }
 
-func batchHasDifferentBranch(batch, branch string) bool {
-	res, err := db.GetResultsByBatch(batch)
+// referenceCases returns the cases the batch is expected to have in db, which
+// may be a transaction, either the cases with a base image or the cases of
+// the last finalized batch on the same branch.
+func referenceCases(db store.Store, b structs.Batch, results []structs.Result, reference string) (structs.Cases, error) {
+	branch := b.Branch
+	projects := map[string]bool{}
+	if b.Project != "" {
+		projects[b.Project] = true
+	}
+	for _, r := range results {
+		projects[r.Project] = true
+		branch = r.Branch
+	}
+
+	cases := structs.Cases{}
+
+	for project := range projects {
+		switch reference {
+		case structs.ReferenceBatch:
+			last, err := db.GetLastFinalizedBatch(project, branch)
+			if err == store.NotFoundError {
+				continue
+			} else if err != nil {
+				return nil, errors.Wrap(err, "error getting last finalized batch")
+			}
+
+			lastResults, err := db.GetResultsByBatch(last.ID)
+			if err != nil {
+				return nil, errors.Wrap(err, "error getting last finalized batch results")
+			}
+
+			cases = append(cases, resultCases(lastResults)...)
+		case structs.ReferenceBaseline, "":
+			baseCases, err := db.GetBaseImageCases(project, branch)
+			if err != nil {
+				return nil, errors.Wrap(err, "error getting base image cases")
+			}
+
+			cases = append(cases, baseCases...)
+		default:
+			return nil, ValidationError{"Unknown reference " + reference + ", expected " + structs.ReferenceBaseline + " or " + structs.ReferenceBatch}
+		}
+	}
+
+	return cases, nil
+}
+
+func resultCases(results []structs.Result) structs.Cases {
+	cases := structs.Cases{}
+	for _, r := range results {
+		cases = append(cases, structs.CaseKey{Project: r.Project, Target: r.Target, Browser: r.Browser})
+	}
+
+	return cases
+}
+
+// compareCases returns the reference cases not in actual, and the actual cases
+// not in reference.
+func compareCases(reference, actual structs.Cases) (missing, added structs.Cases) {
+	inReference := map[structs.CaseKey]bool{}
+	for _, c := range reference {
+		inReference[c] = true
+	}
+
+	inActual := map[structs.CaseKey]bool{}
+	for _, c := range actual {
+		inActual[c] = true
+	}
+
+	missing = structs.Cases{}
+	for _, c := range reference {
+		if !inActual[c] {
+			missing = append(missing, c)
+		}
+	}
+
+	added = structs.Cases{}
+	for _, c := range actual {
+		if !inReference[c] {
+			added = append(added, c)
+		}
+	}
 
+	return missing, added
+}
+
+// caseBatch returns the batch a new case is added to. Batches that don't
+// exist yet are opened implicitly, by by.
+func (s *Service) caseBatch(c structs.Case, by string) (structs.Batch, error) {
+	b, err := s.GetBatch(c.Batch)
+	if err != store.NotFoundError {
+		return b, err
+	}
+
+	b, err = s.OpenBatch(structs.Batch{
+		ID:         c.Batch,
+		Project:    c.ProjectID,
+		Branch:     c.Branch,
+		Commit:     c.Commit,
+		Repository: c.Repository,
+	}, by)
+	if _, ok := err.(ConflictError); ok {
+		// Opened by a concurrent case
+		return s.GetBatch(c.Batch)
+	}
+
+	return b, err
+}
+
+// batchResults returns the results of the batch in db, which may be a
+// transaction, or a NotFoundError if the batch doesn't exist. Batches from
+// before batches were stored only have results.
+func batchResults(db store.Store, id string) ([]structs.Result, error) {
+	results, err := db.GetResultsByBatch(id)
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting results of batch "+id)
+	}
+
+	if len(results) == 0 {
+		_, err = db.GetBatch(id)
+		if err == store.NotFoundError {
+			return nil, NotFoundError{"The batch " + id + " doesn't exist"}
+		} else if err != nil {
+			return nil, errors.Wrap(err, "error getting batch")
+		}
+	}
+
+	return results, nil
+}
+
+// touchBatch records activity on the batch, delaying its idle timeout. The
+// batch is read again in the transaction adding the case, so that a
+// finalization committed since it was first read is neither undone nor
+// ignored.
+func (s *Service) touchBatch(tx store.Store, id string) error {
+	b, err := tx.GetBatch(id)
 	if err != nil {
+		return errors.Wrap(err, "error getting batch")
+	}
+
+	if b.Finalized() || s.batchIsOld(b) {
+		return ConflictError{"The batch " + id + " is finalized, start a new one"}
+	}
+
+	b.UpdatedAt = s.now()
+	return tx.StoreBatch(b)
+}
+
+func batchHasTest(res []structs.Result, projectID, branch, target, browser string) bool {
+	for i := 0; i < len(res); i++ {
+		if res[i].Project == projectID && res[i].Branch == branch && res[i].Target == target && res[i].Browser == browser {
+			return true
+		}
+	}
+	return false
+}
+
+// batchIsOld reports whether an open batch has been idle for longer than
+// the configured BatchIdleTimeout.
+func (s *Service) batchIsOld(b structs.Batch) bool {
+	if b.Finalized() || s.config.BatchIdleTimeout <= 0 {
 		return false
 	}
 
+	return s.now().Sub(b.UpdatedAt) > s.config.BatchIdleTimeout
+}
+
+func batchHasDifferentBranch(res []structs.Result, branch string) bool {
 	for i := 0; i < len(res); i++ {
 		if res[i].Branch != branch {
 			return true
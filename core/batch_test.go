@@ -0,0 +1,307 @@
+package core
+
+import (
+	"image"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/theopticians/optician-api/core/store"
+	"github.com/theopticians/optician-api/core/store/files"
+	"github.com/theopticians/optician-api/core/store/memory"
+	"github.com/theopticians/optician-api/core/structs"
+)
+
+func TestCompareCases(t *testing.T) {
+	home := structs.CaseKey{Project: "p", Target: "home", Browser: "chrome"}
+	about := structs.CaseKey{Project: "p", Target: "about", Browser: "chrome"}
+	contact := structs.CaseKey{Project: "p", Target: "contact", Browser: "firefox"}
+
+	missing, added := compareCases(structs.Cases{home, about}, structs.Cases{home, contact})
+
+	if len(missing) != 1 || missing[0] != about {
+		t.Fatal("Expected missing cases to be", about, "got", missing)
+	}
+
+	if len(added) != 1 || added[0] != contact {
+		t.Fatal("Expected added cases to be", contact, "got", added)
+	}
+}
+
+func TestBatchIdleTimeout(t *testing.T) {
+	now := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	c := DefaultConfig(memory.NewMemoryStore())
+	c.Clock = func() time.Time { return now }
+	c.BatchIdleTimeout = time.Hour
+	s := NewService(c)
+
+	b, err := s.OpenBatch(structs.Batch{}, "tester")
+	if err != nil {
+		t.Fatal("Error opening batch:", err)
+	}
+
+	now = now.Add(30 * time.Minute)
+	b, err = s.GetBatch(b.ID)
+	if err != nil || b.Finalized() {
+		t.Fatal("Expected the batch to be open before its idle timeout, got", b, err)
+	}
+
+	now = now.Add(time.Hour)
+	b, err = s.GetBatch(b.ID)
+	if err != nil || !b.Finalized() {
+		t.Fatal("Expected the batch to be finalized after its idle timeout, got", b, err)
+	}
+
+	if !b.FinalizedAt.Equal(b.UpdatedAt.Add(time.Hour)) {
+		t.Fatal("Expected the batch to be finalized when it timed out, got", b.FinalizedAt)
+	}
+
+	// Reading the batch doesn't store it
+	stored, err := s.db.GetBatch(b.ID)
+	if err != nil || stored.Finalized() {
+		t.Fatal("Expected the idle batch to be stored open until it is swept, got", stored, err)
+	}
+
+	_, err = s.AddCase(structs.Case{ProjectID: "p", Branch: "master", Target: "home", Browser: "chrome", Batch: b.ID, Image: testImg1}, "tester")
+	if _, ok := err.(ConflictError); !ok {
+		t.Fatal("Expected a conflict adding a case to an idle batch, got", err)
+	}
+}
+
+func TestFinalizeBatch(t *testing.T) {
+	s := NewService(DefaultConfig(memory.NewMemoryStore()))
+
+	b, err := s.OpenBatch(structs.Batch{ID: "b1", Project: "p", Branch: "master", ExpectedCases: 3}, "tester")
+	if err != nil {
+		t.Fatal("Error opening batch:", err)
+	}
+
+	for _, target := range []string{"home", "about"} {
+		_, err = s.AddCase(structs.Case{ProjectID: "p", Branch: "master", Target: target, Browser: "chrome", Batch: b.ID, Image: testImg1}, "tester")
+		if err != nil {
+			t.Fatal("Error adding case:", err)
+		}
+	}
+
+	summary, err := s.BatchSummary(b.ID)
+	if err != nil || summary.Cases != 2 || summary.Shortfall != 0 {
+		t.Fatal("Expected no shortfall before the batch is finalized, got", summary, err)
+	}
+
+	summary, err = s.FinalizeBatch(b.ID, structs.FinalizeOptions{}, "tester")
+	if err != nil || !summary.Finalized() || summary.Shortfall != 1 {
+		t.Fatal("Expected the finalized batch to be short of 1 case, got", summary, err)
+	}
+
+	_, err = s.FinalizeBatch(b.ID, structs.FinalizeOptions{}, "tester")
+	if _, ok := err.(ConflictError); !ok {
+		t.Fatal("Expected a conflict finalizing a batch twice, got", err)
+	}
+
+	_, err = s.AddCase(structs.Case{ProjectID: "p", Branch: "master", Target: "blog", Browser: "chrome", Batch: b.ID, Image: testImg1}, "tester")
+	if _, ok := err.(ConflictError); !ok {
+		t.Fatal("Expected a conflict adding a case to a finalized batch, got", err)
+	}
+}
+
+func TestFinalizeIdleBatches(t *testing.T) {
+	now := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	c := DefaultConfig(memory.NewMemoryStore())
+	c.Clock = func() time.Time { return now }
+	c.BatchIdleTimeout = time.Hour
+	s := NewService(c)
+
+	for _, id := range []string{"idle", "active"} {
+		_, err := s.OpenBatch(structs.Batch{ID: id}, "tester")
+		if err != nil {
+			t.Fatal("Error opening batch:", err)
+		}
+	}
+
+	now = now.Add(45 * time.Minute)
+	_, err := s.AddCase(structs.Case{ProjectID: "p", Branch: "master", Target: "home", Browser: "chrome", Batch: "active", Image: testImg1}, "tester")
+	if err != nil {
+		t.Fatal("Error adding case:", err)
+	}
+
+	events, cancel := s.Subscribe(EventFilter{Batch: "idle"})
+	defer cancel()
+
+	now = now.Add(30 * time.Minute)
+	n, err := s.FinalizeIdleBatches()
+	if err != nil || n != 1 {
+		t.Fatal("Expected only the idle batch to be finalized, got", n, err)
+	}
+
+	e := <-events
+	if e.Type != EventBatchFinalized {
+		t.Fatal("Expected a batch.finalized event, got", e.Type)
+	}
+
+	b, err := s.db.GetBatch("active")
+	if err != nil || b.Finalized() {
+		t.Fatal("Expected the batch with a recent case to stay open, got", b, err)
+	}
+
+	n, err = s.FinalizeIdleBatches()
+	if err != nil || n != 0 {
+		t.Fatal("Expected finalized batches to be skipped, got", n, err)
+	}
+}
+
+func TestAddCaseConcurrentBatch(t *testing.T) {
+	project := "concurrent_" + RandStringBytes(10)
+	batch := project + "_b1"
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(target string) {
+			defer wg.Done()
+			_, err := svc.AddCase(structs.Case{ProjectID: project, Branch: "master", Target: target, Browser: "chrome", Batch: batch, Image: image.NewNRGBA(image.Rect(0, 0, 4, 3))}, "tester")
+			errs <- err
+		}(RandStringBytes(8))
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatal("Expected the cases to share the implicitly opened batch, got", err)
+		}
+	}
+
+	_, err := svc.FinalizeBatch(batch, structs.FinalizeOptions{}, "tester")
+	if err != nil {
+		t.Fatal("Error finalizing batch:", err)
+	}
+
+	_, err = svc.AddCase(structs.Case{ProjectID: project, Branch: "master", Target: "late", Browser: "chrome", Batch: batch, Image: image.NewNRGBA(image.Rect(0, 0, 4, 3))}, "tester")
+	if _, ok := err.(ConflictError); !ok {
+		t.Fatal("Expected a conflict adding a case to a finalized batch, got", err)
+	}
+}
+
+func TestPurgeBatches(t *testing.T) {
+	project := "purge_" + RandStringBytes(10)
+
+	old := addCase(t, project, testImg1, project+"_b1")
+	recent := addCase(t, project, testImg1, project+"_b2")
+
+	n, err := svc.PurgeBatches(recent.Timestamp)
+	if err != nil {
+		t.Fatal("Error purging batches:", err)
+	}
+
+	if n < 1 {
+		t.Fatal("Expected the old batch to be purged, got", n)
+	}
+
+	_, err = svc.GetTest(old.ID)
+	if err == nil {
+		t.Fatal("Expected the result of the old batch to be deleted")
+	}
+
+	_, err = svc.GetTest(recent.ID)
+	if err != nil {
+		t.Fatal("Expected the result of the recent batch to be kept, got", err)
+	}
+}
+
+func TestPurgeEmptyBatches(t *testing.T) {
+	now := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	c := DefaultConfig(memory.NewMemoryStore())
+	c.Clock = func() time.Time { return now }
+	s := NewService(c)
+
+	for _, id := range []string{"old", "recent"} {
+		_, err := s.OpenBatch(structs.Batch{ID: id, Project: "p"}, "tester")
+		if err != nil {
+			t.Fatal("Error opening batch:", err)
+		}
+
+		now = now.Add(time.Hour)
+	}
+
+	n, err := s.PurgeBatches(now.Add(-time.Hour))
+	if err != nil || n != 1 {
+		t.Fatal("Expected the old empty batch to be purged, got", n, err)
+	}
+
+	_, err = s.GetBatch("old")
+	if err != store.NotFoundError {
+		t.Fatal("Expected the old batch to be deleted, got", err)
+	}
+
+	_, err = s.GetBatch("recent")
+	if err != nil {
+		t.Fatal("Expected the recent batch to be kept, got", err)
+	}
+}
+
+func TestPurgeBatchImages(t *testing.T) {
+	dir, err := ioutil.TempDir("", "optician-images")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	images, err := files.NewImageStore(dir)
+	if err != nil {
+		t.Fatal("Error opening image store:", err)
+	}
+
+	c := DefaultConfig(memory.NewMemoryStore())
+	c.Images = images
+	s := NewService(c)
+
+	err = s.StartWorkers()
+	if err != nil {
+		t.Fatal("Error starting workers:", err)
+	}
+
+	var results []structs.Result
+	for i, img := range []image.Image{testImg1, testImg2} {
+		r, err := s.AddCase(structs.Case{ProjectID: "p", Branch: "master", Target: "home", Browser: "chrome", Batch: "b" + strconv.Itoa(i), Image: img}, "tester")
+		if err != nil {
+			t.Fatal("Error adding case:", err)
+		}
+
+		r, err = s.WaitResult(r.ID, 10*time.Second)
+		if err != nil || r.Status != structs.StatusDone || r.DiffImageID == "" {
+			t.Fatal("Expected the result to be diffed, got", r, err)
+		}
+
+		results = append(results, r)
+	}
+
+	compared, err := s.CompareBatches("b1", "b0")
+	if err != nil || len(compared) != 1 || compared[0].DiffImageID == "" {
+		t.Fatal("Expected a comparison of the batches, got", compared, err)
+	}
+
+	n, err := s.PurgeBatches(results[1].Timestamp.Add(time.Second))
+	if err != nil || n != 2 {
+		t.Fatal("Expected both batches to be purged, got", n, err)
+	}
+
+	// The first image is still the base image of the case
+	_, err = images.GetImage(results[0].ImageID)
+	if err != nil {
+		t.Fatal("Expected the base image to be kept, got", err)
+	}
+
+	for _, id := range []string{results[0].DiffImageID, results[1].ImageID, results[1].DiffImageID, compared[0].DiffImageID} {
+		_, err = images.GetImage(id)
+		if err != store.NotFoundError {
+			t.Fatal("Expected the unreferenced image", id, "to be deleted, got", err)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package core
+
+import (
+	"github.com/pkg/errors"
+	"github.com/theopticians/optician-api/core/store"
+	"github.com/theopticians/optician-api/core/structs"
+)
+
+// CompareBatches diffs the results of batch b against the results of batch a
+// with the same project, target and browser. The returned results are those
+// of b, with the images of a as base images. Results without a counterpart in
+// a are left out, and those whose images can't be compared are failed with
+// the error. Diffs are cached in the store.
+func (s *Service) CompareBatches(a, b string) ([]structs.Result, error) {
+	aResults, err := batchResults(s.db, a)
+	if err != nil {
+		return nil, err
+	}
+
+	bResults, err := batchResults(s.db, b)
+	if err != nil {
+		return nil, err
+	}
+
+	aByCase := map[structs.CaseKey]structs.Result{}
+	for _, r := range aResults {
+		aByCase[structs.CaseKey{Project: r.Project, Target: r.Target, Browser: r.Browser}] = r
+	}
+
+	ret := []structs.Result{}
+
+	for _, r := range bResults {
+		base, ok := aByCase[structs.CaseKey{Project: r.Project, Target: r.Target, Browser: r.Browser}]
+		if !ok {
+			continue
+		}
+
+		r.BaseImageID = base.ImageID
+
+		c, diffErr, err := s.cachedComparison(r.Project, base.ImageID, r.ImageID, r.MaskID)
+		if err != nil {
+			return nil, err
+		}
+
+		if diffErr != nil {
+			r.Status = structs.StatusFailed
+			r.Error = diffErr.Error()
+			r.DiffImageID = ""
+			r.DiffScore = 0
+			r.DiffClusters = nil
+		} else {
+			r.Status = structs.StatusDone
+			r.Error = ""
+			r.DiffImageID = c.DiffImageID
+			r.DiffScore = c.DiffScore
+			r.DiffClusters = c.DiffClusters
+		}
+
+		ret = append(ret, r)
+	}
+
+	return ret, nil
+}
+
+// cachedComparison returns the comparison of the images with the current
+// settings of the project, computing and caching it if needed. Errors
+// computing the diff are returned as diffErr, and are not cached.
+func (s *Service) cachedComparison(projectID, baseImageID, imageID, maskID string) (c structs.Comparison, diffErr error, err error) {
+	comparator, err := s.comparator(projectID)
+	if err != nil {
+		return structs.Comparison{}, nil, err
+	}
+
+	c, err = s.db.GetComparison(baseImageID, imageID, maskID, comparatorSettings(comparator))
+	if err == nil {
+		return c, nil, nil
+	} else if err != store.NotFoundError {
+		return structs.Comparison{}, nil, errors.Wrap(err, "error getting cached comparison")
+	}
+
+	d, diffErr := s.resultDiff(structs.Result{Project: projectID, BaseImageID: baseImageID, ImageID: imageID, MaskID: maskID})
+	if diffErr != nil {
+		return structs.Comparison{}, diffErr, nil
+	}
+
+	err = d.store(s.imageStore(s.db))
+	if err != nil {
+		return structs.Comparison{}, nil, err
+	}
+
+	err = s.db.StoreComparison(d.comparison)
+	if err != nil {
+		return structs.Comparison{}, nil, errors.Wrap(err, "error storing comparison")
+	}
+
+	return d.comparison, nil, nil
+}
@@ -0,0 +1,53 @@
+package core
+
+import (
+	"image"
+	"testing"
+
+	"github.com/theopticians/optician-api/core/structs"
+)
+
+func TestCompareBatches(t *testing.T) {
+	project := "compare_" + RandStringBytes(10)
+
+	addTargetCase(t, project, project+"_b1", "home", testImg1)
+	addTargetCase(t, project, project+"_b1", "small", testImg1)
+	home := addTargetCase(t, project, project+"_b2", "home", testImg2)
+	small := addTargetCase(t, project, project+"_b2", "small", image.NewNRGBA(image.Rect(0, 0, 10, 10)))
+
+	results, err := svc.CompareBatches(project+"_b1", project+"_b2")
+	if err != nil {
+		t.Fatal("Error comparing batches:", err)
+	}
+
+	byID := map[string]structs.Result{}
+	for _, r := range results {
+		byID[r.ID] = r
+	}
+
+	if r := byID[home.ID]; len(results) != 2 || r.Status != structs.StatusDone || r.DiffScore == 0 || r.DiffImageID == "" {
+		t.Fatal("Expected the home result to be diffed, got", results)
+	}
+
+	if r := byID[small.ID]; r.Status != structs.StatusFailed || r.Error == "" || r.DiffImageID != "" {
+		t.Fatal("Expected the images of different size to fail, got", r)
+	}
+
+	// Every color distance is under the threshold, the cached comparison
+	// is not used
+	_, err = svc.UpdateProject(structs.Project{ID: project, Threshold: 1000}, "tester")
+	if err != nil {
+		t.Fatal("Error updating project:", err)
+	}
+
+	results, err = svc.CompareBatches(project+"_b1", project+"_b2")
+	if err != nil {
+		t.Fatal("Error comparing batches:", err)
+	}
+
+	for _, r := range results {
+		if r.ID == home.ID && r.DiffScore != 0 {
+			t.Fatal("Expected no differences with the new threshold of the project, got", r.DiffScore)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package core
+
+// The errors below are caused by the request rather than by a failure of the
+// service. The API maps each of them to its own status code. Store lookups of
+// missing entities return store.NotFoundError.
+
+// ValidationError is returned when the input of an operation is invalid, like
+// a case without target or a webhook subscribed to an unknown event.
+type ValidationError struct {
+	Message string
+}
+
+func (e ValidationError) Error() string {
+	return e.Message
+}
+
+// NotFoundError is returned when an entity an operation refers to doesn't
+// exist.
+type NotFoundError struct {
+	Message string
+}
+
+func (e NotFoundError) Error() string {
+	return e.Message
+}
+
+// ConflictError is returned when an operation conflicts with the current
+// state, like adding a case to a finalized batch.
+type ConflictError struct {
+	Message string
+}
+
+func (e ConflictError) Error() string {
+	return e.Message
+}
+
+// StaleResultError is returned when reviewing or masking a result that is no
+// longer the last one of its case.
+type StaleResultError struct {
+	Message      string
+	LastResultID string
+}
+
+func (e StaleResultError) Error() string {
+	return e.Message
+}
+
+// UnauthorizedError is returned when the credentials of a caller are missing
+// or invalid.
+type UnauthorizedError struct {
+	Message string
+}
+
+func (e UnauthorizedError) Error() string {
+	return e.Message
+}
+
+// ForbiddenError is returned when a caller isn't allowed an operation, like
+// an uploader accepting a result.
+type ForbiddenError struct {
+	Message string
+}
+
+func (e ForbiddenError) Error() string {
+	return e.Message
+}
@@ -0,0 +1,123 @@
+package core
+
+import (
+	"log"
+
+	"github.com/theopticians/optician-api/core/store"
+	"github.com/theopticians/optician-api/core/structs"
+)
+
+const (
+	EventResultCreated  = "result.created"
+	EventDiffCompleted  = "diff.completed"
+	EventResultAccepted = "result.accepted"
+	EventResultRejected = "result.rejected"
+	EventMaskChanged    = "mask.changed"
+	EventBatchOpened    = "batch.opened"
+	EventBatchFinalized = "batch.finalized"
+)
+
+// EventFilter selects the events delivered to a subscriber. Empty fields
+// match everything.
+type EventFilter struct {
+	Project string
+	Batch   string
+}
+
+func (f EventFilter) matches(e structs.Event) bool {
+	return (f.Project == "" || f.Project == e.Project) && (f.Batch == "" || f.Batch == e.Batch)
+}
+
+type subscriber struct {
+	filter EventFilter
+	events chan structs.Event
+}
+
+// Subscribe returns a channel receiving the events matching the filter, and a
+// function to cancel the subscription. Events are dropped for subscribers
+// that don't keep up.
+func (s *Service) Subscribe(filter EventFilter) (<-chan structs.Event, func()) {
+	sub := &subscriber{filter: filter, events: make(chan structs.Event, 64)}
+
+	s.subscribersMu.Lock()
+	s.subscribers[sub] = true
+	s.subscribersMu.Unlock()
+
+	cancel := func() {
+		s.subscribersMu.Lock()
+		defer s.subscribersMu.Unlock()
+
+		if s.subscribers[sub] {
+			delete(s.subscribers, sub)
+			close(sub.events)
+		}
+	}
+
+	return sub.events, cancel
+}
+
+// emit returns a new event, storing its webhook deliveries in tx so that they
+// are stored if and only if the change emitting the event is. The event is
+// published once the transaction is committed.
+func (s *Service) emit(tx store.Store, eventType, project, batch string, data interface{}) (structs.Event, error) {
+	e := structs.Event{
+		Type:      eventType,
+		Project:   project,
+		Batch:     batch,
+		Timestamp: s.now(),
+		Data:      data,
+	}
+
+	err := s.recordDeliveries(tx, e)
+	if err != nil {
+		return structs.Event{}, err
+	}
+
+	return e, nil
+}
+
+func (s *Service) emitResult(tx store.Store, eventType string, r structs.Result) (structs.Event, error) {
+	return s.emit(tx, eventType, r.Project, r.Batch, r)
+}
+
+// emitBatch emits an event with the summary of the batch, as seen by tx.
+func (s *Service) emitBatch(tx store.Store, eventType string, b structs.Batch) (structs.Event, error) {
+	summary, err := batchSummary(tx, b)
+	if err != nil {
+		return structs.Event{}, err
+	}
+
+	return s.emit(tx, eventType, b.Project, b.ID, summary)
+}
+
+// publish sends an emitted event to its subscribers, and wakes up the webhook
+// deliveries.
+func (s *Service) publish(e structs.Event) {
+	select {
+	case s.webhookTrigger <- struct{}{}:
+	default:
+	}
+
+	s.subscribersMu.Lock()
+	defer s.subscribersMu.Unlock()
+
+	for sub := range s.subscribers {
+		if !sub.filter.matches(e) {
+			continue
+		}
+
+		select {
+		case sub.events <- e:
+		default:
+			log.Println("dropping event", e.Type, "for slow subscriber")
+		}
+	}
+}
+
+// publishBatch publishes an event emitted by emitBatch, and reports the
+// commit status of the batch.
+func (s *Service) publishBatch(e structs.Event) {
+	s.publish(e)
+
+	go s.reportBatchStatus(e.Data.(structs.BatchSummary))
+}
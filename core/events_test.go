@@ -0,0 +1,26 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/theopticians/optician-api/core/structs"
+)
+
+func TestSubscribeFilter(t *testing.T) {
+	events, cancel := svc.Subscribe(EventFilter{Batch: "b1"})
+	defer cancel()
+
+	svc.publish(structs.Event{Type: EventResultCreated, Project: "project", Batch: "b2"})
+	svc.publish(structs.Event{Type: EventResultCreated, Project: "project", Batch: "b1"})
+
+	e := <-events
+	if e.Batch != "b1" {
+		t.Fatal("Expected event of batch b1, got", e.Batch)
+	}
+
+	select {
+	case e := <-events:
+		t.Fatal("Expected a single event, got", e)
+	default:
+	}
+}
@@ -7,11 +7,24 @@ import (
 	"math"
 )
 
-type clusterer func(image.Image) []image.Rectangle
+type clusterer func(image.Image) ([]image.Rectangle, error)
 
 var NoPixelFoundErr = errors.New("No pixel found")
 
-func PerformClustering(img image.Image) []image.Rectangle {
+// DefaultClusterDistance is the distance under which clusters are merged.
+const DefaultClusterDistance = 5
+
+func PerformClustering(img image.Image) ([]image.Rectangle, error) {
+	return PerformClusteringDistance(img, DefaultClusterDistance)
+}
+
+// PerformClusteringDistance is PerformClustering with a custom distance under
+// which clusters are merged.
+func PerformClusteringDistance(img image.Image, minDistance int) ([]image.Rectangle, error) {
+	if img == nil {
+		return nil, errors.New("No image to cluster")
+	}
+
 	mask := image.NewAlpha(img.Bounds())
 
 	var err error
@@ -24,14 +37,14 @@ func PerformClustering(img image.Image) []image.Rectangle {
 		pixels := []image.Point{}
 		findAdjacentPixels(img, pix, mask, &pixels)
 		if len(pixels) == 0 {
-			panic("No pixels returned by adjacent pixels")
+			return nil, errors.New("No pixels returned by adjacent pixels")
 		}
 		cluster := pointsBounds(pixels)
 		clusters = append(clusters, cluster)
 		pix, err = findUnmaskedPixel(img, mask, pix)
 	}
 
-	return mergeCloseClusters(mergeOverlappingClusters(clusters), 5)
+	return mergeCloseClusters(mergeOverlappingClusters(clusters), minDistance), nil
 }
 
 // If needed, makes a rect bigger to fit the point
@@ -140,23 +153,35 @@ func getAlpha(color color.Color) int {
 	return int(a)
 }
 
+// findAdjacentPixels flood fills the pixels connected to start. It uses its
+// own stack rather than recursion, a large area of differences would overflow
+// the goroutine stack.
 func findAdjacentPixels(img image.Image, start image.Point, mask *image.Alpha, pixels *[]image.Point) {
-	if !start.In(img.Bounds()) || mask.AlphaAt(start.X, start.Y).A != 0 {
-		return
-	}
+	stack := []image.Point{start}
 
-	if getAlpha(img.At(start.X, start.Y)) == 0 {
-		return
-	}
+	for len(stack) > 0 {
+		p := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		if !p.In(img.Bounds()) || mask.AlphaAt(p.X, p.Y).A != 0 {
+			continue
+		}
 
-	mask.SetAlpha(start.X, start.Y, color.Alpha{255})
+		if getAlpha(img.At(p.X, p.Y)) == 0 {
+			continue
+		}
+
+		mask.SetAlpha(p.X, p.Y, color.Alpha{255})
 
-	*pixels = append(*pixels, start)
+		*pixels = append(*pixels, p)
 
-	findAdjacentPixels(img, image.Point{start.X - 1, start.Y}, mask, pixels)
-	findAdjacentPixels(img, image.Point{start.X + 1, start.Y}, mask, pixels)
-	findAdjacentPixels(img, image.Point{start.X, start.Y + 1}, mask, pixels)
-	findAdjacentPixels(img, image.Point{start.X, start.Y - 1}, mask, pixels)
+		stack = append(stack,
+			image.Point{p.X, p.Y - 1},
+			image.Point{p.X, p.Y + 1},
+			image.Point{p.X + 1, p.Y},
+			image.Point{p.X - 1, p.Y},
+		)
+	}
 }
 
 func findUnmaskedPixel(img image.Image, mask *image.Alpha, start image.Point) (image.Point, error) {
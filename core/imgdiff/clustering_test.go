@@ -1,24 +1,49 @@
 package imgdiff
 
-/*
+import (
+	"image"
+	"image/color"
+	"testing"
+)
 
-func TestDiffImageClustering(t *testing.T) {
-	diffImg := image.NewAlpha(image.Rect(0, 0, 4, 4))
-
-	diffImg.SetAlpha(0, 1, color.Alpha{255})
-	diffImg.SetAlpha(1, 1, color.Alpha{255})
-	diffImg.SetAlpha(2, 1, color.Alpha{255})
-	diffImg.SetAlpha(3, 1, color.Alpha{255})
+func TestPerformClustering(t *testing.T) {
+	diffImg := image.NewAlpha(image.Rect(0, 0, 40, 40))
+	for x := 0; x < 4; x++ {
+		diffImg.SetAlpha(x, 1, color.Alpha{255})
+	}
+	diffImg.SetAlpha(30, 30, color.Alpha{255})
 
-	rect := naiveClusterer(diffImg)
+	clusters, err := PerformClustering(diffImg)
+	if err != nil {
+		t.Fatal("Error clustering:", err)
+	}
 
+	if len(clusters) != 2 || clusters[0] != image.Rect(0, 1, 3, 1) {
+		t.Fatal("Expected two clusters, got", clusters)
+	}
 }
 
-func TestPointsBounds(t *testing.T) {
-	points := []image.Point{
-		image.Point{3, 3},
-		image.Point{7, 9},
+func TestPerformClusteringLargeArea(t *testing.T) {
+	// A single area of differences this large overflowed the stack when
+	// clustering was recursive.
+	diffImg := image.NewAlpha(image.Rect(0, 0, 3000, 3000))
+	for i := range diffImg.Pix {
+		diffImg.Pix[i] = 255
+	}
+
+	clusters, err := PerformClustering(diffImg)
+	if err != nil {
+		t.Fatal("Error clustering:", err)
+	}
+
+	if len(clusters) != 1 {
+		t.Fatal("Expected a single cluster, got", clusters)
 	}
 }
 
-*/
+func TestPerformClusteringNoImage(t *testing.T) {
+	_, err := PerformClustering(nil)
+	if err == nil {
+		t.Fatal("Expected error clustering no image")
+	}
+}
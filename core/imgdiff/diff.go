@@ -8,9 +8,19 @@ import (
 	"github.com/pkg/errors"
 )
 
-func ComputeDiffImage(img1, img2 image.Image, masks []image.Rectangle) (image.Image, float64) {
-	diffImg, n, _ := compareImagesBin(img1, img2, masks, 0.05)
-	return diffImg, float64(n)
+// DefaultThreshold is the color distance above which pixels are different.
+const DefaultThreshold = 0.05
+
+// ComputeDiffImage returns an image with the pixels that differ, and their
+// number. Images of different sizes can't be compared.
+func ComputeDiffImage(img1, img2 image.Image, masks []image.Rectangle) (image.Image, float64, error) {
+	return ComputeDiffImageThreshold(img1, img2, masks, DefaultThreshold)
+}
+
+// ComputeDiffImageThreshold is ComputeDiffImage with a custom threshold.
+func ComputeDiffImageThreshold(img1, img2 image.Image, masks []image.Rectangle, threshold float64) (image.Image, float64, error) {
+	diffImg, n, err := compareImagesBin(img1, img2, masks, threshold)
+	return diffImg, float64(n), err
 }
 
 // CompareImagesBin compares a and b using binary comparison.
@@ -76,3 +76,10 @@ func TestBinDiffMask(t *testing.T) {
 		t.Fatal("Expected number of pixel differences between equal images to be 0, got ", diffPixels)
 	}
 }
+
+func TestComputeDiffImageDifferentSizes(t *testing.T) {
+	_, _, err := ComputeDiffImage(image.NewNRGBA(image.Rect(0, 0, 2, 2)), image.NewNRGBA(image.Rect(0, 0, 3, 2)), []image.Rectangle{})
+	if err == nil {
+		t.Fatal("Expected error comparing images of different sizes")
+	}
+}
@@ -0,0 +1,19 @@
+package core
+
+import (
+	"os"
+	"testing"
+
+	"github.com/theopticians/optician-api/core/store/memory"
+)
+
+var svc = NewService(DefaultConfig(memory.NewMemoryStore()))
+
+func TestMain(m *testing.M) {
+	err := svc.StartWorkers()
+	if err != nil {
+		panic(err)
+	}
+
+	os.Exit(m.Run())
+}
@@ -0,0 +1,18 @@
+package core
+
+import (
+	"github.com/theopticians/optician-api/core/store"
+)
+
+func (s *Service) SchemaVersion() (int, error) {
+	return s.db.SchemaVersion()
+}
+
+func (s *Service) PendingMigrations() ([]store.Migration, error) {
+	return s.db.PendingMigrations()
+}
+
+// Migrate applies the pending migrations of the store.
+func (s *Service) Migrate() error {
+	return s.db.Migrate()
+}
@@ -0,0 +1,176 @@
+package core
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+	"github.com/theopticians/optician-api/core/store"
+	"github.com/theopticians/optician-api/core/structs"
+)
+
+func (s *Service) Projects() ([]structs.Project, error) {
+	return s.db.GetProjects()
+}
+
+func (s *Service) GetProject(id string) (structs.Project, error) {
+	return s.db.GetProject(id)
+}
+
+// CreateProject stores a new project. Its name defaults to its ID.
+func (s *Service) CreateProject(p structs.Project, by string) (structs.Project, error) {
+	err := validateProject(p)
+	if err != nil {
+		return structs.Project{}, err
+	}
+
+	_, err = s.db.GetProject(p.ID)
+	if err == nil {
+		return structs.Project{}, ConflictError{"The project " + p.ID + " already exists"}
+	} else if err != store.NotFoundError {
+		return structs.Project{}, errors.Wrap(err, "error getting project")
+	}
+
+	if p.Name == "" {
+		p.Name = p.ID
+	}
+
+	now := s.now()
+	p.CreatedAt = now
+	p.UpdatedAt = now
+
+	err = s.db.Transaction(func(tx store.Store) error {
+		err := tx.StoreProject(p)
+		if err != nil {
+			return errors.Wrap(err, "error storing project")
+		}
+
+		return s.audit(tx, structs.AuditEntry{Actor: by, Action: AuditProjectCreated, Project: p.ID}, nil, p)
+	})
+	if err != nil {
+		return structs.Project{}, err
+	}
+
+	return p, nil
+}
+
+// UpdateProject replaces the name and settings of an existing project.
+func (s *Service) UpdateProject(p structs.Project, by string) (structs.Project, error) {
+	err := validateProject(p)
+	if err != nil {
+		return structs.Project{}, err
+	}
+
+	old, err := s.db.GetProject(p.ID)
+	if err != nil {
+		return structs.Project{}, err
+	}
+
+	if p.Name == "" {
+		p.Name = p.ID
+	}
+
+	p.CreatedAt = old.CreatedAt
+	p.UpdatedAt = s.now()
+
+	err = s.db.Transaction(func(tx store.Store) error {
+		err := tx.StoreProject(p)
+		if err != nil {
+			return errors.Wrap(err, "error storing project")
+		}
+
+		return s.audit(tx, structs.AuditEntry{Actor: by, Action: AuditProjectUpdated, Project: p.ID}, old, p)
+	})
+	if err != nil {
+		return structs.Project{}, err
+	}
+
+	return p, nil
+}
+
+// DeleteProject deletes the project. Its batches, results and baselines are
+// kept, and are purged by the retention of the service.
+func (s *Service) DeleteProject(id, by string) error {
+	return s.db.Transaction(func(tx store.Store) error {
+		old, err := tx.GetProject(id)
+		if err != nil {
+			return err
+		}
+
+		err = tx.DeleteProject(id)
+		if err != nil {
+			return err
+		}
+
+		return s.audit(tx, structs.AuditEntry{Actor: by, Action: AuditProjectDeleted, Project: id}, old, nil)
+	})
+}
+
+func validateProject(p structs.Project) error {
+	if p.ID == "" {
+		return ValidationError{"The project has no id"}
+	}
+
+	if p.Threshold < 0 || p.ClusterDistance < 0 || p.RetentionDays < 0 {
+		return ValidationError{"The project settings can't be negative"}
+	}
+
+	return nil
+}
+
+// ensureProject returns the project of a case or batch. Unknown projects are
+// created by by if AutoCreateProjects is set, and rejected otherwise.
+func (s *Service) ensureProject(id, by string) (structs.Project, error) {
+	p, err := s.db.GetProject(id)
+	if err != store.NotFoundError {
+		return p, err
+	}
+
+	if !s.config.AutoCreateProjects {
+		return structs.Project{}, ValidationError{"Unknown project " + id + ", create it first"}
+	}
+
+	p, err = s.CreateProject(structs.Project{ID: id}, by)
+	if _, ok := err.(ConflictError); ok {
+		// Created by a concurrent case or batch
+		return s.db.GetProject(id)
+	}
+
+	return p, err
+}
+
+// comparator returns the configured comparator, with the diff settings of the
+// project when it's an ImgDiff. Results of projects from before projects were
+// stored use the configured settings.
+func (s *Service) comparator(projectID string) (Comparator, error) {
+	d, ok := s.config.Comparator.(ImgDiff)
+	if !ok {
+		return s.config.Comparator, nil
+	}
+
+	p, err := s.db.GetProject(projectID)
+	if err == store.NotFoundError {
+		return d, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "error getting project")
+	}
+
+	if p.Threshold != 0 {
+		d.Threshold = p.Threshold
+	}
+	if p.ClusterDistance != 0 {
+		d.ClusterDistance = p.ClusterDistance
+	}
+
+	return d, nil
+}
+
+// comparatorSettings identifies the settings of the comparator, comparisons
+// are cached by them. Comparators other than ImgDiff have no settings.
+func comparatorSettings(c Comparator) string {
+	d, ok := c.(ImgDiff)
+	if !ok {
+		return ""
+	}
+
+	return fmt.Sprintf("%g/%d", d.Threshold, d.ClusterDistance)
+}
@@ -0,0 +1,156 @@
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/theopticians/optician-api/core/store"
+	"github.com/theopticians/optician-api/core/store/memory"
+	"github.com/theopticians/optician-api/core/structs"
+)
+
+func TestProjectCRUD(t *testing.T) {
+	id := "project_" + RandStringBytes(10)
+
+	p, err := svc.CreateProject(structs.Project{ID: id, DefaultBranch: "master"}, "tester")
+	if err != nil || p.Name != id || p.CreatedAt.IsZero() {
+		t.Fatal("Expected created project named after its ID, got", p, err)
+	}
+
+	_, err = svc.CreateProject(structs.Project{ID: id}, "tester")
+	if _, ok := err.(ConflictError); !ok {
+		t.Fatal("Expected conflict error creating a project twice, got", err)
+	}
+
+	_, err = svc.CreateProject(structs.Project{ID: id + "_2", Threshold: -1}, "tester")
+	if _, ok := err.(ValidationError); !ok {
+		t.Fatal("Expected validation error creating a project with negative settings, got", err)
+	}
+
+	updated, err := svc.UpdateProject(structs.Project{ID: id, Name: "Website", RetentionDays: 7}, "tester")
+	if err != nil || updated.Name != "Website" || !updated.CreatedAt.Equal(p.CreatedAt) {
+		t.Fatal("Expected updated project to keep its creation time, got", updated, err)
+	}
+
+	_, err = svc.UpdateProject(structs.Project{ID: id + "_missing"}, "tester")
+	if err != store.NotFoundError {
+		t.Fatal("Expected not found error updating a missing project, got", err)
+	}
+
+	err = svc.DeleteProject(id, "tester")
+	if err != nil {
+		t.Fatal("Error deleting project:", err)
+	}
+
+	_, err = svc.GetProject(id)
+	if err != store.NotFoundError {
+		t.Fatal("Expected not found error getting deleted project, got", err)
+	}
+}
+
+func TestUnknownProject(t *testing.T) {
+	c := DefaultConfig(memory.NewMemoryStore())
+	c.AutoCreateProjects = false
+	s := NewService(c)
+
+	_, err := s.AddCase(structs.Case{ProjectID: "p", Branch: "master", Target: "home", Browser: "chrome", Batch: "b1", Image: testImg1}, "tester")
+	if _, ok := err.(ValidationError); !ok {
+		t.Fatal("Expected validation error adding a case of an unknown project, got", err)
+	}
+
+	_, err = s.CreateProject(structs.Project{ID: "p"}, "tester")
+	if err != nil {
+		t.Fatal("Error creating project:", err)
+	}
+
+	_, err = s.AddCase(structs.Case{ProjectID: "p", Branch: "master", Target: "home", Browser: "chrome", Batch: "b1", Image: testImg1}, "tester")
+	if err != nil {
+		t.Fatal("Error adding case of a created project:", err)
+	}
+}
+
+func TestProjectDefaultBranch(t *testing.T) {
+	project := "project_" + RandStringBytes(10)
+
+	_, err := svc.CreateProject(structs.Project{ID: project, DefaultBranch: "master"}, "tester")
+	if err != nil {
+		t.Fatal("Error creating project:", err)
+	}
+
+	first := addCase(t, project, testImg1, project+"_b1")
+
+	r, err := svc.AddCase(structs.Case{ProjectID: project, Branch: "feature", Target: "home", Browser: "chrome", Batch: project + "_b2", Image: testImg2}, "tester")
+	if err != nil {
+		t.Fatal("Error adding case:", err)
+	}
+
+	r, err = svc.WaitResult(r.ID, 10*time.Second)
+	if err != nil || r.BaseImageID != first.ImageID || r.DiffScore == 0 {
+		t.Fatal("Expected the case of a new branch to be diffed against the default branch, got", r, err)
+	}
+
+	_, err = svc.db.GetBaseImageID(project, "feature", "home", "chrome")
+	if err != store.NotFoundError {
+		t.Fatal("Expected the new branch to have no base image until accepted, got", err)
+	}
+}
+
+func TestProjectDiffSettings(t *testing.T) {
+	project := "project_" + RandStringBytes(10)
+
+	// Every color distance is under the threshold
+	_, err := svc.CreateProject(structs.Project{ID: project, Threshold: 1000}, "tester")
+	if err != nil {
+		t.Fatal("Error creating project:", err)
+	}
+
+	addCase(t, project, testImg1, project+"_b1")
+	second := addCase(t, project, testImg2, project+"_b2")
+
+	if second.DiffScore != 0 {
+		t.Fatal("Expected no differences with the threshold of the project, got", second.DiffScore)
+	}
+}
+
+func TestPurgeExpiredBatches(t *testing.T) {
+	now := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	c := DefaultConfig(memory.NewMemoryStore())
+	c.Clock = func() time.Time { return now }
+	c.BatchIdleTimeout = 0
+	s := NewService(c)
+
+	_, err := s.CreateProject(structs.Project{ID: "short", RetentionDays: 1}, "tester")
+	if err != nil {
+		t.Fatal("Error creating project:", err)
+	}
+
+	for _, project := range []string{"short", "forever"} {
+		r, err := s.AddCase(structs.Case{ProjectID: project, Branch: "master", Target: "home", Browser: "chrome", Batch: project + "_b1", Image: testImg1}, "tester")
+		if err != nil {
+			t.Fatal("Error adding case:", err)
+		}
+
+		err = s.RunTest(&r)
+		if err != nil {
+			t.Fatal("Error running test:", err)
+		}
+
+		err = s.db.StoreResult(r)
+		if err != nil {
+			t.Fatal("Error storing result:", err)
+		}
+	}
+
+	now = now.Add(48 * time.Hour)
+
+	n, err := s.PurgeExpiredBatches()
+	if err != nil || n != 1 {
+		t.Fatal("Expected only the batch of the project with a retention to be purged, got", n, err)
+	}
+
+	_, err = s.GetBatch("forever_b1")
+	if err != nil {
+		t.Fatal("Expected the batch without retention to be kept, got", err)
+	}
+}
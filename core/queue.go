@@ -0,0 +1,189 @@
+package core
+
+import (
+	"log"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/theopticians/optician-api/core/store"
+	"github.com/theopticians/optician-api/core/structs"
+)
+
+// StartWorkers starts the pool of workers running pending results, and
+// enqueues the jobs left in the store by a previous run.
+func (s *Service) StartWorkers() error {
+	for i := 0; i < s.config.Workers; i++ {
+		go s.worker()
+	}
+
+	stored, err := s.db.GetJobs()
+	if err != nil {
+		return errors.Wrap(err, "error getting stored jobs")
+	}
+
+	for _, j := range stored {
+		s.enqueue(j)
+	}
+
+	return nil
+}
+
+// newJob returns a job running the result. It must be stored along with the
+// result, and queued once stored.
+func (s *Service) newJob(r structs.Result) structs.Job {
+	return structs.Job{
+		ID:        RandStringBytes(14),
+		ResultID:  r.ID,
+		CreatedAt: s.now(),
+	}
+}
+
+func (s *Service) enqueue(j structs.Job) {
+	select {
+	case s.jobs <- j:
+	default:
+		// The queue is full, don't block the caller. The job is persisted
+		// so it's not lost if the process stops before it's queued.
+		go func() { s.jobs <- j }()
+	}
+}
+
+func (s *Service) worker() {
+	for j := range s.jobs {
+		err := s.runJob(j)
+		if err != nil {
+			log.Println("error running job", j.ID, "for result", j.ResultID, ":", err)
+		}
+	}
+}
+
+func (s *Service) runJob(j structs.Job) error {
+	r, err := s.db.GetResult(j.ResultID)
+	if err == store.NotFoundError {
+		// Deleted with its batch, there's nothing left to run
+		err = s.db.DeleteJob(j.ID)
+		if err != nil {
+			return errors.Wrap(err, "error deleting job")
+		}
+
+		return nil
+	} else if err != nil {
+		return errors.Wrap(err, "error getting result")
+	}
+
+	d, diffErr := s.resultDiff(r)
+
+	// The diff image, the result and the job are stored atomically, so a
+	// crash leaves the job to be run again rather than an orphan image.
+	var event structs.Event
+	err = s.db.Transaction(func(tx store.Store) error {
+		err := tx.DeleteJob(j.ID)
+		if err != nil {
+			return errors.Wrap(err, "error deleting job")
+		}
+
+		// The result may have been reviewed or masked while diffing, only
+		// the outcome of the diff is set on its current version.
+		r, err = tx.GetResult(j.ResultID)
+		if err == store.NotFoundError {
+			// Deleted while diffing, only the job is deleted
+			return nil
+		} else if err != nil {
+			return errors.Wrap(err, "error getting result")
+		}
+
+		if diffErr == nil && r.MaskID != d.comparison.MaskID {
+			// The mask changed while diffing, the result already has
+			// the diff with the new mask.
+			return nil
+		}
+
+		if diffErr != nil {
+			r.Status = structs.StatusFailed
+			r.Error = diffErr.Error()
+		} else {
+			err := d.store(s.imageStore(tx))
+			if err != nil {
+				return err
+			}
+
+			r.Status = structs.StatusDone
+			r.DiffScore = d.comparison.DiffScore
+			r.DiffImageID = d.comparison.DiffImageID
+			r.DiffClusters = d.comparison.DiffClusters
+			r.Error = ""
+		}
+
+		err = tx.StoreResult(r)
+		if err != nil {
+			return errors.Wrap(err, "error storing result")
+		}
+
+		event, err = s.emitResult(tx, EventDiffCompleted, r)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	s.notifyWaiters(r.ID)
+
+	if event.Type != "" {
+		s.publish(event)
+		go s.reportChangedBatch(r.Batch)
+	}
+
+	return nil
+}
+
+// WaitResult returns the result once it's no longer pending, or when the
+// timeout expires, whichever happens first.
+func (s *Service) WaitResult(id string, timeout time.Duration) (structs.Result, error) {
+	done := make(chan struct{})
+
+	s.waitersMu.Lock()
+	s.waiters[id] = append(s.waiters[id], done)
+	s.waitersMu.Unlock()
+
+	defer s.removeWaiter(id, done)
+
+	r, err := s.db.GetResult(id)
+	if err != nil || !r.Pending() {
+		return r, err
+	}
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+	}
+
+	return s.db.GetResult(id)
+}
+
+func (s *Service) notifyWaiters(id string) {
+	s.waitersMu.Lock()
+	defer s.waitersMu.Unlock()
+
+	for _, w := range s.waiters[id] {
+		close(w)
+	}
+
+	delete(s.waiters, id)
+}
+
+func (s *Service) removeWaiter(id string, done chan struct{}) {
+	s.waitersMu.Lock()
+	defer s.waitersMu.Unlock()
+
+	ws := s.waiters[id]
+	for i, w := range ws {
+		if w == done {
+			s.waiters[id] = append(ws[:i], ws[i+1:]...)
+			break
+		}
+	}
+
+	if len(s.waiters[id]) == 0 {
+		delete(s.waiters, id)
+	}
+}
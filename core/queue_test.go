@@ -0,0 +1,115 @@
+package core
+
+import (
+	"image"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/theopticians/optician-api/core/store/memory"
+	"github.com/theopticians/optician-api/core/structs"
+)
+
+func TestStoredJobsResume(t *testing.T) {
+	db := memory.NewMemoryStore()
+
+	// No workers, the job is left in the store as if the process stopped
+	stopped := NewService(DefaultConfig(db))
+
+	r, err := stopped.AddCase(structs.Case{ProjectID: "p", Branch: "master", Target: "home", Browser: "chrome", Batch: "b1", Image: testImg1}, "tester")
+	if err != nil {
+		t.Fatal("Error adding case:", err)
+	}
+
+	r, err = stopped.WaitResult(r.ID, 10*time.Millisecond)
+	if err != nil || !r.Pending() {
+		t.Fatal("Expected the result to be pending once the wait timed out, got", r, err)
+	}
+
+	// Changes made while the job is pending are kept when it's run
+	err = stopped.RejectTest(r.ID, "user:bob")
+	if err != nil {
+		t.Fatal("Error rejecting test:", err)
+	}
+
+	restarted := NewService(DefaultConfig(db))
+	err = restarted.StartWorkers()
+	if err != nil {
+		t.Fatal("Error starting workers:", err)
+	}
+
+	r, err = restarted.WaitResult(r.ID, 10*time.Second)
+	if err != nil || r.Status != structs.StatusDone {
+		t.Fatal("Expected the stored job to be run after restarting, got", r, err)
+	}
+
+	if r.Review != structs.ReviewRejected || r.ReviewedBy != "user:bob" {
+		t.Fatal("Expected the review to be kept, got", r.Review, r.ReviewedBy)
+	}
+
+	jobs, err := db.GetJobs()
+	if err != nil || len(jobs) != 0 {
+		t.Fatal("Expected no jobs left, got", jobs, err)
+	}
+}
+
+func TestFailedJob(t *testing.T) {
+	db := memory.NewMemoryStore()
+	s := NewService(DefaultConfig(db))
+
+	err := s.StartWorkers()
+	if err != nil {
+		t.Fatal("Error starting workers:", err)
+	}
+
+	for i, img := range []image.Image{testImg1, image.NewNRGBA(image.Rect(0, 0, 10, 10))} {
+		r, err := s.AddCase(structs.Case{ProjectID: "p", Branch: "master", Target: "home", Browser: "chrome", Batch: "b" + strconv.Itoa(i), Image: img}, "tester")
+		if err != nil {
+			t.Fatal("Error adding case:", err)
+		}
+
+		r, err = s.WaitResult(r.ID, 10*time.Second)
+		if err != nil || r.Pending() {
+			t.Fatal("Expected the result to be run, got", r, err)
+		}
+
+		if img != testImg1 && (r.Status != structs.StatusFailed || r.Error == "" || r.DiffImageID != "") {
+			t.Fatal("Expected the result to fail without a diff image, got", r)
+		}
+	}
+
+	jobs, err := db.GetJobs()
+	if err != nil || len(jobs) != 0 {
+		t.Fatal("Expected the failed job to be deleted, got", jobs, err)
+	}
+}
+
+func TestDeletedResultJob(t *testing.T) {
+	db := memory.NewMemoryStore()
+	s := NewService(DefaultConfig(db))
+
+	_, err := s.AddCase(structs.Case{ProjectID: "p", Branch: "master", Target: "home", Browser: "chrome", Batch: "b1", Image: testImg1}, "tester")
+	if err != nil {
+		t.Fatal("Error adding case:", err)
+	}
+
+	err = db.DeleteBatch("b1")
+	if err != nil {
+		t.Fatal("Error deleting batch:", err)
+	}
+
+	jobs, err := db.GetJobs()
+	if err != nil || len(jobs) != 1 {
+		t.Fatal("Expected the job to be stored, got", jobs, err)
+	}
+
+	err = s.runJob(jobs[0])
+	if err != nil {
+		t.Fatal("Expected the job of a deleted result to be dropped, got", err)
+	}
+
+	jobs, err = db.GetJobs()
+	if err != nil || len(jobs) != 0 {
+		t.Fatal("Expected the job to be deleted, got", jobs, err)
+	}
+}
@@ -0,0 +1,251 @@
+package core
+
+import (
+	"log"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/theopticians/optician-api/core/store"
+	"github.com/theopticians/optician-api/core/structs"
+)
+
+// StartRetention starts deleting expired batches every hour, see
+// PurgeExpiredBatches.
+func (s *Service) StartRetention() {
+	go func() {
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+
+		for {
+			n, err := s.PurgeExpiredBatches()
+			if err != nil {
+				log.Println("error purging batches:", err)
+			} else if n > 0 {
+				log.Println("purged", n, "batches")
+			}
+
+			<-ticker.C
+		}
+	}()
+}
+
+// StartBatchTimeouts starts finalizing idle batches every minute, see
+// FinalizeIdleBatches. It does nothing without a BatchIdleTimeout.
+func (s *Service) StartBatchTimeouts() {
+	if s.config.BatchIdleTimeout <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+
+		for {
+			n, err := s.FinalizeIdleBatches()
+			if err != nil {
+				log.Println("error finalizing idle batches:", err)
+			} else if n > 0 {
+				log.Println("finalized", n, "idle batches")
+			}
+
+			<-ticker.C
+		}
+	}()
+}
+
+// FinalizeIdleBatches finalizes the open batches without new cases for longer
+// than the configured BatchIdleTimeout, as of when they timed out, notifying
+// webhooks and reporting their commit status. GetBatch only reports them as
+// finalized. It returns the number of finalized batches.
+func (s *Service) FinalizeIdleBatches() (int, error) {
+	batches, err := s.db.GetOpenBatches()
+	if err != nil {
+		return 0, errors.Wrap(err, "error getting open batches")
+	}
+
+	n := 0
+	for _, b := range batches {
+		if !s.batchIsOld(b) {
+			continue
+		}
+
+		_, err = s.finalizeBatch(b.ID, b.UpdatedAt.Add(s.config.BatchIdleTimeout), structs.FinalizeOptions{}, SystemActor)
+		if _, ok := err.(ConflictError); ok {
+			// Finalized concurrently
+			continue
+		} else if err != nil {
+			return n, err
+		}
+
+		n++
+	}
+
+	return n, nil
+}
+
+// PurgeExpiredBatches deletes the batches older than the retention of their
+// project, or than the configured Retention for projects without one. Zero
+// keeps them forever. It returns the number of deleted batches.
+func (s *Service) PurgeExpiredBatches() (int, error) {
+	projects, err := s.db.GetProjects()
+	if err != nil {
+		return 0, errors.Wrap(err, "error getting projects")
+	}
+
+	retention := map[string]time.Duration{}
+	for _, p := range projects {
+		if p.RetentionDays > 0 {
+			retention[p.ID] = time.Duration(p.RetentionDays) * 24 * time.Hour
+		}
+	}
+
+	now := s.now()
+
+	return s.purgeBatches(func(b structs.BatchInfo) bool {
+		r, ok := retention[b.Project]
+		if !ok {
+			r = s.config.Retention
+		}
+
+		return r > 0 && b.Timestamp.Before(now.Add(-r))
+	})
+}
+
+// PurgeBatches deletes the batches, with their results, whose last result is
+// older than before, or that were last updated before it if they have no
+// results. The images of the results that are no longer referenced are
+// deleted too. Batches with pending results are kept. It returns the number
+// of deleted batches.
+func (s *Service) PurgeBatches(before time.Time) (int, error) {
+	return s.purgeBatches(func(b structs.BatchInfo) bool {
+		return b.Timestamp.Before(before)
+	})
+}
+
+func (s *Service) purgeBatches(expired func(structs.BatchInfo) bool) (int, error) {
+	batchs, err := s.db.GetBatchs()
+	if err != nil {
+		return 0, errors.Wrap(err, "error getting batches")
+	}
+
+	empty, err := s.db.GetEmptyBatches()
+	if err != nil {
+		return 0, errors.Wrap(err, "error getting empty batches")
+	}
+
+	for _, b := range empty {
+		batchs = append(batchs, structs.BatchInfo{ID: b.ID, Project: b.Project, Timestamp: b.UpdatedAt})
+	}
+
+	n := 0
+	for _, b := range batchs {
+		if !expired(b) {
+			continue
+		}
+
+		purged := false
+		var unused []string
+		err = s.db.Transaction(func(tx store.Store) error {
+			// Listed again, so cases added and diffs queued since are
+			// kept
+			results, err := tx.GetResultsByBatch(b.ID)
+			if err != nil {
+				return errors.Wrap(err, "error getting batch results")
+			}
+
+			for _, r := range results {
+				if r.Pending() || r.Timestamp.After(b.Timestamp) {
+					return nil
+				}
+			}
+
+			err = tx.DeleteBatch(b.ID)
+			if err != nil {
+				return errors.Wrap(err, "error deleting batch "+b.ID)
+			}
+
+			unused, err = unusedImages(tx, results)
+			if err != nil {
+				return err
+			}
+
+			if s.images == nil {
+				err = deleteImages(tx, unused)
+				if err != nil {
+					return err
+				}
+			}
+
+			purged = true
+			return s.audit(tx, structs.AuditEntry{Actor: SystemActor, Action: AuditBatchPurged, Project: b.Project, Batch: b.ID}, b, nil)
+		})
+		if err != nil {
+			return n, err
+		}
+
+		if !purged {
+			continue
+		}
+
+		// Images kept out of the store are deleted once nothing
+		// references them anymore
+		if s.images != nil {
+			err = deleteImages(s.images, unused)
+			if err != nil {
+				return n, err
+			}
+		}
+
+		n++
+	}
+
+	return n, nil
+}
+
+// unusedImages returns the images of the deleted results no longer referenced
+// in tx, and the diff images of their cached comparisons, which are deleted.
+func unusedImages(tx store.Store, results []structs.Result) ([]string, error) {
+	candidates := map[string]bool{}
+	for _, r := range results {
+		for _, id := range []string{r.ImageID, r.BaseImageID, r.DiffImageID} {
+			if id != "" {
+				candidates[id] = true
+			}
+		}
+	}
+
+	ids := []string{}
+	for id := range candidates {
+		ids = append(ids, id)
+	}
+
+	referenced, err := tx.ReferencedImages(ids)
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting referenced images")
+	}
+
+	unused := []string{}
+	for _, id := range ids {
+		if !referenced[id] {
+			unused = append(unused, id)
+		}
+	}
+
+	diffs, err := tx.DeleteComparisons(unused)
+	if err != nil {
+		return nil, errors.Wrap(err, "error deleting comparisons")
+	}
+
+	return append(unused, diffs...), nil
+}
+
+func deleteImages(images ImageStore, ids []string) error {
+	for _, id := range ids {
+		err := images.DeleteImage(id)
+		if err != nil {
+			return errors.Wrap(err, "error deleting image "+id)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,198 @@
+package core
+
+import (
+	"github.com/theopticians/optician-api/core/store"
+	"github.com/theopticians/optician-api/core/structs"
+)
+
+// AcceptBatch accepts every result of the batch matching the filter, setting
+// their images as base images in a single store transaction. Results that are
+// no longer the last one of their case are skipped.
+func (s *Service) AcceptBatch(batch string, filter structs.ReviewFilter, by string) ([]structs.ReviewOutcome, error) {
+	var outcomes []structs.ReviewOutcome
+	var events []structs.Event
+
+	err := s.db.Transaction(func(tx store.Store) error {
+		var selected []structs.Result
+		var err error
+		selected, outcomes, err = reviewableResults(tx, batch, filter)
+		if err != nil {
+			return err
+		}
+
+		for i := range selected {
+			err := s.auditAccept(tx, selected[i], by)
+			if err != nil {
+				return err
+			}
+
+			selected[i].Review = structs.ReviewAccepted
+			selected[i].ReviewedBy = by
+		}
+
+		err = tx.AcceptResults(selected)
+		if err != nil {
+			return err
+		}
+
+		events = []structs.Event{}
+		for _, r := range selected {
+			e, err := s.emitResult(tx, EventResultAccepted, r)
+			if err != nil {
+				return err
+			}
+
+			events = append(events, e)
+			outcomes = append(outcomes, structs.ReviewOutcome{ID: r.ID, Status: structs.OutcomeAccepted})
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, e := range events {
+		s.publish(e)
+	}
+
+	go s.reportChangedBatch(batch)
+
+	return outcomes, nil
+}
+
+// RejectBatch marks every result of the batch matching the filter as
+// rejected, in a single store transaction. Base images are left untouched.
+// Results that are no longer the last one of their case are skipped.
+func (s *Service) RejectBatch(batch string, filter structs.ReviewFilter, by string) ([]structs.ReviewOutcome, error) {
+	var outcomes []structs.ReviewOutcome
+	var events []structs.Event
+
+	err := s.db.Transaction(func(tx store.Store) error {
+		var selected []structs.Result
+		var err error
+		selected, outcomes, err = reviewableResults(tx, batch, filter)
+		if err != nil {
+			return err
+		}
+
+		events = []structs.Event{}
+		for _, r := range selected {
+			e, err := s.reject(tx, r, by)
+			if err != nil {
+				return err
+			}
+
+			events = append(events, e)
+			outcomes = append(outcomes, structs.ReviewOutcome{ID: r.ID, Status: structs.OutcomeRejected})
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, e := range events {
+		s.publish(e)
+	}
+
+	go s.reportChangedBatch(batch)
+
+	return outcomes, nil
+}
+
+// auditAccept appends the audit entry of accepting the result, with the base
+// image it replaces, before it's accepted in the transaction.
+func (s *Service) auditAccept(tx store.Store, r structs.Result, by string) error {
+	oldBaseImageID, err := baseImageID(tx, r)
+	if err != nil {
+		return err
+	}
+
+	before := reviewState{Review: r.Review, BaseImageID: oldBaseImageID}
+	after := reviewState{Review: structs.ReviewAccepted, BaseImageID: r.ImageID}
+
+	return s.audit(tx, structs.AuditEntry{Actor: by, Action: AuditResultAccepted, Project: r.Project, Batch: r.Batch, Result: r.ID, Object: caseObject(r.Project, r.Branch, r.Target, r.Browser)}, before, after)
+}
+
+// reject marks the result as rejected by by, and stores it in tx along with
+// its audit entry. It returns the event to publish.
+func (s *Service) reject(tx store.Store, r structs.Result, by string) (structs.Event, error) {
+	before := reviewState{Review: r.Review}
+
+	r.Review = structs.ReviewRejected
+	r.ReviewedBy = by
+
+	err := s.audit(tx, structs.AuditEntry{Actor: by, Action: AuditResultRejected, Project: r.Project, Batch: r.Batch, Result: r.ID}, before, reviewState{Review: r.Review})
+	if err != nil {
+		return structs.Event{}, err
+	}
+
+	err = tx.StoreResult(r)
+	if err != nil {
+		return structs.Event{}, err
+	}
+
+	return s.emitResult(tx, EventResultRejected, r)
+}
+
+// reviewableResults returns the results of the batch matching the filter that
+// are still the last result of their case in tx, and skipped outcomes for the
+// rest.
+func reviewableResults(tx store.Store, batch string, filter structs.ReviewFilter) ([]structs.Result, []structs.ReviewOutcome, error) {
+	batchResults, err := batchResults(tx, batch)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	selected := []structs.Result{}
+	outcomes := []structs.ReviewOutcome{}
+	found := map[string]bool{}
+
+	for _, r := range batchResults {
+		if !filterMatches(filter, r) {
+			continue
+		}
+
+		found[r.ID] = true
+
+		last, err := tx.GetLastResult(r.Project, r.Branch, r.Target, r.Browser)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if last.ID != r.ID {
+			outcomes = append(outcomes, structs.ReviewOutcome{ID: r.ID, Status: structs.OutcomeSkipped, Reason: "not the last result, last result is " + last.ID})
+			continue
+		}
+
+		selected = append(selected, r)
+	}
+
+	for _, id := range filter.Results {
+		if !found[id] {
+			outcomes = append(outcomes, structs.ReviewOutcome{ID: id, Status: structs.OutcomeSkipped, Reason: "not found in batch " + batch})
+		}
+	}
+
+	return selected, outcomes, nil
+}
+
+func filterMatches(filter structs.ReviewFilter, r structs.Result) bool {
+	return matchesAny(filter.Targets, r.Target) && matchesAny(filter.Browsers, r.Browser) && matchesAny(filter.Results, r.ID)
+}
+
+func matchesAny(values []string, value string) bool {
+	if len(values) == 0 {
+		return true
+	}
+
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,130 @@
+package core
+
+import (
+	"image"
+	"testing"
+	"time"
+
+	"github.com/theopticians/optician-api/core/store"
+	"github.com/theopticians/optician-api/core/structs"
+)
+
+func addTargetCase(t *testing.T, project, batch, target string, img image.Image) structs.Result {
+	r, err := svc.AddCase(structs.Case{ProjectID: project, Branch: "master", Target: target, Browser: "chrome", Batch: batch, Image: img}, "tester")
+	if err != nil {
+		t.Fatal("Error adding case:", err)
+	}
+
+	r, err = svc.WaitResult(r.ID, 10*time.Second)
+	if err != nil {
+		t.Fatal("Error waiting result:", err)
+	}
+
+	return r
+}
+
+// outcomeStatuses returns the status of every outcome by result ID.
+func outcomeStatuses(outcomes []structs.ReviewOutcome) map[string]string {
+	statuses := map[string]string{}
+	for _, o := range outcomes {
+		statuses[o.ID] = o.Status
+	}
+
+	return statuses
+}
+
+func TestAcceptBatch(t *testing.T) {
+	project := "acceptbatch_" + RandStringBytes(10)
+
+	old := addTargetCase(t, project, project+"_b1", "home", testImg1)
+	home := addTargetCase(t, project, project+"_b2", "home", testImg2)
+	about := addTargetCase(t, project, project+"_b2", "about", testImg1)
+
+	outcomes, err := svc.AcceptBatch(project+"_b1", structs.ReviewFilter{Results: []string{old.ID, "nope"}}, "user:ana")
+	if err != nil {
+		t.Fatal("Error accepting batch:", err)
+	}
+
+	statuses := outcomeStatuses(outcomes)
+	if len(outcomes) != 2 || statuses[old.ID] != structs.OutcomeSkipped || statuses["nope"] != structs.OutcomeSkipped {
+		t.Fatal("Expected the old result and the unknown one to be skipped, got", outcomes)
+	}
+
+	outcomes, err = svc.AcceptBatch(project+"_b2", structs.ReviewFilter{Targets: []string{"home"}}, "user:ana")
+	if err != nil {
+		t.Fatal("Error accepting batch:", err)
+	}
+
+	if len(outcomes) != 1 || outcomes[0].ID != home.ID || outcomes[0].Status != structs.OutcomeAccepted {
+		t.Fatal("Expected only the home result to be accepted, got", outcomes)
+	}
+
+	base, err := baseImageID(svc.db, home)
+	if err != nil || base != home.ImageID {
+		t.Fatal("Expected the accepted image to be the base image, got", base, err)
+	}
+
+	r, err := svc.GetTest(about.ID)
+	if err != nil || r.Review != "" {
+		t.Fatal("Expected the filtered out result to be left unreviewed, got", r, err)
+	}
+
+	_, err = svc.AcceptBatch(project+"_nope", structs.ReviewFilter{}, "user:ana")
+	if _, ok := err.(NotFoundError); !ok {
+		t.Fatal("Expected a not found error accepting an unknown batch, got", err)
+	}
+}
+
+func TestRejectBatch(t *testing.T) {
+	project := "rejectbatch_" + RandStringBytes(10)
+
+	old := addTargetCase(t, project, project+"_b1", "home", testImg1)
+	last := addTargetCase(t, project, project+"_b2", "home", testImg2)
+
+	outcomes, err := svc.RejectBatch(project+"_b1", structs.ReviewFilter{}, "user:bob")
+	if err != nil || len(outcomes) != 1 || outcomes[0].Status != structs.OutcomeSkipped {
+		t.Fatal("Expected the old result to be skipped, got", outcomes, err)
+	}
+
+	outcomes, err = svc.RejectBatch(project+"_b2", structs.ReviewFilter{}, "user:bob")
+	if err != nil || len(outcomes) != 1 || outcomes[0].Status != structs.OutcomeRejected {
+		t.Fatal("Expected the last result to be rejected, got", outcomes, err)
+	}
+
+	r, err := svc.GetTest(last.ID)
+	if err != nil || r.Review != structs.ReviewRejected || r.ReviewedBy != "user:bob" {
+		t.Fatal("Expected the result to be rejected by user:bob, got", r, err)
+	}
+
+	r, err = svc.GetTest(old.ID)
+	if err != nil || r.Review != "" {
+		t.Fatal("Expected the old result to be left unreviewed, got", r, err)
+	}
+}
+
+func TestRejectTest(t *testing.T) {
+	project := "rejecttest_" + RandStringBytes(10)
+
+	old := addTargetCase(t, project, project+"_b1", "home", testImg1)
+	last := addTargetCase(t, project, project+"_b2", "home", testImg2)
+
+	err := svc.RejectTest(old.ID, "user:bob")
+	if stale, ok := err.(StaleResultError); !ok || stale.LastResultID != last.ID {
+		t.Fatal("Expected a stale result error pointing to the last result, got", err)
+	}
+
+	err = svc.RejectTest("nope", "user:bob")
+	if err != store.NotFoundError {
+		t.Fatal("Expected a not found error rejecting an unknown result, got", err)
+	}
+
+	err = svc.RejectTest(last.ID, "user:bob")
+	if err != nil {
+		t.Fatal("Error rejecting test:", err)
+	}
+
+	r, err := svc.GetTest(last.ID)
+	if err != nil || r.Review != structs.ReviewRejected {
+		t.Fatal("Expected the result to be rejected, got", r, err)
+	}
+}
@@ -1,46 +1,122 @@
 package core
 
 import (
+	"fmt"
 	"image"
 
 	"github.com/pkg/errors"
-	"github.com/theopticians/optician-api/core/imgdiff"
 	"github.com/theopticians/optician-api/core/structs"
 )
 
-func RunTest(r *structs.Result) error {
+// RunTest computes the diff of the result against its base image and marks it
+// as done.
+func (s *Service) RunTest(r *structs.Result) error {
+	d, err := s.resultDiff(*r)
+	if err != nil {
+		return err
+	}
 
-	baseImg, err := db.GetImage(r.BaseImageID)
+	err = d.store(s.imageStore(s.db))
 	if err != nil {
-		return errors.Wrap(err, "error getting base image")
+		return err
 	}
 
-	testImg, err := db.GetImage(r.ImageID)
+	d.apply(r)
+
+	return nil
+}
+
+// diff is a comparison whose diff image is not stored yet. Computing it is
+// slow, so it's done before opening the transaction that stores it.
+type diff struct {
+	image      image.Image
+	comparison structs.Comparison
+}
+
+// store stores the diff image and sets its ID in the comparison.
+func (d *diff) store(images ImageStore) error {
+	id, err := images.StoreImage(d.image)
 	if err != nil {
-		return errors.Wrap(err, "error getting test image")
+		return errors.Wrap(err, "error storing diff image")
 	}
 
+	d.comparison.DiffImageID = id
+
+	return nil
+}
+
+// apply copies the comparison to the result and marks it as done.
+func (d diff) apply(r *structs.Result) {
+	r.MaskID = d.comparison.MaskID
+	r.DiffClusters = d.comparison.DiffClusters
+	r.DiffImageID = d.comparison.DiffImageID
+	r.DiffScore = d.comparison.DiffScore
+	r.Status = structs.StatusDone
+	r.Error = ""
+}
+
+// resultDiff diffs the result against its base image, with its mask.
+func (s *Service) resultDiff(r structs.Result) (diff, error) {
 	var mask []image.Rectangle
 	if r.MaskID == "nomask" {
 		mask = []image.Rectangle{}
 	} else {
-		mask, err = db.GetMask(r.MaskID)
+		var err error
+		mask, err = s.db.GetMask(r.MaskID)
 		if err != nil {
-			return errors.Wrap(err, "error getting mask")
+			return diff{}, errors.Wrap(err, "error getting mask")
 		}
 	}
 
-	diffImg, diffScore := imgdiff.ComputeDiffImage(baseImg, testImg, mask)
+	return s.computeDiff(r.Project, r.BaseImageID, r.ImageID, r.MaskID, mask)
+}
 
-	diffImageID, err := db.StoreImage(diffImg)
+// computeDiff diffs two stored images of the project, ignoring the areas in
+// the mask.
+func (s *Service) computeDiff(projectID, baseImageID, imageID, maskID string, mask []image.Rectangle) (diff, error) {
+	images := s.imageStore(s.db)
 
+	baseImg, err := images.GetImage(baseImageID)
 	if err != nil {
-		return errors.Wrap(err, "error getting storing diff image")
+		return diff{}, errors.Wrap(err, "error getting base image")
 	}
 
-	r.DiffClusters = imgdiff.PerformClustering(diffImg)
-	r.DiffImageID = diffImageID
-	r.DiffScore = diffScore
+	testImg, err := images.GetImage(imageID)
+	if err != nil {
+		return diff{}, errors.Wrap(err, "error getting test image")
+	}
 
-	return nil
+	comparator, err := s.comparator(projectID)
+	if err != nil {
+		return diff{}, err
+	}
+
+	diffImg, diffScore, clusters, err := s.compare(comparator, baseImg, testImg, mask)
+	if err != nil {
+		return diff{}, errors.Wrap(err, "error comparing images")
+	}
+
+	return diff{
+		image: diffImg,
+		comparison: structs.Comparison{
+			BaseImageID:  baseImageID,
+			ImageID:      imageID,
+			MaskID:       maskID,
+			Settings:     comparatorSettings(comparator),
+			DiffScore:    diffScore,
+			DiffClusters: clusters,
+		},
+	}, nil
+}
+
+// compare runs the comparator, turning its panics into errors so a bad image
+// fails its result rather than the process.
+func (s *Service) compare(comparator Comparator, base, img image.Image, mask []image.Rectangle) (diffImg image.Image, diffScore float64, clusters []image.Rectangle, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("comparator panic: %v", p)
+		}
+	}()
+
+	return comparator.Compare(base, img, mask)
 }
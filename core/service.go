@@ -0,0 +1,179 @@
+package core
+
+import (
+	"image"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/theopticians/optician-api/core/imgdiff"
+	"github.com/theopticians/optician-api/core/status"
+	"github.com/theopticians/optician-api/core/store"
+	"github.com/theopticians/optician-api/core/structs"
+)
+
+// ImageStore stores the images of cases and their diffs. Every store.Store is
+// an ImageStore.
+type ImageStore interface {
+	GetImage(id string) (image.Image, error)
+	StoreImage(img image.Image) (string, error)
+	DeleteImage(id string) error
+}
+
+// Comparator diffs an image against its base image, ignoring the areas in the
+// mask. It returns the diff image, the diff score and the clusters of
+// differences, or an error if the images can't be compared.
+type Comparator interface {
+	Compare(base, img image.Image, mask []image.Rectangle) (image.Image, float64, []image.Rectangle, error)
+}
+
+// ImgDiff is the default Comparator. Zero fields use the imgdiff defaults.
+type ImgDiff struct {
+	// Threshold is the color distance above which pixels are different.
+	Threshold float64
+
+	// ClusterDistance is the distance under which clusters of differences
+	// are merged.
+	ClusterDistance int
+}
+
+func (d ImgDiff) Compare(base, img image.Image, mask []image.Rectangle) (image.Image, float64, []image.Rectangle, error) {
+	threshold := d.Threshold
+	if threshold == 0 {
+		threshold = imgdiff.DefaultThreshold
+	}
+
+	distance := d.ClusterDistance
+	if distance == 0 {
+		distance = imgdiff.DefaultClusterDistance
+	}
+
+	diffImg, diffScore, err := imgdiff.ComputeDiffImageThreshold(base, img, mask, threshold)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	clusters, err := imgdiff.PerformClusteringDistance(diffImg, distance)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	return diffImg, diffScore, clusters, nil
+}
+
+// Clock returns the current time.
+type Clock func() time.Time
+
+// Config is what a Service is built from. Use DefaultConfig to get one with
+// sensible defaults.
+type Config struct {
+	Store store.Store
+
+	// Images stores the images. When nil they are kept in Store, in the
+	// same transactions as the results referencing them.
+	Images ImageStore
+
+	Comparator Comparator
+	Clock      Clock
+
+	// Workers is the number of diffs computed concurrently.
+	Workers int
+
+	// BatchIdleTimeout is the time without new cases after which a batch is
+	// automatically finalized. Zero disables it.
+	BatchIdleTimeout time.Duration
+
+	// Retention is the age after which batches are deleted, with their
+	// results. Zero keeps them forever.
+	Retention time.Duration
+
+	// WebhookMaxAttempts is the number of times a delivery is attempted
+	// before it's marked as failed.
+	WebhookMaxAttempts int
+
+	// StatusReporter posts the verdict of batches as statuses of their
+	// commit. Nil disables it.
+	StatusReporter status.Reporter
+
+	// PublicURL is the URL the API is reachable at, used to link commit
+	// statuses to their batch.
+	PublicURL string
+
+	// AutoCreateProjects creates the projects of cases and batches on
+	// first use. Unknown projects are rejected otherwise.
+	AutoCreateProjects bool
+}
+
+func DefaultConfig(s store.Store) Config {
+	return Config{
+		Store:              s,
+		Comparator:         ImgDiff{},
+		Clock:              time.Now,
+		Workers:            4,
+		BatchIdleTimeout:   6 * time.Hour,
+		WebhookMaxAttempts: 10,
+		AutoCreateProjects: true,
+	}
+}
+
+// Service runs the cases, batches, reviews and webhooks of a store. Several
+// services can run in the same process, each with its own store.
+//
+// Methods changing the store take a by argument identifying who makes the
+// change, like "key:<id>" or "user:<name>", or SystemActor. It's recorded in
+// the audit log, and in the reviewed or masked results.
+type Service struct {
+	db     store.Store
+	images ImageStore
+	config Config
+
+	jobs chan structs.Job
+
+	waitersMu sync.Mutex
+	waiters   map[string][]chan struct{}
+
+	subscribersMu sync.Mutex
+	subscribers   map[*subscriber]bool
+
+	webhookClient  *http.Client
+	webhookTrigger chan struct{}
+}
+
+// NewService returns a service for the config. Zero Comparator and Clock are
+// replaced by their defaults. StartWorkers and StartWebhooks must be called
+// to run diffs and deliver webhooks.
+func NewService(c Config) *Service {
+	if c.Comparator == nil {
+		c.Comparator = ImgDiff{}
+	}
+	if c.Clock == nil {
+		c.Clock = time.Now
+	}
+
+	return &Service{
+		db:     c.Store,
+		images: c.Images,
+		config: c,
+
+		jobs:    make(chan structs.Job, 1000),
+		waiters: map[string][]chan struct{}{},
+
+		subscribers: map[*subscriber]bool{},
+
+		webhookClient:  &http.Client{Timeout: 10 * time.Second},
+		webhookTrigger: make(chan struct{}, 1),
+	}
+}
+
+func (s *Service) now() time.Time {
+	return s.config.Clock()
+}
+
+// imageStore returns where images written in the transaction go.
+func (s *Service) imageStore(tx store.Store) ImageStore {
+	if s.images != nil {
+		return s.images
+	}
+
+	return tx
+}
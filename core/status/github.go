@@ -0,0 +1,77 @@
+package status
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const DefaultGitHubAPIURL = "https://api.github.com"
+
+// GitHubReporter reports statuses through the GitHub commit status REST API,
+// or any API compatible with it.
+type GitHubReporter struct {
+	apiURL string
+	token  string
+	client *http.Client
+}
+
+func NewGitHubReporter(apiURL, token string) *GitHubReporter {
+	if apiURL == "" {
+		apiURL = DefaultGitHubAPIURL
+	}
+
+	return &GitHubReporter{
+		apiURL: strings.TrimSuffix(apiURL, "/"),
+		token:  token,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (g *GitHubReporter) Report(s Status) error {
+	body, err := json.Marshal(struct {
+		State       string `json:"state"`
+		TargetURL   string `json:"target_url,omitempty"`
+		Description string `json:"description,omitempty"`
+		Context     string `json:"context,omitempty"`
+	}{s.State, s.TargetURL, s.Description, s.Context})
+	if err != nil {
+		return err
+	}
+
+	// Each segment is escaped, so values can't point the request elsewhere
+	segments := strings.Split(s.Repository, "/")
+	for i := range segments {
+		segments[i] = url.PathEscape(segments[i])
+	}
+
+	req, err := http.NewRequest("POST", g.apiURL+"/repos/"+strings.Join(segments, "/")+"/statuses/"+url.PathEscape(s.Commit), bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/vnd.github.v3+json")
+	if g.token != "" {
+		req.Header.Set("Authorization", "token "+g.token)
+	}
+
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return errors.Errorf("error reporting status of %s@%s: %s %s", s.Repository, s.Commit, resp.Status, msg)
+	}
+
+	return nil
+}
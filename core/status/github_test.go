@@ -0,0 +1,78 @@
+package status
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGitHubReporter(t *testing.T) {
+	var path, auth string
+	var body map[string]string
+
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		auth = r.Header.Get("Authorization")
+		json.NewDecoder(r.Body).Decode(&body)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer api.Close()
+
+	r := NewGitHubReporter(api.URL, "secret")
+
+	err := r.Report(Status{
+		Repository:  "theopticians/optician-api",
+		Commit:      "abc123",
+		State:       Failure,
+		Description: "2 of 10 cases failed",
+		TargetURL:   "http://optician/batches/b1/summary",
+		Context:     "optician",
+	})
+	if err != nil {
+		t.Fatal("Error reporting status:", err)
+	}
+
+	if path != "/repos/theopticians/optician-api/statuses/abc123" {
+		t.Fatal("Unexpected request path", path)
+	}
+
+	if auth != "token secret" {
+		t.Fatal("Unexpected authorization header", auth)
+	}
+
+	if body["state"] != Failure || body["target_url"] != "http://optician/batches/b1/summary" || body["context"] != "optician" {
+		t.Fatal("Unexpected request body", body)
+	}
+}
+
+func TestGitHubReporterError(t *testing.T) {
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	}))
+	defer api.Close()
+
+	err := NewGitHubReporter(api.URL, "").Report(Status{Repository: "a/b", Commit: "c", State: "bogus"})
+	if err == nil {
+		t.Fatal("Expected error when the API rejects the status")
+	}
+}
+
+func TestGitHubReporterEscaping(t *testing.T) {
+	var path string
+
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.EscapedPath()
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer api.Close()
+
+	err := NewGitHubReporter(api.URL, "").Report(Status{Repository: "a/b", Commit: "../../../user?x#y", State: Success})
+	if err != nil {
+		t.Fatal("Error reporting status:", err)
+	}
+
+	if path != "/repos/a/b/statuses/..%2F..%2F..%2Fuser%3Fx%23y" {
+		t.Fatal("Expected the commit to be escaped, got", path)
+	}
+}
@@ -0,0 +1,23 @@
+package status
+
+const (
+	Pending = "pending"
+	Success = "success"
+	Failure = "failure"
+	Error   = "error"
+)
+
+// Status is the state of a commit as seen by optician.
+type Status struct {
+	Repository  string
+	Commit      string
+	State       string
+	Description string
+	TargetURL   string
+	Context     string
+}
+
+// Reporter posts commit statuses to a version control system.
+type Reporter interface {
+	Report(Status) error
+}
@@ -6,6 +6,8 @@ import (
 	"image"
 	"image/png"
 	"sort"
+	"strings"
+	"time"
 
 	"github.com/boltdb/bolt"
 	"github.com/theopticians/optician-api/core/store"
@@ -13,43 +15,87 @@ import (
 )
 
 var (
-	imagesBucket     = []byte("images")
-	resultsBucket    = []byte("results")
-	baseImagesBucket = []byte("baseImages")
-	baseMasksBucket  = []byte("baseMasks")
-	masksBucket      = []byte("masks")
+	imagesBucket      = []byte("images")
+	resultsBucket     = []byte("results")
+	baseImagesBucket  = []byte("baseImages")
+	baseMasksBucket   = []byte("baseMasks")
+	masksBucket       = []byte("masks")
+	batchesBucket     = []byte("batches")
+	comparisonsBucket = []byte("comparisons")
+	jobsBucket        = []byte("jobs")
+	webhooksBucket    = []byte("webhooks")
+	projectsBucket    = []byte("projects")
+	apiKeysBucket     = []byte("apiKeys")
+	deliveriesBucket  = []byte("deliveries")
+	auditBucket       = []byte("audit")
 )
 
 type BoltStore struct {
 	db *bolt.DB
+
+	// tx is set on the stores handed out by Transaction, so every operation
+	// runs inside the same bolt transaction.
+	tx *bolt.Tx
 }
 
+// NewBoltStore opens the database and applies any pending migration.
 func NewBoltStore(path string) store.Store {
-	db, err := bolt.Open(path, 0600, nil)
+	s, err := OpenBoltStore(path)
 	if err != nil {
 		panic(err)
 	}
 
-	err = db.Update(func(tx *bolt.Tx) error {
-		var err error
-		_, err = tx.CreateBucketIfNotExists(resultsBucket)
-		_, err = tx.CreateBucketIfNotExists(imagesBucket)
-		_, err = tx.CreateBucketIfNotExists(baseImagesBucket)
-		_, err = tx.CreateBucketIfNotExists(masksBucket)
-		_, err = tx.CreateBucketIfNotExists(baseMasksBucket)
-		return err
-	})
+	err = s.Migrate()
 	if err != nil {
 		panic(err)
 	}
 
-	return &BoltStore{db}
+	return s
+}
+
+// OpenBoltStore opens the database without migrating it.
+func OpenBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &BoltStore{db: db}, nil
 }
 
 func (s *BoltStore) Close() {
+	if s.tx != nil {
+		return
+	}
 	s.db.Close()
 }
 
+// Transaction runs fn with a store whose operations all happen in a single
+// read-write transaction, committed only if fn returns nil.
+func (s *BoltStore) Transaction(fn func(store.Store) error) error {
+	if s.tx != nil {
+		return fn(s)
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return fn(&BoltStore{db: s.db, tx: tx})
+	})
+}
+
+func (s *BoltStore) view(fn func(*bolt.Tx) error) error {
+	if s.tx != nil {
+		return fn(s.tx)
+	}
+	return s.db.View(fn)
+}
+
+func (s *BoltStore) update(fn func(*bolt.Tx) error) error {
+	if s.tx != nil {
+		return fn(s.tx)
+	}
+	return s.db.Update(fn)
+}
+
 func (s *BoltStore) generateUniqueKey(projectID, branch, target, browser string) string {
 	return projectID + "|" + branch + "|" + target + "|" + browser
 }
@@ -66,7 +112,7 @@ func (s *BoltStore) getStringValue(bucket []byte, key string) (string, error) {
 
 func (s *BoltStore) getValue(bucket []byte, key string) ([]byte, error) {
 	var results []byte
-	err := s.db.View(func(tx *bolt.Tx) error {
+	err := s.view(func(tx *bolt.Tx) error {
 		b := tx.Bucket(bucket)
 		results = b.Get([]byte(key))
 		return nil
@@ -88,7 +134,7 @@ func (s *BoltStore) storeStringValue(bucket []byte, key, value string) error {
 }
 
 func (s *BoltStore) storeValue(bucket []byte, key string, value []byte) error {
-	err := s.db.Update(func(tx *bolt.Tx) error {
+	err := s.update(func(tx *bolt.Tx) error {
 		b, err := tx.CreateBucketIfNotExists(bucket)
 		if err != nil {
 			return err
@@ -99,9 +145,32 @@ func (s *BoltStore) storeValue(bucket []byte, key string, value []byte) error {
 	return err
 }
 
+func (s *BoltStore) deleteValue(bucket []byte, key string) error {
+	return s.update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).Delete([]byte(key))
+	})
+}
+
+// forEachValue calls fn with every value of the bucket, stopping at the first
+// error.
+func (s *BoltStore) forEachValue(bucket []byte, fn func([]byte) error) error {
+	return s.view(func(tx *bolt.Tx) error {
+		c := tx.Bucket(bucket).Cursor()
+
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			err := fn(v)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
 func (s *BoltStore) GetResults() ([]structs.Result, error) {
 	ret := []structs.Result{}
-	err := s.db.View(func(tx *bolt.Tx) error {
+	err := s.view(func(tx *bolt.Tx) error {
 
 		b := tx.Bucket(resultsBucket)
 
@@ -126,106 +195,235 @@ func (s *BoltStore) GetResults() ([]structs.Result, error) {
 	return ret, err
 }
 
+func (s *BoltStore) QueryResults(q store.ResultQuery) (store.ResultPage, error) {
+	results := []structs.Result{}
+	err := s.view(func(tx *bolt.Tx) error {
+		candidates, err := s.queryResults(tx, q)
+		if err != nil {
+			return err
+		}
+
+		for _, r := range candidates {
+			if q.Matches(r) {
+				results = append(results, r)
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return store.ResultPage{}, err
+	}
+
+	return store.PageResults(results, q)
+}
+
 func (s *BoltStore) GetResultsByBatch(batch string) ([]structs.Result, error) {
+	var ret []structs.Result
+	err := s.view(func(tx *bolt.Tx) error {
+		var err error
+		ret, err = s.batchResults(tx, batch)
+		return err
+	})
 
-	ret := []structs.Result{}
-	err := s.db.View(func(tx *bolt.Tx) error {
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Timestamp.After(ret[j].Timestamp) })
 
-		b := tx.Bucket(resultsBucket)
+	return ret, err
+}
+
+func (s *BoltStore) GetBatchs() ([]structs.BatchInfo, error) {
+	ret := []structs.BatchInfo{}
+	err := s.forEachValue(batchSummariesIndex, func(v []byte) error {
+		var info structs.BatchInfo
+
+		err := json.Unmarshal(v, &info)
+		if err != nil {
+			return err
+		}
+
+		ret = append(ret, info)
+		return nil
+	})
+
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Timestamp.After(ret[j].Timestamp) })
+
+	return ret, err
+}
+
+func (s *BoltStore) GetJobs() ([]structs.Job, error) {
+	ret := []structs.Job{}
+	err := s.view(func(tx *bolt.Tx) error {
+
+		b := tx.Bucket(jobsBucket)
 
 		c := b.Cursor()
 
 		for k, v := c.First(); k != nil; k, v = c.Next() {
-			r := structs.Result{}
+			j := structs.Job{}
 
-			err := json.Unmarshal(v, &r)
+			err := json.Unmarshal(v, &j)
 			if err != nil {
 				return err
 			}
 
-			if r.Batch == batch {
-				ret = append(ret, r)
-			}
+			ret = append(ret, j)
 		}
 
 		return nil
 	})
 
-	sort.Slice(ret, func(i, j int) bool { return ret[i].Timestamp.After(ret[j].Timestamp) })
+	sort.Slice(ret, func(i, j int) bool { return ret[i].CreatedAt.Before(ret[j].CreatedAt) })
 
 	return ret, err
 }
 
-func (s *BoltStore) GetBatchs() ([]structs.BatchInfo, error) {
-	ret := []structs.BatchInfo{}
+func (s *BoltStore) StoreJob(j structs.Job) error {
+	encoded, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
 
-	err := s.db.View(func(tx *bolt.Tx) error {
+	return s.storeValue(jobsBucket, j.ID, encoded)
+}
 
-		b := tx.Bucket(resultsBucket)
+func (s *BoltStore) DeleteJob(id string) error {
+	return s.update(func(tx *bolt.Tx) error {
+		return tx.Bucket(jobsBucket).Delete([]byte(id))
+	})
+}
 
-		c := b.Cursor()
+// QueryBatchs reads the batches of the query from the batch time indexes. When
+// sorted by timestamp, only the page is read.
+func (s *BoltStore) QueryBatchs(q store.BatchQuery) (store.BatchPage, error) {
+	key, desc, err := store.Sort(q.Sort, store.BatchSortKeys)
+	if err != nil {
+		return store.BatchPage{}, err
+	}
 
-		for k, v := c.First(); k != nil; k, v = c.Next() {
+	cursor, err := store.DecodeCursor(q.Cursor, key, store.BatchSortKeys)
+	if err != nil {
+		return store.BatchPage{}, err
+	}
 
-			var t structs.Result
+	// Other sorts need every batch in range
+	limit := -1
+	if key != "timestamp" {
+		cursor = nil
+	} else {
+		limit = store.Limit(q.Limit)
+	}
 
-			err := json.Unmarshal(v, &t)
+	batchs := []structs.BatchInfo{}
+	err = s.view(func(tx *bolt.Tx) error {
+		index := timeIndex(tx, batchTimesIndex, projectBatchTimesIndex, q.Project)
+		if index == nil {
+			return nil
+		}
+
+		summaries := tx.Bucket(batchSummariesIndex)
+
+		return walkTimeIndex(index, q.Since, q.Until, cursor, desc, func(id []byte) (bool, error) {
+			var info structs.BatchInfo
+
+			err := json.Unmarshal(summaries.Get(id), &info)
 			if err != nil {
-				return err
+				return false, err
 			}
 
-			found := -1
-			for i := 0; i < len(ret); i++ {
-				if ret[i].ID == t.Batch {
-					found = i
-					break
-				}
+			if q.Matches(info) {
+				batchs = append(batchs, info)
 			}
 
-			if found >= 0 {
-				if t.Timestamp.After(ret[found].Timestamp) {
-					ret[found].Timestamp = t.Timestamp
-				}
+			// One more than the page tells whether there's a next one
+			return limit < 0 || len(batchs) <= limit, nil
+		})
+	})
+	if err != nil {
+		return store.BatchPage{}, err
+	}
 
-				if t.DiffScore > 0 {
-					ret[found].Failed++
-				}
-			} else {
-				failed := 0
-				if t.DiffScore > 0 {
-					failed++
-				}
-				ret = append(ret, structs.BatchInfo{t.Batch, t.Timestamp, failed, t.Project})
+	return store.PageBatchs(batchs, q)
+}
+
+func (s *BoltStore) GetBatch(id string) (structs.Batch, error) {
+	val, err := s.getValue(batchesBucket, id)
+
+	b := structs.Batch{}
+
+	if err != nil {
+		return b, err
+	}
+
+	err = json.Unmarshal(val, &b)
+
+	return b, err
+}
+
+func (s *BoltStore) StoreBatch(b structs.Batch) error {
+	encoded, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+
+	return s.storeValue(batchesBucket, b.ID, encoded)
+}
+
+func (s *BoltStore) DeleteBatch(id string) error {
+	return s.update(func(tx *bolt.Tx) error {
+		results, err := s.batchResults(tx, id)
+		if err != nil {
+			return err
+		}
+
+		for _, r := range results {
+			err = s.unindexResult(tx, r)
+			if err != nil {
+				return err
 			}
 
+			err = tx.Bucket(resultsBucket).Delete([]byte(r.ID))
+			if err != nil {
+				return err
+			}
 		}
 
-		return nil
-	})
+		if tx.Bucket(batchResultsIndex).Bucket([]byte(id)) != nil {
+			err = tx.Bucket(batchResultsIndex).DeleteBucket([]byte(id))
+			if err != nil {
+				return err
+			}
+		}
 
-	return ret, err
+		err = deleteBatchSummary(tx, id)
+		if err != nil {
+			return err
+		}
+
+		return tx.Bucket(batchesBucket).Delete([]byte(id))
+	})
 }
 
-func (s *BoltStore) GetLastResult(projectID, branch, target, browser string) (structs.Result, error) {
-	ret := structs.Result{}
-	err := s.db.View(func(tx *bolt.Tx) error {
+func (s *BoltStore) GetLastFinalizedBatch(projectID, branch string) (structs.Batch, error) {
+	ret := structs.Batch{}
+	err := s.view(func(tx *bolt.Tx) error {
 
-		b := tx.Bucket(resultsBucket)
+		b := tx.Bucket(batchesBucket)
 
 		c := b.Cursor()
 
 		for k, v := c.First(); k != nil; k, v = c.Next() {
 
-			var t structs.Result
+			var batch structs.Batch
 
-			err := json.Unmarshal(v, &t)
+			err := json.Unmarshal(v, &batch)
 			if err != nil {
 				return err
 			}
 
-			if t.Project == projectID && t.Branch == branch && t.Target == target && t.Browser == browser {
-				if t.Timestamp.After(ret.Timestamp) {
-					ret = t
+			if batch.Project == projectID && batch.Branch == branch && batch.Finalized() {
+				if !ret.Finalized() || batch.FinalizedAt.After(*ret.FinalizedAt) {
+					ret = batch
 				}
 			}
 		}
@@ -233,24 +431,104 @@ func (s *BoltStore) GetLastResult(projectID, branch, target, browser string) (st
 		return nil
 	})
 
+	if err == nil && !ret.Finalized() {
+		return ret, store.NotFoundError
+	}
+
 	return ret, err
 }
 
-func (s *BoltStore) StoreResult(r structs.Result) error {
-	err := s.db.Update(func(tx *bolt.Tx) error {
-		b, err := tx.CreateBucketIfNotExists(resultsBucket)
+func (s *BoltStore) GetOpenBatches() ([]structs.Batch, error) {
+	ret := []structs.Batch{}
+	err := s.forEachValue(batchesBucket, func(v []byte) error {
+		b := structs.Batch{}
+
+		err := json.Unmarshal(v, &b)
 		if err != nil {
 			return err
 		}
 
-		encoded, err := json.Marshal(r)
-		if err != nil {
-			return err
+		if !b.Finalized() {
+			ret = append(ret, b)
 		}
-		return b.Put([]byte(r.ID), encoded)
+
+		return nil
 	})
-	return err
 
+	return ret, err
+}
+
+func (s *BoltStore) GetEmptyBatches() ([]structs.Batch, error) {
+	ret := []structs.Batch{}
+	err := s.view(func(tx *bolt.Tx) error {
+		index := tx.Bucket(batchResultsIndex)
+
+		return tx.Bucket(batchesBucket).ForEach(func(k, v []byte) error {
+			if results := index.Bucket(k); results != nil {
+				if first, _ := results.Cursor().First(); first != nil {
+					return nil
+				}
+			}
+
+			b := structs.Batch{}
+
+			err := json.Unmarshal(v, &b)
+			if err != nil {
+				return err
+			}
+
+			ret = append(ret, b)
+			return nil
+		})
+	})
+
+	return ret, err
+}
+
+func (s *BoltStore) GetLastResult(projectID, branch, target, browser string) (structs.Result, error) {
+	ret := structs.Result{}
+	err := s.view(func(tx *bolt.Tx) error {
+		index := tx.Bucket(caseResultsIndex).Bucket([]byte(s.generateUniqueKey(projectID, branch, target, browser)))
+		if index == nil {
+			return store.NotFoundError
+		}
+
+		_, id := index.Cursor().Last()
+		if id == nil {
+			return store.NotFoundError
+		}
+
+		return json.Unmarshal(tx.Bucket(resultsBucket).Get(id), &ret)
+	})
+
+	return ret, err
+}
+
+func (s *BoltStore) StoreResult(r structs.Result) error {
+	return s.update(func(tx *bolt.Tx) error {
+		return s.putResult(tx, r)
+	})
+}
+
+func (s *BoltStore) AcceptResults(results []structs.Result) error {
+	return s.update(func(tx *bolt.Tx) error {
+		bb := tx.Bucket(baseImagesBucket)
+
+		for _, r := range results {
+			err := s.putResult(tx, r)
+			if err != nil {
+				return err
+			}
+
+			key := s.generateUniqueKey(r.Project, r.Branch, r.Target, r.Browser)
+			err = bb.Put([]byte(key), []byte(r.ImageID))
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
 }
 
 func (s *BoltStore) GetResult(ID string) (structs.Result, error) {
@@ -303,6 +581,345 @@ func (s *BoltStore) StoreMask(masks structs.Mask) (string, error) {
 	return key, nil
 }
 
+func (s *BoltStore) GetProjects() ([]structs.Project, error) {
+	ret := []structs.Project{}
+	err := s.forEachValue(projectsBucket, func(v []byte) error {
+		p := structs.Project{}
+
+		err := json.Unmarshal(v, &p)
+		if err != nil {
+			return err
+		}
+
+		ret = append(ret, p)
+
+		return nil
+	})
+
+	return ret, err
+}
+
+func (s *BoltStore) GetProject(id string) (structs.Project, error) {
+	val, err := s.getValue(projectsBucket, id)
+
+	p := structs.Project{}
+
+	if err != nil {
+		return p, err
+	}
+
+	err = json.Unmarshal(val, &p)
+
+	return p, err
+}
+
+func (s *BoltStore) StoreProject(p structs.Project) error {
+	encoded, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+
+	return s.storeValue(projectsBucket, p.ID, encoded)
+}
+
+func (s *BoltStore) DeleteProject(id string) error {
+	_, err := s.getValue(projectsBucket, id)
+	if err != nil {
+		return err
+	}
+
+	return s.deleteValue(projectsBucket, id)
+}
+
+func (s *BoltStore) GetAPIKeys(projectID string) ([]structs.APIKey, error) {
+	ret := []structs.APIKey{}
+	err := s.forEachValue(apiKeysBucket, func(v []byte) error {
+		k := structs.APIKey{}
+
+		err := json.Unmarshal(v, &k)
+		if err != nil {
+			return err
+		}
+
+		if k.Project == projectID {
+			ret = append(ret, k)
+		}
+
+		return nil
+	})
+
+	sort.Slice(ret, func(i, j int) bool { return ret[i].CreatedAt.Before(ret[j].CreatedAt) })
+
+	return ret, err
+}
+
+func (s *BoltStore) GetAPIKey(id string) (structs.APIKey, error) {
+	val, err := s.getValue(apiKeysBucket, id)
+
+	k := structs.APIKey{}
+
+	if err != nil {
+		return k, err
+	}
+
+	err = json.Unmarshal(val, &k)
+
+	return k, err
+}
+
+func (s *BoltStore) StoreAPIKey(k structs.APIKey) error {
+	encoded, err := json.Marshal(k)
+	if err != nil {
+		return err
+	}
+
+	return s.storeValue(apiKeysBucket, k.ID, encoded)
+}
+
+func (s *BoltStore) DeleteAPIKey(id string) error {
+	_, err := s.getValue(apiKeysBucket, id)
+	if err != nil {
+		return err
+	}
+
+	return s.deleteValue(apiKeysBucket, id)
+}
+
+func (s *BoltStore) AppendAudit(e structs.AuditEntry) error {
+	encoded, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	return s.update(func(tx *bolt.Tx) error {
+		err := tx.Bucket(auditBucket).Put([]byte(e.ID), encoded)
+		if err != nil {
+			return err
+		}
+
+		return indexAudit(tx, e)
+	})
+}
+
+// QueryAudit reads the page of entries of the query from the audit time
+// indexes.
+func (s *BoltStore) QueryAudit(q store.AuditQuery) (store.AuditPage, error) {
+	key, desc, err := store.Sort(q.Sort, store.AuditSortKeys)
+	if err != nil {
+		return store.AuditPage{}, err
+	}
+
+	cursor, err := store.DecodeCursor(q.Cursor, key, store.AuditSortKeys)
+	if err != nil {
+		return store.AuditPage{}, err
+	}
+
+	limit := store.Limit(q.Limit)
+
+	entries := []structs.AuditEntry{}
+	err = s.view(func(tx *bolt.Tx) error {
+		index := timeIndex(tx, auditTimesIndex, projectAuditTimesIndex, q.Project)
+		if index == nil {
+			return nil
+		}
+
+		audit := tx.Bucket(auditBucket)
+
+		return walkTimeIndex(index, q.Since, q.Until, cursor, desc, func(id []byte) (bool, error) {
+			var e structs.AuditEntry
+
+			err := json.Unmarshal(audit.Get(id), &e)
+			if err != nil {
+				return false, err
+			}
+
+			if q.Matches(e) {
+				entries = append(entries, e)
+			}
+
+			// One more than the page tells whether there's a next one
+			return len(entries) <= limit, nil
+		})
+	})
+	if err != nil {
+		return store.AuditPage{}, err
+	}
+
+	return store.PageAudit(entries, q)
+}
+
+func (s *BoltStore) GetWebhooks(projectID string) ([]structs.Webhook, error) {
+	ret := []structs.Webhook{}
+	err := s.forEachValue(webhooksBucket, func(v []byte) error {
+		w := structs.Webhook{}
+
+		err := json.Unmarshal(v, &w)
+		if err != nil {
+			return err
+		}
+
+		if w.Project == projectID {
+			ret = append(ret, w)
+		}
+
+		return nil
+	})
+
+	sort.Slice(ret, func(i, j int) bool { return ret[i].CreatedAt.Before(ret[j].CreatedAt) })
+
+	return ret, err
+}
+
+func (s *BoltStore) GetWebhook(id string) (structs.Webhook, error) {
+	val, err := s.getValue(webhooksBucket, id)
+
+	w := structs.Webhook{}
+
+	if err != nil {
+		return w, err
+	}
+
+	err = json.Unmarshal(val, &w)
+
+	return w, err
+}
+
+func (s *BoltStore) StoreWebhook(w structs.Webhook) error {
+	encoded, err := json.Marshal(w)
+	if err != nil {
+		return err
+	}
+
+	return s.storeValue(webhooksBucket, w.ID, encoded)
+}
+
+func (s *BoltStore) DeleteWebhook(id string) error {
+	_, err := s.getValue(webhooksBucket, id)
+	if err != nil {
+		return err
+	}
+
+	return s.deleteValue(webhooksBucket, id)
+}
+
+func (s *BoltStore) GetDeliveries(webhookID string) ([]structs.Delivery, error) {
+	ret := []structs.Delivery{}
+	err := s.forEachValue(deliveriesBucket, func(v []byte) error {
+		d := structs.Delivery{}
+
+		err := json.Unmarshal(v, &d)
+		if err != nil {
+			return err
+		}
+
+		if d.WebhookID == webhookID {
+			ret = append(ret, d)
+		}
+
+		return nil
+	})
+
+	sort.Slice(ret, func(i, j int) bool { return ret[i].CreatedAt.After(ret[j].CreatedAt) })
+
+	return ret, err
+}
+
+func (s *BoltStore) GetDueDeliveries(now time.Time) ([]structs.Delivery, error) {
+	ret := []structs.Delivery{}
+	err := s.forEachValue(deliveriesBucket, func(v []byte) error {
+		d := structs.Delivery{}
+
+		err := json.Unmarshal(v, &d)
+		if err != nil {
+			return err
+		}
+
+		if d.Status == structs.DeliveryPending && !d.NextAttempt.After(now) {
+			ret = append(ret, d)
+		}
+
+		return nil
+	})
+
+	sort.Slice(ret, func(i, j int) bool { return ret[i].CreatedAt.Before(ret[j].CreatedAt) })
+
+	return ret, err
+}
+
+func (s *BoltStore) StoreDelivery(d structs.Delivery) error {
+	encoded, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+
+	return s.storeValue(deliveriesBucket, d.ID, encoded)
+}
+
+func (s *BoltStore) GetComparison(baseImageID, imageID, maskID, settings string) (structs.Comparison, error) {
+	val, err := s.getValue(comparisonsBucket, baseImageID+"|"+imageID+"|"+maskID+"|"+settings)
+
+	c := structs.Comparison{}
+
+	if err != nil {
+		return c, err
+	}
+
+	err = json.Unmarshal(val, &c)
+
+	return c, err
+}
+
+func (s *BoltStore) StoreComparison(c structs.Comparison) error {
+	encoded, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+
+	return s.storeValue(comparisonsBucket, c.BaseImageID+"|"+c.ImageID+"|"+c.MaskID+"|"+c.Settings, encoded)
+}
+
+func (s *BoltStore) DeleteComparisons(imageIDs []string) ([]string, error) {
+	images := idSet(imageIDs)
+	diffs := []string{}
+
+	err := s.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(comparisonsBucket)
+
+		// Keys are deleted once iterated, deleting while iterating skips
+		// keys
+		var keys [][]byte
+		err := b.ForEach(func(k, v []byte) error {
+			var c structs.Comparison
+
+			err := json.Unmarshal(v, &c)
+			if err != nil {
+				return err
+			}
+
+			if images[c.BaseImageID] || images[c.ImageID] {
+				keys = append(keys, append([]byte{}, k...))
+				diffs = append(diffs, c.DiffImageID)
+			}
+
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, k := range keys {
+			err = b.Delete(k)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	return diffs, err
+}
+
 func (s *BoltStore) GetImage(imgID string) (image.Image, error) {
 	val, err := s.getValue(imagesBucket, imgID)
 
@@ -336,11 +953,71 @@ func (s *BoltStore) GetBaseImageID(projectID, branch, target, browser string) (s
 	return s.getStringValue(baseImagesBucket, key)
 }
 
+func (s *BoltStore) DeleteImage(id string) error {
+	return s.deleteValue(imagesBucket, id)
+}
+
+func (s *BoltStore) ReferencedImages(ids []string) (map[string]bool, error) {
+	images := idSet(ids)
+	ret := map[string]bool{}
+
+	err := s.forEachValue(resultsBucket, func(v []byte) error {
+		var r structs.Result
+
+		err := json.Unmarshal(v, &r)
+		if err != nil {
+			return err
+		}
+
+		for _, id := range []string{r.ImageID, r.BaseImageID, r.DiffImageID} {
+			if images[id] {
+				ret[id] = true
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.forEachValue(baseImagesBucket, func(v []byte) error {
+		if images[string(v)] {
+			ret[string(v)] = true
+		}
+
+		return nil
+	})
+
+	return ret, err
+}
+
 func (s *BoltStore) SetBaseImageID(baseImageID, projectID, branch, target, browser string) error {
 	key := s.generateUniqueKey(projectID, branch, target, browser)
 	return s.storeStringValue(baseImagesBucket, key, baseImageID)
 }
 
+func (s *BoltStore) GetBaseImageCases(projectID, branch string) ([]structs.CaseKey, error) {
+	ret := []structs.CaseKey{}
+	prefix := []byte(projectID + "|" + branch + "|")
+	err := s.view(func(tx *bolt.Tx) error {
+		c := tx.Bucket(baseImagesBucket).Cursor()
+
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			parts := strings.SplitN(string(k[len(prefix):]), "|", 2)
+			if len(parts) != 2 {
+				continue
+			}
+
+			ret = append(ret, structs.CaseKey{Project: projectID, Target: parts[0], Browser: parts[1]})
+		}
+
+		return nil
+	})
+
+	return ret, err
+}
+
 func (s *BoltStore) GetBaseMaskID(projectID, branch, target, browser string) (string, error) {
 	key := s.generateUniqueKey(projectID, branch, target, browser)
 	return s.getStringValue(baseMasksBucket, key)
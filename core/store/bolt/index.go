@@ -0,0 +1,546 @@
+package bolt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/theopticians/optician-api/core/store"
+	"github.com/theopticians/optician-api/core/structs"
+)
+
+// Index buckets, maintained by putResult in the same transaction as the
+// results bucket:
+//   - batchResultsIndex has a nested bucket per batch with its result IDs.
+//   - caseResultsIndex has a nested bucket per case key with its result IDs,
+//     keyed by timestamp so the last one is the last result of the case.
+//   - batchSummariesIndex has the BatchInfo aggregate of every batch.
+//   - batchTimesIndex has the batch IDs keyed by the timestamp of their
+//     summary, and projectBatchTimesIndex the same in a nested bucket per
+//     project.
+//
+// And by AppendAudit, in the same transaction as the audit bucket:
+//   - auditTimesIndex has the audit entry IDs keyed by timestamp, and
+//     projectAuditTimesIndex the same in a nested bucket per project.
+var (
+	batchResultsIndex      = []byte("idxBatchResults")
+	caseResultsIndex       = []byte("idxCaseResults")
+	batchSummariesIndex    = []byte("idxBatchSummaries")
+	batchTimesIndex        = []byte("idxBatchTimes")
+	projectBatchTimesIndex = []byte("idxProjectBatchTimes")
+	auditTimesIndex        = []byte("idxAuditTimes")
+	projectAuditTimesIndex = []byte("idxProjectAuditTimes")
+)
+
+var indexBuckets = [][]byte{batchResultsIndex, caseResultsIndex, batchSummariesIndex, batchTimesIndex, projectBatchTimesIndex, auditTimesIndex, projectAuditTimesIndex}
+
+// rebuildIndexesIfMissing creates the index buckets from the results and audit
+// buckets if any of them doesn't exist, like in databases created before
+// indexing.
+func (s *BoltStore) rebuildIndexesIfMissing(tx *bolt.Tx) error {
+	missing := false
+	for _, name := range indexBuckets {
+		if tx.Bucket(name) == nil {
+			missing = true
+		}
+	}
+
+	if !missing {
+		return nil
+	}
+
+	for _, name := range indexBuckets {
+		if tx.Bucket(name) != nil {
+			err := tx.DeleteBucket(name)
+			if err != nil {
+				return err
+			}
+		}
+
+		_, err := tx.CreateBucket(name)
+		if err != nil {
+			return err
+		}
+	}
+
+	batches := map[string]bool{}
+
+	err := tx.Bucket(resultsBucket).ForEach(func(k, v []byte) error {
+		var r structs.Result
+
+		err := json.Unmarshal(v, &r)
+		if err != nil {
+			return err
+		}
+
+		batches[r.Batch] = true
+
+		return s.indexResult(tx, r)
+	})
+	if err != nil {
+		return err
+	}
+
+	for batch := range batches {
+		err = s.rebuildBatchSummary(tx, batch)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Created by a later migration
+	if tx.Bucket(auditBucket) == nil {
+		return nil
+	}
+
+	return tx.Bucket(auditBucket).ForEach(func(k, v []byte) error {
+		var e structs.AuditEntry
+
+		err := json.Unmarshal(v, &e)
+		if err != nil {
+			return err
+		}
+
+		return indexAudit(tx, e)
+	})
+}
+
+// putResult stores the result and updates the indexes.
+func (s *BoltStore) putResult(tx *bolt.Tx, r structs.Result) error {
+	b := tx.Bucket(resultsBucket)
+
+	// The stored version of the result, if any
+	var old *structs.Result
+
+	if v := b.Get([]byte(r.ID)); v != nil {
+		old = &structs.Result{}
+
+		err := json.Unmarshal(v, old)
+		if err != nil {
+			return err
+		}
+
+		err = s.unindexResult(tx, *old)
+		if err != nil {
+			return err
+		}
+	}
+
+	encoded, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	err = b.Put([]byte(r.ID), encoded)
+	if err != nil {
+		return err
+	}
+
+	err = s.indexResult(tx, r)
+	if err != nil {
+		return err
+	}
+
+	if old != nil && old.Batch != r.Batch {
+		err = s.removeFromBatchSummary(tx, *old)
+		if err != nil {
+			return err
+		}
+
+		old = nil
+	}
+
+	return s.addToBatchSummary(tx, r, old)
+}
+
+func (s *BoltStore) indexResult(tx *bolt.Tx, r structs.Result) error {
+	batch, err := tx.Bucket(batchResultsIndex).CreateBucketIfNotExists([]byte(r.Batch))
+	if err != nil {
+		return err
+	}
+
+	err = batch.Put([]byte(r.ID), []byte{})
+	if err != nil {
+		return err
+	}
+
+	c, err := tx.Bucket(caseResultsIndex).CreateBucketIfNotExists([]byte(s.generateUniqueKey(r.Project, r.Branch, r.Target, r.Browser)))
+	if err != nil {
+		return err
+	}
+
+	return c.Put(caseIndexKey(r), []byte(r.ID))
+}
+
+func (s *BoltStore) unindexResult(tx *bolt.Tx, r structs.Result) error {
+	if batch := tx.Bucket(batchResultsIndex).Bucket([]byte(r.Batch)); batch != nil {
+		err := batch.Delete([]byte(r.ID))
+		if err != nil {
+			return err
+		}
+	}
+
+	if c := tx.Bucket(caseResultsIndex).Bucket([]byte(s.generateUniqueKey(r.Project, r.Branch, r.Target, r.Browser))); c != nil {
+		return c.Delete(caseIndexKey(r))
+	}
+
+	return nil
+}
+
+// caseIndexKey sorts results by timestamp, then ID.
+func caseIndexKey(r structs.Result) []byte {
+	key := make([]byte, 8, 8+len(r.ID))
+	binary.BigEndian.PutUint64(key, uint64(r.Timestamp.UnixNano()))
+	return append(key, r.ID...)
+}
+
+// rebuildBatchSummary recomputes the summary of the batch from its results.
+func (s *BoltStore) rebuildBatchSummary(tx *bolt.Tx, batch string) error {
+	results, err := s.batchResults(tx, batch)
+	if err != nil {
+		return err
+	}
+
+	if len(results) == 0 {
+		return deleteBatchSummary(tx, batch)
+	}
+
+	info := structs.BatchInfo{ID: batch}
+	for _, r := range results {
+		if r.Timestamp.After(info.Timestamp) {
+			info.Timestamp = r.Timestamp
+			info.Project = r.Project
+		}
+
+		if r.Failed() {
+			info.Failed++
+		}
+	}
+
+	return putBatchSummary(tx, info)
+}
+
+// addToBatchSummary updates the summary of the batch of r, stored in its
+// indexes, with r replacing old, its previous version in the same batch, if
+// not nil. The summary is only recomputed from every result of the batch
+// when old was its last result and r is older.
+func (s *BoltStore) addToBatchSummary(tx *bolt.Tx, r structs.Result, old *structs.Result) error {
+	info, err := getBatchSummary(tx, r.Batch)
+	if err != nil {
+		return err
+	}
+
+	if old != nil {
+		if old.Timestamp.Equal(info.Timestamp) && r.Timestamp.Before(old.Timestamp) {
+			return s.rebuildBatchSummary(tx, r.Batch)
+		}
+
+		if old.Failed() {
+			info.Failed--
+		}
+	}
+
+	if r.Failed() {
+		info.Failed++
+	}
+
+	if !r.Timestamp.Before(info.Timestamp) {
+		info.Timestamp = r.Timestamp
+		info.Project = r.Project
+	}
+
+	return putBatchSummary(tx, info)
+}
+
+// removeFromBatchSummary updates the summary of the batch of r, already
+// removed from its indexes. The summary is only recomputed from every result
+// of the batch when r was its last result.
+func (s *BoltStore) removeFromBatchSummary(tx *bolt.Tx, r structs.Result) error {
+	info, err := getBatchSummary(tx, r.Batch)
+	if err != nil {
+		return err
+	}
+
+	if r.Timestamp.Equal(info.Timestamp) {
+		return s.rebuildBatchSummary(tx, r.Batch)
+	}
+
+	if r.Failed() {
+		info.Failed--
+	}
+
+	return putBatchSummary(tx, info)
+}
+
+// getBatchSummary returns the summary of the batch, empty if it has none.
+func getBatchSummary(tx *bolt.Tx, batch string) (structs.BatchInfo, error) {
+	info := structs.BatchInfo{ID: batch}
+
+	v := tx.Bucket(batchSummariesIndex).Get([]byte(batch))
+	if v == nil {
+		return info, nil
+	}
+
+	err := json.Unmarshal(v, &info)
+
+	return info, err
+}
+
+// putBatchSummary stores the summary of the batch, and moves the batch in the
+// time indexes to its timestamp.
+func putBatchSummary(tx *bolt.Tx, info structs.BatchInfo) error {
+	err := deleteBatchSummary(tx, info.ID)
+	if err != nil {
+		return err
+	}
+
+	encoded, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Bucket(batchSummariesIndex).Put([]byte(info.ID), encoded)
+	if err != nil {
+		return err
+	}
+
+	return putTimeIndex(tx, batchTimesIndex, projectBatchTimesIndex, info.Project, info.Timestamp, info.ID)
+}
+
+// deleteBatchSummary deletes the summary of the batch, and the batch from the
+// time indexes.
+func deleteBatchSummary(tx *bolt.Tx, batch string) error {
+	v := tx.Bucket(batchSummariesIndex).Get([]byte(batch))
+	if v == nil {
+		return nil
+	}
+
+	var info structs.BatchInfo
+
+	err := json.Unmarshal(v, &info)
+	if err != nil {
+		return err
+	}
+
+	err = deleteTimeIndex(tx, batchTimesIndex, projectBatchTimesIndex, info.Project, info.Timestamp, info.ID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Bucket(batchSummariesIndex).Delete([]byte(batch))
+}
+
+func indexAudit(tx *bolt.Tx, e structs.AuditEntry) error {
+	return putTimeIndex(tx, auditTimesIndex, projectAuditTimesIndex, e.Project, e.Timestamp, e.ID)
+}
+
+// timeIndexKey sorts the IDs of time indexes by timestamp, then ID, like the
+// timestamp sort of queries.
+func timeIndexKey(t time.Time, id string) []byte {
+	key := make([]byte, 8, 8+len(id))
+	binary.BigEndian.PutUint64(key, uint64(t.UnixNano()))
+	return append(key, id...)
+}
+
+// putTimeIndex adds the ID to the time index, and to the bucket of its
+// project in the project time index if it has one.
+func putTimeIndex(tx *bolt.Tx, index, projectIndex []byte, project string, t time.Time, id string) error {
+	err := tx.Bucket(index).Put(timeIndexKey(t, id), []byte(id))
+	if err != nil || project == "" {
+		return err
+	}
+
+	p, err := tx.Bucket(projectIndex).CreateBucketIfNotExists([]byte(project))
+	if err != nil {
+		return err
+	}
+
+	return p.Put(timeIndexKey(t, id), []byte(id))
+}
+
+func deleteTimeIndex(tx *bolt.Tx, index, projectIndex []byte, project string, t time.Time, id string) error {
+	err := tx.Bucket(index).Delete(timeIndexKey(t, id))
+	if err != nil || project == "" {
+		return err
+	}
+
+	if p := tx.Bucket(projectIndex).Bucket([]byte(project)); p != nil {
+		return p.Delete(timeIndexKey(t, id))
+	}
+
+	return nil
+}
+
+// timeIndex returns the time index of the project, or of every project if
+// empty. It returns nil if the project has no index.
+func timeIndex(tx *bolt.Tx, index, projectIndex []byte, project string) *bolt.Bucket {
+	if project == "" {
+		return tx.Bucket(index)
+	}
+
+	return tx.Bucket(projectIndex).Bucket([]byte(project))
+}
+
+// walkTimeIndex calls fn with the IDs of the time index from since until
+// until, in order or newest first if desc, and after the cursor if not nil.
+// It stops when fn returns false.
+func walkTimeIndex(index *bolt.Bucket, since, until time.Time, cursor *store.Cursor, desc bool, fn func(id []byte) (bool, error)) error {
+	// Keys from lower, inclusive, to upper, exclusive
+	var lower, upper []byte
+	if !since.IsZero() {
+		lower = timeIndexKey(since, "")
+	}
+	if !until.IsZero() {
+		upper = timeIndexKey(until, "")
+	}
+
+	if cursor != nil {
+		after := timeIndexKey(cursor.Value.(time.Time), cursor.ID)
+		if desc && (upper == nil || bytes.Compare(after, upper) < 0) {
+			upper = after
+		}
+
+		// The key right after the cursor
+		after = append(after, 0)
+		if !desc && bytes.Compare(after, lower) > 0 {
+			lower = after
+		}
+	}
+
+	c := index.Cursor()
+
+	var k, v []byte
+	switch {
+	case !desc && lower == nil:
+		k, v = c.First()
+	case !desc:
+		k, v = c.Seek(lower)
+	case upper == nil:
+		k, v = c.Last()
+	default:
+		k, v = c.Seek(upper)
+		if k == nil {
+			k, v = c.Last()
+		} else {
+			k, v = c.Prev()
+		}
+	}
+
+	for k != nil && (upper == nil || bytes.Compare(k, upper) < 0) && (lower == nil || bytes.Compare(k, lower) >= 0) {
+		more, err := fn(v)
+		if err != nil || !more {
+			return err
+		}
+
+		if desc {
+			k, v = c.Prev()
+		} else {
+			k, v = c.Next()
+		}
+	}
+
+	return nil
+}
+
+func (s *BoltStore) batchResults(tx *bolt.Tx, batch string) ([]structs.Result, error) {
+	ret := []structs.Result{}
+
+	index := tx.Bucket(batchResultsIndex).Bucket([]byte(batch))
+	if index == nil {
+		return ret, nil
+	}
+
+	results := tx.Bucket(resultsBucket)
+
+	err := index.ForEach(func(k, _ []byte) error {
+		var r structs.Result
+
+		err := json.Unmarshal(results.Get(k), &r)
+		if err != nil {
+			return err
+		}
+
+		ret = append(ret, r)
+		return nil
+	})
+
+	return ret, err
+}
+
+// queryResults returns the results that may match the query. They are read
+// from the batch index when the query filters by batch, from the case index
+// when it filters by project, and from the results bucket otherwise.
+func (s *BoltStore) queryResults(tx *bolt.Tx, q store.ResultQuery) ([]structs.Result, error) {
+	if q.Batch != "" {
+		return s.batchResults(tx, q.Batch)
+	}
+
+	if q.Project != "" {
+		return s.caseResults(tx, caseKeyPrefix(q))
+	}
+
+	ret := []structs.Result{}
+	err := tx.Bucket(resultsBucket).ForEach(func(_, v []byte) error {
+		var r structs.Result
+
+		err := json.Unmarshal(v, &r)
+		if err != nil {
+			return err
+		}
+
+		ret = append(ret, r)
+		return nil
+	})
+
+	return ret, err
+}
+
+// caseKeyPrefix returns the prefix of the case keys of the cases matching the
+// query, built from its leading case fields.
+func caseKeyPrefix(q store.ResultQuery) []byte {
+	fields := []string{q.Project}
+	for _, f := range []string{q.Branch, q.Target, q.Browser} {
+		if f == "" {
+			break
+		}
+		fields = append(fields, f)
+	}
+
+	prefix := strings.Join(fields, "|")
+	if len(fields) < 4 {
+		prefix += "|"
+	}
+
+	return []byte(prefix)
+}
+
+// caseResults returns the results of the cases whose key starts with prefix.
+func (s *BoltStore) caseResults(tx *bolt.Tx, prefix []byte) ([]structs.Result, error) {
+	ret := []structs.Result{}
+
+	index := tx.Bucket(caseResultsIndex)
+	results := tx.Bucket(resultsBucket)
+
+	c := index.Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		err := index.Bucket(k).ForEach(func(_, id []byte) error {
+			var r structs.Result
+
+			err := json.Unmarshal(results.Get(id), &r)
+			if err != nil {
+				return err
+			}
+
+			ret = append(ret, r)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return ret, nil
+}
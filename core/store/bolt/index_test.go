@@ -0,0 +1,175 @@
+package bolt
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/theopticians/optician-api/core/store"
+	"github.com/theopticians/optician-api/core/structs"
+)
+
+func TestIndexes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "optician")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "optician.db")
+	s := NewBoltStore(path)
+
+	now := time.Now()
+	results := []structs.Result{
+		{ID: "r1", Project: "p", Branch: "master", Batch: "b1", Target: "home", Browser: "chrome", Timestamp: now},
+		{ID: "r2", Project: "p", Branch: "master", Batch: "b2", Target: "home", Browser: "chrome", DiffScore: 3, Timestamp: now.Add(time.Second)},
+		{ID: "r3", Project: "p", Branch: "master", Batch: "b2", Target: "about", Browser: "chrome", Timestamp: now.Add(2 * time.Second)},
+	}
+
+	for _, r := range results {
+		err = s.StoreResult(r)
+		if err != nil {
+			t.Fatal("Error storing result:", err)
+		}
+	}
+
+	err = s.AppendAudit(structs.AuditEntry{ID: "a1", Timestamp: now, Actor: "admin", Action: "project.create", Project: "p"})
+	if err != nil {
+		t.Fatal("Error appending audit entry:", err)
+	}
+
+	// Moving a result to another batch updates both batches
+	results[0].Batch = "b2"
+	err = s.StoreResult(results[0])
+	if err != nil {
+		t.Fatal("Error storing result:", err)
+	}
+
+	check := func() {
+		last, err := s.GetLastResult("p", "master", "home", "chrome")
+		if err != nil || last.ID != "r2" {
+			t.Fatal("Expected last result to be r2, got", last.ID, err)
+		}
+
+		b2, err := s.GetResultsByBatch("b2")
+		if err != nil || len(b2) != 3 {
+			t.Fatal("Expected 3 results in batch b2, got", len(b2), err)
+		}
+
+		batchs, err := s.GetBatchs()
+		if err != nil || len(batchs) != 1 {
+			t.Fatal("Expected a single batch, got", batchs, err)
+		}
+
+		if batchs[0].ID != "b2" || batchs[0].Failed != 1 || !batchs[0].Timestamp.Equal(results[2].Timestamp) {
+			t.Fatal("Unexpected batch summary", batchs[0])
+		}
+
+		page, err := s.QueryBatchs(store.BatchQuery{Project: "p"})
+		if err != nil || len(page.Batchs) != 1 || page.Batchs[0].ID != "b2" {
+			t.Fatal("Expected the batch to be indexed once at its last timestamp, got", page, err)
+		}
+
+		audit, err := s.QueryAudit(store.AuditQuery{Project: "p"})
+		if err != nil || len(audit.Entries) != 1 || audit.Entries[0].ID != "a1" {
+			t.Fatal("Expected the audit entry to be indexed, got", audit, err)
+		}
+	}
+
+	check()
+
+	// Indexes are rebuilt when missing
+	s.(*BoltStore).db.Update(func(tx *bolt.Tx) error {
+		return tx.DeleteBucket(caseResultsIndex)
+	})
+	s.Close()
+
+	s = NewBoltStore(path)
+	defer s.Close()
+
+	check()
+}
+
+func TestBatchSummaryUpdates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "optician")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := NewBoltStore(filepath.Join(dir, "optician.db"))
+	defer s.Close()
+
+	store := func(r structs.Result) {
+		err := s.StoreResult(r)
+		if err != nil {
+			t.Fatal("Error storing result:", err)
+		}
+	}
+
+	// check checks the summary updated with every stored result against the
+	// one recomputed from the results of the batch.
+	check := func(batch string, failed int, timestamp time.Time) {
+		var info, rebuilt structs.BatchInfo
+		err := s.(*BoltStore).db.Update(func(tx *bolt.Tx) error {
+			var err error
+			info, err = getBatchSummary(tx, batch)
+			if err != nil {
+				return err
+			}
+
+			err = s.(*BoltStore).rebuildBatchSummary(tx, batch)
+			if err != nil {
+				return err
+			}
+
+			rebuilt, err = getBatchSummary(tx, batch)
+			return err
+		})
+
+		if err != nil || info != rebuilt {
+			t.Fatal("Expected the summary of", batch, "to be", rebuilt, "got", info, err)
+		}
+
+		if info.Failed != failed || !info.Timestamp.Equal(timestamp) {
+			t.Fatal("Expected", failed, "failed results in", batch, "at", timestamp, "got", info)
+		}
+	}
+
+	now := time.Now()
+	r1 := structs.Result{ID: "r1", Project: "p", Branch: "master", Batch: "b1", Target: "home", Browser: "chrome", Status: structs.StatusFailed, Timestamp: now}
+	r2 := structs.Result{ID: "r2", Project: "p", Branch: "master", Batch: "b1", Target: "about", Browser: "chrome", Status: structs.StatusPending, Timestamp: now.Add(time.Second)}
+
+	store(r1)
+	store(r2)
+	check("b1", 1, r2.Timestamp)
+
+	r2.Status, r2.DiffScore = structs.StatusDone, 0.5
+	store(r2)
+	r1.Status = structs.StatusDone
+	store(r1)
+	check("b1", 1, r2.Timestamp)
+
+	// The last result gets older, the summary is recomputed
+	r2.Timestamp = now.Add(-time.Second)
+	store(r2)
+	check("b1", 1, r1.Timestamp)
+
+	// The last result moves to another batch
+	r1.Batch = "b2"
+	store(r1)
+	check("b1", 1, r2.Timestamp)
+	check("b2", 0, r1.Timestamp)
+
+	r2.Batch = "b2"
+	store(r2)
+	check("b2", 1, r1.Timestamp)
+
+	batchs, err := s.GetBatchs()
+	if err != nil || len(batchs) != 1 || batchs[0].ID != "b2" {
+		t.Fatal("Expected the summary of the empty batch to be deleted, got", batchs, err)
+	}
+}
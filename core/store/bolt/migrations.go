@@ -0,0 +1,134 @@
+package bolt
+
+import (
+	"strconv"
+
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+	"github.com/theopticians/optician-api/core/store"
+)
+
+var (
+	metaBucket       = []byte("meta")
+	schemaVersionKey = []byte("schemaVersion")
+)
+
+type migration struct {
+	store.Migration
+	up func(s *BoltStore, tx *bolt.Tx) error
+}
+
+// migrations are applied in order, each one in a transaction. Never change a
+// released migration, add a new one instead.
+var migrations = []migration{
+	{store.Migration{Version: 1, Description: "initial buckets"}, func(s *BoltStore, tx *bolt.Tx) error {
+		return createBuckets(tx, resultsBucket, imagesBucket, baseImagesBucket, masksBucket, baseMasksBucket)
+	}},
+	{store.Migration{Version: 2, Description: "batches, jobs, webhooks and comparisons buckets"}, func(s *BoltStore, tx *bolt.Tx) error {
+		return createBuckets(tx, batchesBucket, comparisonsBucket, jobsBucket, webhooksBucket, deliveriesBucket)
+	}},
+	{store.Migration{Version: 3, Description: "result indexes"}, func(s *BoltStore, tx *bolt.Tx) error {
+		return s.rebuildIndexesIfMissing(tx)
+	}},
+	{store.Migration{Version: 4, Description: "projects bucket"}, func(s *BoltStore, tx *bolt.Tx) error {
+		return createBuckets(tx, projectsBucket)
+	}},
+	{store.Migration{Version: 5, Description: "API keys bucket"}, func(s *BoltStore, tx *bolt.Tx) error {
+		return createBuckets(tx, apiKeysBucket)
+	}},
+	{store.Migration{Version: 6, Description: "audit log bucket"}, func(s *BoltStore, tx *bolt.Tx) error {
+		return createBuckets(tx, auditBucket)
+	}},
+	// Comparisons are a cache, the ones keyed without comparator settings
+	// are dropped rather than migrated.
+	{store.Migration{Version: 7, Description: "comparator settings of comparisons"}, func(s *BoltStore, tx *bolt.Tx) error {
+		err := tx.DeleteBucket(comparisonsBucket)
+		if err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+
+		return createBuckets(tx, comparisonsBucket)
+	}},
+}
+
+func createBuckets(tx *bolt.Tx, buckets ...[]byte) error {
+	for _, b := range buckets {
+		_, err := tx.CreateBucketIfNotExists(b)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *BoltStore) SchemaVersion() (int, error) {
+	version := 0
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		version, err = schemaVersion(tx)
+		return err
+	})
+
+	return version, err
+}
+
+func schemaVersion(tx *bolt.Tx) (int, error) {
+	meta := tx.Bucket(metaBucket)
+	if meta == nil {
+		return 0, nil
+	}
+
+	v := meta.Get(schemaVersionKey)
+	if v == nil {
+		return 0, nil
+	}
+
+	return strconv.Atoi(string(v))
+}
+
+func (s *BoltStore) PendingMigrations() ([]store.Migration, error) {
+	version, err := s.SchemaVersion()
+	if err != nil {
+		return nil, err
+	}
+
+	pending := []store.Migration{}
+	for _, m := range migrations {
+		if m.Version > version {
+			pending = append(pending, m.Migration)
+		}
+	}
+
+	return pending, nil
+}
+
+func (s *BoltStore) Migrate() error {
+	for _, m := range migrations {
+		err := s.db.Update(func(tx *bolt.Tx) error {
+			version, err := schemaVersion(tx)
+			if err != nil || m.Version <= version {
+				return err
+			}
+
+			err = m.up(s, tx)
+			if err != nil {
+				return err
+			}
+
+			meta, err := tx.CreateBucketIfNotExists(metaBucket)
+			if err != nil {
+				return err
+			}
+
+			return meta.Put(schemaVersionKey, []byte(strconv.Itoa(m.Version)))
+		})
+
+		if err != nil {
+			return errors.Wrapf(err, "error applying migration %d (%s)", m.Version, m.Description)
+		}
+	}
+
+	// Indexes are derived data, rebuild them if they were lost
+	return s.db.Update(s.rebuildIndexesIfMissing)
+}
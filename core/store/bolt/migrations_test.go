@@ -0,0 +1,52 @@
+package bolt
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMigrate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "optician")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := OpenBoltStore(filepath.Join(dir, "optician.db"))
+	if err != nil {
+		t.Fatal("Error opening store:", err)
+	}
+	defer s.Close()
+
+	pending, err := s.PendingMigrations()
+	if err != nil {
+		t.Fatal("Error getting pending migrations:", err)
+	}
+
+	if len(pending) != len(migrations) {
+		t.Fatal("Expected all migrations to be pending on a new store, got", pending)
+	}
+
+	err = s.Migrate()
+	if err != nil {
+		t.Fatal("Error migrating:", err)
+	}
+
+	version, err := s.SchemaVersion()
+	if err != nil || version != migrations[len(migrations)-1].Version {
+		t.Fatal("Expected schema version to be the last migration, got", version, err)
+	}
+
+	// Migrating is idempotent
+	err = s.Migrate()
+	if err != nil {
+		t.Fatal("Error migrating twice:", err)
+	}
+
+	pending, err = s.PendingMigrations()
+	if err != nil || len(pending) != 0 {
+		t.Fatal("Expected no pending migrations, got", pending, err)
+	}
+}
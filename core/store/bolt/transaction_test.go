@@ -0,0 +1,87 @@
+package bolt
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/theopticians/optician-api/core/store"
+	"github.com/theopticians/optician-api/core/structs"
+)
+
+func TestTransaction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "optician")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := NewBoltStore(filepath.Join(dir, "optician.db"))
+	defer s.Close()
+
+	r := structs.Result{ID: "r1", Project: "p", Branch: "master", Batch: "b1", Target: "home", Browser: "chrome", Timestamp: time.Now()}
+	j := structs.Job{ID: "j1", ResultID: "r1", CreatedAt: time.Now()}
+
+	// A failing transaction stores nothing
+	fail := errors.New("fail")
+	err = s.Transaction(func(tx store.Store) error {
+		err := tx.StoreResult(r)
+		if err != nil {
+			return err
+		}
+
+		// Reads see the writes of the transaction
+		_, err = tx.GetResult("r1")
+		if err != nil {
+			t.Fatal("Expected to read result in transaction, got", err)
+		}
+
+		err = tx.StoreJob(j)
+		if err != nil {
+			return err
+		}
+
+		return fail
+	})
+	if err != fail {
+		t.Fatal("Expected transaction error, got", err)
+	}
+
+	_, err = s.GetResult("r1")
+	if err != store.NotFoundError {
+		t.Fatal("Expected result to be rolled back, got", err)
+	}
+
+	jobs, err := s.GetJobs()
+	if err != nil || len(jobs) != 0 {
+		t.Fatal("Expected job to be rolled back, got", jobs, err)
+	}
+
+	// A nested transaction is part of the outer one
+	err = s.Transaction(func(tx store.Store) error {
+		err := tx.Transaction(func(tx store.Store) error {
+			return tx.StoreResult(r)
+		})
+		if err != nil {
+			return err
+		}
+
+		return tx.StoreJob(j)
+	})
+	if err != nil {
+		t.Fatal("Error running transaction:", err)
+	}
+
+	_, err = s.GetResult("r1")
+	if err != nil {
+		t.Fatal("Expected result to be committed, got", err)
+	}
+
+	jobs, err = s.GetJobs()
+	if err != nil || len(jobs) != 1 {
+		t.Fatal("Expected job to be committed, got", jobs, err)
+	}
+}
@@ -13,3 +13,12 @@ func RandStringBytes(n int) string {
 	}
 	return string(b)
 }
+
+func idSet(ids []string) map[string]bool {
+	set := map[string]bool{}
+	for _, id := range ids {
+		set[id] = true
+	}
+
+	return set
+}
@@ -0,0 +1,107 @@
+// Package files stores images as PNG files in a directory, to keep them out
+// of the database.
+package files
+
+import (
+	"image"
+	"image/png"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/theopticians/optician-api/core/store"
+)
+
+type ImageStore struct {
+	dir string
+}
+
+// NewImageStore returns a store keeping images in dir, creating it if it
+// doesn't exist.
+func NewImageStore(dir string) (*ImageStore, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ImageStore{dir: dir}, nil
+}
+
+func (s *ImageStore) GetImage(id string) (image.Image, error) {
+	f, err := os.Open(s.path(id))
+	if os.IsNotExist(err) {
+		return nil, store.NotFoundError
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	img, _, err := image.Decode(f)
+
+	return img, err
+}
+
+// StoreImage writes the image to a temporary file renamed once complete, so
+// readers never see a partial image.
+func (s *ImageStore) StoreImage(img image.Image) (string, error) {
+	id := randString(10)
+
+	f, err := ioutil.TempFile(s.dir, ".tmp-")
+	if err != nil {
+		return "", err
+	}
+
+	err = png.Encode(f, img)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+
+	err = os.Rename(f.Name(), s.path(id))
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+
+	return id, nil
+}
+
+// DeleteImage deletes the file of the image, if it exists.
+func (s *ImageStore) DeleteImage(id string) error {
+	err := os.Remove(s.path(id))
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
+
+// path returns the file of the image. IDs are random letters, so they're safe
+// to use as file names.
+func (s *ImageStore) path(id string) string {
+	return filepath.Join(s.dir, filepath.Base(id)+".png")
+}
+
+const letterBytes = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+var (
+	randMu sync.Mutex
+	random = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+func randString(n int) string {
+	randMu.Lock()
+	defer randMu.Unlock()
+
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = letterBytes[random.Intn(len(letterBytes))]
+	}
+	return string(b)
+}
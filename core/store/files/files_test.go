@@ -0,0 +1,61 @@
+package files
+
+import (
+	"image"
+	"image/color"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/theopticians/optician-api/core/store"
+)
+
+func TestImageStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "optician-images")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := NewImageStore(dir)
+	if err != nil {
+		t.Fatal("Error opening image store:", err)
+	}
+
+	img := image.NewNRGBA(image.Rect(0, 0, 2, 2))
+	img.Set(1, 1, color.NRGBA{R: 0xff, A: 0xff})
+
+	id, err := s.StoreImage(img)
+	if err != nil {
+		t.Fatal("Error storing image:", err)
+	}
+
+	retrieved, err := s.GetImage(id)
+	if err != nil {
+		t.Fatal("Error getting image:", err)
+	}
+
+	if retrieved.Bounds() != img.Bounds() || retrieved.At(1, 1) != img.At(1, 1) {
+		t.Fatal("Retrieved image is not equal to original")
+	}
+
+	_, err = s.GetImage("missing")
+	if err != store.NotFoundError {
+		t.Fatal("Expected not found error getting missing image, got", err)
+	}
+
+	err = s.DeleteImage(id)
+	if err != nil {
+		t.Fatal("Error deleting image:", err)
+	}
+
+	_, err = s.GetImage(id)
+	if err != store.NotFoundError {
+		t.Fatal("Expected not found error getting deleted image, got", err)
+	}
+
+	err = s.DeleteImage(id)
+	if err != nil {
+		t.Fatal("Expected deleting a missing image to succeed, got", err)
+	}
+}
@@ -0,0 +1,699 @@
+// Package memory implements a store.Store keeping everything in memory, for
+// tests and ephemeral runs.
+package memory
+
+import (
+	"image"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/theopticians/optician-api/core/store"
+	"github.com/theopticians/optician-api/core/structs"
+)
+
+const (
+	imagesBucket      = "images"
+	resultsBucket     = "results"
+	baseImagesBucket  = "baseImages"
+	baseMasksBucket   = "baseMasks"
+	masksBucket       = "masks"
+	batchesBucket     = "batches"
+	comparisonsBucket = "comparisons"
+	jobsBucket        = "jobs"
+	webhooksBucket    = "webhooks"
+	projectsBucket    = "projects"
+	apiKeysBucket     = "apiKeys"
+	deliveriesBucket  = "deliveries"
+	auditBucket       = "audit"
+)
+
+// MemoryStore keeps values by key in buckets, like the Bolt store, without
+// encoding them. It's safe for concurrent use.
+type MemoryStore struct {
+	mu      *sync.RWMutex
+	buckets map[string]map[string]interface{}
+
+	// undo is set on the stores handed out by Transaction, which hold the
+	// write lock. It restores the values overwritten by the transaction.
+	undo *[]func()
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		mu:      &sync.RWMutex{},
+		buckets: map[string]map[string]interface{}{},
+	}
+}
+
+func (s *MemoryStore) Close() {}
+
+// The store has no schema, there is nothing to migrate.
+
+func (s *MemoryStore) SchemaVersion() (int, error) {
+	return 0, nil
+}
+
+func (s *MemoryStore) PendingMigrations() ([]store.Migration, error) {
+	return []store.Migration{}, nil
+}
+
+func (s *MemoryStore) Migrate() error {
+	return nil
+}
+
+// Transaction runs fn with the write lock held, undoing its writes if it
+// returns an error.
+func (s *MemoryStore) Transaction(fn func(store.Store) error) error {
+	if s.undo != nil {
+		return fn(s)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	undo := []func(){}
+	err := fn(&MemoryStore{mu: s.mu, buckets: s.buckets, undo: &undo})
+	if err != nil {
+		for i := len(undo) - 1; i >= 0; i-- {
+			undo[i]()
+		}
+	}
+
+	return err
+}
+
+func (s *MemoryStore) read(fn func()) {
+	if s.undo == nil {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+	}
+	fn()
+}
+
+func (s *MemoryStore) write(fn func()) {
+	if s.undo == nil {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+	}
+	fn()
+}
+
+// get, put and remove must be called from read or write.
+
+func (s *MemoryStore) get(bucket, key string) (interface{}, bool) {
+	v, ok := s.buckets[bucket][key]
+	return v, ok
+}
+
+func (s *MemoryStore) put(bucket, key string, value interface{}) {
+	s.set(bucket, key, value, true)
+}
+
+func (s *MemoryStore) remove(bucket, key string) {
+	s.set(bucket, key, nil, false)
+}
+
+func (s *MemoryStore) set(bucket, key string, value interface{}, exists bool) {
+	b, ok := s.buckets[bucket]
+	if !ok {
+		b = map[string]interface{}{}
+		s.buckets[bucket] = b
+	}
+
+	if s.undo != nil {
+		old, existed := b[key]
+		*s.undo = append(*s.undo, func() {
+			if existed {
+				b[key] = old
+			} else {
+				delete(b, key)
+			}
+		})
+	}
+
+	if exists {
+		b[key] = value
+	} else {
+		delete(b, key)
+	}
+}
+
+func (s *MemoryStore) getValue(bucket, key string) (interface{}, error) {
+	var v interface{}
+	var ok bool
+	s.read(func() { v, ok = s.get(bucket, key) })
+
+	if !ok {
+		return nil, store.NotFoundError
+	}
+
+	return v, nil
+}
+
+func (s *MemoryStore) getString(bucket, key string) (string, error) {
+	v, err := s.getValue(bucket, key)
+	if err != nil {
+		return "", err
+	}
+
+	return v.(string), nil
+}
+
+func (s *MemoryStore) putValue(bucket, key string, value interface{}) error {
+	s.write(func() { s.put(bucket, key, value) })
+	return nil
+}
+
+func caseKey(projectID, branch, target, browser string) string {
+	return projectID + "|" + branch + "|" + target + "|" + browser
+}
+
+func (s *MemoryStore) results(match func(structs.Result) bool) []structs.Result {
+	ret := []structs.Result{}
+	s.read(func() {
+		for _, v := range s.buckets[resultsBucket] {
+			r := v.(structs.Result)
+			if match(r) {
+				ret = append(ret, r)
+			}
+		}
+	})
+
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Timestamp.After(ret[j].Timestamp) })
+
+	return ret
+}
+
+func (s *MemoryStore) GetResults() ([]structs.Result, error) {
+	return s.results(func(structs.Result) bool { return true }), nil
+}
+
+func (s *MemoryStore) GetResultsByBatch(batch string) ([]structs.Result, error) {
+	return s.results(func(r structs.Result) bool { return r.Batch == batch }), nil
+}
+
+func (s *MemoryStore) QueryResults(q store.ResultQuery) (store.ResultPage, error) {
+	return store.PageResults(s.results(q.Matches), q)
+}
+
+func (s *MemoryStore) GetResult(id string) (structs.Result, error) {
+	v, err := s.getValue(resultsBucket, id)
+	if err != nil {
+		return structs.Result{}, err
+	}
+
+	return v.(structs.Result), nil
+}
+
+func (s *MemoryStore) GetLastResult(projectID, branch, target, browser string) (structs.Result, error) {
+	results := s.results(func(r structs.Result) bool {
+		return r.Project == projectID && r.Branch == branch && r.Target == target && r.Browser == browser
+	})
+
+	if len(results) == 0 {
+		return structs.Result{}, store.NotFoundError
+	}
+
+	return results[0], nil
+}
+
+func (s *MemoryStore) StoreResult(r structs.Result) error {
+	return s.putValue(resultsBucket, r.ID, r)
+}
+
+func (s *MemoryStore) AcceptResults(results []structs.Result) error {
+	s.write(func() {
+		for _, r := range results {
+			s.put(resultsBucket, r.ID, r)
+			s.put(baseImagesBucket, caseKey(r.Project, r.Branch, r.Target, r.Browser), r.ImageID)
+		}
+	})
+
+	return nil
+}
+
+func (s *MemoryStore) GetJobs() ([]structs.Job, error) {
+	ret := []structs.Job{}
+	s.read(func() {
+		for _, v := range s.buckets[jobsBucket] {
+			ret = append(ret, v.(structs.Job))
+		}
+	})
+
+	sort.Slice(ret, func(i, j int) bool { return ret[i].CreatedAt.Before(ret[j].CreatedAt) })
+
+	return ret, nil
+}
+
+func (s *MemoryStore) StoreJob(j structs.Job) error {
+	return s.putValue(jobsBucket, j.ID, j)
+}
+
+func (s *MemoryStore) DeleteJob(id string) error {
+	s.write(func() { s.remove(jobsBucket, id) })
+	return nil
+}
+
+func (s *MemoryStore) GetBatchs() ([]structs.BatchInfo, error) {
+	byID := map[string]*structs.BatchInfo{}
+	for _, r := range s.results(func(structs.Result) bool { return true }) {
+		info, ok := byID[r.Batch]
+		if !ok {
+			// Results are sorted by timestamp, the first one is the last
+			info = &structs.BatchInfo{ID: r.Batch, Timestamp: r.Timestamp, Project: r.Project}
+			byID[r.Batch] = info
+		}
+
+		if r.Failed() {
+			info.Failed++
+		}
+	}
+
+	ret := []structs.BatchInfo{}
+	for _, info := range byID {
+		ret = append(ret, *info)
+	}
+
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Timestamp.After(ret[j].Timestamp) })
+
+	return ret, nil
+}
+
+func (s *MemoryStore) QueryBatchs(q store.BatchQuery) (store.BatchPage, error) {
+	all, err := s.GetBatchs()
+	if err != nil {
+		return store.BatchPage{}, err
+	}
+
+	batchs := []structs.BatchInfo{}
+	for _, b := range all {
+		if q.Matches(b) {
+			batchs = append(batchs, b)
+		}
+	}
+
+	return store.PageBatchs(batchs, q)
+}
+
+func (s *MemoryStore) GetBatch(id string) (structs.Batch, error) {
+	v, err := s.getValue(batchesBucket, id)
+	if err != nil {
+		return structs.Batch{}, err
+	}
+
+	return v.(structs.Batch), nil
+}
+
+func (s *MemoryStore) StoreBatch(b structs.Batch) error {
+	return s.putValue(batchesBucket, b.ID, b)
+}
+
+func (s *MemoryStore) DeleteBatch(id string) error {
+	s.write(func() {
+		s.remove(batchesBucket, id)
+
+		for k, v := range s.buckets[resultsBucket] {
+			if v.(structs.Result).Batch == id {
+				s.remove(resultsBucket, k)
+			}
+		}
+	})
+
+	return nil
+}
+
+func (s *MemoryStore) GetLastFinalizedBatch(projectID, branch string) (structs.Batch, error) {
+	ret := structs.Batch{}
+	s.read(func() {
+		for _, v := range s.buckets[batchesBucket] {
+			b := v.(structs.Batch)
+			if b.Project == projectID && b.Branch == branch && b.Finalized() {
+				if !ret.Finalized() || b.FinalizedAt.After(*ret.FinalizedAt) {
+					ret = b
+				}
+			}
+		}
+	})
+
+	if !ret.Finalized() {
+		return ret, store.NotFoundError
+	}
+
+	return ret, nil
+}
+
+func (s *MemoryStore) GetOpenBatches() ([]structs.Batch, error) {
+	ret := []structs.Batch{}
+	s.read(func() {
+		for _, v := range s.buckets[batchesBucket] {
+			b := v.(structs.Batch)
+			if !b.Finalized() {
+				ret = append(ret, b)
+			}
+		}
+	})
+
+	return ret, nil
+}
+
+func (s *MemoryStore) GetEmptyBatches() ([]structs.Batch, error) {
+	ret := []structs.Batch{}
+	s.read(func() {
+		withResults := map[string]bool{}
+		for _, v := range s.buckets[resultsBucket] {
+			withResults[v.(structs.Result).Batch] = true
+		}
+
+		for _, v := range s.buckets[batchesBucket] {
+			b := v.(structs.Batch)
+			if !withResults[b.ID] {
+				ret = append(ret, b)
+			}
+		}
+	})
+
+	return ret, nil
+}
+
+func (s *MemoryStore) GetMask(id string) (structs.Mask, error) {
+	v, err := s.getValue(masksBucket, id)
+	if err != nil {
+		return nil, err
+	}
+
+	return v.(structs.Mask), nil
+}
+
+func (s *MemoryStore) StoreMask(mask structs.Mask) (string, error) {
+	id := randString(10)
+	return id, s.putValue(masksBucket, id, append(structs.Mask{}, mask...))
+}
+
+func (s *MemoryStore) GetProjects() ([]structs.Project, error) {
+	ret := []structs.Project{}
+	s.read(func() {
+		for _, v := range s.buckets[projectsBucket] {
+			ret = append(ret, v.(structs.Project))
+		}
+	})
+
+	sort.Slice(ret, func(i, j int) bool { return ret[i].ID < ret[j].ID })
+
+	return ret, nil
+}
+
+func (s *MemoryStore) GetProject(id string) (structs.Project, error) {
+	v, err := s.getValue(projectsBucket, id)
+	if err != nil {
+		return structs.Project{}, err
+	}
+
+	return v.(structs.Project), nil
+}
+
+func (s *MemoryStore) StoreProject(p structs.Project) error {
+	return s.putValue(projectsBucket, p.ID, p)
+}
+
+func (s *MemoryStore) DeleteProject(id string) error {
+	var ok bool
+	s.write(func() {
+		_, ok = s.get(projectsBucket, id)
+		if ok {
+			s.remove(projectsBucket, id)
+		}
+	})
+
+	if !ok {
+		return store.NotFoundError
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) GetAPIKeys(projectID string) ([]structs.APIKey, error) {
+	ret := []structs.APIKey{}
+	s.read(func() {
+		for _, v := range s.buckets[apiKeysBucket] {
+			k := v.(structs.APIKey)
+			if k.Project == projectID {
+				ret = append(ret, k)
+			}
+		}
+	})
+
+	sort.Slice(ret, func(i, j int) bool { return ret[i].CreatedAt.Before(ret[j].CreatedAt) })
+
+	return ret, nil
+}
+
+func (s *MemoryStore) GetAPIKey(id string) (structs.APIKey, error) {
+	v, err := s.getValue(apiKeysBucket, id)
+	if err != nil {
+		return structs.APIKey{}, err
+	}
+
+	return v.(structs.APIKey), nil
+}
+
+func (s *MemoryStore) StoreAPIKey(k structs.APIKey) error {
+	return s.putValue(apiKeysBucket, k.ID, k)
+}
+
+func (s *MemoryStore) DeleteAPIKey(id string) error {
+	var ok bool
+	s.write(func() {
+		_, ok = s.get(apiKeysBucket, id)
+		if ok {
+			s.remove(apiKeysBucket, id)
+		}
+	})
+
+	if !ok {
+		return store.NotFoundError
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) AppendAudit(e structs.AuditEntry) error {
+	return s.putValue(auditBucket, e.ID, e)
+}
+
+func (s *MemoryStore) QueryAudit(q store.AuditQuery) (store.AuditPage, error) {
+	entries := []structs.AuditEntry{}
+	s.read(func() {
+		for _, v := range s.buckets[auditBucket] {
+			e := v.(structs.AuditEntry)
+			if q.Matches(e) {
+				entries = append(entries, e)
+			}
+		}
+	})
+
+	return store.PageAudit(entries, q)
+}
+
+func (s *MemoryStore) GetWebhooks(projectID string) ([]structs.Webhook, error) {
+	ret := []structs.Webhook{}
+	s.read(func() {
+		for _, v := range s.buckets[webhooksBucket] {
+			w := v.(structs.Webhook)
+			if w.Project == projectID {
+				ret = append(ret, w)
+			}
+		}
+	})
+
+	sort.Slice(ret, func(i, j int) bool { return ret[i].CreatedAt.Before(ret[j].CreatedAt) })
+
+	return ret, nil
+}
+
+func (s *MemoryStore) GetWebhook(id string) (structs.Webhook, error) {
+	v, err := s.getValue(webhooksBucket, id)
+	if err != nil {
+		return structs.Webhook{}, err
+	}
+
+	return v.(structs.Webhook), nil
+}
+
+func (s *MemoryStore) StoreWebhook(w structs.Webhook) error {
+	return s.putValue(webhooksBucket, w.ID, w)
+}
+
+func (s *MemoryStore) DeleteWebhook(id string) error {
+	var ok bool
+	s.write(func() {
+		_, ok = s.get(webhooksBucket, id)
+		if ok {
+			s.remove(webhooksBucket, id)
+		}
+	})
+
+	if !ok {
+		return store.NotFoundError
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) deliveries(match func(structs.Delivery) bool) []structs.Delivery {
+	ret := []structs.Delivery{}
+	s.read(func() {
+		for _, v := range s.buckets[deliveriesBucket] {
+			d := v.(structs.Delivery)
+			if match(d) {
+				ret = append(ret, d)
+			}
+		}
+	})
+
+	return ret
+}
+
+func (s *MemoryStore) GetDeliveries(webhookID string) ([]structs.Delivery, error) {
+	ret := s.deliveries(func(d structs.Delivery) bool { return d.WebhookID == webhookID })
+
+	sort.Slice(ret, func(i, j int) bool { return ret[i].CreatedAt.After(ret[j].CreatedAt) })
+
+	return ret, nil
+}
+
+func (s *MemoryStore) GetDueDeliveries(now time.Time) ([]structs.Delivery, error) {
+	ret := s.deliveries(func(d structs.Delivery) bool {
+		return d.Status == structs.DeliveryPending && !d.NextAttempt.After(now)
+	})
+
+	sort.Slice(ret, func(i, j int) bool { return ret[i].CreatedAt.Before(ret[j].CreatedAt) })
+
+	return ret, nil
+}
+
+func (s *MemoryStore) StoreDelivery(d structs.Delivery) error {
+	return s.putValue(deliveriesBucket, d.ID, d)
+}
+
+func (s *MemoryStore) GetComparison(baseImageID, imageID, maskID, settings string) (structs.Comparison, error) {
+	v, err := s.getValue(comparisonsBucket, baseImageID+"|"+imageID+"|"+maskID+"|"+settings)
+	if err != nil {
+		return structs.Comparison{}, err
+	}
+
+	return v.(structs.Comparison), nil
+}
+
+func (s *MemoryStore) StoreComparison(c structs.Comparison) error {
+	return s.putValue(comparisonsBucket, c.BaseImageID+"|"+c.ImageID+"|"+c.MaskID+"|"+c.Settings, c)
+}
+
+func (s *MemoryStore) DeleteComparisons(imageIDs []string) ([]string, error) {
+	images := idSet(imageIDs)
+	diffs := []string{}
+
+	s.write(func() {
+		for k, v := range s.buckets[comparisonsBucket] {
+			c := v.(structs.Comparison)
+			if images[c.BaseImageID] || images[c.ImageID] {
+				diffs = append(diffs, c.DiffImageID)
+				s.remove(comparisonsBucket, k)
+			}
+		}
+	})
+
+	return diffs, nil
+}
+
+// Images are stored as they are, callers must not modify them afterwards.
+
+func (s *MemoryStore) GetImage(id string) (image.Image, error) {
+	v, err := s.getValue(imagesBucket, id)
+	if err != nil {
+		return nil, err
+	}
+
+	return v.(image.Image), nil
+}
+
+func (s *MemoryStore) StoreImage(img image.Image) (string, error) {
+	id := randString(10)
+	return id, s.putValue(imagesBucket, id, img)
+}
+
+func (s *MemoryStore) DeleteImage(id string) error {
+	s.write(func() { s.remove(imagesBucket, id) })
+	return nil
+}
+
+func (s *MemoryStore) ReferencedImages(ids []string) (map[string]bool, error) {
+	images := idSet(ids)
+	ret := map[string]bool{}
+
+	s.read(func() {
+		for _, v := range s.buckets[resultsBucket] {
+			r := v.(structs.Result)
+			for _, id := range []string{r.ImageID, r.BaseImageID, r.DiffImageID} {
+				if images[id] {
+					ret[id] = true
+				}
+			}
+		}
+
+		for _, v := range s.buckets[baseImagesBucket] {
+			if id := v.(string); images[id] {
+				ret[id] = true
+			}
+		}
+	})
+
+	return ret, nil
+}
+
+func idSet(ids []string) map[string]bool {
+	set := map[string]bool{}
+	for _, id := range ids {
+		set[id] = true
+	}
+
+	return set
+}
+
+func (s *MemoryStore) GetBaseImageID(projectID, branch, target, browser string) (string, error) {
+	return s.getString(baseImagesBucket, caseKey(projectID, branch, target, browser))
+}
+
+func (s *MemoryStore) SetBaseImageID(baseImageID, projectID, branch, target, browser string) error {
+	return s.putValue(baseImagesBucket, caseKey(projectID, branch, target, browser), baseImageID)
+}
+
+func (s *MemoryStore) GetBaseImageCases(projectID, branch string) ([]structs.CaseKey, error) {
+	ret := []structs.CaseKey{}
+	prefix := projectID + "|" + branch + "|"
+	s.read(func() {
+		for k := range s.buckets[baseImagesBucket] {
+			if !strings.HasPrefix(k, prefix) {
+				continue
+			}
+
+			parts := strings.SplitN(k[len(prefix):], "|", 2)
+			if len(parts) != 2 {
+				continue
+			}
+
+			ret = append(ret, structs.CaseKey{Project: projectID, Target: parts[0], Browser: parts[1]})
+		}
+	})
+
+	return ret, nil
+}
+
+func (s *MemoryStore) GetBaseMaskID(projectID, branch, target, browser string) (string, error) {
+	return s.getString(baseMasksBucket, caseKey(projectID, branch, target, browser))
+}
+
+func (s *MemoryStore) SetBaseMaskID(baseMaskID, projectID, branch, target, browser string) error {
+	return s.putValue(baseMasksBucket, caseKey(projectID, branch, target, browser), baseMaskID)
+}
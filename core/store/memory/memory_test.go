@@ -0,0 +1,14 @@
+package memory
+
+import (
+	"testing"
+
+	"github.com/theopticians/optician-api/core/store"
+	"github.com/theopticians/optician-api/core/store/storetest"
+)
+
+func TestMemoryStore(t *testing.T) {
+	storetest.GenericTestStore(t, func() store.Store {
+		return NewMemoryStore()
+	})
+}
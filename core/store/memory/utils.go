@@ -0,0 +1,27 @@
+package memory
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const letterBytes = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+// The store is used concurrently, so IDs can't come from a source seeded on
+// every call.
+var (
+	randMu sync.Mutex
+	random = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+func randString(n int) string {
+	randMu.Lock()
+	defer randMu.Unlock()
+
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = letterBytes[random.Intn(len(letterBytes))]
+	}
+	return string(b)
+}
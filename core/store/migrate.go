@@ -0,0 +1,15 @@
+package store
+
+// Migration is a versioned change to the schema of a store.
+type Migration struct {
+	Version     int    `json:"version"`
+	Description string `json:"description"`
+}
+
+// Migrator applies the migrations of a store in order, recording the version
+// of the last one applied.
+type Migrator interface {
+	SchemaVersion() (int, error)
+	PendingMigrations() ([]Migration, error)
+	Migrate() error
+}
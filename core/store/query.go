@@ -0,0 +1,446 @@
+package store
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/theopticians/optician-api/core/structs"
+)
+
+const (
+	DefaultLimit = 100
+	MaxLimit     = 1000
+)
+
+// QueryError is returned for invalid queries, like an unknown sort key or a
+// malformed cursor.
+type QueryError struct {
+	msg string
+}
+
+func (e QueryError) Error() string {
+	return e.msg
+}
+
+// ResultQuery filters, sorts and paginates results. Empty fields match
+// everything. Sort is a sort key, prefixed with - for descending order.
+type ResultQuery struct {
+	Project  string
+	Branch   string
+	Batch    string
+	Target   string
+	Browser  string
+	Status   string
+	MinScore *float64
+	MaxScore *float64
+	Since    time.Time
+	Until    time.Time
+	Sort     string
+	Cursor   string
+	Limit    int
+}
+
+type ResultPage struct {
+	Results []structs.Result `json:"results"`
+	Next    string           `json:"next"`
+}
+
+// BatchQuery filters, sorts and paginates batchs, like ResultQuery.
+type BatchQuery struct {
+	Project string
+	Since   time.Time
+	Until   time.Time
+	Sort    string
+	Cursor  string
+	Limit   int
+}
+
+type BatchPage struct {
+	Batchs []structs.BatchInfo `json:"batchs"`
+	Next   string              `json:"next"`
+}
+
+// AuditQuery filters and paginates the audit log, like ResultQuery. Entries
+// can only be sorted by timestamp.
+type AuditQuery struct {
+	Project string
+	Batch   string
+	Result  string
+	Object  string
+	Actor   string
+	Action  string
+	Since   time.Time
+	Until   time.Time
+	Sort    string
+	Cursor  string
+	Limit   int
+}
+
+type AuditPage struct {
+	Entries []structs.AuditEntry `json:"entries"`
+	Next    string               `json:"next"`
+}
+
+// Sort keys and the type of their values.
+const (
+	stringKey = iota
+	floatKey
+	intKey
+	timeKey
+)
+
+var ResultSortKeys = map[string]int{
+	"timestamp": timeKey,
+	"diffscore": floatKey,
+	"project":   stringKey,
+	"batch":     stringKey,
+	"target":    stringKey,
+	"browser":   stringKey,
+}
+
+var BatchSortKeys = map[string]int{
+	"timestamp": timeKey,
+	"failed":    intKey,
+	"project":   stringKey,
+	"id":        stringKey,
+}
+
+var AuditSortKeys = map[string]int{
+	"timestamp": timeKey,
+}
+
+// Cursor is the position after which a page starts: the sort value and ID of
+// the last element of the previous page.
+type Cursor struct {
+	Value interface{}
+	ID    string
+}
+
+// Sort parses a sort parameter into its key and direction, defaulting to the
+// newest first.
+func Sort(s string, keys map[string]int) (key string, desc bool, err error) {
+	if s == "" {
+		return "timestamp", true, nil
+	}
+
+	desc = strings.HasPrefix(s, "-")
+	key = strings.TrimPrefix(s, "-")
+
+	if _, ok := keys[key]; !ok {
+		return "", false, QueryError{"Unknown sort key " + key}
+	}
+
+	return key, desc, nil
+}
+
+// Limit returns the page size of a query limit.
+func Limit(limit int) int {
+	if limit <= 0 {
+		return DefaultLimit
+	}
+	if limit > MaxLimit {
+		return MaxLimit
+	}
+	return limit
+}
+
+func EncodeCursor(value interface{}, id string) string {
+	var v string
+	switch t := value.(type) {
+	case string:
+		v = t
+	case float64:
+		v = strconv.FormatFloat(t, 'g', -1, 64)
+	case int:
+		v = strconv.Itoa(t)
+	case time.Time:
+		v = t.UTC().Format(time.RFC3339Nano)
+	}
+
+	b, _ := json.Marshal([]string{v, id})
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// DecodeCursor decodes a cursor, parsing its value with the type of the sort
+// key. An empty cursor returns nil.
+func DecodeCursor(s, key string, keys map[string]int) (*Cursor, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	invalid := QueryError{"Invalid cursor " + s}
+
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, invalid
+	}
+
+	var parts []string
+	if json.Unmarshal(b, &parts) != nil || len(parts) != 2 {
+		return nil, invalid
+	}
+
+	c := &Cursor{ID: parts[1]}
+
+	switch keys[key] {
+	case stringKey:
+		c.Value = parts[0]
+	case floatKey:
+		c.Value, err = strconv.ParseFloat(parts[0], 64)
+	case intKey:
+		c.Value, err = strconv.Atoi(parts[0])
+	case timeKey:
+		c.Value, err = time.Parse(time.RFC3339Nano, parts[0])
+	}
+
+	if err != nil {
+		return nil, invalid
+	}
+
+	return c, nil
+}
+
+// ResultSortValue returns the value of the result for a sort key.
+func ResultSortValue(r structs.Result, key string) interface{} {
+	switch key {
+	case "diffscore":
+		return r.DiffScore
+	case "project":
+		return r.Project
+	case "batch":
+		return r.Batch
+	case "target":
+		return r.Target
+	case "browser":
+		return r.Browser
+	}
+	return r.Timestamp
+}
+
+// BatchSortValue returns the value of the batch for a sort key.
+func BatchSortValue(b structs.BatchInfo, key string) interface{} {
+	switch key {
+	case "failed":
+		return b.Failed
+	case "project":
+		return b.Project
+	case "id":
+		return b.ID
+	}
+	return b.Timestamp
+}
+
+// Matches reports whether the result matches the filters of the query.
+func (q ResultQuery) Matches(r structs.Result) bool {
+	if (q.Project != "" && r.Project != q.Project) ||
+		(q.Branch != "" && r.Branch != q.Branch) ||
+		(q.Batch != "" && r.Batch != q.Batch) ||
+		(q.Target != "" && r.Target != q.Target) ||
+		(q.Browser != "" && r.Browser != q.Browser) {
+		return false
+	}
+
+	if q.Status != "" {
+		status := r.Status
+		if status == "" {
+			status = structs.StatusDone
+		}
+		if status != q.Status {
+			return false
+		}
+	}
+
+	if (q.MinScore != nil && r.DiffScore < *q.MinScore) || (q.MaxScore != nil && r.DiffScore > *q.MaxScore) {
+		return false
+	}
+
+	return inRange(r.Timestamp, q.Since, q.Until)
+}
+
+// Matches reports whether the batch matches the filters of the query.
+func (q BatchQuery) Matches(b structs.BatchInfo) bool {
+	if q.Project != "" && b.Project != q.Project {
+		return false
+	}
+
+	return inRange(b.Timestamp, q.Since, q.Until)
+}
+
+// Matches reports whether the audit entry matches the filters of the query.
+func (q AuditQuery) Matches(e structs.AuditEntry) bool {
+	if (q.Project != "" && e.Project != q.Project) ||
+		(q.Batch != "" && e.Batch != q.Batch) ||
+		(q.Result != "" && e.Result != q.Result) ||
+		(q.Object != "" && e.Object != q.Object) ||
+		(q.Actor != "" && e.Actor != q.Actor) ||
+		(q.Action != "" && e.Action != q.Action) {
+		return false
+	}
+
+	return inRange(e.Timestamp, q.Since, q.Until)
+}
+
+func inRange(t, since, until time.Time) bool {
+	return (since.IsZero() || !t.Before(since)) && (until.IsZero() || t.Before(until))
+}
+
+// PageResults sorts and paginates results already filtered by the query, for
+// stores without native sorting.
+func PageResults(results []structs.Result, q ResultQuery) (ResultPage, error) {
+	key, desc, err := Sort(q.Sort, ResultSortKeys)
+	if err != nil {
+		return ResultPage{}, err
+	}
+
+	cursor, err := DecodeCursor(q.Cursor, key, ResultSortKeys)
+	if err != nil {
+		return ResultPage{}, err
+	}
+
+	less := func(i, j int) bool {
+		return before(ResultSortValue(results[i], key), results[i].ID, ResultSortValue(results[j], key), results[j].ID, desc)
+	}
+	sort.Slice(results, less)
+
+	page := ResultPage{Results: []structs.Result{}}
+	limit := Limit(q.Limit)
+
+	for _, r := range results {
+		if cursor != nil && !before(cursor.Value, cursor.ID, ResultSortValue(r, key), r.ID, desc) {
+			continue
+		}
+
+		if len(page.Results) == limit {
+			last := page.Results[limit-1]
+			page.Next = EncodeCursor(ResultSortValue(last, key), last.ID)
+			break
+		}
+
+		page.Results = append(page.Results, r)
+	}
+
+	return page, nil
+}
+
+// PageBatchs sorts and paginates batchs already filtered by the query, for
+// stores without native sorting.
+func PageBatchs(batchs []structs.BatchInfo, q BatchQuery) (BatchPage, error) {
+	key, desc, err := Sort(q.Sort, BatchSortKeys)
+	if err != nil {
+		return BatchPage{}, err
+	}
+
+	cursor, err := DecodeCursor(q.Cursor, key, BatchSortKeys)
+	if err != nil {
+		return BatchPage{}, err
+	}
+
+	less := func(i, j int) bool {
+		return before(BatchSortValue(batchs[i], key), batchs[i].ID, BatchSortValue(batchs[j], key), batchs[j].ID, desc)
+	}
+	sort.Slice(batchs, less)
+
+	page := BatchPage{Batchs: []structs.BatchInfo{}}
+	limit := Limit(q.Limit)
+
+	for _, b := range batchs {
+		if cursor != nil && !before(cursor.Value, cursor.ID, BatchSortValue(b, key), b.ID, desc) {
+			continue
+		}
+
+		if len(page.Batchs) == limit {
+			last := page.Batchs[limit-1]
+			page.Next = EncodeCursor(BatchSortValue(last, key), last.ID)
+			break
+		}
+
+		page.Batchs = append(page.Batchs, b)
+	}
+
+	return page, nil
+}
+
+// PageAudit sorts and paginates audit entries already filtered by the query,
+// for stores without native sorting.
+func PageAudit(entries []structs.AuditEntry, q AuditQuery) (AuditPage, error) {
+	key, desc, err := Sort(q.Sort, AuditSortKeys)
+	if err != nil {
+		return AuditPage{}, err
+	}
+
+	cursor, err := DecodeCursor(q.Cursor, key, AuditSortKeys)
+	if err != nil {
+		return AuditPage{}, err
+	}
+
+	less := func(i, j int) bool {
+		return before(entries[i].Timestamp, entries[i].ID, entries[j].Timestamp, entries[j].ID, desc)
+	}
+	sort.Slice(entries, less)
+
+	page := AuditPage{Entries: []structs.AuditEntry{}}
+	limit := Limit(q.Limit)
+
+	for _, e := range entries {
+		if cursor != nil && !before(cursor.Value, cursor.ID, e.Timestamp, e.ID, desc) {
+			continue
+		}
+
+		if len(page.Entries) == limit {
+			last := page.Entries[limit-1]
+			page.Next = EncodeCursor(last.Timestamp, last.ID)
+			break
+		}
+
+		page.Entries = append(page.Entries, e)
+	}
+
+	return page, nil
+}
+
+// before reports whether the element with sort value a and id aID goes
+// before the one with b and bID. Ties are broken by ID, in the same direction.
+func before(a interface{}, aID string, b interface{}, bID string, desc bool) bool {
+	c := compare(a, b)
+	if c == 0 {
+		c = strings.Compare(aID, bID)
+	}
+
+	if desc {
+		return c > 0
+	}
+	return c < 0
+}
+
+func compare(a, b interface{}) int {
+	switch av := a.(type) {
+	case string:
+		return strings.Compare(av, b.(string))
+	case float64:
+		bv := b.(float64)
+		if av < bv {
+			return -1
+		} else if av > bv {
+			return 1
+		}
+	case int:
+		bv := b.(int)
+		if av < bv {
+			return -1
+		} else if av > bv {
+			return 1
+		}
+	case time.Time:
+		bv := b.(time.Time)
+		if av.Before(bv) {
+			return -1
+		} else if av.After(bv) {
+			return 1
+		}
+	}
+	return 0
+}
@@ -0,0 +1,93 @@
+package store
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/theopticians/optician-api/core/structs"
+)
+
+func TestPageResults(t *testing.T) {
+	now := time.Now()
+	results := []structs.Result{}
+	for i := 0; i < 5; i++ {
+		results = append(results, structs.Result{
+			ID:        "r" + strconv.Itoa(i),
+			DiffScore: float64(i % 2),
+			Timestamp: now.Add(time.Duration(i) * time.Second),
+		})
+	}
+
+	q := ResultQuery{Sort: "-timestamp", Limit: 2}
+	ids := []string{}
+
+	for {
+		page, err := PageResults(results, q)
+		if err != nil {
+			t.Fatal("Error paging results:", err)
+		}
+
+		for _, r := range page.Results {
+			ids = append(ids, r.ID)
+		}
+
+		if page.Next == "" {
+			break
+		}
+		q.Cursor = page.Next
+	}
+
+	expected := []string{"r4", "r3", "r2", "r1", "r0"}
+	if len(ids) != len(expected) {
+		t.Fatal("Expected", expected, "got", ids)
+	}
+	for i := range ids {
+		if ids[i] != expected[i] {
+			t.Fatal("Expected", expected, "got", ids)
+		}
+	}
+
+	page, err := PageResults(results, ResultQuery{Sort: "diffscore", Limit: 3})
+	if err != nil {
+		t.Fatal("Error paging results:", err)
+	}
+
+	page, err = PageResults(results, ResultQuery{Sort: "diffscore", Limit: 3, Cursor: page.Next})
+	if err != nil {
+		t.Fatal("Error paging results:", err)
+	}
+
+	if len(page.Results) != 2 || page.Results[0].ID != "r1" || page.Results[1].ID != "r3" {
+		t.Fatal("Expected second page sorted by diffscore to be r1, r3, got", page.Results)
+	}
+}
+
+func TestInvalidQuery(t *testing.T) {
+	_, err := PageResults(nil, ResultQuery{Sort: "unknown"})
+	if _, ok := err.(QueryError); !ok {
+		t.Fatal("Expected QueryError for unknown sort key, got", err)
+	}
+
+	_, err = PageResults(nil, ResultQuery{Cursor: "%%%"})
+	if _, ok := err.(QueryError); !ok {
+		t.Fatal("Expected QueryError for invalid cursor, got", err)
+	}
+}
+
+func TestResultQueryMatches(t *testing.T) {
+	min := 10.0
+	q := ResultQuery{Project: "p", Status: structs.StatusDone, MinScore: &min}
+
+	if !q.Matches(structs.Result{Project: "p", DiffScore: 20}) {
+		t.Fatal("Expected result without status to match done status")
+	}
+
+	if q.Matches(structs.Result{Project: "p", DiffScore: 5}) {
+		t.Fatal("Expected result below min score not to match")
+	}
+
+	if q.Matches(structs.Result{Project: "p", DiffScore: 20, Status: structs.StatusPending}) {
+		t.Fatal("Expected pending result not to match done status")
+	}
+}
@@ -0,0 +1,173 @@
+package sql
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// upsert styles, the statement inserting a row or updating it when its key
+// already exists.
+const (
+	// UPSERT INTO ...
+	upsertStatement = iota
+	// INSERT INTO ... ON CONFLICT (...) DO UPDATE SET ...
+	upsertOnConflict
+	// INSERT INTO ... ON DUPLICATE KEY UPDATE ...
+	upsertOnDuplicateKey
+)
+
+// dialect holds what differs between the supported SQL engines. Queries are
+// written with ? placeholders and rebound to the driver's bindvars by sqlx.
+type dialect struct {
+	// driver is the name of the database/sql driver.
+	driver string
+
+	// setup is run on every new connection pool, before migrating.
+	setup []string
+
+	// types rewrites the schema statements for the engine, replacing their
+	// {type} placeholders.
+	types *strings.Replacer
+
+	upsert int
+
+	// quote is the character quoting identifiers.
+	quote string
+}
+
+// mysqlStringLength is the length of MySQL string columns. InnoDB keys are
+// limited to 3072 bytes, and utf8mb4 characters take up to 4 bytes.
+const mysqlStringLength = 150
+
+var dialects = map[string]dialect{
+	"cockroach": {
+		driver: "postgres",
+		setup: []string{
+			"CREATE DATABASE IF NOT EXISTS optician",
+			"SET DATABASE = optician",
+		},
+		types: strings.NewReplacer(
+			"{string}", "STRING",
+			"{text}", "STRING",
+			"{bytes}", "BYTEA",
+			"{float}", "FLOAT",
+			"{timestamp}", "TIMESTAMP",
+			"{ifnotexists}", "IF NOT EXISTS",
+		),
+		upsert: upsertStatement,
+		quote:  "\"",
+	},
+	"postgres": {
+		driver: "postgres",
+		types: strings.NewReplacer(
+			"{string}", "TEXT",
+			"{text}", "TEXT",
+			"{bytes}", "BYTEA",
+			"{float}", "DOUBLE PRECISION",
+			"{timestamp}", "TIMESTAMP WITH TIME ZONE",
+			"{ifnotexists}", "IF NOT EXISTS",
+		),
+		upsert: upsertOnConflict,
+		quote:  "\"",
+	},
+	"sqlite": {
+		driver: "sqlite3",
+		types: strings.NewReplacer(
+			"{string}", "TEXT",
+			"{text}", "TEXT",
+			"{bytes}", "BLOB",
+			"{float}", "REAL",
+			"{timestamp}", "TIMESTAMP",
+			// SQLite can't add a column only if it doesn't exist. Tables
+			// are only altered by versioned migrations, so it's not needed.
+			"ADD COLUMN {ifnotexists}", "ADD COLUMN",
+			"{ifnotexists}", "IF NOT EXISTS",
+		),
+		upsert: upsertOnConflict,
+		quote:  "\"",
+	},
+	"mysql": {
+		driver: "mysql",
+		types: strings.NewReplacer(
+			// Indexed columns need a length, short enough for the five
+			// utf8mb4 columns of the unique result key to fit in an index.
+			"{string}", "VARCHAR("+strconv.Itoa(mysqlStringLength)+")",
+			"{text}", "LONGTEXT",
+			"{bytes}", "LONGBLOB",
+			"{float}", "DOUBLE",
+			"{timestamp}", "DATETIME(6)",
+			// Same as SQLite, and MySQL doesn't have CREATE INDEX IF NOT
+			// EXISTS either.
+			"{ifnotexists}", "",
+			"\"", "`",
+		),
+		upsert: upsertOnDuplicateKey,
+		quote:  "`",
+	},
+}
+
+func getDialect(name string) (dialect, error) {
+	d, ok := dialects[name]
+	if !ok {
+		return dialect{}, errors.New("unknown SQL dialect " + name)
+	}
+
+	return d, nil
+}
+
+// schema returns the schema statement with the types of the dialect.
+func (d dialect) schema(stmt string) string {
+	return d.types.Replace(stmt)
+}
+
+func (d dialect) quoteAll(identifiers []string) []string {
+	quoted := make([]string, len(identifiers))
+	for i, id := range identifiers {
+		quoted[i] = d.quote + id + d.quote
+	}
+
+	return quoted
+}
+
+// insertQuery returns a statement inserting a row in the table, failing if a
+// row with the same keys exists. Values are named like in upsertQuery.
+func (d dialect) insertQuery(table string, columns ...string) string {
+	return "INSERT" + d.into(table, columns)
+}
+
+// into returns the INTO clause of an insert of the columns, with values named
+// after them.
+func (d dialect) into(table string, columns []string) string {
+	values := make([]string, len(columns))
+	for i, c := range columns {
+		values[i] = ":" + c
+	}
+
+	return " INTO " + table + " (" + strings.Join(d.quoteAll(columns), ",") + ") VALUES (" + strings.Join(values, ",") + ")"
+}
+
+// upsertQuery returns a statement inserting a row in the table, or updating
+// it if a row with the same keys exists. Values are named after their column,
+// to be used with NamedExec.
+func (d dialect) upsertQuery(table string, keys []string, columns ...string) string {
+	insert := d.into(table, append(append([]string{}, keys...), columns...))
+
+	switch d.upsert {
+	case upsertOnConflict:
+		set := make([]string, len(columns))
+		for i, c := range d.quoteAll(columns) {
+			set[i] = c + "=excluded." + c
+		}
+		return "INSERT" + insert + " ON CONFLICT (" + strings.Join(d.quoteAll(keys), ",") + ") DO UPDATE SET " + strings.Join(set, ",")
+	case upsertOnDuplicateKey:
+		set := make([]string, len(columns))
+		for i, c := range d.quoteAll(columns) {
+			set[i] = c + "=VALUES(" + c + ")"
+		}
+		return "INSERT" + insert + " ON DUPLICATE KEY UPDATE " + strings.Join(set, ",")
+	default:
+		return "UPSERT" + insert
+	}
+}
@@ -0,0 +1,78 @@
+package sql
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestUpsertQuery(t *testing.T) {
+	expected := map[string]string{
+		"cockroach": `UPSERT INTO base_masks ("project","branch","maskid") VALUES (:project,:branch,:maskid)`,
+		"postgres":  `INSERT INTO base_masks ("project","branch","maskid") VALUES (:project,:branch,:maskid) ON CONFLICT ("project","branch") DO UPDATE SET "maskid"=excluded."maskid"`,
+		"sqlite":    `INSERT INTO base_masks ("project","branch","maskid") VALUES (:project,:branch,:maskid) ON CONFLICT ("project","branch") DO UPDATE SET "maskid"=excluded."maskid"`,
+		"mysql":     "INSERT INTO base_masks (`project`,`branch`,`maskid`) VALUES (:project,:branch,:maskid) ON DUPLICATE KEY UPDATE `maskid`=VALUES(`maskid`)",
+	}
+
+	for name, query := range expected {
+		d, err := getDialect(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		q := d.upsertQuery("base_masks", []string{"project", "branch"}, "maskid")
+		if q != query {
+			t.Errorf("Expected %s upsert to be %q, got %q", name, query, q)
+		}
+	}
+
+	_, err := getDialect("oracle")
+	if err == nil {
+		t.Fatal("Expected error getting an unknown dialect")
+	}
+}
+
+func TestSchema(t *testing.T) {
+	d, _ := getDialect("sqlite")
+	s := d.schema(`ALTER TABLE results ADD COLUMN {ifnotexists} "commit" {string}`)
+	if s != `ALTER TABLE results ADD COLUMN "commit" TEXT` {
+		t.Fatal("Unexpected sqlite schema statement", s)
+	}
+
+	d, _ = getDialect("cockroach")
+	s = d.schema("CREATE INDEX {ifnotexists} results_batch ON results (batch)")
+	if s != "CREATE INDEX IF NOT EXISTS results_batch ON results (batch)" {
+		t.Fatal("Unexpected cockroach schema statement", s)
+	}
+
+	d, _ = getDialect("mysql")
+	s = d.schema(`CREATE INDEX {ifnotexists} results_case ON results (project, "commit")`)
+	if s != "CREATE INDEX  results_case ON results (project, `commit`)" {
+		t.Fatal("Unexpected mysql schema statement", s)
+	}
+}
+
+// TestMySQLKeyLength checks the keys and indexes of the schema fit in InnoDB,
+// which MySQL only reports when migrating.
+func TestMySQLKeyLength(t *testing.T) {
+	keys := regexp.MustCompile(`(?:KEY|UNIQUE|ON \w+)\s*\(([^)]*)\)`)
+
+	for _, m := range migrations {
+		for _, stmt := range m.statements {
+			for _, key := range keys.FindAllStringSubmatch(stmt, -1) {
+				length := 0
+				for _, column := range strings.Split(key[1], ",") {
+					if strings.TrimSpace(column) == "timestamp" {
+						length += 8
+					} else {
+						length += 4 * mysqlStringLength
+					}
+				}
+
+				if length > 3072 {
+					t.Errorf("Key (%s) of migration %d is %d bytes long in MySQL", key[1], m.Version, length)
+				}
+			}
+		}
+	}
+}
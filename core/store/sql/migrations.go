@@ -0,0 +1,256 @@
+package sql
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/theopticians/optician-api/core/store"
+)
+
+type migration struct {
+	store.Migration
+	statements []string
+}
+
+// migrations are applied in order, each one in a transaction. Never change a
+// released migration, add a new one instead. Column types are written as
+// {type} placeholders, replaced by those of the dialect, and identifiers
+// that are keywords in some engine are quoted with double quotes.
+var migrations = []migration{
+	{store.Migration{Version: 1, Description: "initial schema"}, []string{`
+	CREATE TABLE IF NOT EXISTS masks (
+		id {string},
+		mask {text},
+		PRIMARY KEY( id )
+	)`, `
+	CREATE TABLE IF NOT EXISTS images (
+		id {string},
+		image {bytes},
+		PRIMARY KEY( id )
+	)`, `
+	CREATE TABLE IF NOT EXISTS results (
+		id {string},
+		project {string},
+		branch {string},
+		batch {string},
+		target {string},
+		browser {string},
+		maskid {string},
+		diffscore {float},
+		imageid {string},
+		baseimageid {string},
+		diffimageid {string},
+		diffclusters {text},
+		timestamp {timestamp},
+		PRIMARY KEY( id ),
+		CONSTRAINT UQ_result UNIQUE ( project, branch, batch, target, browser )
+	)`, `
+	CREATE TABLE IF NOT EXISTS base_images (
+		project {string},
+		branch {string},
+		target {string},
+		browser {string},
+		imageid {string},
+		PRIMARY KEY( project, branch,target, browser )
+	)`, `
+	CREATE TABLE IF NOT EXISTS base_masks (
+		project {string},
+		branch {string},
+		target {string},
+		browser {string},
+		maskid {string},
+		PRIMARY KEY( project, branch,target, browser )
+	)`,
+	}},
+	{store.Migration{Version: 2, Description: "result review, status and commit, batches, jobs, webhooks and comparisons"}, []string{
+		`ALTER TABLE results ADD COLUMN {ifnotexists} "commit" {string}`,
+		`ALTER TABLE results ADD COLUMN {ifnotexists} repository {string}`,
+		`ALTER TABLE results ADD COLUMN {ifnotexists} review {string}`,
+		`ALTER TABLE results ADD COLUMN {ifnotexists} status {string}`,
+		`ALTER TABLE results ADD COLUMN {ifnotexists} error {text}`, `
+	CREATE TABLE IF NOT EXISTS jobs (
+		id {string},
+		resultid {string},
+		createdat {timestamp},
+		PRIMARY KEY( id )
+	)`, `
+	CREATE TABLE IF NOT EXISTS webhooks (
+		id {string},
+		project {string},
+		url {text},
+		secret {string},
+		events {text},
+		createdat {timestamp},
+		PRIMARY KEY( id )
+	)`, `
+	CREATE TABLE IF NOT EXISTS deliveries (
+		id {string},
+		webhookid {string},
+		event {string},
+		payload {text},
+		status {string},
+		attempts INT,
+		nextattempt {timestamp},
+		lasterror {text},
+		responsecode INT,
+		createdat {timestamp},
+		deliveredat {timestamp} NULL,
+		PRIMARY KEY( id )
+	)`, `
+	CREATE TABLE IF NOT EXISTS comparisons (
+		baseimageid {string},
+		imageid {string},
+		maskid {string},
+		diffscore {float},
+		diffimageid {string},
+		diffclusters {text},
+		PRIMARY KEY( baseimageid, imageid, maskid )
+	)`, `
+	CREATE TABLE IF NOT EXISTS batches (
+		id {string},
+		project {string},
+		branch {string},
+		"commit" {string},
+		repository {string},
+		expectedcases INT,
+		createdat {timestamp},
+		updatedat {timestamp},
+		finalizedat {timestamp} NULL,
+		missing {text},
+		added {text},
+		missingasfailures BOOL,
+		PRIMARY KEY( id )
+	)`,
+	}},
+	{store.Migration{Version: 3, Description: "index results by batch and case"}, []string{
+		`CREATE INDEX {ifnotexists} results_batch ON results (batch)`,
+		`CREATE INDEX {ifnotexists} results_case ON results (project, branch, target, browser, timestamp)`,
+	}},
+	{store.Migration{Version: 4, Description: "projects"}, []string{`
+	CREATE TABLE IF NOT EXISTS projects (
+		id {string},
+		name {string},
+		defaultbranch {string},
+		threshold {float},
+		clusterdistance INT,
+		retentiondays INT,
+		createdat {timestamp},
+		updatedat {timestamp},
+		PRIMARY KEY( id )
+	)`,
+	}},
+	{store.Migration{Version: 5, Description: "API keys and result attribution"}, []string{
+		`ALTER TABLE results ADD COLUMN {ifnotexists} reviewedby {string} DEFAULT ''`,
+		`ALTER TABLE results ADD COLUMN {ifnotexists} maskedby {string} DEFAULT ''`, `
+	CREATE TABLE IF NOT EXISTS api_keys (
+		id {string},
+		project {string},
+		name {string},
+		role {string},
+		hash {string},
+		createdat {timestamp},
+		PRIMARY KEY( id )
+	)`,
+	}},
+	{store.Migration{Version: 6, Description: "audit log"}, []string{`
+	CREATE TABLE IF NOT EXISTS audit_log (
+		id {string},
+		timestamp {timestamp},
+		actor {string},
+		action {string},
+		project {string},
+		batch {string},
+		result {string},
+		object {string},
+		"before" {text},
+		"after" {text},
+		PRIMARY KEY( id )
+	)`,
+		`CREATE INDEX {ifnotexists} audit_log_timestamp ON audit_log (timestamp)`,
+	}},
+	// Comparisons are a cache, they are dropped rather than migrated.
+	{store.Migration{Version: 7, Description: "comparator settings of comparisons"}, []string{
+		`DROP TABLE IF EXISTS comparisons`, `
+	CREATE TABLE comparisons (
+		baseimageid {string},
+		imageid {string},
+		maskid {string},
+		settings {string},
+		diffscore {float},
+		diffimageid {string},
+		diffclusters {text},
+		PRIMARY KEY( baseimageid, imageid, maskid, settings )
+	)`,
+	}},
+}
+
+func (s *SqlStore) SchemaVersion() (int, error) {
+	_, err := s.conn.Exec(s.dialect.schema("CREATE TABLE IF NOT EXISTS schema_migrations (version INT, description {string}, appliedat {timestamp}, PRIMARY KEY( version ))"))
+	if err != nil {
+		return 0, errors.Wrap(err, "error creating migrations table")
+	}
+
+	var version int
+	err = s.conn.Get(&version, "SELECT COALESCE(MAX(version), 0) FROM schema_migrations")
+
+	return version, err
+}
+
+func (s *SqlStore) PendingMigrations() ([]store.Migration, error) {
+	version, err := s.SchemaVersion()
+	if err != nil {
+		return nil, err
+	}
+
+	pending := []store.Migration{}
+	for _, m := range migrations {
+		if m.Version > version {
+			pending = append(pending, m.Migration)
+		}
+	}
+
+	return pending, nil
+}
+
+func (s *SqlStore) Migrate() error {
+	version, err := s.SchemaVersion()
+	if err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if m.Version <= version {
+			continue
+		}
+
+		err = s.applyMigration(m)
+		if err != nil {
+			return errors.Wrapf(err, "error applying migration %d (%s)", m.Version, m.Description)
+		}
+	}
+
+	return nil
+}
+
+func (s *SqlStore) applyMigration(m migration) error {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return err
+	}
+
+	for _, stmt := range m.statements {
+		_, err = tx.Exec(s.dialect.schema(stmt))
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	_, err = tx.Exec(tx.Rebind("INSERT INTO schema_migrations (version, description, appliedat) VALUES (?, ?, ?)"), m.Version, m.Description, time.Now())
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,72 @@
+package sql
+
+import (
+	"strings"
+	"time"
+
+	"github.com/theopticians/optician-api/core/store"
+)
+
+// where builds the WHERE clause of a query along with its arguments.
+type where struct {
+	conditions []string
+	args       []interface{}
+}
+
+// arg adds an argument and returns its placeholder. Placeholders can't be
+// reused, MySQL and SQLite bind them in order.
+func (w *where) arg(v interface{}) string {
+	w.args = append(w.args, v)
+	return "?"
+}
+
+func (w *where) add(condition string) {
+	w.conditions = append(w.conditions, condition)
+}
+
+func (w *where) equal(column, value string) {
+	if value != "" {
+		w.add(column + "=" + w.arg(value))
+	}
+}
+
+func (w *where) timeRange(column string, since, until time.Time) {
+	if !since.IsZero() {
+		w.add(column + ">=" + w.arg(since))
+	}
+	if !until.IsZero() {
+		w.add(column + "<" + w.arg(until))
+	}
+}
+
+// cursor restricts the query to the rows after the cursor in the sort order,
+// ties being broken by id.
+func (w *where) cursor(column string, c *store.Cursor, desc bool) {
+	if c == nil {
+		return
+	}
+
+	op := ">"
+	if desc {
+		op = "<"
+	}
+
+	w.add("(" + column + op + w.arg(c.Value) + " OR (" + column + "=" + w.arg(c.Value) + " AND id" + op + w.arg(c.ID) + "))")
+}
+
+func (w *where) String() string {
+	if len(w.conditions) == 0 {
+		return ""
+	}
+
+	return " WHERE " + strings.Join(w.conditions, " AND ")
+}
+
+func orderBy(column string, desc bool) string {
+	dir := " ASC"
+	if desc {
+		dir = " DESC"
+	}
+
+	return " ORDER BY " + column + dir + ", id" + dir
+}
@@ -7,112 +7,299 @@ import (
 	"image"
 	"image/png"
 	"log"
+	"strconv"
+	"time"
 
 	"github.com/jmoiron/sqlx"
 	"github.com/theopticians/optician-api/core/store"
 	"github.com/theopticians/optician-api/core/structs"
 
-	// Import postgres driver.
+	// Import postgres and mysql drivers.
+	_ "github.com/go-sql-driver/mysql"
 	_ "github.com/lib/pq"
 )
 
-var schema = `
-	CREATE TABLE IF NOT EXISTS masks (
-		id STRING,
-		mask TEXT,
-		PRIMARY KEY( id )
-	);
-
-	CREATE TABLE IF NOT EXISTS images (
-		id STRING,
-		image BYTEA,
-		PRIMARY KEY( id )
-	);
-
-	CREATE TABLE IF NOT EXISTS results (
-		id STRING,
-		project STRING,
-		branch STRING,
-		batch STRING,
-		target STRING,
-		browser STRING,
-		maskid STRING,
-		diffscore FLOAT,
-		imageid STRING,
-		baseimageid STRING,
-		diffimageid STRING,
-		diffclusters STRING,
-		timestamp TIMESTAMP,
-		PRIMARY KEY( id ),
-		CONSTRAINT UQ_result UNIQUE ( project, branch, batch, target, browser )
-	);
-
-	CREATE TABLE IF NOT EXISTS base_images (
-		project STRING,
-		branch STRING,
-		target STRING,
-		browser STRING,
-		imageid STRING,
-		PRIMARY KEY( project, branch,target, browser )
-	);
-
-	CREATE TABLE IF NOT EXISTS base_masks (
-		project STRING,
-		branch STRING,
-		target STRING,
-		browser STRING,
-		maskid STRING,
-		PRIMARY KEY( project, branch,target, browser )
-	);
-`
+// conn is implemented by both *sqlx.DB and *sqlx.Tx, so the same queries
+// run inside or outside a transaction.
+type conn interface {
+	Get(dest interface{}, query string, args ...interface{}) error
+	Select(dest interface{}, query string, args ...interface{}) error
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	NamedExec(query string, arg interface{}) (sql.Result, error)
+	Rebind(query string) string
+}
 
 type SqlStore struct {
-	conn *sqlx.DB
+	db      *sqlx.DB
+	conn    conn
+	dialect dialect
 }
 
-func NewSqlStore(driver, url string) store.Store {
-	conn, err := sqlx.Connect(driver, url)
+// NewSqlStore opens the database and applies any pending migration.
+func NewSqlStore(dialect, url string) store.Store {
+	s, err := OpenSqlStore(dialect, url)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	conn.MustExec("CREATE DATABASE IF NOT EXISTS optician")
-	conn.MustExec("SET DATABASE = optician;")
-	conn.MustExec(schema)
+	err = s.Migrate()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return s
+}
+
+// OpenSqlStore opens the database without migrating it. The dialect is one of
+// cockroach, postgres, sqlite or mysql.
+func OpenSqlStore(dialectName, url string) (*SqlStore, error) {
+	d, err := getDialect(dialectName)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := sqlx.Connect(d.driver, url)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, stmt := range d.setup {
+		_, err = db.Exec(stmt)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	return &SqlStore{conn}
+	return &SqlStore{db: db, conn: db, dialect: d}, nil
 }
 
 func (s *SqlStore) Close() {
-	s.conn.Close()
+	if s.conn != s.db {
+		return
+	}
+	s.db.Close()
+}
+
+// get, all and exec run queries written with ? placeholders.
+func (s *SqlStore) get(dest interface{}, query string, args ...interface{}) error {
+	return s.conn.Get(dest, s.conn.Rebind(query), args...)
+}
+
+func (s *SqlStore) all(dest interface{}, query string, args ...interface{}) error {
+	return s.conn.Select(dest, s.conn.Rebind(query), args...)
+}
+
+func (s *SqlStore) exec(query string, args ...interface{}) (sql.Result, error) {
+	return s.conn.Exec(s.conn.Rebind(query), args...)
+}
+
+// Transaction runs fn with a store whose queries all happen in a single
+// database transaction, committed only if fn returns nil.
+func (s *SqlStore) Transaction(fn func(store.Store) error) error {
+	if s.conn != s.db {
+		return fn(s)
+	}
+
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return err
+	}
+
+	err = fn(&SqlStore{db: s.db, conn: tx, dialect: s.dialect})
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
 }
 
 func (s *SqlStore) GetResults() ([]structs.Result, error) {
 	results := []structs.Result{}
-	err := s.conn.Select(&results, "SELECT * FROM results ORDER BY timestamp DESC")
+	err := s.all(&results, "SELECT * FROM results ORDER BY timestamp DESC")
 
 	return results, err
 }
 
 func (s *SqlStore) GetResultsByBatch(batch string) ([]structs.Result, error) {
 	results := []structs.Result{}
-	err := s.conn.Select(&results, "SELECT * FROM results WHERE batch=$1 ORDER BY timestamp DESC", batch)
+	err := s.all(&results, "SELECT * FROM results WHERE batch=? ORDER BY timestamp DESC", batch)
 
 	return results, err
 }
 
+func (s *SqlStore) QueryResults(q store.ResultQuery) (store.ResultPage, error) {
+	key, desc, err := store.Sort(q.Sort, store.ResultSortKeys)
+	if err != nil {
+		return store.ResultPage{}, err
+	}
+
+	cursor, err := store.DecodeCursor(q.Cursor, key, store.ResultSortKeys)
+	if err != nil {
+		return store.ResultPage{}, err
+	}
+
+	w := &where{}
+	w.equal("project", q.Project)
+	w.equal("branch", q.Branch)
+	w.equal("batch", q.Batch)
+	w.equal("target", q.Target)
+	w.equal("browser", q.Browser)
+	if q.Status == structs.StatusDone {
+		// Results stored before diffs were asynchronous have no status
+		w.add("(status=" + w.arg(q.Status) + " OR status='' OR status IS NULL)")
+	} else {
+		w.equal("status", q.Status)
+	}
+	if q.MinScore != nil {
+		w.add("diffscore>=" + w.arg(*q.MinScore))
+	}
+	if q.MaxScore != nil {
+		w.add("diffscore<=" + w.arg(*q.MaxScore))
+	}
+	w.timeRange("timestamp", q.Since, q.Until)
+	w.cursor(key, cursor, desc)
+
+	limit := store.Limit(q.Limit)
+
+	results := []structs.Result{}
+	err = s.all(&results, "SELECT * FROM results"+w.String()+orderBy(key, desc)+" LIMIT "+strconv.Itoa(limit+1), w.args...)
+	if err != nil {
+		return store.ResultPage{}, err
+	}
+
+	page := store.ResultPage{Results: results}
+	if len(results) > limit {
+		page.Results = results[:limit]
+		last := page.Results[limit-1]
+		page.Next = store.EncodeCursor(store.ResultSortValue(last, key), last.ID)
+	}
+
+	return page, nil
+}
+
+const batchsQuery = `
+	SELECT t1.batch AS id, t1.timestamp, t1.project, COALESCE(t3.failed,0) AS failed FROM results AS t1 JOIN (SELECT batch, max(timestamp) AS maxdate FROM results GROUP BY batch) AS t2 ON (t1.batch = t2.batch) AND (t1.timestamp = t2.maxdate) LEFT JOIN (SELECT batch, count(*) AS failed FROM results WHERE diffscore>0 OR status='failed' GROUP BY batch) AS t3 ON (t1.batch = t3.batch) GROUP BY t1.batch, t1.timestamp, t1.project, failed
+`
+
 func (s *SqlStore) GetBatchs() ([]structs.BatchInfo, error) {
 	batches := []structs.BatchInfo{}
-	err := s.conn.Select(&batches, `
-	SELECT t1.batch AS id, t1.timestamp, t1.project, COALESCE(t3.failed,0) AS failed FROM results AS t1 JOIN (SELECT batch, max(timestamp) AS maxdate FROM results GROUP BY batch) AS t2 ON (t1.batch = t2.batch) AND (t1.timestamp = t2.maxdate) FULL JOIN (SELECT batch, count(*) AS failed FROM results WHERE diffscore>0 GROUP BY batch) AS t3 ON (t1.batch = t3.batch) GROUP BY t1.batch, t1.timestamp, t1.project, failed ORDER BY t1.timestamp DESC
-`)
+	err := s.all(&batches, batchsQuery+" ORDER BY t1.timestamp DESC")
+
+	return batches, err
+}
+
+func (s *SqlStore) QueryBatchs(q store.BatchQuery) (store.BatchPage, error) {
+	key, desc, err := store.Sort(q.Sort, store.BatchSortKeys)
+	if err != nil {
+		return store.BatchPage{}, err
+	}
+
+	cursor, err := store.DecodeCursor(q.Cursor, key, store.BatchSortKeys)
+	if err != nil {
+		return store.BatchPage{}, err
+	}
+
+	w := &where{}
+	w.equal("project", q.Project)
+	w.timeRange("timestamp", q.Since, q.Until)
+	w.cursor(key, cursor, desc)
+
+	limit := store.Limit(q.Limit)
+
+	batches := []structs.BatchInfo{}
+	err = s.all(&batches, "SELECT * FROM ("+batchsQuery+") AS b"+w.String()+orderBy(key, desc)+" LIMIT "+strconv.Itoa(limit+1), w.args...)
+	if err != nil {
+		return store.BatchPage{}, err
+	}
+
+	page := store.BatchPage{Batchs: batches}
+	if len(batches) > limit {
+		page.Batchs = batches[:limit]
+		last := page.Batchs[limit-1]
+		page.Next = store.EncodeCursor(store.BatchSortValue(last, key), last.ID)
+	}
+
+	return page, nil
+}
+
+func (s *SqlStore) GetJobs() ([]structs.Job, error) {
+	jobs := []structs.Job{}
+	err := s.all(&jobs, "SELECT * FROM jobs ORDER BY createdat")
+
+	return jobs, err
+}
+
+func (s *SqlStore) StoreJob(j structs.Job) error {
+	_, err := s.conn.NamedExec(s.dialect.upsertQuery("jobs", []string{"id"}, "resultid", "createdat"), j)
+
+	return err
+}
+
+func (s *SqlStore) DeleteJob(id string) error {
+	_, err := s.exec("DELETE FROM jobs WHERE id=?", id)
+
+	return err
+}
+
+func (s *SqlStore) GetBatch(id string) (structs.Batch, error) {
+	batch := structs.Batch{}
+	err := s.get(&batch, "SELECT * FROM batches WHERE id=?", id)
+
+	if err == sql.ErrNoRows {
+		return batch, store.NotFoundError
+	}
+
+	return batch, err
+}
+
+func (s *SqlStore) StoreBatch(b structs.Batch) error {
+	_, err := s.conn.NamedExec(s.dialect.upsertQuery("batches", []string{"id"}, "project", "branch", "commit", "repository", "expectedcases", "createdat", "updatedat", "finalizedat", "missing", "added", "missingasfailures"), b)
+
+	return err
+}
+
+func (s *SqlStore) DeleteBatch(id string) error {
+	return s.Transaction(func(tx store.Store) error {
+		_, err := tx.(*SqlStore).exec("DELETE FROM results WHERE batch=?", id)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.(*SqlStore).exec("DELETE FROM batches WHERE id=?", id)
+
+		return err
+	})
+}
+
+func (s *SqlStore) GetLastFinalizedBatch(projectID, branch string) (structs.Batch, error) {
+	batch := structs.Batch{}
+	err := s.get(&batch, "SELECT * FROM batches WHERE project=? AND branch=? AND finalizedat IS NOT NULL ORDER BY finalizedat DESC LIMIT 1", projectID, branch)
+
+	if err == sql.ErrNoRows {
+		return batch, store.NotFoundError
+	}
+
+	return batch, err
+}
+
+func (s *SqlStore) GetOpenBatches() ([]structs.Batch, error) {
+	batches := []structs.Batch{}
+	err := s.all(&batches, "SELECT * FROM batches WHERE finalizedat IS NULL")
+
+	return batches, err
+}
+
+func (s *SqlStore) GetEmptyBatches() ([]structs.Batch, error) {
+	batches := []structs.Batch{}
+	err := s.all(&batches, "SELECT * FROM batches WHERE NOT EXISTS (SELECT 1 FROM results WHERE results.batch = batches.id)")
 
 	return batches, err
 }
 
 func (s *SqlStore) GetLastResult(projectID, branch, target, browser string) (structs.Result, error) {
 	result := structs.Result{}
-	err := s.conn.Get(&result, "SELECT * FROM results ORDER BY timestamp DESC LIMIT 1")
+	err := s.get(&result, "SELECT * FROM results WHERE project=? AND branch=? AND target=? AND browser=? ORDER BY timestamp DESC LIMIT 1", projectID, branch, target, browser)
 
 	if err == sql.ErrNoRows {
 		return result, store.NotFoundError
@@ -121,15 +308,42 @@ func (s *SqlStore) GetLastResult(projectID, branch, target, browser string) (str
 	return result, err
 }
 
+func (s *SqlStore) upsertResultQuery() string {
+	return s.dialect.upsertQuery("results", []string{"id"}, "project", "branch", "batch", "target", "browser", "commit", "repository", "maskid", "diffscore", "imageid", "baseimageid", "diffimageid", "diffclusters", "review", "status", "error", "timestamp", "reviewedby", "maskedby")
+}
+
+// upsertBaseQuery returns the query setting the base image or mask of a case.
+func (s *SqlStore) upsertBaseQuery(table, column string) string {
+	return s.dialect.upsertQuery(table, []string{"project", "branch", "target", "browser"}, column)
+}
+
 func (s *SqlStore) StoreResult(r structs.Result) error {
-	_, err := s.conn.NamedExec("INSERT INTO results (id,project,branch,batch,target,browser,maskid,diffscore,imageid,baseimageid,diffimageid,diffclusters,timestamp) VALUES (:id,:project,:branch,:batch,:target,:browser,:maskid,:diffscore,:imageid,:baseimageid,:diffimageid,:diffclusters,:timestamp)", r)
+	_, err := s.conn.NamedExec(s.upsertResultQuery(), r)
 
 	return err
 }
 
+func (s *SqlStore) AcceptResults(results []structs.Result) error {
+	return s.Transaction(func(tx store.Store) error {
+		for _, r := range results {
+			err := tx.StoreResult(r)
+			if err != nil {
+				return err
+			}
+
+			err = tx.SetBaseImageID(r.ImageID, r.Project, r.Branch, r.Target, r.Browser)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
 func (s *SqlStore) GetResult(ID string) (structs.Result, error) {
 	result := structs.Result{}
-	err := s.conn.Get(&result, "SELECT * FROM results WHERE id=$1", ID)
+	err := s.get(&result, "SELECT * FROM results WHERE id=?", ID)
 
 	if err == sql.ErrNoRows {
 		return result, store.NotFoundError
@@ -140,7 +354,7 @@ func (s *SqlStore) GetResult(ID string) (structs.Result, error) {
 
 func (s *SqlStore) GetMask(id string) (structs.Mask, error) {
 	mask := structs.Mask{}
-	err := s.conn.Get(&mask, "SELECT mask FROM masks WHERE id=$1", id)
+	err := s.get(&mask, "SELECT mask FROM masks WHERE id=?", id)
 
 	if err == sql.ErrNoRows {
 		return nil, store.NotFoundError
@@ -151,14 +365,241 @@ func (s *SqlStore) GetMask(id string) (structs.Mask, error) {
 
 func (s *SqlStore) StoreMask(mask structs.Mask) (string, error) {
 	id := RandStringBytes(10)
-	s.conn.MustExec("INSERT INTO masks (id, mask) VALUES ($1, $2)", id, mask)
+	_, err := s.exec("INSERT INTO masks (id, mask) VALUES (?, ?)", id, mask)
+	if err != nil {
+		return "", err
+	}
+
 	return id, nil
 }
 
+func (s *SqlStore) GetProjects() ([]structs.Project, error) {
+	projects := []structs.Project{}
+	err := s.all(&projects, "SELECT * FROM projects ORDER BY id")
+
+	return projects, err
+}
+
+func (s *SqlStore) GetProject(id string) (structs.Project, error) {
+	p := structs.Project{}
+	err := s.get(&p, "SELECT * FROM projects WHERE id=?", id)
+
+	if err == sql.ErrNoRows {
+		return p, store.NotFoundError
+	}
+
+	return p, err
+}
+
+func (s *SqlStore) StoreProject(p structs.Project) error {
+	_, err := s.conn.NamedExec(s.dialect.upsertQuery("projects", []string{"id"}, "name", "defaultbranch", "threshold", "clusterdistance", "retentiondays", "createdat", "updatedat"), p)
+
+	return err
+}
+
+func (s *SqlStore) DeleteProject(id string) error {
+	res, err := s.exec("DELETE FROM projects WHERE id=?", id)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err == nil && n == 0 {
+		return store.NotFoundError
+	}
+
+	return err
+}
+
+func (s *SqlStore) GetAPIKeys(projectID string) ([]structs.APIKey, error) {
+	keys := []structs.APIKey{}
+	err := s.all(&keys, "SELECT * FROM api_keys WHERE project=? ORDER BY createdat", projectID)
+
+	return keys, err
+}
+
+func (s *SqlStore) GetAPIKey(id string) (structs.APIKey, error) {
+	k := structs.APIKey{}
+	err := s.get(&k, "SELECT * FROM api_keys WHERE id=?", id)
+
+	if err == sql.ErrNoRows {
+		return k, store.NotFoundError
+	}
+
+	return k, err
+}
+
+func (s *SqlStore) StoreAPIKey(k structs.APIKey) error {
+	_, err := s.conn.NamedExec(s.dialect.upsertQuery("api_keys", []string{"id"}, "project", "name", "role", "hash", "createdat"), k)
+
+	return err
+}
+
+func (s *SqlStore) DeleteAPIKey(id string) error {
+	res, err := s.exec("DELETE FROM api_keys WHERE id=?", id)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err == nil && n == 0 {
+		return store.NotFoundError
+	}
+
+	return err
+}
+
+// AppendAudit inserts the entry, failing if one with the same ID exists.
+func (s *SqlStore) AppendAudit(e structs.AuditEntry) error {
+	_, err := s.conn.NamedExec(s.dialect.insertQuery("audit_log", "id", "timestamp", "actor", "action", "project", "batch", "result", "object", "before", "after"), e)
+
+	return err
+}
+
+func (s *SqlStore) QueryAudit(q store.AuditQuery) (store.AuditPage, error) {
+	key, desc, err := store.Sort(q.Sort, store.AuditSortKeys)
+	if err != nil {
+		return store.AuditPage{}, err
+	}
+
+	cursor, err := store.DecodeCursor(q.Cursor, key, store.AuditSortKeys)
+	if err != nil {
+		return store.AuditPage{}, err
+	}
+
+	w := &where{}
+	w.equal("project", q.Project)
+	w.equal("batch", q.Batch)
+	w.equal("result", q.Result)
+	w.equal("object", q.Object)
+	w.equal("actor", q.Actor)
+	w.equal("action", q.Action)
+	w.timeRange("timestamp", q.Since, q.Until)
+	w.cursor(key, cursor, desc)
+
+	limit := store.Limit(q.Limit)
+
+	entries := []structs.AuditEntry{}
+	err = s.all(&entries, "SELECT * FROM audit_log"+w.String()+orderBy(key, desc)+" LIMIT "+strconv.Itoa(limit+1), w.args...)
+	if err != nil {
+		return store.AuditPage{}, err
+	}
+
+	page := store.AuditPage{Entries: entries}
+	if len(entries) > limit {
+		page.Entries = entries[:limit]
+		last := page.Entries[limit-1]
+		page.Next = store.EncodeCursor(last.Timestamp, last.ID)
+	}
+
+	return page, nil
+}
+
+func (s *SqlStore) GetWebhooks(projectID string) ([]structs.Webhook, error) {
+	webhooks := []structs.Webhook{}
+	err := s.all(&webhooks, "SELECT * FROM webhooks WHERE project=? ORDER BY createdat", projectID)
+
+	return webhooks, err
+}
+
+func (s *SqlStore) GetWebhook(id string) (structs.Webhook, error) {
+	w := structs.Webhook{}
+	err := s.get(&w, "SELECT * FROM webhooks WHERE id=?", id)
+
+	if err == sql.ErrNoRows {
+		return w, store.NotFoundError
+	}
+
+	return w, err
+}
+
+func (s *SqlStore) StoreWebhook(w structs.Webhook) error {
+	_, err := s.conn.NamedExec(s.dialect.upsertQuery("webhooks", []string{"id"}, "project", "url", "secret", "events", "createdat"), w)
+
+	return err
+}
+
+func (s *SqlStore) DeleteWebhook(id string) error {
+	res, err := s.exec("DELETE FROM webhooks WHERE id=?", id)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err == nil && n == 0 {
+		return store.NotFoundError
+	}
+
+	return err
+}
+
+func (s *SqlStore) GetDeliveries(webhookID string) ([]structs.Delivery, error) {
+	deliveries := []structs.Delivery{}
+	err := s.all(&deliveries, "SELECT * FROM deliveries WHERE webhookid=? ORDER BY createdat DESC", webhookID)
+
+	return deliveries, err
+}
+
+func (s *SqlStore) GetDueDeliveries(now time.Time) ([]structs.Delivery, error) {
+	deliveries := []structs.Delivery{}
+	err := s.all(&deliveries, "SELECT * FROM deliveries WHERE status=? AND nextattempt<=? ORDER BY createdat", structs.DeliveryPending, now)
+
+	return deliveries, err
+}
+
+func (s *SqlStore) StoreDelivery(d structs.Delivery) error {
+	_, err := s.conn.NamedExec(s.dialect.upsertQuery("deliveries", []string{"id"}, "webhookid", "event", "payload", "status", "attempts", "nextattempt", "lasterror", "responsecode", "createdat", "deliveredat"), d)
+
+	return err
+}
+
+func (s *SqlStore) GetComparison(baseImageID, imageID, maskID, settings string) (structs.Comparison, error) {
+	c := structs.Comparison{}
+	err := s.get(&c, "SELECT * FROM comparisons WHERE baseimageid=? AND imageid=? AND maskid=? AND settings=?", baseImageID, imageID, maskID, settings)
+
+	if err == sql.ErrNoRows {
+		return c, store.NotFoundError
+	}
+
+	return c, err
+}
+
+func (s *SqlStore) StoreComparison(c structs.Comparison) error {
+	_, err := s.conn.NamedExec(s.dialect.upsertQuery("comparisons", []string{"baseimageid", "imageid", "maskid", "settings"}, "diffscore", "diffimageid", "diffclusters"), c)
+
+	return err
+}
+
+func (s *SqlStore) DeleteComparisons(imageIDs []string) ([]string, error) {
+	diffs := []string{}
+	if len(imageIDs) == 0 {
+		return diffs, nil
+	}
+
+	query, args, err := sqlx.In("SELECT diffimageid FROM comparisons WHERE baseimageid IN (?) OR imageid IN (?)", imageIDs, imageIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.all(&diffs, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	query, args, err = sqlx.In("DELETE FROM comparisons WHERE baseimageid IN (?) OR imageid IN (?)", imageIDs, imageIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = s.exec(query, args...)
+
+	return diffs, err
+}
+
 // The image methods make sense, but in the SQL case we are encoding/decoding 2 times and we dont need to (API is png and DB is png)
 func (s *SqlStore) GetImage(imgID string) (image.Image, error) {
 	imageBytes := []byte{}
-	err := s.conn.Get(&imageBytes, "SELECT image FROM images WHERE id=$1", imgID)
+	err := s.get(&imageBytes, "SELECT image FROM images WHERE id=?", imgID)
 
 	if err == sql.ErrNoRows {
 		return nil, store.NotFoundError
@@ -187,13 +628,54 @@ func (s *SqlStore) StoreImage(img image.Image) (string, error) {
 	}
 	imageBytes := buf.Bytes()
 
-	s.conn.MustExec("INSERT INTO images (id, image) VALUES ($1, $2)", id, imageBytes)
+	_, err = s.exec("INSERT INTO images (id, image) VALUES (?, ?)", id, imageBytes)
+	if err != nil {
+		return "", err
+	}
+
 	return id, nil
 }
 
+func (s *SqlStore) DeleteImage(id string) error {
+	_, err := s.exec("DELETE FROM images WHERE id=?", id)
+
+	return err
+}
+
+func (s *SqlStore) ReferencedImages(ids []string) (map[string]bool, error) {
+	ret := map[string]bool{}
+	if len(ids) == 0 {
+		return ret, nil
+	}
+
+	for _, q := range []string{
+		"SELECT imageid FROM results WHERE imageid IN (?)",
+		"SELECT baseimageid FROM results WHERE baseimageid IN (?)",
+		"SELECT diffimageid FROM results WHERE diffimageid IN (?)",
+		"SELECT imageid FROM base_images WHERE imageid IN (?)",
+	} {
+		query, args, err := sqlx.In(q, ids)
+		if err != nil {
+			return nil, err
+		}
+
+		var referenced []string
+		err = s.all(&referenced, query, args...)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, id := range referenced {
+			ret[id] = true
+		}
+	}
+
+	return ret, nil
+}
+
 func (s *SqlStore) GetBaseImageID(projectID, branch, target, browser string) (string, error) {
 	var imgID string
-	err := s.conn.Get(&imgID, "SELECT imageid FROM base_images WHERE project=$1 AND branch=$2 AND target=$3 AND browser=$4", projectID, branch, target, browser)
+	err := s.get(&imgID, "SELECT imageid FROM base_images WHERE project=? AND branch=? AND target=? AND browser=?", projectID, branch, target, browser)
 
 	if err == sql.ErrNoRows {
 		return "", store.NotFoundError
@@ -203,20 +685,27 @@ func (s *SqlStore) GetBaseImageID(projectID, branch, target, browser string) (st
 }
 
 func (s *SqlStore) SetBaseImageID(baseImageID, projectID, branch, target, browser string) error {
-	_, err := s.GetBaseImageID(projectID, branch, target, browser)
+	_, err := s.conn.NamedExec(s.upsertBaseQuery("base_images", "imageid"), map[string]interface{}{
+		"project": projectID,
+		"branch":  branch,
+		"target":  target,
+		"browser": browser,
+		"imageid": baseImageID,
+	})
 
-	if err == store.NotFoundError {
-		s.conn.MustExec("INSERT INTO base_images (project, branch, target, browser, imageid) VALUES($1, $2, $3, $4, $5)", projectID, branch, target, browser, baseImageID)
-	} else if err == nil {
-		s.conn.MustExec("UPDATE base_images SET imageid=$5 WHERE project=$1 AND branch=$2 AND target=$3 AND browser=$4", projectID, branch, target, browser, baseImageID)
-	}
+	return err
+}
+
+func (s *SqlStore) GetBaseImageCases(projectID, branch string) ([]structs.CaseKey, error) {
+	cases := []structs.CaseKey{}
+	err := s.all(&cases, "SELECT project, target, browser FROM base_images WHERE project=? AND branch=?", projectID, branch)
 
-	return nil
+	return cases, err
 }
 
 func (s *SqlStore) GetBaseMaskID(projectID, branch, target, browser string) (string, error) {
 	var maskID string
-	err := s.conn.Get(&maskID, "SELECT maskid FROM base_masks WHERE project=$1 AND branch=$2 AND target=$3 AND browser=$4", projectID, branch, target, browser)
+	err := s.get(&maskID, "SELECT maskid FROM base_masks WHERE project=? AND branch=? AND target=? AND browser=?", projectID, branch, target, browser)
 
 	if err == sql.ErrNoRows {
 		return "", store.NotFoundError
@@ -226,6 +715,13 @@ func (s *SqlStore) GetBaseMaskID(projectID, branch, target, browser string) (str
 }
 
 func (s *SqlStore) SetBaseMaskID(baseMaskID, projectID, branch, target, browser string) error {
-	s.conn.MustExec("INSERT INTO base_masks (project, branch, target, browser, maskid) VALUES($1, $2, $3, $4, $5) ON DUPLICATE KEY UPDATE maskid=$5", projectID, branch, target, browser, baseMaskID)
-	return nil
+	_, err := s.conn.NamedExec(s.upsertBaseQuery("base_masks", "maskid"), map[string]interface{}{
+		"project": projectID,
+		"branch":  branch,
+		"target":  target,
+		"browser": browser,
+		"maskid":  baseMaskID,
+	})
+
+	return err
 }
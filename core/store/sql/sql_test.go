@@ -0,0 +1,40 @@
+package sql
+
+import (
+	"os"
+	"testing"
+
+	"github.com/theopticians/optician-api/core/store"
+	"github.com/theopticians/optician-api/core/store/storetest"
+)
+
+// TestSqlStore needs a database, set SQL_TEST_DIALECT and SQL_TEST_URL to run
+// it. Every table is dropped first.
+func TestSqlStore(t *testing.T) {
+	dialect := os.Getenv("SQL_TEST_DIALECT")
+	url := os.Getenv("SQL_TEST_URL")
+	if dialect == "" || url == "" {
+		t.Skip("SQL_TEST_DIALECT and SQL_TEST_URL not set")
+	}
+
+	storetest.GenericTestStore(t, func() store.Store {
+		s, err := OpenSqlStore(dialect, url)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, table := range []string{"schema_migrations", "masks", "images", "results", "base_images", "base_masks", "jobs", "webhooks", "deliveries", "comparisons", "batches", "projects", "api_keys", "audit_log"} {
+			_, err = s.exec("DROP TABLE IF EXISTS " + table)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		err = s.Migrate()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return s
+	})
+}
@@ -0,0 +1,16 @@
+package sql
+
+import (
+	// Import sqlite driver, it needs cgo.
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// OpenSqliteStore opens the SQLite database in the file, creating it if
+// needed, without migrating it.
+//
+// SQLite allows a single writer: transactions take the write lock when they
+// begin, and wait for it up to 5 seconds, so concurrent ones don't fail when
+// they first write. WAL lets reads go on while a transaction writes.
+func OpenSqliteStore(path string) (*SqlStore, error) {
+	return OpenSqlStore("sqlite", "file:"+path+"?_busy_timeout=5000&_journal_mode=WAL&_txlock=immediate")
+}
@@ -0,0 +1,33 @@
+package sql
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/theopticians/optician-api/core/store"
+	"github.com/theopticians/optician-api/core/store/storetest"
+)
+
+func TestSqliteStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "optician")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	storetest.GenericTestStore(t, func() store.Store {
+		s, err := OpenSqliteStore(filepath.Join(dir, "optician_test_"+RandStringBytes(10)+".sqlite"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = s.Migrate()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return s
+	})
+}
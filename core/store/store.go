@@ -3,6 +3,7 @@ package store
 import (
 	"errors"
 	"image"
+	"time"
 
 	"github.com/theopticians/optician-api/core/structs"
 )
@@ -10,23 +11,91 @@ import (
 var NotFoundError = errors.New("Not found in DB")
 
 type Store interface {
+	Migrator
+
 	Close()
+
+	// Transaction runs fn with a store whose operations are applied
+	// atomically: all of them are committed if fn returns nil, none of them
+	// otherwise. Calling Transaction on that store runs fn in the same
+	// transaction.
+	Transaction(fn func(Store) error) error
+
 	GetResults() ([]structs.Result, error)
 	GetResultsByBatch(string) ([]structs.Result, error)
 	GetResult(string) (structs.Result, error)
 	GetLastResult(projectID, branch, target, browser string) (structs.Result, error)
 	StoreResult(structs.Result) error
+	QueryResults(ResultQuery) (ResultPage, error)
+
+	// AcceptResults stores the results and sets each of them as the base image
+	// of its case, in a single transaction.
+	AcceptResults([]structs.Result) error
+
+	GetJobs() ([]structs.Job, error)
+	StoreJob(structs.Job) error
+	DeleteJob(string) error
 
 	GetBatchs() ([]structs.BatchInfo, error)
+	QueryBatchs(BatchQuery) (BatchPage, error)
+	GetBatch(string) (structs.Batch, error)
+	StoreBatch(structs.Batch) error
+	GetLastFinalizedBatch(projectID, branch string) (structs.Batch, error)
+	GetOpenBatches() ([]structs.Batch, error)
+
+	// GetEmptyBatches returns the stored batches without results, which
+	// GetBatchs doesn't list.
+	GetEmptyBatches() ([]structs.Batch, error)
+
+	// DeleteBatch deletes the batch and its results, in a single
+	// transaction. Their images are kept, they may be base images.
+	DeleteBatch(string) error
 
 	GetMask(string) (structs.Mask, error)
 	StoreMask(masks structs.Mask) (string, error)
 
+	GetProjects() ([]structs.Project, error)
+	GetProject(string) (structs.Project, error)
+	StoreProject(structs.Project) error
+	DeleteProject(string) error
+
+	GetAPIKeys(projectID string) ([]structs.APIKey, error)
+	GetAPIKey(string) (structs.APIKey, error)
+	StoreAPIKey(structs.APIKey) error
+	DeleteAPIKey(string) error
+
+	// AppendAudit adds an entry to the audit log, whose entries are never
+	// updated or deleted.
+	AppendAudit(structs.AuditEntry) error
+	QueryAudit(AuditQuery) (AuditPage, error)
+
+	GetWebhooks(projectID string) ([]structs.Webhook, error)
+	GetWebhook(string) (structs.Webhook, error)
+	StoreWebhook(structs.Webhook) error
+	DeleteWebhook(string) error
+
+	GetDeliveries(webhookID string) ([]structs.Delivery, error)
+	GetDueDeliveries(time.Time) ([]structs.Delivery, error)
+	StoreDelivery(structs.Delivery) error
+
+	GetComparison(baseImageID, imageID, maskID, settings string) (structs.Comparison, error)
+	StoreComparison(structs.Comparison) error
+
+	// DeleteComparisons deletes the comparisons of any of the images, as
+	// base or compared image, and returns their diff images.
+	DeleteComparisons(imageIDs []string) ([]string, error)
+
 	GetImage(string) (image.Image, error)
 	StoreImage(image.Image) (string, error)
+	DeleteImage(string) error
+
+	// ReferencedImages returns which of the images are the image, base image
+	// or diff image of a result, or the base image of a case.
+	ReferencedImages(ids []string) (map[string]bool, error)
 
 	GetBaseImageID(projectID, branch, target, browser string) (string, error)
 	SetBaseImageID(baseImageID, projectID, branch, target, browser string) error
+	GetBaseImageCases(projectID, branch string) ([]structs.CaseKey, error)
 
 	GetBaseMaskID(projectID, branch, target, browser string) (string, error)
 	SetBaseMaskID(baseImageID, projectID, branch, target, browser string) error
@@ -0,0 +1,750 @@
+// Package storetest holds the tests every store.Store implementation must
+// pass.
+package storetest
+
+import (
+	"errors"
+	"image"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	_ "image/png"
+
+	"github.com/theopticians/optician-api/core/imgdiff"
+	"github.com/theopticians/optician-api/core/store"
+	"github.com/theopticians/optician-api/core/structs"
+)
+
+var testImg1 = readImage("so_1.png")
+
+func readImage(name string) image.Image {
+	_, file, _, _ := runtime.Caller(0)
+	reader, err := os.Open(filepath.Join(filepath.Dir(file), "..", "..", "testimages", name))
+	if err != nil {
+		panic(err)
+	}
+	defer reader.Close()
+	im, _, err := image.Decode(reader)
+	if err != nil {
+		panic(err)
+	}
+	return im
+}
+
+// GenericTestStore runs the tests against stores returned by newStore, which
+// must be empty and migrated.
+func GenericTestStore(t *testing.T, newStore func() store.Store) {
+
+	t.Run("image storage", func(t *testing.T) {
+		s := newStore()
+		defer s.Close()
+
+		img1ID, err := s.StoreImage(testImg1)
+		if err != nil {
+			t.Fatal("Error storing image:", err)
+		}
+
+		img1Retrieved, err := s.GetImage(img1ID)
+		if err != nil {
+			t.Fatal("Error retrieving image:", err)
+		}
+
+		_, diffPixels, err := imgdiff.ComputeDiffImage(testImg1, img1Retrieved, []image.Rectangle{})
+		if err != nil || diffPixels > 0 {
+			t.Fatal("Retrieved image is not equal to original")
+		}
+	})
+
+	t.Run("referenced images", func(t *testing.T) {
+		s := newStore()
+		defer s.Close()
+
+		err := s.StoreResult(structs.Result{ID: "r1", Project: "p", Branch: "master", Batch: "b1", Target: "home", Browser: "chrome", ImageID: "i1", BaseImageID: "i2", DiffImageID: "i3", Timestamp: time.Now()})
+		if err != nil {
+			t.Fatal("Error storing result:", err)
+		}
+
+		err = s.SetBaseImageID("i4", "p", "master", "about", "chrome")
+		if err != nil {
+			t.Fatal("Error setting base image:", err)
+		}
+
+		referenced, err := s.ReferencedImages([]string{"i1", "i2", "i3", "i4", "i5"})
+		if err != nil || len(referenced) != 4 || referenced["i5"] {
+			t.Fatal("Expected every image but i5 to be referenced, got", referenced, err)
+		}
+
+		for _, c := range []structs.Comparison{
+			{BaseImageID: "i1", ImageID: "i5", MaskID: "nomask", DiffImageID: "d1"},
+			{BaseImageID: "i5", ImageID: "i2", MaskID: "nomask", DiffImageID: "d2"},
+			{BaseImageID: "i1", ImageID: "i2", MaskID: "nomask", DiffImageID: "d3"},
+		} {
+			err = s.StoreComparison(c)
+			if err != nil {
+				t.Fatal("Error storing comparison:", err)
+			}
+		}
+
+		diffs, err := s.DeleteComparisons([]string{"i5"})
+		if err != nil || len(diffs) != 2 {
+			t.Fatal("Expected the comparisons of i5 to be deleted, got", diffs, err)
+		}
+
+		_, err = s.GetComparison("i1", "i5", "nomask", "")
+		if err != store.NotFoundError {
+			t.Fatal("Expected the comparison to be deleted, got", err)
+		}
+
+		_, err = s.GetComparison("i1", "i2", "nomask", "")
+		if err != nil {
+			t.Fatal("Expected the comparison of other images to be kept, got", err)
+		}
+
+		id, err := s.StoreImage(testImg1)
+		if err != nil {
+			t.Fatal("Error storing image:", err)
+		}
+
+		err = s.DeleteImage(id)
+		if err != nil {
+			t.Fatal("Error deleting image:", err)
+		}
+
+		_, err = s.GetImage(id)
+		if err != store.NotFoundError {
+			t.Fatal("Expected the image to be deleted, got", err)
+		}
+	})
+
+	t.Run("base image id", func(t *testing.T) {
+		const baseImageID = "abc"
+		const project = "project"
+		const branch = "branch"
+		const target = "target"
+		const browser = "browser"
+
+		s := newStore()
+		defer s.Close()
+
+		_, err := s.GetBaseImageID(project, branch, target, browser)
+		if err != store.NotFoundError {
+			t.Fatal("Expected not found error when getting unexistant base image ID, got", err)
+		}
+
+		err = s.SetBaseImageID(baseImageID, project, branch, target, browser)
+		if err != nil {
+			t.Fatal("Error setting base image:", err)
+		}
+
+		retrieved, err := s.GetBaseImageID(project, branch, target, browser)
+		if err != nil {
+			t.Fatal("Error getting base image:", err)
+		}
+
+		if retrieved != baseImageID {
+			t.Fatal("Expected retrieved base image to be ", baseImageID, " got ", retrieved)
+		}
+
+		// Setting it again replaces it
+		err = s.SetBaseImageID("def", project, branch, target, browser)
+		if err != nil {
+			t.Fatal("Error setting base image again:", err)
+		}
+
+		retrieved, err = s.GetBaseImageID(project, branch, target, browser)
+		if err != nil || retrieved != "def" {
+			t.Fatal("Expected retrieved base image to be def, got", retrieved, err)
+		}
+
+		cases, err := s.GetBaseImageCases(project, branch)
+		if err != nil || len(cases) != 1 {
+			t.Fatal("Expected a single case with a base image, got", cases, err)
+		}
+	})
+
+	t.Run("base mask id", func(t *testing.T) {
+		s := newStore()
+		defer s.Close()
+
+		_, err := s.GetBaseMaskID("project", "branch", "target", "browser")
+		if err != store.NotFoundError {
+			t.Fatal("Expected not found error when getting unexistant base mask ID, got", err)
+		}
+
+		for _, maskID := range []string{"abc", "def"} {
+			err = s.SetBaseMaskID(maskID, "project", "branch", "target", "browser")
+			if err != nil {
+				t.Fatal("Error setting base mask:", err)
+			}
+
+			retrieved, err := s.GetBaseMaskID("project", "branch", "target", "browser")
+			if err != nil || retrieved != maskID {
+				t.Fatal("Expected retrieved base mask to be", maskID, "got", retrieved, err)
+			}
+		}
+	})
+
+	t.Run("last result", func(t *testing.T) {
+		s := newStore()
+		defer s.Close()
+
+		now := time.Now()
+		results := []structs.Result{
+			{ID: "r1", Project: "p", Branch: "master", Batch: "b1", Target: "home", Browser: "chrome", Timestamp: now},
+			{ID: "r2", Project: "p", Branch: "master", Batch: "b2", Target: "home", Browser: "chrome", Timestamp: now.Add(time.Second)},
+			// Newer, but of other cases
+			{ID: "r3", Project: "p", Branch: "master", Batch: "b2", Target: "about", Browser: "chrome", Timestamp: now.Add(2 * time.Second)},
+			{ID: "r4", Project: "p", Branch: "dev", Batch: "b3", Target: "home", Browser: "chrome", Timestamp: now.Add(3 * time.Second)},
+		}
+
+		for _, r := range results {
+			err := s.StoreResult(r)
+			if err != nil {
+				t.Fatal("Error storing result:", err)
+			}
+		}
+
+		last, err := s.GetLastResult("p", "master", "home", "chrome")
+		if err != nil || last.ID != "r2" {
+			t.Fatal("Expected last result to be r2, got", last.ID, err)
+		}
+
+		last, err = s.GetLastResult("p", "dev", "home", "chrome")
+		if err != nil || last.ID != "r4" {
+			t.Fatal("Expected last result to be r4, got", last.ID, err)
+		}
+
+		_, err = s.GetLastResult("p", "master", "home", "firefox")
+		if err != store.NotFoundError {
+			t.Fatal("Expected not found error for a case without results, got", err)
+		}
+	})
+
+	t.Run("store result twice", func(t *testing.T) {
+		s := newStore()
+		defer s.Close()
+
+		r := structs.Result{ID: "r1", Project: "p", Branch: "master", Batch: "b1", Target: "home", Browser: "chrome", Status: structs.StatusPending, Timestamp: time.Now()}
+		err := s.StoreResult(r)
+		if err != nil {
+			t.Fatal("Error storing result:", err)
+		}
+
+		r.Status = structs.StatusDone
+		r.DiffScore = 12
+		err = s.StoreResult(r)
+		if err != nil {
+			t.Fatal("Error storing result again:", err)
+		}
+
+		retrieved, err := s.GetResult("r1")
+		if err != nil || retrieved.Status != structs.StatusDone || retrieved.DiffScore != 12 {
+			t.Fatal("Expected result to be updated, got", retrieved, err)
+		}
+
+		batch, err := s.GetResultsByBatch("b1")
+		if err != nil || len(batch) != 1 {
+			t.Fatal("Expected a single result in the batch, got", batch, err)
+		}
+	})
+
+	t.Run("accept results", func(t *testing.T) {
+		s := newStore()
+		defer s.Close()
+
+		err := s.SetBaseImageID("old", "p", "master", "home", "chrome")
+		if err != nil {
+			t.Fatal("Error setting base image:", err)
+		}
+
+		r := structs.Result{ID: "r1", Project: "p", Branch: "master", Batch: "b1", Target: "home", Browser: "chrome", ImageID: "new", Review: structs.ReviewAccepted, ReviewedBy: "key:k1", Timestamp: time.Now()}
+		err = s.AcceptResults([]structs.Result{r})
+		if err != nil {
+			t.Fatal("Error accepting results:", err)
+		}
+
+		baseImageID, err := s.GetBaseImageID("p", "master", "home", "chrome")
+		if err != nil || baseImageID != "new" {
+			t.Fatal("Expected base image to be new, got", baseImageID, err)
+		}
+
+		retrieved, err := s.GetResult("r1")
+		if err != nil || retrieved.Review != structs.ReviewAccepted || retrieved.ReviewedBy != "key:k1" {
+			t.Fatal("Expected result to be accepted by its reviewer, got", retrieved, err)
+		}
+	})
+
+	t.Run("delete batch", func(t *testing.T) {
+		s := newStore()
+		defer s.Close()
+
+		now := time.Now()
+		for _, r := range []structs.Result{
+			{ID: "r1", Project: "p", Branch: "master", Batch: "b1", Target: "home", Browser: "chrome", Timestamp: now},
+			{ID: "r2", Project: "p", Branch: "master", Batch: "b1", Target: "about", Browser: "chrome", Timestamp: now},
+			{ID: "r3", Project: "p", Branch: "master", Batch: "b2", Target: "home", Browser: "chrome", Timestamp: now.Add(time.Second)},
+		} {
+			err := s.StoreResult(r)
+			if err != nil {
+				t.Fatal("Error storing result:", err)
+			}
+		}
+
+		err := s.StoreBatch(structs.Batch{ID: "b1", Project: "p", Branch: "master", CreatedAt: now, UpdatedAt: now})
+		if err != nil {
+			t.Fatal("Error storing batch:", err)
+		}
+
+		err = s.DeleteBatch("b1")
+		if err != nil {
+			t.Fatal("Error deleting batch:", err)
+		}
+
+		_, err = s.GetBatch("b1")
+		if err != store.NotFoundError {
+			t.Fatal("Expected not found error getting deleted batch, got", err)
+		}
+
+		_, err = s.GetResult("r1")
+		if err != store.NotFoundError {
+			t.Fatal("Expected not found error getting result of deleted batch, got", err)
+		}
+
+		batchs, err := s.GetBatchs()
+		if err != nil || len(batchs) != 1 || batchs[0].ID != "b2" {
+			t.Fatal("Expected only batch b2 to be left, got", batchs, err)
+		}
+
+		last, err := s.GetLastResult("p", "master", "home", "chrome")
+		if err != nil || last.ID != "r3" {
+			t.Fatal("Expected last result to be r3, got", last, err)
+		}
+	})
+
+	t.Run("open batches", func(t *testing.T) {
+		s := newStore()
+		defer s.Close()
+
+		now := time.Now()
+		for _, b := range []structs.Batch{
+			{ID: "b1", Project: "p", Branch: "master", CreatedAt: now, UpdatedAt: now},
+			{ID: "b2", Project: "p", Branch: "master", CreatedAt: now, UpdatedAt: now, FinalizedAt: &now},
+		} {
+			err := s.StoreBatch(b)
+			if err != nil {
+				t.Fatal("Error storing batch:", err)
+			}
+		}
+
+		batches, err := s.GetOpenBatches()
+		if err != nil || len(batches) != 1 || batches[0].ID != "b1" {
+			t.Fatal("Expected only batch b1 to be open, got", batches, err)
+		}
+
+		err = s.StoreResult(structs.Result{ID: "r1", Project: "p", Branch: "master", Batch: "b1", Target: "home", Browser: "chrome", Timestamp: now})
+		if err != nil {
+			t.Fatal("Error storing result:", err)
+		}
+
+		batches, err = s.GetEmptyBatches()
+		if err != nil || len(batches) != 1 || batches[0].ID != "b2" {
+			t.Fatal("Expected only batch b2 to be empty, got", batches, err)
+		}
+	})
+
+	t.Run("failed batch results", func(t *testing.T) {
+		s := newStore()
+		defer s.Close()
+
+		now := time.Now()
+		for _, r := range []structs.Result{
+			{ID: "r1", Project: "p", Branch: "master", Batch: "b1", Target: "home", Browser: "chrome", DiffScore: 0.5, Status: structs.StatusDone, Timestamp: now},
+			{ID: "r2", Project: "p", Branch: "master", Batch: "b1", Target: "about", Browser: "chrome", Status: structs.StatusFailed, Timestamp: now},
+			{ID: "r3", Project: "p", Branch: "master", Batch: "b1", Target: "blog", Browser: "chrome", Status: structs.StatusPending, Timestamp: now},
+			{ID: "r4", Project: "p", Branch: "master", Batch: "b1", Target: "faq", Browser: "chrome", Status: structs.StatusDone, Timestamp: now},
+		} {
+			err := s.StoreResult(r)
+			if err != nil {
+				t.Fatal("Error storing result:", err)
+			}
+		}
+
+		batchs, err := s.GetBatchs()
+		if err != nil || len(batchs) != 1 || batchs[0].Failed != 2 {
+			t.Fatal("Expected the differing and failed results to count as failed, got", batchs, err)
+		}
+	})
+
+	t.Run("query results", func(t *testing.T) {
+		s := newStore()
+		defer s.Close()
+
+		now := time.Now().UTC().Truncate(time.Second)
+		for _, r := range []structs.Result{
+			{ID: "r1", Project: "p", Branch: "master", Batch: "b1", Target: "home", Browser: "chrome", DiffScore: 0.2, Status: structs.StatusDone, Timestamp: now},
+			{ID: "r2", Project: "p", Branch: "master", Batch: "b1", Target: "about", Browser: "chrome", Status: structs.StatusFailed, Timestamp: now.Add(time.Second)},
+			{ID: "r3", Project: "p", Branch: "dev", Batch: "b2", Target: "home", Browser: "firefox", DiffScore: 0.1, Status: structs.StatusDone, Timestamp: now.Add(2 * time.Second)},
+			{ID: "r4", Project: "p", Branch: "master", Batch: "b3", Target: "home", Browser: "chrome", DiffScore: 0.3, Status: structs.StatusDone, Timestamp: now.Add(3 * time.Second)},
+			{ID: "r5", Project: "pp", Branch: "master", Batch: "b4", Target: "home", Browser: "chrome", Status: structs.StatusDone, Timestamp: now.Add(4 * time.Second)},
+		} {
+			err := s.StoreResult(r)
+			if err != nil {
+				t.Fatal("Error storing result:", err)
+			}
+		}
+
+		minScore := 0.15
+		for _, test := range []struct {
+			query store.ResultQuery
+			ids   string
+		}{
+			{store.ResultQuery{}, "r5 r4 r3 r2 r1"},
+			{store.ResultQuery{Project: "p"}, "r4 r3 r2 r1"},
+			{store.ResultQuery{Project: "p", Branch: "master", Target: "home"}, "r4 r1"},
+			{store.ResultQuery{Project: "p", Branch: "master", Target: "home", Browser: "chrome"}, "r4 r1"},
+			{store.ResultQuery{Project: "p", Target: "home"}, "r4 r3 r1"},
+			{store.ResultQuery{Batch: "b1"}, "r2 r1"},
+			{store.ResultQuery{Batch: "b1", Status: structs.StatusFailed}, "r2"},
+			{store.ResultQuery{Browser: "firefox"}, "r3"},
+			{store.ResultQuery{MinScore: &minScore}, "r4 r1"},
+			{store.ResultQuery{Since: now.Add(time.Second), Until: now.Add(3 * time.Second)}, "r3 r2"},
+			{store.ResultQuery{Project: "p", Sort: "diffscore"}, "r2 r3 r1 r4"},
+			{store.ResultQuery{Sort: "-target"}, "r5 r4 r3 r1 r2"},
+		} {
+			page, err := s.QueryResults(test.query)
+			if err != nil {
+				t.Fatal("Error querying results:", err)
+			}
+
+			if ids := resultIDs(page.Results); ids != test.ids || page.Next != "" {
+				t.Errorf("Expected results %s for query %+v, got %s", test.ids, test.query, ids)
+			}
+		}
+
+		// Pages follow each other until there's no next one
+		q := store.ResultQuery{Sort: "diffscore", Limit: 2}
+		var results []structs.Result
+		for i := 0; i < 3; i++ {
+			page, err := s.QueryResults(q)
+			if err != nil {
+				t.Fatal("Error querying results:", err)
+			}
+
+			results = append(results, page.Results...)
+			if page.Next == "" {
+				break
+			}
+			q.Cursor = page.Next
+		}
+
+		if ids := resultIDs(results); ids != "r2 r5 r3 r1 r4" {
+			t.Fatal("Expected pages of results r2 r5 r3 r1 r4, got", ids)
+		}
+
+		_, err := s.QueryResults(store.ResultQuery{Sort: "nope"})
+		if _, ok := err.(store.QueryError); !ok {
+			t.Fatal("Expected a query error sorting by an unknown key, got", err)
+		}
+
+		_, err = s.QueryResults(store.ResultQuery{Cursor: "nope"})
+		if _, ok := err.(store.QueryError); !ok {
+			t.Fatal("Expected a query error with an invalid cursor, got", err)
+		}
+	})
+
+	t.Run("query batchs", func(t *testing.T) {
+		s := newStore()
+		defer s.Close()
+
+		now := time.Now().UTC().Truncate(time.Second)
+		for _, r := range []structs.Result{
+			{ID: "r1", Project: "p", Branch: "master", Batch: "b1", Target: "home", Browser: "chrome", Status: structs.StatusFailed, Timestamp: now},
+			{ID: "r2", Project: "p", Branch: "master", Batch: "b1", Target: "about", Browser: "chrome", Status: structs.StatusFailed, Timestamp: now},
+			{ID: "r3", Project: "p", Branch: "master", Batch: "b2", Target: "home", Browser: "chrome", Status: structs.StatusDone, Timestamp: now.Add(time.Second)},
+			{ID: "r4", Project: "q", Branch: "master", Batch: "b3", Target: "home", Browser: "chrome", Status: structs.StatusFailed, Timestamp: now.Add(2 * time.Second)},
+		} {
+			err := s.StoreResult(r)
+			if err != nil {
+				t.Fatal("Error storing result:", err)
+			}
+		}
+
+		for _, test := range []struct {
+			query store.BatchQuery
+			ids   string
+		}{
+			{store.BatchQuery{}, "b3 b2 b1"},
+			{store.BatchQuery{Project: "p"}, "b2 b1"},
+			{store.BatchQuery{Since: now.Add(time.Second)}, "b3 b2"},
+			{store.BatchQuery{Until: now.Add(time.Second)}, "b1"},
+			{store.BatchQuery{Sort: "-failed"}, "b1 b3 b2"},
+			{store.BatchQuery{Sort: "id"}, "b1 b2 b3"},
+		} {
+			page, err := s.QueryBatchs(test.query)
+			if err != nil {
+				t.Fatal("Error querying batchs:", err)
+			}
+
+			if ids := batchIDs(page.Batchs); ids != test.ids || page.Next != "" {
+				t.Errorf("Expected batchs %s for query %+v, got %s", test.ids, test.query, ids)
+			}
+		}
+
+		page, err := s.QueryBatchs(store.BatchQuery{Sort: "id", Limit: 2})
+		if err != nil || batchIDs(page.Batchs) != "b1 b2" || page.Next == "" {
+			t.Fatal("Expected a first page of batchs b1 b2, got", page, err)
+		}
+
+		ids := []string{}
+		q := store.BatchQuery{Limit: 1}
+		for {
+			page, err := s.QueryBatchs(q)
+			if err != nil {
+				t.Fatal("Error querying batchs:", err)
+			}
+
+			ids = append(ids, batchIDs(page.Batchs))
+			if page.Next == "" {
+				break
+			}
+			q.Cursor = page.Next
+		}
+
+		if strings.Join(ids, " ") != "b3 b2 b1" {
+			t.Fatal("Expected pages of the newest batchs b3 b2 b1, got", ids)
+		}
+
+		page, err = s.QueryBatchs(store.BatchQuery{Sort: "id", Limit: 2, Cursor: page.Next})
+		if err != nil || batchIDs(page.Batchs) != "b3" || page.Next != "" {
+			t.Fatal("Expected a last page of batch b3, got", page, err)
+		}
+
+		_, err = s.QueryBatchs(store.BatchQuery{Sort: "diffscore"})
+		if _, ok := err.(store.QueryError); !ok {
+			t.Fatal("Expected a query error sorting by an unknown key, got", err)
+		}
+	})
+
+	t.Run("projects", func(t *testing.T) {
+		s := newStore()
+		defer s.Close()
+
+		now := time.Now().UTC().Truncate(time.Second)
+		for _, p := range []structs.Project{
+			{ID: "web", Name: "Web", DefaultBranch: "master", Threshold: 0.1, ClusterDistance: 3, RetentionDays: 30, CreatedAt: now, UpdatedAt: now},
+			{ID: "app", Name: "App", CreatedAt: now, UpdatedAt: now},
+		} {
+			err := s.StoreProject(p)
+			if err != nil {
+				t.Fatal("Error storing project:", err)
+			}
+		}
+
+		p, err := s.GetProject("web")
+		if err != nil || p.DefaultBranch != "master" || p.Threshold != 0.1 || p.ClusterDistance != 3 || p.RetentionDays != 30 || !p.CreatedAt.Equal(now) {
+			t.Fatal("Expected stored project, got", p, err)
+		}
+
+		p.Name = "Website"
+		err = s.StoreProject(p)
+		if err != nil {
+			t.Fatal("Error updating project:", err)
+		}
+
+		projects, err := s.GetProjects()
+		if err != nil || len(projects) != 2 || projects[0].ID != "app" || projects[1].Name != "Website" {
+			t.Fatal("Expected both projects sorted by ID, got", projects, err)
+		}
+
+		err = s.DeleteProject("app")
+		if err != nil {
+			t.Fatal("Error deleting project:", err)
+		}
+
+		_, err = s.GetProject("app")
+		if err != store.NotFoundError {
+			t.Fatal("Expected not found error getting deleted project, got", err)
+		}
+
+		err = s.DeleteProject("app")
+		if err != store.NotFoundError {
+			t.Fatal("Expected not found error deleting missing project, got", err)
+		}
+	})
+
+	t.Run("api keys", func(t *testing.T) {
+		s := newStore()
+		defer s.Close()
+
+		now := time.Now().UTC().Truncate(time.Second)
+		for _, k := range []structs.APIKey{
+			{ID: "k1", Project: "p", Name: "CI", Role: structs.RoleUploader, Hash: "h1", CreatedAt: now},
+			{ID: "k2", Project: "p", Name: "QA", Role: structs.RoleReviewer, Hash: "h2", CreatedAt: now.Add(time.Second)},
+			{ID: "k3", Project: "other", Role: structs.RoleUploader, Hash: "h3", CreatedAt: now},
+		} {
+			err := s.StoreAPIKey(k)
+			if err != nil {
+				t.Fatal("Error storing API key:", err)
+			}
+		}
+
+		k, err := s.GetAPIKey("k2")
+		if err != nil || k.Project != "p" || k.Role != structs.RoleReviewer || k.Hash != "h2" {
+			t.Fatal("Expected stored API key with its hash, got", k, err)
+		}
+
+		keys, err := s.GetAPIKeys("p")
+		if err != nil || len(keys) != 2 || keys[0].ID != "k1" || keys[1].ID != "k2" {
+			t.Fatal("Expected the keys of the project by creation, got", keys, err)
+		}
+
+		err = s.DeleteAPIKey("k1")
+		if err != nil {
+			t.Fatal("Error deleting API key:", err)
+		}
+
+		_, err = s.GetAPIKey("k1")
+		if err != store.NotFoundError {
+			t.Fatal("Expected not found error getting deleted API key, got", err)
+		}
+
+		err = s.DeleteAPIKey("k1")
+		if err != store.NotFoundError {
+			t.Fatal("Expected not found error deleting missing API key, got", err)
+		}
+	})
+
+	t.Run("audit log", func(t *testing.T) {
+		s := newStore()
+		defer s.Close()
+
+		now := time.Now().UTC().Truncate(time.Second)
+		for _, e := range []structs.AuditEntry{
+			{ID: "a1", Timestamp: now, Actor: "key:k1", Action: "case.add", Project: "p", Batch: "b1", Result: "r1", After: structs.JSON(`{"id":"r1"}`)},
+			{ID: "a2", Timestamp: now.Add(time.Second), Actor: "user:ana", Action: "result.accept", Project: "p", Batch: "b1", Result: "r1", Before: structs.JSON(`{"review":""}`), After: structs.JSON(`{"review":"accepted"}`)},
+			{ID: "a3", Timestamp: now.Add(2 * time.Second), Actor: "admin", Action: "project.update", Project: "other"},
+		} {
+			err := s.AppendAudit(e)
+			if err != nil {
+				t.Fatal("Error appending audit entry:", err)
+			}
+		}
+
+		page, err := s.QueryAudit(store.AuditQuery{Project: "p"})
+		if err != nil || len(page.Entries) != 2 || page.Entries[0].ID != "a2" || page.Entries[1].ID != "a1" {
+			t.Fatal("Expected the entries of the project, newest first, got", page, err)
+		}
+
+		e := page.Entries[0]
+		if e.Actor != "user:ana" || string(e.Before) != `{"review":""}` || string(e.After) != `{"review":"accepted"}` || !e.Timestamp.Equal(now.Add(time.Second)) {
+			t.Fatal("Expected stored audit entry with its values, got", e)
+		}
+
+		page, err = s.QueryAudit(store.AuditQuery{Result: "r1", Action: "case.add"})
+		if err != nil || len(page.Entries) != 1 || page.Entries[0].ID != "a1" || len(page.Entries[0].Before) != 0 {
+			t.Fatal("Expected the entry of the action on the result, got", page, err)
+		}
+
+		page, err = s.QueryAudit(store.AuditQuery{Sort: "timestamp", Limit: 2})
+		if err != nil || len(page.Entries) != 2 || page.Entries[0].ID != "a1" || page.Next == "" {
+			t.Fatal("Expected the first page of the oldest entries, got", page, err)
+		}
+
+		page, err = s.QueryAudit(store.AuditQuery{Sort: "timestamp", Limit: 2, Cursor: page.Next})
+		if err != nil || len(page.Entries) != 1 || page.Entries[0].ID != "a3" || page.Next != "" {
+			t.Fatal("Expected the last page of entries, got", page, err)
+		}
+
+		page, err = s.QueryAudit(store.AuditQuery{Actor: "admin", Since: now.Add(time.Second)})
+		if err != nil || len(page.Entries) != 1 || page.Entries[0].ID != "a3" {
+			t.Fatal("Expected the entries of the actor since the time, got", page, err)
+		}
+
+		page, err = s.QueryAudit(store.AuditQuery{Until: now.Add(2 * time.Second), Limit: 1})
+		if err != nil || len(page.Entries) != 1 || page.Entries[0].ID != "a2" || page.Next == "" {
+			t.Fatal("Expected the first page of the newest entries until the time, got", page, err)
+		}
+
+		page, err = s.QueryAudit(store.AuditQuery{Until: now.Add(2 * time.Second), Limit: 1, Cursor: page.Next})
+		if err != nil || len(page.Entries) != 1 || page.Entries[0].ID != "a1" || page.Next != "" {
+			t.Fatal("Expected the last page of the newest entries until the time, got", page, err)
+		}
+
+		err = s.AppendAudit(structs.AuditEntry{ID: "a4", Timestamp: now.Add(3 * time.Second), Actor: "admin", Action: "project.create"})
+		if err != nil {
+			t.Fatal("Error appending audit entry:", err)
+		}
+
+		page, err = s.QueryAudit(store.AuditQuery{Actor: "admin"})
+		if err != nil || len(page.Entries) != 2 || page.Entries[0].ID != "a4" || page.Entries[1].ID != "a3" {
+			t.Fatal("Expected the entries of the actor with and without project, got", page, err)
+		}
+	})
+
+	t.Run("transaction", func(t *testing.T) {
+		s := newStore()
+		defer s.Close()
+
+		fail := errors.New("fail")
+		err := s.Transaction(func(tx store.Store) error {
+			err := tx.SetBaseMaskID("abc", "p", "master", "home", "chrome")
+			if err != nil {
+				return err
+			}
+
+			err = tx.StoreJob(structs.Job{ID: "j1", ResultID: "r1", CreatedAt: time.Now()})
+			if err != nil {
+				return err
+			}
+
+			return fail
+		})
+		if err != fail {
+			t.Fatal("Expected transaction error, got", err)
+		}
+
+		_, err = s.GetBaseMaskID("p", "master", "home", "chrome")
+		if err != store.NotFoundError {
+			t.Fatal("Expected base mask to be rolled back, got", err)
+		}
+
+		jobs, err := s.GetJobs()
+		if err != nil || len(jobs) != 0 {
+			t.Fatal("Expected job to be rolled back, got", jobs, err)
+		}
+
+		err = s.Transaction(func(tx store.Store) error {
+			return tx.StoreJob(structs.Job{ID: "j1", ResultID: "r1", CreatedAt: time.Now()})
+		})
+		if err != nil {
+			t.Fatal("Error running transaction:", err)
+		}
+
+		jobs, err = s.GetJobs()
+		if err != nil || len(jobs) != 1 {
+			t.Fatal("Expected job to be committed, got", jobs, err)
+		}
+	})
+}
+
+func resultIDs(results []structs.Result) string {
+	ids := []string{}
+	for _, r := range results {
+		ids = append(ids, r.ID)
+	}
+
+	return strings.Join(ids, " ")
+}
+
+func batchIDs(batchs []structs.BatchInfo) string {
+	ids := []string{}
+	for _, b := range batchs {
+		ids = append(ids, b.ID)
+	}
+
+	return strings.Join(ids, " ")
+}
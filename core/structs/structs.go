@@ -15,15 +15,55 @@ type Result struct {
 	Batch        string    `json:"batch"`
 	Target       string    `json:"target"`
 	Browser      string    `json:"browser"`
+	Commit       string    `json:"commit"`
+	Repository   string    `json:"repository"`
 	MaskID       string    `json:"mask"`
 	DiffScore    float64   `json:"diffscore"`
 	ImageID      string    `json:"image"`
 	BaseImageID  string    `json:"baseimage"`
 	DiffImageID  string    `json:"diffimage"`
 	DiffClusters Mask      `json:"diffclusters"`
+	Review       string    `json:"review"`
+	Status       string    `json:"status"`
+	Error        string    `json:"error"`
 	Timestamp    time.Time `json:"timestamp"`
+
+	// ReviewedBy and MaskedBy identify who accepted or rejected the result
+	// and who last changed its mask.
+	ReviewedBy string `json:"reviewedby"`
+	MaskedBy   string `json:"maskedby"`
+}
+
+// Results are pending until their diff is computed. Results stored before
+// diffs were asynchronous have an empty status and are done.
+const (
+	StatusPending = "pending"
+	StatusDone    = "done"
+	StatusFailed  = "failed"
+)
+
+func (r Result) Pending() bool {
+	return r.Status == StatusPending
+}
+
+// Failed reports whether the result differs from its base image, or couldn't
+// be diffed against it.
+func (r Result) Failed() bool {
+	return r.Status == StatusFailed || r.DiffScore > 0
+}
+
+// Job is a result waiting for its diff to be computed.
+type Job struct {
+	ID        string    `json:"id"`
+	ResultID  string    `json:"result"`
+	CreatedAt time.Time `json:"createdat"`
 }
 
+const (
+	ReviewAccepted = "accepted"
+	ReviewRejected = "rejected"
+)
+
 type BatchInfo struct {
 	ID        string    `json:"id"`
 	Timestamp time.Time `json:"timestamp"`
@@ -31,13 +71,311 @@ type BatchInfo struct {
 	Project   string    `json:"project"`
 }
 
+// Event is emitted by core whenever results or batches change. Data holds the
+// changed Result or BatchSummary.
+type Event struct {
+	Type      string      `json:"type"`
+	Project   string      `json:"project"`
+	Batch     string      `json:"batch"`
+	Timestamp time.Time   `json:"timestamp"`
+	Data      interface{} `json:"data"`
+}
+
+// Project groups the cases of an application. Zero settings use the defaults
+// of the service.
+type Project struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+
+	// DefaultBranch is the branch whose baselines are used by the cases of
+	// other branches until they have their own.
+	DefaultBranch string `json:"defaultbranch"`
+
+	// Threshold and ClusterDistance override the diff settings of the
+	// service, when it uses the default comparator.
+	Threshold       float64 `json:"threshold"`
+	ClusterDistance int     `json:"clusterdistance"`
+
+	// RetentionDays is the age in days after which the batches of the
+	// project are deleted.
+	RetentionDays int `json:"retentiondays"`
+
+	CreatedAt time.Time `json:"createdat"`
+	UpdatedAt time.Time `json:"updatedat"`
+}
+
+const (
+	RoleUploader = "uploader"
+	RoleReviewer = "reviewer"
+)
+
+// APIKey authenticates the clients of a project. Uploaders can add cases and
+// batches, reviewers can accept, reject and mask results. Only the hash of
+// the key is stored.
+type APIKey struct {
+	ID        string    `json:"id"`
+	Project   string    `json:"project"`
+	Name      string    `json:"name"`
+	Role      string    `json:"role"`
+	Hash      string    `json:"hash,omitempty"`
+	CreatedAt time.Time `json:"createdat"`
+}
+
+// AuditEntry records a change made through the service: who made it, what it
+// changed and the values before and after it. Entries are never updated or
+// deleted.
+type AuditEntry struct {
+	ID        string    `json:"id"`
+	Timestamp time.Time `json:"timestamp"`
+	Actor     string    `json:"actor"`
+	Action    string    `json:"action"`
+
+	// Project, Batch and Result identify what the action changed, Object
+	// the API key or webhook when it changed one, or the case whose base
+	// image it changed.
+	Project string `json:"project"`
+	Batch   string `json:"batch"`
+	Result  string `json:"result"`
+	Object  string `json:"object"`
+
+	Before JSON `json:"before,omitempty"`
+	After  JSON `json:"after,omitempty"`
+}
+
+// Webhook subscribes an URL to the events of a project. An empty event list
+// subscribes to every event.
+type Webhook struct {
+	ID        string    `json:"id"`
+	Project   string    `json:"project"`
+	URL       string    `json:"url"`
+	Secret    string    `json:"secret,omitempty"`
+	Events    Strings   `json:"events"`
+	CreatedAt time.Time `json:"createdat"`
+}
+
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+// Delivery is an event sent, or to be sent, to a webhook.
+type Delivery struct {
+	ID           string     `json:"id"`
+	WebhookID    string     `json:"webhook"`
+	Event        string     `json:"event"`
+	Payload      string     `json:"payload"`
+	Status       string     `json:"status"`
+	Attempts     int        `json:"attempts"`
+	NextAttempt  time.Time  `json:"nextattempt"`
+	LastError    string     `json:"lasterror"`
+	ResponseCode int        `json:"responsecode"`
+	CreatedAt    time.Time  `json:"createdat"`
+	DeliveredAt  *time.Time `json:"deliveredat"`
+}
+
+// Comparison is a cached diff between two images. Settings identifies the
+// comparator settings it was computed with.
+type Comparison struct {
+	BaseImageID  string  `json:"baseimage"`
+	ImageID      string  `json:"image"`
+	MaskID       string  `json:"mask"`
+	Settings     string  `json:"settings"`
+	DiffScore    float64 `json:"diffscore"`
+	DiffImageID  string  `json:"diffimage"`
+	DiffClusters Mask    `json:"diffclusters"`
+}
+
+// Batch is a group of cases uploaded together, usually by a single CI run.
+// A finalized batch does not accept new cases.
+type Batch struct {
+	ID            string     `json:"id"`
+	Project       string     `json:"project"`
+	Branch        string     `json:"branch"`
+	Commit        string     `json:"commit"`
+	Repository    string     `json:"repository"`
+	ExpectedCases int        `json:"expectedcases"`
+	CreatedAt     time.Time  `json:"createdat"`
+	UpdatedAt     time.Time  `json:"updatedat"`
+	FinalizedAt   *time.Time `json:"finalizedat"`
+
+	// Cases missing from or added to the batch compared to its reference,
+	// computed when it is finalized.
+	Missing           Cases `json:"missing"`
+	Added             Cases `json:"added"`
+	MissingAsFailures bool  `json:"missingasfailures"`
+}
+
+func (b Batch) Finalized() bool {
+	return b.FinalizedAt != nil
+}
+
+// BatchSummary is the state of a batch along with counts of its results.
+// Shortfall is the number of ExpectedCases a finalized batch didn't receive.
+type BatchSummary struct {
+	Batch
+	Cases     int `json:"cases"`
+	Failed    int `json:"failed"`
+	Pending   int `json:"pending"`
+	Shortfall int `json:"shortfall"`
+}
+
+const (
+	ReferenceBaseline = "baseline"
+	ReferenceBatch    = "batch"
+)
+
+// FinalizeOptions controls how missing cases are detected when a batch is
+// finalized. The reference is either the current base images or the last
+// finalized batch on the same branch.
+type FinalizeOptions struct {
+	Reference         string `json:"reference"`
+	MissingAsFailures bool   `json:"missingasfailures"`
+}
+
+// Baseline is the base image of a case in a branch.
+type Baseline struct {
+	Project string `json:"project"`
+	Branch  string `json:"branch"`
+	Target  string `json:"target"`
+	Browser string `json:"browser"`
+	ImageID string `json:"image"`
+}
+
+// CaseKey identifies a case within a branch.
+type CaseKey struct {
+	Project string `json:"project"`
+	Target  string `json:"target"`
+	Browser string `json:"browser"`
+}
+
+type Cases []CaseKey
+
+func (c Cases) Value() (driver.Value, error) {
+	b, err := json.Marshal([]CaseKey(c))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return string(b), nil
+}
+
+func (c *Cases) Scan(value interface{}) error {
+	if value == nil {
+		*c = nil
+		return nil
+	}
+	if bv, err := driver.String.ConvertValue(value); err == nil {
+		if v, ok := bv.(string); ok {
+			return json.Unmarshal([]byte(v), (*[]CaseKey)(c))
+		}
+	}
+	return errors.New("failed to scan Cases")
+}
+
+// ReviewFilter selects the results of a batch affected by a bulk review. Empty
+// fields match everything.
+type ReviewFilter struct {
+	Targets  []string `json:"targets"`
+	Browsers []string `json:"browsers"`
+	Results  []string `json:"results"`
+}
+
+const (
+	OutcomeAccepted = "accepted"
+	OutcomeRejected = "rejected"
+	OutcomeSkipped  = "skipped"
+)
+
+// ReviewOutcome is the outcome of a bulk review for a single result.
+type ReviewOutcome struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+	Reason string `json:"reason,omitempty"`
+}
+
 type Case struct {
 	ProjectID string `json:"projectid"`
 	Branch    string `json:"branch"`
 	Target    string `json:"target"`
 	Browser   string `json:"browser"`
 	Batch     string `json:"batch"`
-	Image     image.Image
+
+	// Optional commit and repository the case was taken from, used to report
+	// commit statuses.
+	Commit     string `json:"commit"`
+	Repository string `json:"repository"`
+
+	Image image.Image
+}
+
+type Strings []string
+
+func (s Strings) Value() (driver.Value, error) {
+	b, err := json.Marshal([]string(s))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return string(b), nil
+}
+
+func (s *Strings) Scan(value interface{}) error {
+	if value == nil {
+		*s = nil
+		return nil
+	}
+	if bv, err := driver.String.ConvertValue(value); err == nil {
+		if v, ok := bv.(string); ok {
+			return json.Unmarshal([]byte(v), (*[]string)(s))
+		}
+	}
+	return errors.New("failed to scan Strings")
+}
+
+// JSON is an encoded JSON value, stored as text.
+type JSON []byte
+
+func (j JSON) MarshalJSON() ([]byte, error) {
+	if len(j) == 0 {
+		return []byte("null"), nil
+	}
+
+	return j, nil
+}
+
+func (j *JSON) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		*j = nil
+		return nil
+	}
+
+	*j = append((*j)[:0], data...)
+	return nil
+}
+
+func (j JSON) Value() (driver.Value, error) {
+	return string(j), nil
+}
+
+func (j *JSON) Scan(value interface{}) error {
+	if value == nil {
+		*j = nil
+		return nil
+	}
+	if bv, err := driver.String.ConvertValue(value); err == nil {
+		switch v := bv.(type) {
+		case string:
+			*j = JSON(v)
+			return nil
+		case []byte:
+			*j = append(JSON{}, v...)
+			return nil
+		}
+	}
+	return errors.New("failed to scan JSON")
 }
 
 type Mask []image.Rectangle
@@ -0,0 +1,89 @@
+package core
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+
+	"github.com/theopticians/optician-api/core/status"
+	"github.com/theopticians/optician-api/core/structs"
+)
+
+const statusContext = "optician"
+
+var (
+	repositoryPattern = regexp.MustCompile(`^[\w.-]+/[\w.-]+$`)
+	commitPattern     = regexp.MustCompile(`^[0-9a-fA-F]{40}$`)
+)
+
+// ValidateRevision checks the repository and commit statuses are reported
+// to, if set. The repository is "owner/name" and the commit a full SHA, so
+// they can't add path segments to the status API URL.
+func ValidateRevision(repository, commit string) error {
+	if repository != "" && !repositoryPattern.MatchString(repository) {
+		return ValidationError{"The repository " + repository + " is not an owner/name repository"}
+	}
+
+	if commit != "" && !commitPattern.MatchString(commit) {
+		return ValidationError{"The commit " + commit + " is not a 40 character SHA"}
+	}
+
+	return nil
+}
+
+// reportBatchStatus posts the state of the batch as the status of its commit:
+// pending while it's open or has pending diffs, and success or failure once
+// it's finalized and diffed.
+func (s *Service) reportBatchStatus(summary structs.BatchSummary) {
+	if s.config.StatusReporter == nil || summary.Commit == "" || summary.Repository == "" {
+		return
+	}
+
+	st := status.Status{
+		Repository: summary.Repository,
+		Commit:     summary.Commit,
+		TargetURL:  s.config.PublicURL + "/batches/" + summary.ID + "/summary",
+		Context:    statusContext,
+	}
+
+	switch {
+	case !summary.Finalized():
+		st.State = status.Pending
+		st.Description = "Waiting for the batch to be finalized"
+	case summary.Pending > 0:
+		st.State = status.Pending
+		st.Description = fmt.Sprintf("Waiting for %d of %d diffs", summary.Pending, summary.Cases)
+	case summary.Shortfall > 0:
+		st.State = status.Failure
+		st.Description = fmt.Sprintf("Received %d of %d expected cases", summary.Cases, summary.ExpectedCases)
+	case summary.Failed > 0:
+		st.State = status.Failure
+		st.Description = fmt.Sprintf("%d of %d cases failed", summary.Failed, summary.Cases+len(summary.Missing))
+	default:
+		st.State = status.Success
+		st.Description = fmt.Sprintf("All %d cases passed", summary.Cases)
+	}
+
+	err := s.config.StatusReporter.Report(st)
+	if err != nil {
+		log.Println("error reporting status of batch", summary.ID, ":", err)
+	}
+}
+
+// reportChangedBatch reports again the status of the batch once its results
+// are diffed or reviewed, if the batch was finalized before.
+func (s *Service) reportChangedBatch(batch string) {
+	if s.config.StatusReporter == nil {
+		return
+	}
+
+	summary, err := s.BatchSummary(batch)
+	if err != nil {
+		log.Println("error getting summary of batch", batch, ":", err)
+		return
+	}
+
+	if summary.Finalized() {
+		s.reportBatchStatus(summary)
+	}
+}
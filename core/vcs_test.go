@@ -0,0 +1,168 @@
+package core
+
+import (
+	"image"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/theopticians/optician-api/core/status"
+	"github.com/theopticians/optician-api/core/store/memory"
+	"github.com/theopticians/optician-api/core/structs"
+)
+
+const testCommit = "0123456789abcdef0123456789abcdef01234567"
+
+type statusRecorder chan status.Status
+
+func (r statusRecorder) Report(st status.Status) error {
+	r <- st
+	return nil
+}
+
+// waitStatus waits for a report with the state and a description starting
+// with prefix, skipping the others.
+func waitStatus(t *testing.T, reports statusRecorder, state, prefix string) {
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case st := <-reports:
+			if st.State == state && strings.HasPrefix(st.Description, prefix) {
+				return
+			}
+		case <-timeout:
+			t.Fatal("Expected a", state, "status", prefix)
+		}
+	}
+}
+
+func newStatusTestService() (*Service, statusRecorder) {
+	reports := make(statusRecorder, 64)
+
+	c := DefaultConfig(memory.NewMemoryStore())
+	c.StatusReporter = reports
+
+	return NewService(c), reports
+}
+
+func statusCase(batch string, img image.Image) structs.Case {
+	return structs.Case{ProjectID: "p", Branch: "master", Target: "home", Browser: "chrome", Batch: batch, Commit: testCommit, Repository: "o/r", Image: img}
+}
+
+func TestStatusPendingDiffs(t *testing.T) {
+	s, reports := newStatusTestService()
+
+	_, err := s.AddCase(statusCase("b1", testImg1), "tester")
+	if err != nil {
+		t.Fatal("Error adding case:", err)
+	}
+
+	_, err = s.FinalizeBatch("b1", structs.FinalizeOptions{}, "tester")
+	if err != nil {
+		t.Fatal("Error finalizing batch:", err)
+	}
+
+	waitStatus(t, reports, status.Pending, "Waiting for 1 of 1 diffs")
+
+	// The diff completes after the batch is finalized
+	err = s.StartWorkers()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitStatus(t, reports, status.Success, "All 1 cases passed")
+}
+
+func TestStatusFailedDiff(t *testing.T) {
+	s, reports := newStatusTestService()
+
+	err := s.StartWorkers()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, img := range []image.Image{testImg1, image.NewNRGBA(image.Rect(0, 0, 10, 10))} {
+		batch := []string{"b1", "b2"}[i]
+
+		r, err := s.AddCase(statusCase(batch, img), "tester")
+		if err != nil {
+			t.Fatal("Error adding case:", err)
+		}
+
+		_, err = s.WaitResult(r.ID, 10*time.Second)
+		if err != nil {
+			t.Fatal("Error waiting result:", err)
+		}
+	}
+
+	summary, err := s.FinalizeBatch("b2", structs.FinalizeOptions{}, "tester")
+	if err != nil || summary.Failed != 1 {
+		t.Fatal("Expected the result of a different size to fail, got", summary, err)
+	}
+
+	waitStatus(t, reports, status.Failure, "1 of 1 cases failed")
+}
+
+func TestValidateRevision(t *testing.T) {
+	s, _ := newStatusTestService()
+
+	for _, c := range []structs.Case{
+		{Repository: "o/r/../../../user", Commit: testCommit},
+		{Repository: "o/r", Commit: "../../../user?"},
+		{Repository: "o/r", Commit: "abc"},
+	} {
+		c.ProjectID, c.Branch, c.Target, c.Browser, c.Batch, c.Image = "p", "master", "home", "chrome", "b1", testImg1
+
+		_, err := s.AddCase(c, "tester")
+		if _, ok := err.(ValidationError); !ok {
+			t.Error("Expected a validation error adding case of", c.Repository, c.Commit, "got", err)
+		}
+
+		_, err = s.OpenBatch(structs.Batch{Repository: c.Repository, Commit: c.Commit}, "tester")
+		if _, ok := err.(ValidationError); !ok {
+			t.Error("Expected a validation error opening batch of", c.Repository, c.Commit, "got", err)
+		}
+	}
+}
+
+func TestStatusAcceptedBatch(t *testing.T) {
+	s, reports := newStatusTestService()
+
+	err := s.StartWorkers()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, img := range []image.Image{testImg1, testImg2} {
+		batch := []string{"b1", "b2"}[i]
+
+		r, err := s.AddCase(statusCase(batch, img), "tester")
+		if err != nil {
+			t.Fatal("Error adding case:", err)
+		}
+
+		_, err = s.WaitResult(r.ID, 10*time.Second)
+		if err != nil {
+			t.Fatal("Error waiting result:", err)
+		}
+	}
+
+	_, err = s.FinalizeBatch("b2", structs.FinalizeOptions{}, "tester")
+	if err != nil {
+		t.Fatal("Error finalizing batch:", err)
+	}
+
+	waitStatus(t, reports, status.Failure, "1 of 1 cases failed")
+
+	_, err = s.AcceptBatch("b2", structs.ReviewFilter{}, "user:ana")
+	if err != nil {
+		t.Fatal("Error accepting batch:", err)
+	}
+
+	waitStatus(t, reports, status.Success, "All 1 cases passed")
+
+	summary, err := s.BatchSummary("b2")
+	if err != nil || summary.Failed != 0 {
+		t.Fatal("Expected accepted differences not to fail the batch, got", summary, err)
+	}
+}
@@ -0,0 +1,267 @@
+package core
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/theopticians/optician-api/core/store"
+	"github.com/theopticians/optician-api/core/structs"
+)
+
+var (
+	webhookBackoff    = time.Second
+	webhookMaxBackoff = time.Hour
+)
+
+var eventTypes = []string{
+	EventResultCreated,
+	EventDiffCompleted,
+	EventResultAccepted,
+	EventResultRejected,
+	EventMaskChanged,
+	EventBatchOpened,
+	EventBatchFinalized,
+}
+
+// CreateWebhook stores a new webhook, with a random secret unless it has one.
+func (s *Service) CreateWebhook(w structs.Webhook, by string) (structs.Webhook, error) {
+	u, err := url.Parse(w.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return structs.Webhook{}, ValidationError{"The webhook URL " + w.URL + " is not a valid http(s) URL"}
+	}
+
+	for _, e := range w.Events {
+		if !matchesAny(eventTypes, e) {
+			return structs.Webhook{}, ValidationError{"Unknown event " + e}
+		}
+	}
+
+	if w.Secret == "" {
+		w.Secret, err = randomSecret()
+		if err != nil {
+			return structs.Webhook{}, errors.Wrap(err, "error generating webhook secret")
+		}
+	}
+
+	w.ID = RandStringBytes(14)
+	w.CreatedAt = s.now()
+
+	err = s.db.Transaction(func(tx store.Store) error {
+		err := tx.StoreWebhook(w)
+		if err != nil {
+			return errors.Wrap(err, "error storing webhook")
+		}
+
+		return s.audit(tx, structs.AuditEntry{Actor: by, Action: AuditWebhookCreated, Project: w.Project, Object: w.ID}, nil, withoutSecret(w))
+	})
+	if err != nil {
+		return structs.Webhook{}, err
+	}
+
+	return w, nil
+}
+
+// Webhooks returns the webhooks of the project, without their secrets.
+func (s *Service) Webhooks(project string) ([]structs.Webhook, error) {
+	webhooks, err := s.db.GetWebhooks(project)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range webhooks {
+		webhooks[i].Secret = ""
+	}
+
+	return webhooks, nil
+}
+
+// DeleteWebhook deletes the webhook.
+func (s *Service) DeleteWebhook(id, by string) error {
+	return s.db.Transaction(func(tx store.Store) error {
+		old, err := tx.GetWebhook(id)
+		if err != nil {
+			return err
+		}
+
+		err = tx.DeleteWebhook(id)
+		if err != nil {
+			return err
+		}
+
+		return s.audit(tx, structs.AuditEntry{Actor: by, Action: AuditWebhookDeleted, Project: old.Project, Object: id}, withoutSecret(old), nil)
+	})
+}
+
+func withoutSecret(w structs.Webhook) structs.Webhook {
+	w.Secret = ""
+	return w
+}
+
+func (s *Service) WebhookDeliveries(id string) ([]structs.Delivery, error) {
+	_, err := s.db.GetWebhook(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.db.GetDeliveries(id)
+}
+
+// StartWebhooks starts delivering the outbox of webhook deliveries, including
+// the ones left pending by a previous run.
+func (s *Service) StartWebhooks() {
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+			case <-s.webhookTrigger:
+			}
+
+			err := s.deliverDue(s.now())
+			if err != nil {
+				log.Println("error delivering webhooks:", err)
+			}
+		}
+	}()
+}
+
+// recordDeliveries stores in tx a delivery in the outbox for every webhook
+// subscribed to the event.
+func (s *Service) recordDeliveries(tx store.Store, e structs.Event) error {
+	if e.Project == "" {
+		return nil
+	}
+
+	webhooks, err := tx.GetWebhooks(e.Project)
+	if err != nil {
+		return errors.Wrap(err, "error getting webhooks of project "+e.Project)
+	}
+
+	if len(webhooks) == 0 {
+		return nil
+	}
+
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return errors.Wrap(err, "error encoding event "+e.Type)
+	}
+
+	for _, w := range webhooks {
+		if !matchesAny(w.Events, e.Type) {
+			continue
+		}
+
+		d := structs.Delivery{
+			ID:          RandStringBytes(14),
+			WebhookID:   w.ID,
+			Event:       e.Type,
+			Payload:     string(payload),
+			Status:      structs.DeliveryPending,
+			NextAttempt: e.Timestamp,
+			CreatedAt:   e.Timestamp,
+		}
+
+		err = tx.StoreDelivery(d)
+		if err != nil {
+			return errors.Wrap(err, "error storing delivery for webhook "+w.ID)
+		}
+	}
+
+	return nil
+}
+
+func (s *Service) deliverDue(now time.Time) error {
+	deliveries, err := s.db.GetDueDeliveries(now)
+	if err != nil {
+		return err
+	}
+
+	for _, d := range deliveries {
+		w, err := s.db.GetWebhook(d.WebhookID)
+		if err != nil {
+			d.Status = structs.DeliveryFailed
+			d.LastError = "webhook not found: " + err.Error()
+		} else {
+			s.deliver(&d, w, now)
+		}
+
+		err = s.db.StoreDelivery(d)
+		if err != nil {
+			return errors.Wrap(err, "error storing delivery")
+		}
+	}
+
+	return nil
+}
+
+// deliver posts the delivery payload to the webhook, scheduling a retry with
+// exponential backoff if it fails.
+func (s *Service) deliver(d *structs.Delivery, w structs.Webhook, now time.Time) {
+	d.Attempts++
+
+	err := s.post(d, w)
+	if err == nil {
+		d.Status = structs.DeliveryDelivered
+		d.LastError = ""
+		d.DeliveredAt = &now
+		return
+	}
+
+	d.LastError = err.Error()
+
+	if d.Attempts >= s.config.WebhookMaxAttempts {
+		d.Status = structs.DeliveryFailed
+		return
+	}
+
+	backoff := webhookBackoff << uint(d.Attempts-1)
+	if backoff > webhookMaxBackoff || backoff <= 0 {
+		backoff = webhookMaxBackoff
+	}
+	d.NextAttempt = now.Add(backoff)
+}
+
+func (s *Service) post(d *structs.Delivery, w structs.Webhook) error {
+	req, err := http.NewRequest("POST", w.URL, bytes.NewBufferString(d.Payload))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Optician-Event", d.Event)
+	req.Header.Set("X-Optician-Delivery", d.ID)
+	req.Header.Set("X-Optician-Signature", SignPayload(w.Secret, []byte(d.Payload)))
+
+	resp, err := s.webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	d.ResponseCode = resp.StatusCode
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.New("unexpected response status " + strconv.Itoa(resp.StatusCode))
+	}
+
+	return nil
+}
+
+// SignPayload returns the signature sent in the X-Optician-Signature header,
+// the hex encoded HMAC-SHA256 of the payload keyed with the webhook secret.
+func SignPayload(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,134 @@
+package core
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/theopticians/optician-api/core/store/memory"
+	"github.com/theopticians/optician-api/core/structs"
+)
+
+func TestWebhookDelivery(t *testing.T) {
+	received := make(chan *http.Request, 1)
+	var body []byte
+
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = ioutil.ReadAll(r.Body)
+		received <- r
+	}))
+	defer receiver.Close()
+
+	project := "webhooks_" + RandStringBytes(10)
+
+	webhook, err := svc.CreateWebhook(structs.Webhook{Project: project, URL: receiver.URL, Events: []string{EventBatchFinalized}}, "tester")
+	if err != nil {
+		t.Fatal("Error creating webhook:", err)
+	}
+
+	b, err := svc.OpenBatch(structs.Batch{Project: project}, "tester")
+	if err != nil {
+		t.Fatal("Error opening batch:", err)
+	}
+
+	_, err = svc.FinalizeBatch(b.ID, structs.FinalizeOptions{}, "tester")
+	if err != nil {
+		t.Fatal("Error finalizing batch:", err)
+	}
+
+	// The deliveries are stored with the change, there's none for a
+	// failed one.
+	_, err = svc.FinalizeBatch(b.ID, structs.FinalizeOptions{}, "tester")
+	if err == nil {
+		t.Fatal("Expected finalizing the batch twice to fail")
+	}
+
+	err = svc.deliverDue(time.Now())
+	if err != nil {
+		t.Fatal("Error delivering webhooks:", err)
+	}
+
+	req := <-received
+
+	if event := req.Header.Get("X-Optician-Event"); event != EventBatchFinalized {
+		t.Fatal("Expected event", EventBatchFinalized, "got", event)
+	}
+
+	if sig := req.Header.Get("X-Optician-Signature"); sig != SignPayload(webhook.Secret, body) {
+		t.Fatal("Signature", sig, "does not match payload")
+	}
+
+	deliveries, err := svc.WebhookDeliveries(webhook.ID)
+	if err != nil {
+		t.Fatal("Error getting deliveries:", err)
+	}
+
+	if len(deliveries) != 1 || deliveries[0].Status != structs.DeliveryDelivered {
+		t.Fatal("Expected a single delivered delivery, got", deliveries)
+	}
+}
+
+func TestWebhookRetry(t *testing.T) {
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer receiver.Close()
+
+	project := "webhooks_" + RandStringBytes(10)
+
+	webhook, err := svc.CreateWebhook(structs.Webhook{Project: project, URL: receiver.URL}, "tester")
+	if err != nil {
+		t.Fatal("Error creating webhook:", err)
+	}
+
+	_, err = svc.OpenBatch(structs.Batch{Project: project}, "tester")
+	if err != nil {
+		t.Fatal("Error opening batch:", err)
+	}
+
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		err = svc.deliverDue(now)
+		if err != nil {
+			t.Fatal("Error delivering webhooks:", err)
+		}
+		now = now.Add(time.Hour)
+	}
+
+	deliveries, err := svc.WebhookDeliveries(webhook.ID)
+	if err != nil {
+		t.Fatal("Error getting deliveries:", err)
+	}
+
+	d := deliveries[0]
+	if d.Status != structs.DeliveryPending || d.Attempts != 3 || d.ResponseCode != http.StatusServiceUnavailable {
+		t.Fatal("Expected a pending delivery after 3 failed attempts, got", d)
+	}
+
+	if !d.NextAttempt.After(now.Add(-time.Hour)) {
+		t.Fatal("Expected next attempt to be backed off, got", d.NextAttempt)
+	}
+}
+
+func TestWebhookSecrets(t *testing.T) {
+	now := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	c := DefaultConfig(memory.NewMemoryStore())
+	c.Clock = func() time.Time { return now }
+	s := NewService(c)
+
+	secrets := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		webhook, err := s.CreateWebhook(structs.Webhook{Project: "secrets", URL: "http://localhost/hook"}, "tester")
+		if err != nil {
+			t.Fatal("Error creating webhook:", err)
+		}
+
+		if len(webhook.Secret) != 64 || secrets[webhook.Secret] {
+			t.Fatal("Expected a new random secret, got", webhook.Secret)
+		}
+		secrets[webhook.Secret] = true
+	}
+}
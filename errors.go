@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/pkg/errors"
+	"github.com/theopticians/optician-api/core"
+	"github.com/theopticians/optician-api/core/store"
+)
+
+// errorModel is the body of error responses, as described in swagger.yaml.
+type errorModel struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// errorStatus returns the status code the API replies to the error with.
+func errorStatus(err error) int {
+	cause := errors.Cause(err)
+	if cause == store.NotFoundError {
+		return http.StatusNotFound
+	}
+
+	switch cause.(type) {
+	case store.QueryError:
+		return http.StatusBadRequest
+	case core.ValidationError:
+		return http.StatusUnprocessableEntity
+	case core.NotFoundError:
+		return http.StatusNotFound
+	case core.ConflictError, core.StaleResultError:
+		return http.StatusConflict
+	case core.UnauthorizedError:
+		return http.StatusUnauthorized
+	case core.ForbiddenError:
+		return http.StatusForbidden
+	}
+
+	return http.StatusInternalServerError
+}
+
+// newErrorModel returns the body of the error response with the status
+// code. Errors of the service, rather than of the request, are logged and
+// replied to with a generic message, as theirs may reveal queries or paths.
+func newErrorModel(code int, err error) errorModel {
+	if code >= http.StatusInternalServerError {
+		log.Println("error serving request:", err)
+		return errorModel{Code: code, Message: "Internal server error"}
+	}
+
+	message := err.Error()
+	if errors.Cause(err) == store.NotFoundError {
+		message = "Not found"
+	}
+
+	return errorModel{Code: code, Message: message}
+}
+
+// writeError replies with the error and the status code matching it.
+func writeError(rw http.ResponseWriter, err error) {
+	writeErrorStatus(rw, errorStatus(err), err)
+}
+
+// writeErrorStatus replies with the error and the status code.
+func writeErrorStatus(rw http.ResponseWriter, code int, err error) {
+	writeErrorModel(rw, newErrorModel(code, err))
+}
+
+func writeErrorModel(rw http.ResponseWriter, e errorModel) {
+	body, _ := json.Marshal(e)
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(e.Code)
+	rw.Write(body)
+}
+
+// recovery replies with a 500 error when the handler panics, instead of
+// dropping the connection, and logs the panic with the request.
+func recovery(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+
+			// Aborting the response is how handlers stop streaming
+			if p == http.ErrAbortHandler {
+				panic(p)
+			}
+
+			log.Printf("panic serving %s %s from %s: %v\n%s", req.Method, req.URL, req.RemoteAddr, p, debug.Stack())
+			writeErrorModel(rw, errorModel{Code: http.StatusInternalServerError, Message: "Internal server error"})
+		}()
+
+		h.ServeHTTP(rw, req)
+	})
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/theopticians/optician-api/core"
+	"github.com/theopticians/optician-api/core/store"
+)
+
+func TestErrorStatus(t *testing.T) {
+	tests := []struct {
+		err  error
+		code int
+	}{
+		{store.NotFoundError, http.StatusNotFound},
+		{errors.Wrap(store.NotFoundError, "error getting batch"), http.StatusNotFound},
+		{store.QueryError{}, http.StatusBadRequest},
+		{core.ValidationError{Message: "Unknown event"}, http.StatusUnprocessableEntity},
+		{core.NotFoundError{Message: "No such batch"}, http.StatusNotFound},
+		{errors.Wrap(core.ConflictError{Message: "The batch is finalized"}, "error adding case"), http.StatusConflict},
+		{core.StaleResultError{Message: "Cannot accept an old test", LastResultID: "r2"}, http.StatusConflict},
+		{core.UnauthorizedError{Message: "Invalid API key"}, http.StatusUnauthorized},
+		{core.ForbiddenError{Message: "The reviewer role is required"}, http.StatusForbidden},
+		{errors.New("disk full"), http.StatusInternalServerError},
+	}
+
+	for _, test := range tests {
+		if code := errorStatus(test.err); code != test.code {
+			t.Error("Expected status", test.code, "for", test.err, "got", code)
+		}
+	}
+}
+
+func TestRecovery(t *testing.T) {
+	h := recovery(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		panic("boom")
+	}))
+
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, httptest.NewRequest("GET", "/results/abc", nil))
+
+	if rw.Code != http.StatusInternalServerError {
+		t.Fatal("Expected status 500, got", rw.Code)
+	}
+
+	var body errorModel
+	err := json.Unmarshal(rw.Body.Bytes(), &body)
+	if err != nil || body.Code != http.StatusInternalServerError {
+		t.Fatal("Expected an error model, got", rw.Body.String(), err)
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	tests := []struct {
+		err     error
+		code    int
+		message string
+	}{
+		{errors.Wrap(errors.New("open /var/lib/optician/db: disk full"), "error storing result"), http.StatusInternalServerError, "Internal server error"},
+		{errors.Wrap(store.NotFoundError, "error getting batch"), http.StatusNotFound, "Not found"},
+		{core.ConflictError{Message: "The batch is finalized"}, http.StatusConflict, "The batch is finalized"},
+	}
+
+	for _, test := range tests {
+		rw := httptest.NewRecorder()
+		writeError(rw, test.err)
+
+		var body errorModel
+		err := json.Unmarshal(rw.Body.Bytes(), &body)
+		if err != nil || rw.Code != test.code || body.Code != test.code || body.Message != test.message {
+			t.Error("Expected status", test.code, "and message", test.message, "for", test.err, "got", rw.Code, rw.Body.String(), err)
+		}
+	}
+}
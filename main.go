@@ -3,181 +3,572 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"flag"
+	"fmt"
 	"image"
 	_ "image/jpeg"
 	"image/png"
+	"io"
 	"log"
 	"net/http"
+	"os"
 	"strconv"
+	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
 	"github.com/theopticians/optician-api/core"
-	"github.com/theopticians/optician-api/core/store"
 	"github.com/theopticians/optician-api/core/structs"
+	_ "golang.org/x/image/webp"
 )
 
+// maxWait caps the time a client can wait for a pending result.
+const maxWait = 60 * time.Second
+
+// server serves the API of a core service.
+type server struct {
+	core *core.Service
+
+	// maxUploadSize is the maximum size in bytes of the body of a case.
+	maxUploadSize int64
+
+	// maxBulkUploadSize is the maximum size in bytes of the body of a bulk
+	// upload.
+	maxBulkUploadSize int64
+
+	imageLimits imageLimits
+
+	// authEnabled requires the callers of mutating endpoints to
+	// authenticate, with adminToken, an API key or a JWT verified by oidc,
+	// when set.
+	authEnabled bool
+	adminToken  string
+	oidc        *oidcVerifier
+}
+
 func main() {
-	r := mux.NewRouter()
+	c, args, err := loadConfig(os.Args[1:])
+	if err == flag.ErrHelp {
+		return
+	} else if err != nil {
+		log.Fatal(err)
+	}
+
+	db, err := openStore(c.Store)
+	if err != nil {
+		log.Fatal(err)
+	}
+	println("Using backend: " + c.Store.Type)
+
+	config, err := serviceConfig(c, db)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	s := &server{
+		core:              core.NewService(config),
+		maxUploadSize:     int64(c.MaxUploadSize),
+		maxBulkUploadSize: int64(c.MaxBulkUploadSize),
+		imageLimits:       imageLimits{width: c.MaxImageWidth, height: c.MaxImageHeight},
+		authEnabled:       c.Auth.Enabled,
+		adminToken:        c.Auth.AdminToken,
+	}
 
-	r.HandleFunc("/cases", addCaseHandler).Methods("POST")
-	r.HandleFunc("/batches", getBatchsHandler).Methods("GET")
-	r.HandleFunc("/batches/{id}", getResultsByBatchHandler).Methods("GET")
-	r.HandleFunc("/results", getResultsHandler).Methods("GET")
-	r.HandleFunc("/results/{id}", getResultHandler).Methods("GET")
-	r.HandleFunc("/results/{id}/accept", acceptHandler).Methods("POST")
-	r.HandleFunc("/results/{id}/mask", maskHandler).Methods("POST")
-	r.HandleFunc("/image/{id}", imageHandler).Methods("GET")
+	if c.Auth.OIDC.Issuer != "" {
+		s.oidc, err = newOIDCVerifier(c.Auth.OIDC)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
 
-	http.Handle("/", middleware(r))
-	log.Println("Server started at port 9000")
-	log.Fatal(http.ListenAndServe(":9000", nil))
+	if len(args) > 0 && args[0] == "migrate" {
+		migrateCommand(s.core, c.Store.Type, args[1:])
+		return
+	}
+
+	if !c.AutoMigrate {
+		pending, err := s.core.PendingMigrations()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(pending) > 0 {
+			log.Fatalf("The %s store has %d pending migrations, run %s migrate", c.Store.Type, len(pending), os.Args[0])
+		}
+	} else {
+		err = s.core.Migrate()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	err = s.core.StartWorkers()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	s.core.StartWebhooks()
+	s.core.StartRetention()
+	s.core.StartBatchTimeouts()
+
+	http.Handle("/", recovery(cors(c.CORS.Origins, s.authenticate(s.router()))))
+	log.Println("Server started at " + c.Listen)
+	if c.TLS.CertFile != "" {
+		log.Fatal(http.ListenAndServeTLS(c.Listen, c.TLS.CertFile, c.TLS.KeyFile, nil))
+	}
+	log.Fatal(http.ListenAndServe(c.Listen, nil))
 }
 
-func middleware(h http.Handler) http.Handler {
+func (s *server) router() *mux.Router {
+	r := mux.NewRouter()
+
+	r.HandleFunc("/cases", s.addCaseHandler).Methods("POST")
+	r.HandleFunc("/batches", s.getBatchsHandler).Methods("GET")
+	r.HandleFunc("/batches", s.openBatchHandler).Methods("POST")
+	r.HandleFunc("/batches/{id}", s.getResultsByBatchHandler).Methods("GET")
+	r.HandleFunc("/batches/{id}/cases", s.bulkCasesHandler).Methods("POST")
+	r.HandleFunc("/batches/{id}/summary", s.batchSummaryHandler).Methods("GET")
+	r.HandleFunc("/batches/{a}/compare/{b}", s.compareBatchesHandler).Methods("GET")
+	r.HandleFunc("/batches/{id}/finalize", s.finalizeBatchHandler).Methods("POST")
+	r.HandleFunc("/batches/{id}/accept", s.batchAcceptHandler).Methods("POST")
+	r.HandleFunc("/batches/{id}/reject", s.batchRejectHandler).Methods("POST")
+	r.HandleFunc("/results", s.getResultsHandler).Methods("GET")
+	r.HandleFunc("/results/{id}", s.getResultHandler).Methods("GET")
+	r.HandleFunc("/results/{id}/accept", s.acceptHandler).Methods("POST")
+	r.HandleFunc("/results/{id}/reject", s.rejectHandler).Methods("POST")
+	r.HandleFunc("/results/{id}/mask", s.maskHandler).Methods("POST")
+	r.HandleFunc("/image/{id}", s.imageHandler).Methods("GET")
+	r.HandleFunc("/events", s.eventsHandler).Methods("GET")
+	r.HandleFunc("/projects", s.getProjectsHandler).Methods("GET")
+	r.HandleFunc("/projects", s.createProjectHandler).Methods("POST")
+	r.HandleFunc("/projects/{project}", s.getProjectHandler).Methods("GET")
+	r.HandleFunc("/projects/{project}", s.updateProjectHandler).Methods("PUT")
+	r.HandleFunc("/projects/{project}", s.deleteProjectHandler).Methods("DELETE")
+	r.HandleFunc("/projects/{project}/baselines/revert", s.revertBaselineHandler).Methods("POST")
+	r.HandleFunc("/projects/{project}/keys", s.getAPIKeysHandler).Methods("GET")
+	r.HandleFunc("/projects/{project}/keys", s.createAPIKeyHandler).Methods("POST")
+	r.HandleFunc("/keys/{id}", s.deleteAPIKeyHandler).Methods("DELETE")
+	r.HandleFunc("/projects/{project}/webhooks", s.getWebhooksHandler).Methods("GET")
+	r.HandleFunc("/projects/{project}/webhooks", s.createWebhookHandler).Methods("POST")
+	r.HandleFunc("/webhooks/{id}", s.deleteWebhookHandler).Methods("DELETE")
+	r.HandleFunc("/webhooks/{id}/deliveries", s.getDeliveriesHandler).Methods("GET")
+	r.HandleFunc("/audit", s.auditHandler).Methods("GET")
+
+	return r
+}
+
+// cors allows the origins to call the API from browsers.
+func cors(origins []string, h http.Handler) http.Handler {
+	allowed := map[string]bool{}
+	for _, o := range origins {
+		allowed[o] = true
+	}
+
 	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
-		rw.Header().Set("Access-Control-Allow-Origin", "*")
+		if allowed["*"] {
+			rw.Header().Set("Access-Control-Allow-Origin", "*")
+		} else if origin := req.Header.Get("Origin"); allowed[origin] {
+			rw.Header().Set("Access-Control-Allow-Origin", origin)
+			rw.Header().Add("Vary", "Origin")
+		}
+
+		// Preflight requests of browsers sending credentials or JSON
+		if req.Method == "OPTIONS" && req.Header.Get("Access-Control-Request-Method") != "" {
+			rw.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE")
+			rw.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+			rw.WriteHeader(http.StatusNoContent)
+			return
+		}
+
 		h.ServeHTTP(rw, req)
 	})
 }
 
-func getBatchsHandler(rw http.ResponseWriter, req *http.Request) {
-	batchs, err := core.Batchs()
+func (s *server) getBatchsHandler(rw http.ResponseWriter, req *http.Request) {
+	q, err := parseBatchQuery(req.URL.Query())
+	if err != nil {
+		writeErrorStatus(rw, http.StatusBadRequest, err)
+		return
+	}
+
+	page, err := s.core.QueryBatchs(q)
 
 	if err != nil {
-		rw.WriteHeader(http.StatusInternalServerError)
-		rw.Write([]byte(err.Error()))
+		writeError(rw, err)
 		return
 	}
 
-	trJSON, err := json.Marshal(batchs)
+	trJSON, err := json.Marshal(page.Batchs)
 
 	if err != nil {
-		rw.WriteHeader(http.StatusInternalServerError)
-		rw.Write([]byte(err.Error()))
+		writeError(rw, err)
 		return
 	}
 
+	setNextPage(rw, req, page.Next)
 	rw.Write(trJSON)
 }
 
-func getResultsByBatchHandler(rw http.ResponseWriter, req *http.Request) {
+func (s *server) getResultsByBatchHandler(rw http.ResponseWriter, req *http.Request) {
 	vars := mux.Vars(req)
 	id := vars["id"]
-	tests, err := core.ResultsByBatchs(id)
+	tests, err := s.core.ResultsByBatchs(id)
 
 	if err != nil {
-		rw.WriteHeader(http.StatusInternalServerError)
-		rw.Write([]byte(err.Error()))
+		writeError(rw, err)
 		return
 	}
 
 	trJSON, err := json.Marshal(tests)
 
 	if err != nil {
-		rw.WriteHeader(http.StatusInternalServerError)
-		rw.Write([]byte(err.Error()))
+		writeError(rw, err)
 		return
 	}
 
 	rw.Write(trJSON)
 }
 
-func getResultsHandler(rw http.ResponseWriter, req *http.Request) {
-	tests, err := core.Results()
+func (s *server) openBatchHandler(rw http.ResponseWriter, req *http.Request) {
+	decoder := json.NewDecoder(req.Body)
+	var b structs.Batch
+	err := decoder.Decode(&b)
+	if err != nil {
+		writeErrorStatus(rw, http.StatusBadRequest, err)
+		return
+	}
+
+	defer req.Body.Close()
+
+	err = s.authorize(req, b.Project, structs.RoleUploader)
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+
+	b, err = s.core.OpenBatch(b, actor(req))
+
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+
+	bJSON, err := json.Marshal(b)
+
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+
+	rw.Header().Set("Location", "/batches/"+b.ID)
+	rw.WriteHeader(http.StatusCreated)
+	rw.Write(bJSON)
+}
+
+func (s *server) batchSummaryHandler(rw http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	id := vars["id"]
+
+	summary, err := s.core.BatchSummary(id)
 
 	if err != nil {
-		rw.WriteHeader(http.StatusInternalServerError)
-		rw.Write([]byte(err.Error()))
+		writeError(rw, err)
+		return
+	}
+
+	summaryJSON, err := json.Marshal(summary)
+
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+
+	rw.Write(summaryJSON)
+}
+
+func (s *server) finalizeBatchHandler(rw http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	id := vars["id"]
+
+	// The options are optional, an empty body compares against base images
+	var opts structs.FinalizeOptions
+	err := json.NewDecoder(req.Body).Decode(&opts)
+	if err != nil && err != io.EOF {
+		writeErrorStatus(rw, http.StatusBadRequest, err)
+		return
+	}
+
+	defer req.Body.Close()
+
+	err = s.authorizeBatch(req, id, structs.RoleUploader)
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+
+	summary, err := s.core.FinalizeBatch(id, opts, actor(req))
+
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+
+	summaryJSON, err := json.Marshal(summary)
+
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+
+	rw.Write(summaryJSON)
+}
+
+func (s *server) compareBatchesHandler(rw http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	tests, err := s.core.CompareBatches(vars["a"], vars["b"])
+
+	if err != nil {
+		writeError(rw, err)
 		return
 	}
 
 	trJSON, err := json.Marshal(tests)
 
 	if err != nil {
-		rw.WriteHeader(http.StatusInternalServerError)
-		rw.Write([]byte(err.Error()))
+		writeError(rw, err)
 		return
 	}
 
 	rw.Write(trJSON)
 }
 
-func addCaseHandler(rw http.ResponseWriter, req *http.Request) {
-	decoder := json.NewDecoder(req.Body)
-	var c ApiCase
-	err := decoder.Decode(&c)
+func (s *server) getResultsHandler(rw http.ResponseWriter, req *http.Request) {
+	q, err := parseResultQuery(req.URL.Query())
+	if err != nil {
+		writeErrorStatus(rw, http.StatusBadRequest, err)
+		return
+	}
+
+	page, err := s.core.QueryResults(q)
+
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+
+	trJSON, err := json.Marshal(page.Results)
+
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+
+	setNextPage(rw, req, page.Next)
+	rw.Write(trJSON)
+}
+
+func (s *server) addCaseHandler(rw http.ResponseWriter, req *http.Request) {
+	// The uploader is authorized before the image is decoded
+	c, err := readCase(req, s.maxUploadSize, s.imageLimits, func(c structs.Case) error {
+		return s.authorize(req, c.ProjectID, structs.RoleUploader)
+	})
 	if err != nil {
-		rw.WriteHeader(http.StatusInternalServerError)
-		rw.Write([]byte(err.Error()))
+		writeErrorStatus(rw, uploadErrorStatus(err), err)
 		return
 	}
 
 	defer req.Body.Close()
 
-	results, err := core.AddCase(structs.Case(c))
+	results, err := s.core.AddCase(c, actor(req))
+
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
 
+	apiResult, err := s.apiResult(results)
 	if err != nil {
-		rw.WriteHeader(http.StatusInternalServerError)
-		rw.Write([]byte(err.Error()))
+		writeError(rw, err)
 		return
 	}
 
+	trJSON, err := json.Marshal(apiResult)
+
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+
+	// The diff is computed asynchronously, clients poll the result or wait
+	// for it with the wait parameter
 	rw.Header().Set("Location", "/results/"+results.ID)
-	rw.WriteHeader(http.StatusCreated)
+	rw.WriteHeader(http.StatusAccepted)
+	rw.Write(trJSON)
 }
 
-func getResultHandler(rw http.ResponseWriter, req *http.Request) {
+func (s *server) getResultHandler(rw http.ResponseWriter, req *http.Request) {
 	var results structs.Result
 	var err error
 	vars := mux.Vars(req)
 	id := vars["id"]
 
-	if id != "" {
-		results, err = core.GetTest(id)
+	if wait := req.URL.Query().Get("wait"); wait != "" {
+		timeout, err := time.ParseDuration(wait)
 		if err != nil {
-			if err == store.NotFoundError {
-				rw.WriteHeader(http.StatusNotFound)
-				return
-			}
-			rw.WriteHeader(http.StatusInternalServerError)
-			rw.Write([]byte(err.Error()))
+			writeErrorStatus(rw, http.StatusBadRequest, err)
 			return
 		}
+		if timeout > maxWait {
+			timeout = maxWait
+		}
+		results, err = s.core.WaitResult(id, timeout)
 	} else {
-		rw.WriteHeader(http.StatusBadRequest)
+		results, err = s.core.GetTest(id)
+	}
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+
+	apiResult, err := s.apiResult(results)
+	if err != nil {
+		writeError(rw, err)
 		return
 	}
 
-	apiResult := ApiResult(results)
-	trJSON, err := json.Marshal(&apiResult)
+	trJSON, err := json.Marshal(apiResult)
 
 	if err != nil {
-		panic(err)
+		writeError(rw, err)
+		return
 	}
 
 	rw.Write(trJSON)
 }
 
-func acceptHandler(w http.ResponseWriter, r *http.Request) {
+func (s *server) acceptHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id := vars["id"]
 
-	err := core.AcceptTest(id)
+	err := s.authorizeResult(r, id, structs.RoleReviewer)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	err = s.core.AcceptTest(id, actor(r))
 
 	if err != nil {
-		if err == store.NotFoundError {
-			w.WriteHeader(http.StatusNotFound)
-			return
-		}
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(err.Error()))
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *server) rejectHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	err := s.authorizeResult(r, id, structs.RoleReviewer)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	err = s.core.RejectTest(id, actor(r))
+
+	if err != nil {
+		writeError(w, err)
 		return
 	}
 
 	w.WriteHeader(http.StatusOK)
 }
 
-func maskHandler(w http.ResponseWriter, r *http.Request) {
+// revertBaselineHandler sets the base image of the case in the body back to
+// the one before its last accept.
+func (s *server) revertBaselineHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	var baseline structs.Baseline
+	err := json.NewDecoder(r.Body).Decode(&baseline)
+	if err != nil {
+		writeErrorStatus(w, http.StatusBadRequest, err)
+		return
+	}
+
+	defer r.Body.Close()
+
+	err = s.authorize(r, vars["project"], structs.RoleReviewer)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	baseline.Project = vars["project"]
+	baseline, err = s.core.RevertBaseline(baseline, actor(r))
+
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	baselineJSON, err := json.Marshal(baseline)
+
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Write(baselineJSON)
+}
+
+func (s *server) batchAcceptHandler(w http.ResponseWriter, r *http.Request) {
+	s.batchReviewHandler(w, r, s.core.AcceptBatch)
+}
+
+func (s *server) batchRejectHandler(w http.ResponseWriter, r *http.Request) {
+	s.batchReviewHandler(w, r, s.core.RejectBatch)
+}
+
+func (s *server) batchReviewHandler(w http.ResponseWriter, r *http.Request, review func(string, structs.ReviewFilter, string) ([]structs.ReviewOutcome, error)) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	// The filter is optional, an empty body reviews the whole batch
+	var filter structs.ReviewFilter
+	err := json.NewDecoder(r.Body).Decode(&filter)
+	if err != nil && err != io.EOF {
+		writeErrorStatus(w, http.StatusBadRequest, err)
+		return
+	}
+
+	defer r.Body.Close()
+
+	err = s.authorizeBatch(r, id, structs.RoleReviewer)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	outcomes, err := review(id, filter, actor(r))
+
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	outcomesJSON, err := json.Marshal(outcomes)
+
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Write(outcomesJSON)
+}
+
+func (s *server) maskHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id := vars["id"]
 
@@ -185,39 +576,418 @@ func maskHandler(w http.ResponseWriter, r *http.Request) {
 	m := &structs.Mask{}
 	err := decoder.Decode(m)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(err.Error()))
+		writeErrorStatus(w, http.StatusBadRequest, err)
 		return
 	}
 
 	defer r.Body.Close()
 
+	err = s.authorizeResult(r, id, structs.RoleReviewer)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
 	// TODO return new results
-	_, err = core.MaskTest(id, []image.Rectangle(*m))
+	_, err = s.core.MaskTest(id, []image.Rectangle(*m), actor(r))
 
 	if err != nil {
-		if err == store.NotFoundError {
-			w.WriteHeader(http.StatusNotFound)
-			return
-		}
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(err.Error()))
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *server) getProjectsHandler(w http.ResponseWriter, r *http.Request) {
+	projects, err := s.core.Projects()
+
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	projectsJSON, err := json.Marshal(projects)
+
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Write(projectsJSON)
+}
+
+func (s *server) getProjectHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	project, err := s.core.GetProject(vars["project"])
+
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	projectJSON, err := json.Marshal(project)
+
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Write(projectJSON)
+}
+
+func (s *server) createProjectHandler(w http.ResponseWriter, r *http.Request) {
+	var project structs.Project
+	err := json.NewDecoder(r.Body).Decode(&project)
+	if err != nil {
+		writeErrorStatus(w, http.StatusBadRequest, err)
+		return
+	}
+
+	defer r.Body.Close()
+
+	err = s.authorizeAdmin(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	project, err = s.core.CreateProject(project, actor(r))
+
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	projectJSON, err := json.Marshal(project)
+
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Location", "/projects/"+project.ID)
+	w.WriteHeader(http.StatusCreated)
+	w.Write(projectJSON)
+}
+
+func (s *server) updateProjectHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	var project structs.Project
+	err := json.NewDecoder(r.Body).Decode(&project)
+	if err != nil {
+		writeErrorStatus(w, http.StatusBadRequest, err)
+		return
+	}
+
+	defer r.Body.Close()
+
+	err = s.authorizeAdmin(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	project.ID = vars["project"]
+	project, err = s.core.UpdateProject(project, actor(r))
+
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	projectJSON, err := json.Marshal(project)
+
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Write(projectJSON)
+}
+
+func (s *server) deleteProjectHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	err := s.authorizeAdmin(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	err = s.core.DeleteProject(vars["project"], actor(r))
+
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *server) getAPIKeysHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	err := s.authorizeAdmin(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	keys, err := s.core.APIKeys(vars["project"])
+
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	keysJSON, err := json.Marshal(keys)
+
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Write(keysJSON)
+}
+
+// createdAPIKey is the reply to the creation of a key, the only one with its
+// token.
+type createdAPIKey struct {
+	structs.APIKey
+	Token string `json:"token"`
+}
+
+func (s *server) createAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	var key structs.APIKey
+	err := json.NewDecoder(r.Body).Decode(&key)
+	if err != nil {
+		writeErrorStatus(w, http.StatusBadRequest, err)
+		return
+	}
+
+	defer r.Body.Close()
+
+	err = s.authorizeAdmin(r)
+	if err != nil {
+		writeError(w, err)
 		return
 	}
 
+	key.Project = vars["project"]
+	key, token, err := s.core.CreateAPIKey(key, actor(r))
+
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	keyJSON, err := json.Marshal(createdAPIKey{key, token})
+
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	w.Write(keyJSON)
+}
+
+func (s *server) deleteAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	err := s.authorizeAdmin(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	err = s.core.DeleteAPIKey(vars["id"], actor(r))
+
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *server) getWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	err := s.authorizeAdmin(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	webhooks, err := s.core.Webhooks(vars["project"])
+
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	webhooksJSON, err := json.Marshal(webhooks)
+
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Write(webhooksJSON)
+}
+
+func (s *server) createWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	var webhook structs.Webhook
+	err := json.NewDecoder(r.Body).Decode(&webhook)
+	if err != nil {
+		writeErrorStatus(w, http.StatusBadRequest, err)
+		return
+	}
+
+	defer r.Body.Close()
+
+	err = s.authorizeAdmin(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	webhook.Project = vars["project"]
+	webhook, err = s.core.CreateWebhook(webhook, actor(r))
+
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	webhookJSON, err := json.Marshal(webhook)
+
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Location", "/webhooks/"+webhook.ID)
+	w.WriteHeader(http.StatusCreated)
+	w.Write(webhookJSON)
+}
+
+func (s *server) deleteWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	err := s.authorizeAdmin(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	err = s.core.DeleteWebhook(vars["id"], actor(r))
+
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *server) getDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	err := s.authorizeAdmin(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	deliveries, err := s.core.WebhookDeliveries(vars["id"])
+
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	deliveriesJSON, err := json.Marshal(deliveries)
+
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Write(deliveriesJSON)
+}
+
+// eventsHandler streams core events as Server-Sent Events, optionally filtered
+// by the project and batch query parameters.
+func (s *server) eventsHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, errors.New("streaming not supported"))
+		return
+	}
+
+	filter := core.EventFilter{
+		Project: r.URL.Query().Get("project"),
+		Batch:   r.URL.Query().Get("batch"),
+	}
+
+	events, cancel := s.core.Subscribe(filter)
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
 	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(30 * time.Second)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+
+			eJSON, err := json.Marshal(e)
+			if err != nil {
+				log.Println("unable to encode event:", err)
+				continue
+			}
+
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, eJSON)
+			flusher.Flush()
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
 }
 
-func imageHandler(w http.ResponseWriter, r *http.Request) {
+func (s *server) imageHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id := vars["id"]
 
-	img := core.GetImage(id)
+	img, err := s.core.GetImage(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
 
 	buffer := new(bytes.Buffer)
 	if err := png.Encode(buffer, img); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("unable to encode image."))
+		writeError(w, errors.Wrap(err, "unable to encode image"))
+		return
 	}
 
 	w.Header().Set("Content-Type", "image/png")
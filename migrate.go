@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/theopticians/optician-api/core"
+)
+
+// migrateCommand runs the migrate subcommand:
+//
+//	optician-api migrate          applies the pending migrations
+//	optician-api migrate status   reports the schema version and pending migrations
+func migrateCommand(service *core.Service, storeType string, args []string) {
+	if len(args) > 0 && args[0] != "status" {
+		fmt.Fprintf(os.Stderr, "usage: %s migrate [status]\n", os.Args[0])
+		os.Exit(2)
+	}
+
+	if len(args) == 0 {
+		err := service.Migrate()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	version, err := service.SchemaVersion()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	pending, err := service.PendingMigrations()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Printf("%s store at schema version %d, %d pending migrations\n", storeType, version, len(pending))
+	for _, m := range pending {
+		fmt.Printf("  %d: %s\n", m.Version, m.Description)
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+	"github.com/pkg/errors"
+	"github.com/theopticians/optician-api/core"
+)
+
+// jwksRefreshInterval is the minimum time between fetches of the JWKS URL,
+// which is refetched when a token is signed by an unknown key.
+const jwksRefreshInterval = time.Minute
+
+// oidcVerifier authenticates the JWTs of an identity provider and maps their
+// claims to principals.
+type oidcVerifier struct {
+	config OIDCConfig
+	keys   *jwks
+	parser *jwt.Parser
+}
+
+func newOIDCVerifier(c OIDCConfig) (*oidcVerifier, error) {
+	keys := &jwks{url: c.JWKSURL, client: &http.Client{Timeout: 10 * time.Second}}
+
+	var err error
+	if c.JWKSFile != "" {
+		err = keys.loadFile(c.JWKSFile)
+	} else {
+		err = keys.fetch()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	options := []jwt.ParserOption{
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}),
+		jwt.WithIssuer(c.Issuer),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(30 * time.Second),
+	}
+	if c.Audience != "" {
+		options = append(options, jwt.WithAudience(c.Audience))
+	}
+
+	return &oidcVerifier{config: c, keys: keys, parser: jwt.NewParser(options...)}, nil
+}
+
+// principal verifies the token and returns the user it identifies, with the
+// project roles of its roles claim.
+func (v *oidcVerifier) principal(token string) (*principal, error) {
+	claims := jwt.MapClaims{}
+	_, err := v.parser.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		return v.keys.key(kid)
+	})
+	if err != nil {
+		return nil, core.UnauthorizedError{Message: "Invalid token: " + err.Error()}
+	}
+
+	user, _ := claims[v.config.UserClaim].(string)
+	if user == "" {
+		return nil, core.UnauthorizedError{Message: "The token has no " + v.config.UserClaim + " claim"}
+	}
+
+	p := &principal{actor: "user:" + user, roles: map[string][]string{}}
+
+	for _, role := range claimStrings(claims[v.config.RolesClaim]) {
+		if role == "admin" {
+			p.admin = true
+			continue
+		}
+
+		// Project roles are project:role, project IDs may contain colons
+		i := strings.LastIndex(role, ":")
+		if i <= 0 {
+			continue
+		}
+		p.roles[role[:i]] = append(p.roles[role[:i]], role[i+1:])
+	}
+
+	return p, nil
+}
+
+// claimStrings returns the strings of a claim, which is either a string or a
+// list of them.
+func claimStrings(claim interface{}) []string {
+	switch c := claim.(type) {
+	case string:
+		return strings.Fields(c)
+	case []interface{}:
+		ret := []string{}
+		for _, v := range c {
+			if s, ok := v.(string); ok {
+				ret = append(ret, s)
+			}
+		}
+		return ret
+	}
+
+	return nil
+}
+
+// jwks is a JSON Web Key Set, loaded from a file or fetched from an URL.
+type jwks struct {
+	url    string
+	client *http.Client
+
+	mu        sync.Mutex
+	keys      map[string]crypto.PublicKey
+	fetchedAt time.Time
+}
+
+// key returns the key with the ID. Keys of providers that rotate them are
+// refetched when the ID is unknown, at most once per jwksRefreshInterval.
+func (s *jwks) key(kid string) (crypto.PublicKey, error) {
+	s.mu.Lock()
+	k, ok := s.keys[kid]
+	refetch := !ok && s.url != "" && time.Since(s.fetchedAt) > jwksRefreshInterval
+	s.mu.Unlock()
+
+	if ok {
+		return k, nil
+	}
+
+	if refetch {
+		err := s.fetch()
+		if err != nil {
+			return nil, err
+		}
+
+		s.mu.Lock()
+		k, ok = s.keys[kid]
+		s.mu.Unlock()
+
+		if ok {
+			return k, nil
+		}
+	}
+
+	return nil, errors.New("unknown key " + kid)
+}
+
+func (s *jwks) loadFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return errors.Wrap(err, "error reading JWKS file")
+	}
+
+	return s.set(data)
+}
+
+func (s *jwks) fetch() error {
+	s.mu.Lock()
+	s.fetchedAt = time.Now()
+	s.mu.Unlock()
+
+	resp, err := s.client.Get(s.url)
+	if err != nil {
+		return errors.Wrap(err, "error fetching JWKS")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("error fetching JWKS: %s replied %s", s.url, resp.Status)
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return errors.Wrap(err, "error fetching JWKS")
+	}
+
+	return s.set(data)
+}
+
+// set replaces the keys with those of the JSON key set. Keys of unsupported
+// types or uses are skipped.
+func (s *jwks) set(data []byte) error {
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	err := json.Unmarshal(data, &set)
+	if err != nil {
+		return errors.Wrap(err, "invalid JWKS")
+	}
+
+	keys := map[string]crypto.PublicKey{}
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+
+		k, err := jwk.publicKey()
+		if err != nil {
+			return errors.Wrap(err, "invalid key "+jwk.Kid+" in JWKS")
+		}
+		if k != nil {
+			keys[jwk.Kid] = k
+		}
+	}
+
+	s.mu.Lock()
+	s.keys = keys
+	s.mu.Unlock()
+
+	return nil
+}
+
+// jsonWebKey is a RSA or EC public key of a JWKS, as described in RFC 7517.
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// publicKey returns the key, or nil if its type isn't supported.
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64URLInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64URLInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+		curve, ok := curves[k.Crv]
+		if !ok {
+			return nil, errors.New("unsupported curve " + k.Crv)
+		}
+		x, err := base64URLInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64URLInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point not on curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+
+	return nil, nil
+}
+
+func base64URLInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+
+	return new(big.Int).SetBytes(b), nil
+}
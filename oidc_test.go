@@ -0,0 +1,201 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"image"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+	"github.com/theopticians/optician-api/core"
+	"github.com/theopticians/optician-api/core/structs"
+)
+
+const testIssuer = "https://id.example.com"
+
+type testIdentityProvider struct {
+	rsaKey *rsa.PrivateKey
+	ecKey  *ecdsa.PrivateKey
+	jwks   string
+}
+
+// newTestIdentityProvider writes the JWKS of a RSA and an EC key to a file.
+func newTestIdentityProvider(t *testing.T) *testIdentityProvider {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b64 := func(i *big.Int) string { return base64.RawURLEncoding.EncodeToString(i.Bytes()) }
+	set := map[string][]jsonWebKey{"keys": {
+		{Kty: "RSA", Kid: "rsa", Use: "sig", N: b64(rsaKey.N), E: b64(big.NewInt(int64(rsaKey.E)))},
+		{Kty: "EC", Kid: "ec", Crv: "P-256", X: b64(ecKey.X), Y: b64(ecKey.Y)},
+		{Kty: "oct", Kid: "symmetric"},
+	}}
+
+	data, err := json.Marshal(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	err = ioutil.WriteFile(path, data, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testIdentityProvider{rsaKey: rsaKey, ecKey: ecKey, jwks: path}
+}
+
+// token signs the claims with the RSA key, the EC key when kid is "ec".
+func (p *testIdentityProvider) token(t *testing.T, kid string, claims jwt.MapClaims) string {
+	method, key := jwt.SigningMethod(jwt.SigningMethodRS256), interface{}(p.rsaKey)
+	if kid == "ec" {
+		method, key = jwt.SigningMethodES256, p.ecKey
+	}
+
+	token := jwt.NewWithClaims(method, claims)
+	token.Header["kid"] = kid
+
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signed
+}
+
+func userClaims(user string, roles ...string) jwt.MapClaims {
+	return jwt.MapClaims{
+		"iss":            testIssuer,
+		"aud":            "optician",
+		"sub":            user,
+		"exp":            time.Now().Add(time.Hour).Unix(),
+		"optician_roles": roles,
+	}
+}
+
+func newOIDCTestServer(t *testing.T, idp *testIdentityProvider) (*server, http.Handler) {
+	s, _ := newAuthTestServer(t)
+
+	var err error
+	s.oidc, err = newOIDCVerifier(OIDCConfig{
+		Issuer:     testIssuer,
+		Audience:   "optician",
+		JWKSFile:   idp.jwks,
+		UserClaim:  "sub",
+		RolesClaim: "optician_roles",
+	})
+	if err != nil {
+		t.Fatal("Error creating verifier:", err)
+	}
+
+	return s, s.authenticate(s.router())
+}
+
+func TestOIDCPrincipal(t *testing.T) {
+	idp := newTestIdentityProvider(t)
+	s, _ := newOIDCTestServer(t, idp)
+
+	p, err := s.principal(idp.token(t, "ec", userClaims("ana@example.com", "web:reviewer", "ns:app:uploader", "admin")))
+	if err != nil {
+		t.Fatal("Error authenticating token:", err)
+	}
+	if p.actor != "user:ana@example.com" || !p.admin || !p.can("web", structs.RoleReviewer) || !p.can("ns:app", structs.RoleUploader) {
+		t.Fatal("Expected the user with its roles, got", p)
+	}
+
+	claims := userClaims("ana@example.com")
+	claims["optician_roles"] = "web:reviewer web:uploader"
+	p, err = s.principal(idp.token(t, "rsa", claims))
+	if err != nil || p.admin || !p.can("web", structs.RoleUploader) || p.can("other", structs.RoleReviewer) {
+		t.Fatal("Expected the space separated roles of the user, got", p, err)
+	}
+
+	wrongIssuer := userClaims("ana@example.com")
+	wrongIssuer["iss"] = "https://evil.example.com"
+	expired := userClaims("ana@example.com")
+	expired["exp"] = time.Now().Add(-time.Hour).Unix()
+	wrongAudience := userClaims("ana@example.com")
+	wrongAudience["aud"] = "other"
+	noExpiration := userClaims("ana@example.com")
+	delete(noExpiration, "exp")
+	noUser := userClaims("")
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"wrong issuer", idp.token(t, "rsa", wrongIssuer)},
+		{"expired", idp.token(t, "rsa", expired)},
+		{"wrong audience", idp.token(t, "rsa", wrongAudience)},
+		{"no expiration", idp.token(t, "rsa", noExpiration)},
+		{"no user", idp.token(t, "rsa", noUser)},
+		{"unknown key", idp.token(t, "missing", userClaims("ana@example.com"))},
+		{"other key", newTestIdentityProvider(t).token(t, "rsa", userClaims("ana@example.com"))},
+	}
+
+	for _, test := range tests {
+		_, err := s.principal(test.token)
+		if _, ok := err.(core.UnauthorizedError); !ok {
+			t.Error(test.name+": expected unauthorized error, got", err)
+		}
+	}
+
+	unsigned := jwt.NewWithClaims(jwt.SigningMethodNone, userClaims("ana@example.com", "admin"))
+	token, _ := unsigned.SignedString(jwt.UnsafeAllowNoneSignatureType)
+	_, err = s.principal(token)
+	if _, ok := err.(core.UnauthorizedError); !ok {
+		t.Fatal("Expected unsigned tokens to be rejected, got", err)
+	}
+}
+
+func TestOIDCReview(t *testing.T) {
+	idp := newTestIdentityProvider(t)
+	s, h := newOIDCTestServer(t, idp)
+
+	_, uploader := createKey(t, s, "p", structs.RoleUploader)
+
+	caseJSON := `{"projectid":"p","branch":"master","target":"home","browser":"chrome","batch":"b1","image":"` + imageToBase64(image.NewNRGBA(image.Rect(0, 0, 4, 3))) + `"}`
+
+	rw := authRequest(h, "POST", "/cases", uploader, caseJSON)
+	if rw.Code != http.StatusAccepted {
+		t.Fatal("Expected the API key to keep working, got", rw.Code, rw.Body.String())
+	}
+
+	var r structs.Result
+	json.Unmarshal(rw.Body.Bytes(), &r)
+
+	rw = authRequest(h, "POST", "/results/"+r.ID+"/accept", idp.token(t, "rsa", userClaims("bob@example.com", "other:reviewer")), "")
+	if rw.Code != http.StatusForbidden {
+		t.Fatal("Expected users to review only their projects, got", rw.Code, rw.Body.String())
+	}
+
+	rw = authRequest(h, "POST", "/results/"+r.ID+"/accept", idp.token(t, "rsa", userClaims("ana@example.com", "p:reviewer")), "")
+	if rw.Code != http.StatusOK {
+		t.Fatal("Expected the reviewer to accept, got", rw.Code, rw.Body.String())
+	}
+
+	accepted, err := s.core.GetTest(r.ID)
+	if err != nil || accepted.ReviewedBy != "user:ana@example.com" {
+		t.Fatal("Expected the accept to be attributed to the user, got", accepted.ReviewedBy, err)
+	}
+
+	rw = authRequest(h, "POST", "/results/"+r.ID+"/accept", "not.a.jwt", "")
+	if rw.Code != http.StatusUnauthorized {
+		t.Fatal("Expected invalid tokens to be rejected, got", rw.Code, rw.Body.String())
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/theopticians/optician-api/core/store"
+)
+
+func parseResultQuery(values url.Values) (store.ResultQuery, error) {
+	q := store.ResultQuery{
+		Project: values.Get("project"),
+		Branch:  values.Get("branch"),
+		Batch:   values.Get("batch"),
+		Target:  values.Get("target"),
+		Browser: values.Get("browser"),
+		Status:  values.Get("status"),
+		Sort:    values.Get("sort"),
+		Cursor:  values.Get("cursor"),
+	}
+
+	var err error
+
+	if q.MinScore, err = parseFloat(values, "minscore"); err != nil {
+		return q, err
+	}
+	if q.MaxScore, err = parseFloat(values, "maxscore"); err != nil {
+		return q, err
+	}
+	if q.Since, err = parseTime(values, "since"); err != nil {
+		return q, err
+	}
+	if q.Until, err = parseTime(values, "until"); err != nil {
+		return q, err
+	}
+	if q.Limit, err = parseInt(values, "limit"); err != nil {
+		return q, err
+	}
+
+	return q, nil
+}
+
+func parseBatchQuery(values url.Values) (store.BatchQuery, error) {
+	q := store.BatchQuery{
+		Project: values.Get("project"),
+		Sort:    values.Get("sort"),
+		Cursor:  values.Get("cursor"),
+	}
+
+	var err error
+
+	if q.Since, err = parseTime(values, "since"); err != nil {
+		return q, err
+	}
+	if q.Until, err = parseTime(values, "until"); err != nil {
+		return q, err
+	}
+	if q.Limit, err = parseInt(values, "limit"); err != nil {
+		return q, err
+	}
+
+	return q, nil
+}
+
+func parseAuditQuery(values url.Values) (store.AuditQuery, error) {
+	q := store.AuditQuery{
+		Project: values.Get("project"),
+		Batch:   values.Get("batch"),
+		Result:  values.Get("result"),
+		Object:  values.Get("object"),
+		Actor:   values.Get("actor"),
+		Action:  values.Get("action"),
+		Sort:    values.Get("sort"),
+		Cursor:  values.Get("cursor"),
+	}
+
+	var err error
+
+	if q.Since, err = parseTime(values, "since"); err != nil {
+		return q, err
+	}
+	if q.Until, err = parseTime(values, "until"); err != nil {
+		return q, err
+	}
+	if q.Limit, err = parseInt(values, "limit"); err != nil {
+		return q, err
+	}
+
+	return q, nil
+}
+
+// setNextPage links the next page of a paginated response, if any.
+func setNextPage(rw http.ResponseWriter, req *http.Request, next string) {
+	if next == "" {
+		return
+	}
+
+	values := req.URL.Query()
+	values.Set("cursor", next)
+
+	rw.Header().Set("X-Next-Cursor", next)
+	rw.Header().Set("Link", "<"+req.URL.Path+"?"+values.Encode()+`>; rel="next"`)
+}
+
+func parseFloat(values url.Values, name string) (*float64, error) {
+	v := values.Get(name)
+	if v == "" {
+		return nil, nil
+	}
+
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return nil, errors.New("Invalid " + name + " " + v)
+	}
+
+	return &f, nil
+}
+
+func parseTime(values url.Values, name string) (time.Time, error) {
+	v := values.Get(name)
+	if v == "" {
+		return time.Time{}, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return time.Time{}, errors.New("Invalid " + name + " " + v + ", expected an RFC 3339 date")
+	}
+
+	return t, nil
+}
+
+func parseInt(values url.Values, name string) (int, error) {
+	v := values.Get(name)
+	if v == "" {
+		return 0, nil
+	}
+
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, errors.New("Invalid " + name + " " + v)
+	}
+
+	return i, nil
+}
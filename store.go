@@ -0,0 +1,63 @@
+package main
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/theopticians/optician-api/core"
+	"github.com/theopticians/optician-api/core/status"
+	"github.com/theopticians/optician-api/core/store"
+	"github.com/theopticians/optician-api/core/store/bolt"
+	"github.com/theopticians/optician-api/core/store/files"
+	"github.com/theopticians/optician-api/core/store/memory"
+	"github.com/theopticians/optician-api/core/store/sql"
+)
+
+// openStore opens the configured store, without migrating it.
+func openStore(c StoreConfig) (store.Store, error) {
+	switch c.Type {
+	case "sql":
+		return sql.OpenSqlStore(c.Dialect, c.DSN)
+	case "sqlite":
+		path := c.Path
+		if path == "" {
+			path = "./optician.sqlite"
+		}
+		return sql.OpenSqliteStore(path)
+	case "memory":
+		return memory.NewMemoryStore(), nil
+	default:
+		path := c.Path
+		if path == "" {
+			path = "./optician.db"
+		}
+		return bolt.OpenBoltStore(path)
+	}
+}
+
+// serviceConfig returns the config of the service using the store.
+func serviceConfig(c Config, s store.Store) (core.Config, error) {
+	config := core.DefaultConfig(s)
+
+	if c.Images.Type == "files" {
+		images, err := files.NewImageStore(c.Images.Path)
+		if err != nil {
+			return config, errors.Wrap(err, "error opening image storage")
+		}
+		config.Images = images
+	}
+
+	config.Comparator = core.ImgDiff{Threshold: c.Diff.Threshold, ClusterDistance: c.Diff.ClusterDistance}
+	config.Workers = c.Workers
+	config.BatchIdleTimeout = time.Duration(c.BatchIdleTimeout)
+	config.Retention = time.Duration(c.Retention)
+	config.WebhookMaxAttempts = c.WebhookMaxAttempts
+	config.PublicURL = c.PublicURL
+	config.AutoCreateProjects = c.AutoCreateProjects
+
+	if c.GitHub.Token != "" {
+		config.StatusReporter = status.NewGitHubReporter(c.GitHub.APIURL, c.GitHub.Token)
+	}
+
+	return config, nil
+}
@@ -1,49 +1,26 @@
 package main
 
 import (
-	"encoding/json"
-
-	"github.com/theopticians/optician-api/core"
 	"github.com/theopticians/optician-api/core/store"
 	"github.com/theopticians/optician-api/core/structs"
 )
 
-type ApiResult structs.Result
-type ApiCase structs.Case
-
-func (u *ApiCase) UnmarshalJSON(data []byte) error {
-	type Alias ApiCase
-	aux := struct {
-		Image string `json:"image"`
-		*Alias
-	}{
-		Alias: (*Alias)(u),
-	}
-
-	err := json.Unmarshal(data, &aux)
-	if err != nil {
-		return err
-	}
-	u.Image = base64ToImage(aux.Image)
-
-	return nil
+// ApiResult is a result as returned by the API, with its mask instead of the
+// mask ID.
+type ApiResult struct {
+	Mask   structs.Mask `json:"mask"`
+	MaskID string       `json:"-"`
+	structs.Result
 }
 
-func (r *ApiResult) MarshalJSON() ([]byte, error) {
-	mask, err := core.GetMask(r.MaskID)
+// apiResult returns the result with its mask.
+func (s *server) apiResult(r structs.Result) (ApiResult, error) {
+	mask, err := s.core.GetMask(r.MaskID)
 	if err == store.NotFoundError {
 		mask = structs.Mask{}
 	} else if err != nil {
-		return nil, err
+		return ApiResult{}, err
 	}
 
-	type Alias ApiResult
-	return json.Marshal(&struct {
-		Mask   structs.Mask `json:"mask"`
-		MaskID string       `json:"-"`
-		*Alias
-	}{
-		Mask:  structs.Mask(mask),
-		Alias: (*Alias)(r),
-	})
+	return ApiResult{Mask: structs.Mask(mask), Result: r}, nil
 }
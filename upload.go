@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+
+	"github.com/pkg/errors"
+	"github.com/theopticians/optician-api/core/structs"
+)
+
+// maxFieldSize caps the metadata fields of multipart uploads.
+const maxFieldSize = 4096
+
+// caseFields are the metadata of a case, named as in the JSON body, with the
+// header setting them in raw image uploads.
+var caseFields = []struct{ name, header string }{
+	{"projectid", "X-Optician-Project"},
+	{"branch", "X-Optician-Branch"},
+	{"target", "X-Optician-Target"},
+	{"browser", "X-Optician-Browser"},
+	{"batch", "X-Optician-Batch"},
+	{"commit", "X-Optician-Commit"},
+	{"repository", "X-Optician-Repository"},
+}
+
+var (
+	errUploadTooLarge     = errors.New("The upload is too large")
+	errImageTooLarge      = errors.New("The image is larger than the maximum width or height")
+	errUnsupportedContent = errors.New("Unsupported content type, expected application/json, multipart/form-data, image/png, image/jpeg or image/webp")
+)
+
+// imageLimits are the maximum dimensions of uploaded images. They are
+// checked from the image header, before the image is decoded, as the pixels
+// of a small but highly compressed upload can take gigabytes.
+type imageLimits struct {
+	width, height int
+}
+
+// decode decodes the PNG, JPEG or WebP image, failing with errImageTooLarge
+// if it exceeds the limits.
+func (l imageLimits) decode(r io.Reader) (image.Image, error) {
+	header := new(bytes.Buffer)
+	config, _, err := image.DecodeConfig(io.TeeReader(r, header))
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid image")
+	}
+
+	if config.Width > l.width || config.Height > l.height {
+		return nil, errImageTooLarge
+	}
+
+	img, _, err := image.Decode(io.MultiReader(header, r))
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid image")
+	}
+
+	return img, nil
+}
+
+// limitedBody fails reads past its limit with errUploadTooLarge. Decoders
+// don't always return read errors as is, so it records that the limit was
+// hit.
+type limitedBody struct {
+	r        io.Reader
+	n        int64
+	exceeded bool
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	// One byte past the limit is read, to tell bodies of the limit size from
+	// larger ones.
+	if int64(len(p)) > b.n+1 {
+		p = p[:b.n+1]
+	}
+
+	n, err := b.r.Read(p)
+	if int64(n) > b.n {
+		n = int(b.n)
+		b.n = 0
+		b.exceeded = true
+		return n, errUploadTooLarge
+	}
+
+	b.n -= int64(n)
+
+	return n, err
+}
+
+// readCase reads the case from the body of the request, which is either:
+//   - JSON with the image encoded in base64
+//   - multipart/form-data with the metadata fields and an image file part
+//   - a raw PNG, JPEG or WebP image, with the metadata in the query
+//     parameters or the X-Optician-* headers
+//
+// Bodies larger than maxSize fail with errUploadTooLarge. The case is passed
+// to authorize, without its image, before the image is decoded.
+func readCase(req *http.Request, maxSize int64, limits imageLimits, authorize func(structs.Case) error) (structs.Case, error) {
+	body := &limitedBody{r: req.Body, n: maxSize}
+
+	c, err := decodeCase(req, body, limits, authorize)
+	if body.exceeded {
+		return structs.Case{}, errUploadTooLarge
+	}
+
+	return c, err
+}
+
+func decodeCase(req *http.Request, body io.Reader, limits imageLimits, authorize func(structs.Case) error) (structs.Case, error) {
+	contentType := req.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = "application/json"
+	}
+
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return structs.Case{}, errUnsupportedContent
+	}
+
+	switch mediaType {
+	case "application/json":
+		var c structs.Case
+		aux := struct {
+			Image string `json:"image"`
+			*structs.Case
+		}{
+			Case: &c,
+		}
+
+		err := json.NewDecoder(body).Decode(&aux)
+		if err != nil {
+			return structs.Case{}, err
+		}
+
+		err = authorize(c)
+		if err != nil {
+			return structs.Case{}, err
+		}
+
+		if aux.Image != "" {
+			c.Image, err = base64ToImage(aux.Image, limits)
+		}
+
+		return c, err
+	case "multipart/form-data":
+		return decodeMultipartCase(body, params["boundary"], limits, authorize)
+	case "image/png", "image/jpeg", "image/webp":
+		values := url.Values{}
+		for _, f := range caseFields {
+			value := req.URL.Query().Get(f.name)
+			if value == "" {
+				value = req.Header.Get(f.header)
+			}
+			values.Set(f.name, value)
+		}
+
+		err := authorize(caseFromValues(values, nil))
+		if err != nil {
+			return structs.Case{}, err
+		}
+
+		img, err := limits.decode(body)
+		if err != nil {
+			return structs.Case{}, err
+		}
+
+		return caseFromValues(values, img), nil
+	}
+
+	return structs.Case{}, errUnsupportedContent
+}
+
+// decodeMultipartCase streams the parts, decoding the image part as it's
+// read rather than buffering it when the fields come first. Otherwise the
+// image is buffered until the fields are read and authorized.
+func decodeMultipartCase(body io.Reader, boundary string, limits imageLimits, authorize func(structs.Case) error) (structs.Case, error) {
+	if boundary == "" {
+		return structs.Case{}, errors.New("The multipart body has no boundary")
+	}
+
+	r := multipart.NewReader(body, boundary)
+	values := url.Values{}
+	authorized := false
+	var img image.Image
+	var pending []byte
+
+	for {
+		part, err := r.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return structs.Case{}, errors.Wrap(err, "invalid multipart body")
+		}
+
+		if part.FormName() == "image" {
+			if values.Get("projectid") == "" {
+				pending, err = ioutil.ReadAll(part)
+				if err != nil {
+					return structs.Case{}, errors.Wrap(err, "invalid multipart body")
+				}
+				continue
+			}
+
+			err = authorize(caseFromValues(values, nil))
+			if err != nil {
+				return structs.Case{}, err
+			}
+			authorized = true
+
+			img, err = limits.decode(part)
+			if err != nil {
+				return structs.Case{}, err
+			}
+			continue
+		}
+
+		value, err := ioutil.ReadAll(io.LimitReader(part, maxFieldSize))
+		if err != nil {
+			return structs.Case{}, errors.Wrap(err, "invalid multipart body")
+		}
+		values.Set(part.FormName(), string(value))
+	}
+
+	if !authorized {
+		err := authorize(caseFromValues(values, nil))
+		if err != nil {
+			return structs.Case{}, err
+		}
+	}
+
+	if pending != nil {
+		var err error
+		img, err = limits.decode(bytes.NewReader(pending))
+		if err != nil {
+			return structs.Case{}, err
+		}
+	}
+
+	return caseFromValues(values, img), nil
+}
+
+func caseFromValues(values url.Values, img image.Image) structs.Case {
+	return structs.Case{
+		ProjectID:  values.Get("projectid"),
+		Branch:     values.Get("branch"),
+		Target:     values.Get("target"),
+		Browser:    values.Get("browser"),
+		Batch:      values.Get("batch"),
+		Commit:     values.Get("commit"),
+		Repository: values.Get("repository"),
+		Image:      img,
+	}
+}
+
+// uploadErrorStatus returns the status of an error reading an upload.
+func uploadErrorStatus(err error) int {
+	switch err {
+	case errUploadTooLarge, errImageTooLarge:
+		return http.StatusRequestEntityTooLarge
+	case errUnsupportedContent:
+		return http.StatusUnsupportedMediaType
+	}
+
+	// Authorization errors
+	if code := errorStatus(err); code != http.StatusInternalServerError {
+		return code
+	}
+
+	return http.StatusBadRequest
+}
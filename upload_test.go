@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/theopticians/optician-api/core"
+	"github.com/theopticians/optician-api/core/structs"
+)
+
+var testLimits = imageLimits{width: 100, height: 100}
+
+func allowCase(structs.Case) error {
+	return nil
+}
+
+func pngBytes(t *testing.T) []byte {
+	buf := new(bytes.Buffer)
+	err := png.Encode(buf, image.NewNRGBA(image.Rect(0, 0, 4, 3)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestReadCaseJSON(t *testing.T) {
+	body := `{"projectid":"p","branch":"master","target":"home","browser":"chrome","batch":"b1","image":"` + imageToBase64(image.NewNRGBA(image.Rect(0, 0, 4, 3))) + `"}`
+	req := httptest.NewRequest("POST", "/cases", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+
+	c, err := readCase(req, 1<<20, testLimits, allowCase)
+	if err != nil {
+		t.Fatal("Error reading case:", err)
+	}
+
+	if c.ProjectID != "p" || c.Batch != "b1" || c.Image == nil || c.Image.Bounds().Dx() != 4 {
+		t.Fatal("Expected case from the JSON body, got", c)
+	}
+}
+
+func TestReadCaseMultipart(t *testing.T) {
+	body := new(bytes.Buffer)
+	w := multipart.NewWriter(body)
+
+	// The image can come before the fields, parts are read as they come
+	part, err := w.CreateFormFile("image", "home.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(pngBytes(t))
+
+	for name, value := range map[string]string{"projectid": "p", "branch": "master", "target": "home", "browser": "chrome", "batch": "b1"} {
+		w.WriteField(name, value)
+	}
+	w.Close()
+
+	req := httptest.NewRequest("POST", "/cases", body)
+	req.Header.Set("Content-Type", w.FormDataContentType())
+
+	c, err := readCase(req, 1<<20, testLimits, allowCase)
+	if err != nil {
+		t.Fatal("Error reading case:", err)
+	}
+
+	if c.ProjectID != "p" || c.Target != "home" || c.Image == nil || c.Image.Bounds().Dx() != 4 {
+		t.Fatal("Expected case from the multipart body, got", c)
+	}
+}
+
+func TestReadCaseRawImage(t *testing.T) {
+	req := httptest.NewRequest("POST", "/cases?projectid=p&target=home", bytes.NewReader(pngBytes(t)))
+	req.Header.Set("Content-Type", "image/png")
+	req.Header.Set("X-Optician-Project", "ignored")
+	req.Header.Set("X-Optician-Branch", "master")
+
+	c, err := readCase(req, 1<<20, testLimits, allowCase)
+	if err != nil {
+		t.Fatal("Error reading case:", err)
+	}
+
+	if c.ProjectID != "p" || c.Branch != "master" || c.Target != "home" || c.Image == nil {
+		t.Fatal("Expected case from the query and headers, got", c)
+	}
+}
+
+func TestReadCaseLimits(t *testing.T) {
+	img := pngBytes(t)
+
+	req := httptest.NewRequest("POST", "/cases", bytes.NewReader(img))
+	req.Header.Set("Content-Type", "image/png")
+
+	_, err := readCase(req, int64(len(img)), testLimits, allowCase)
+	if err != nil {
+		t.Fatal("Expected a body of the maximum size to be read, got", err)
+	}
+
+	req = httptest.NewRequest("POST", "/cases", bytes.NewReader(img))
+	req.Header.Set("Content-Type", "image/png")
+
+	_, err = readCase(req, int64(len(img)-1), testLimits, allowCase)
+	if uploadErrorStatus(err) != http.StatusRequestEntityTooLarge {
+		t.Fatal("Expected upload too large error, got", err)
+	}
+
+	req = httptest.NewRequest("POST", "/cases", bytes.NewReader(img))
+	req.Header.Set("Content-Type", "image/gif")
+
+	_, err = readCase(req, 1<<20, testLimits, allowCase)
+	if uploadErrorStatus(err) != http.StatusUnsupportedMediaType {
+		t.Fatal("Expected unsupported content type error, got", err)
+	}
+}
+
+func TestReadCaseImageLimits(t *testing.T) {
+	buf := new(bytes.Buffer)
+	err := png.Encode(buf, image.NewNRGBA(image.Rect(0, 0, 101, 1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("POST", "/cases", buf)
+	req.Header.Set("Content-Type", "image/png")
+
+	_, err = readCase(req, 1<<20, testLimits, allowCase)
+	if err != errImageTooLarge || uploadErrorStatus(err) != http.StatusRequestEntityTooLarge {
+		t.Fatal("Expected image too large error, got", err)
+	}
+}
+
+func TestReadCaseAuthorizesBeforeDecoding(t *testing.T) {
+	forbid := func(c structs.Case) error {
+		if c.ProjectID != "p" || c.Image != nil {
+			t.Fatal("Expected the case without its image, got", c)
+		}
+
+		return core.ForbiddenError{Message: "Forbidden"}
+	}
+
+	// The image is invalid, it's never decoded
+	req := httptest.NewRequest("POST", "/cases?projectid=p", strings.NewReader("not an image"))
+	req.Header.Set("Content-Type", "image/png")
+
+	_, err := readCase(req, 1<<20, testLimits, forbid)
+	if uploadErrorStatus(err) != http.StatusForbidden {
+		t.Fatal("Expected forbidden error, got", err)
+	}
+
+	body := new(bytes.Buffer)
+	w := multipart.NewWriter(body)
+	part, err := w.CreateFormFile("image", "home.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write([]byte("not an image"))
+	w.WriteField("projectid", "p")
+	w.Close()
+
+	req = httptest.NewRequest("POST", "/cases", body)
+	req.Header.Set("Content-Type", w.FormDataContentType())
+
+	_, err = readCase(req, 1<<20, testLimits, forbid)
+	if uploadErrorStatus(err) != http.StatusForbidden {
+		t.Fatal("Expected forbidden error, got", err)
+	}
+
+	req = httptest.NewRequest("POST", "/cases", strings.NewReader(`{"projectid":"p","image":"bm90IGFuIGltYWdl"}`))
+	req.Header.Set("Content-Type", "application/json")
+
+	_, err = readCase(req, 1<<20, testLimits, forbid)
+	if uploadErrorStatus(err) != http.StatusForbidden {
+		t.Fatal("Expected forbidden error, got", err)
+	}
+}
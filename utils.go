@@ -5,6 +5,8 @@ import (
 	"encoding/base64"
 	"image"
 	"image/png"
+
+	"github.com/pkg/errors"
 )
 
 func imageToBase64(img image.Image) string {
@@ -16,18 +18,13 @@ func imageToBase64(img image.Image) string {
 	return base64.StdEncoding.EncodeToString(b.Bytes())
 }
 
-func base64ToImage(b64 string) image.Image {
-	pngbytes, err := base64.StdEncoding.DecodeString(b64)
-	if err != nil {
-		panic(err)
-	}
-
-	b := bytes.NewBuffer(pngbytes)
-
-	img, _, err := image.Decode(b)
+// base64ToImage decodes a base64 encoded PNG, JPEG or WebP image within the
+// limits.
+func base64ToImage(b64 string, limits imageLimits) (image.Image, error) {
+	imgBytes, err := base64.StdEncoding.DecodeString(b64)
 	if err != nil {
-		panic(err)
+		return nil, errors.Wrap(err, "invalid base64 image")
 	}
 
-	return img
+	return limits.decode(bytes.NewReader(imgBytes))
 }
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"encoding/base64"
+	"image"
+	"testing"
+)
+
+func TestBase64ToImage(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 3, 2))
+
+	decoded, err := base64ToImage(imageToBase64(img), testLimits)
+	if err != nil || decoded.Bounds() != img.Bounds() {
+		t.Fatal("Expected the image to be decoded, got", decoded, err)
+	}
+
+	_, err = base64ToImage("not base64!", testLimits)
+	if err == nil {
+		t.Fatal("Expected error decoding invalid base64")
+	}
+
+	_, err = base64ToImage(base64.StdEncoding.EncodeToString([]byte("not an image")), testLimits)
+	if err == nil {
+		t.Fatal("Expected error decoding an invalid image")
+	}
+}